@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/history"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// historyCommand is the positional argument that prints the history of a
+// service instead of managing the rollouts.
+const historyCommand = "history"
+
+// defaultHistoryLimit is the number of records shown if no limit is given.
+const defaultHistoryLimit = 20
+
+// runHistoryCommand prints the most recent records of the service given in the
+// command's arguments (e.g. history -service=mysvc -region=us-east1).
+func runHistoryCommand(ctx context.Context, logger *logrus.Logger, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet(historyCommand, flag.ContinueOnError)
+	service := fs.String("service", "", "name of the service")
+	region := fs.String("region", "", "region of the service")
+	limit := fs.Int("limit", defaultHistoryLimit, "maximum number of records shown, use 0 to show all")
+	jsonOutput := fs.Bool("json", false, "print the records as JSON lines")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *service == "" || *region == "" {
+		return errors.New("-service and -region must be specified")
+	}
+
+	store, err := chooseHistoryStore(logger)
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize history store")
+	}
+	if store == nil {
+		return errors.New("history is not recorded, specify one of -history-file, -history-db or -history-annotation-size")
+	}
+
+	key := history.Key{Project: flProject, Region: *region, Service: *service}
+	records, err := store.Records(ctx, key, *limit)
+	if err != nil {
+		return errors.Wrapf(err, "failed to retrieve history of %s", key)
+	}
+	if *jsonOutput {
+		encoder := json.NewEncoder(out)
+		for _, record := range records {
+			if err := encoder.Encode(record); err != nil {
+				return errors.Wrap(err, "failed to encode record")
+			}
+		}
+		return nil
+	}
+	return printHistory(out, records)
+}
+
+// printHistory prints a table with a row for each record.
+func printHistory(out io.Writer, records []history.Record) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tCANDIDATE\tSTABLE\tRESULT\tDECISION\tTRAFFIC\tREASON")
+	for _, record := range records {
+		diagnosis := record.Diagnosis
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d%% -> %d%%\t%s\n",
+			record.Timestamp.Format(time.RFC3339),
+			diagnosis.Candidate,
+			diagnosis.Stable,
+			diagnosis.Result,
+			diagnosis.Decision,
+			diagnosis.TrafficPercent,
+			diagnosis.NewTrafficPercent,
+			strings.ReplaceAll(diagnosis.Reason, "\n", " "),
+		)
+	}
+	return w.Flush()
+}
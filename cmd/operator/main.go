@@ -19,15 +19,25 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"cloud.google.com/go/compute/metadata"
 	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health/webhook"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/incident"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification/cloudevents"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification/pubsub"
+	notificationwebhook "github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification/webhook"
 	sdlog "github.com/TV4/logrus-stackdriver-formatter"
 	isatty "github.com/mattn/go-isatty"
 	"github.com/pkg/errors"
@@ -72,15 +82,101 @@ var (
 	flHealthOffset       time.Duration
 	flTimeBeweenRollouts time.Duration
 	flMinRequestCount    int
+	flMinTrafficShare    float64
+	flMisroutedShare     float64
 	flErrorRate          float64
+	flClientErrorRate    float64
 	flLatencyP99         float64
 	flLatencyP95         float64
 	flLatencyP50         float64
+	flMissingData        string
+	flHealthExpression   string
+	flSLOTarget          float64
+	flSLOBurnRatesString string
+	flSLOBurnRates       []sloBurnRate
+
+	// Anomaly detection flags.
+	flAnomalyZScore       float64
+	flAnomalyMetrics      string
+	flAnomalyBaselineSize int
+	flBaselineFile        string
+
+	// History flags.
+	flHistoryFile           string
+	flHistoryDB             string
+	flHistoryAnnotationSize int
+
+	// File where the rollout state is kept instead of the annotations.
+	flStateFile string
+
+	// Notification flags. The event types of each sink are parsed from the
+	// flags ending in -events, all of them if empty.
+	flPubSubTopic                string
+	flPubSubTimeout              time.Duration
+	flPubSubOutbox               string
+	flPubSubOutboxSize           int
+	flPubSubEventsString         string
+	flPubSubEvents               []notification.EventType
+	flNotificationWebhooks       string
+	flNotificationWebhookEvents  string
+	flNotificationWebhookTypes   []notification.EventType
+	flNotificationWebhookTimeout time.Duration
+	flNotificationLog            bool
+	flNotificationLogEvents      string
+	flNotificationLogTypes       []notification.EventType
+	flNotificationInconclusive   int
+	flSlackWebhooks              string
+	flSlackEvents                string
+	flSlackTypes                 []notification.EventType
+	flSlackTemplate              string
+	flCloudEventsSinks           string
+	flCloudEventsModeString      string
+	flCloudEventsMode            cloudevents.Mode
+	flCloudEventsEvents          string
+	flCloudEventsTypes           []notification.EventType
+
+	// Error response codes, parsed from -error-codes.
+	flErrorCodesString   string
+	flErrorCodes         []string
+	flExcludedErrorCodes []string
+
+	// Health scoring flags.
+	flHealthScoring  bool
+	flHealthyScore   float64
+	flUnhealthyScore float64
+	flAdvisoryString string
+	flWeightsString  string
+	flAdvisory       []string
+	flWeights        map[string]float64
+
+	// Alert incidents flags.
+	flAlertIncidents              string
+	flAlertPoliciesString         string
+	flAlertIncidentsToken         string
+	flAlertIncidentsWarmUp        time.Duration
+	flAlertIncidentsServiceLabel  string
+	flAlertIncidentsLocationLabel string
+
+	// Health webhooks flags.
+	flHealthWebhooks       string
+	flHealthWebhookTimeout time.Duration
+
+	// Per-criterion windows, parsed from -windows.
+	flWindowsString string
+	flWindows       map[string]criterionWindow
 
 	// Metrics provider flags.
-	flGoogleSheetsID string
+	flGoogleSheetsID          string
+	flMetricsTimeout          time.Duration
+	flMetricsRetries          int
+	flMetricsBreakerThreshold int
+	flMetricsBreakerCooldown  time.Duration
 )
 
+// metricsRetryBackoff is the time to wait before retrying a failed metrics
+// query for the first time.
+const metricsRetryBackoff = time.Second
+
 func init() {
 	defaultAddr := ":8080"
 	if v := os.Getenv("PORT"); v != "" {
@@ -99,15 +195,66 @@ func init() {
 	flag.DurationVar(&flHealthOffset, "healthcheck-offset", 30*time.Minute, "time window to look back during health check to assess the candidate's health")
 	flag.DurationVar(&flTimeBeweenRollouts, "min-wait", 30*time.Minute, "minimum time to wait between rollout stages (in minutes), use 0 to disable")
 	flag.IntVar(&flMinRequestCount, "min-requests", 0, "expected minimum requests (in time window given by -healthcheck-offset) needed to determine candidate's health")
+	flag.Float64Var(&flMinTrafficShare, "min-traffic-share", 0, "expected minimum percentage of its expected share of requests, given its traffic percentage, needed to determine candidate's health (set 0 to ignore)")
+	flag.Float64Var(&flMisroutedShare, "misrouted-traffic-share", 25, "percentage of its expected share of requests below which the candidate is reported as misrouted, only used with -min-traffic-share")
 	flag.Float64Var(&flErrorRate, "max-error-rate", 1.0, "expected max server error rate (in percent)")
+	flag.StringVar(&flErrorCodesString, "error-codes", "5xx", "response codes or classes counted as server errors separated by commas, prefix with ! to exclude (e.g. 5xx,429,!503)")
+	flag.Float64Var(&flClientErrorRate, "max-4xx-rate", 0, "expected max rate of 4xx responses (in percent), use 0 to ignore")
+	flag.Float64Var(&flSLOTarget, "slo-target", 0, "availability SLO target (in percent) used to check error budget burn rates instead of -max-error-rate, use 0 to ignore")
+	flag.StringVar(&flSLOBurnRatesString, "slo-burn-rates", "5m/1h=14.4,30m/6h=6", "maximum error budget burn rates over short and long windows separated by commas, only used with -slo-target")
+	flag.Float64Var(&flAnomalyZScore, "max-anomaly-zscore", 0, "expected max z-score of the candidate's metrics against previous stable revisions, use 0 to ignore")
+	flag.StringVar(&flAnomalyMetrics, "anomaly-metrics", "max-error-rate,latency-p99", "metrics checked for anomalies, by flag name separated by commas (e.g. max-error-rate,latency-p99)")
+	flag.IntVar(&flAnomalyBaselineSize, "anomaly-baseline-size", 5, "number of previous stable revisions the candidate is compared against for anomalies")
+	flag.StringVar(&flBaselineFile, "baseline-file", "", "file where the metrics of stable revisions are kept for anomaly detection, they are kept in memory if empty")
+	flag.StringVar(&flHistoryFile, "history-file", "", "JSON lines file where the evaluations of candidates are recorded")
+	flag.StringVar(&flHistoryDB, "history-db", "", "embedded database file where the evaluations of candidates are recorded")
+	flag.IntVar(&flHistoryAnnotationSize, "history-annotation-size", 0, "number of the most recent evaluations of candidates recorded in an annotation of the service, use 0 to disable")
+	flag.StringVar(&flPubSubTopic, "pubsub-topic", "", "Pub/Sub topic where an event is published every time the traffic of a candidate changes (e.g. projects/my-project/topics/my-topic)")
+	flag.DurationVar(&flPubSubTimeout, "pubsub-timeout", pubsub.DefaultTimeout, "maximum time to wait for an event to be published to Pub/Sub")
+	flag.StringVar(&flPubSubOutbox, "pubsub-outbox", "", "file where events are kept until they are published to Pub/Sub, so the ones that failed are retried")
+	flag.IntVar(&flPubSubOutboxSize, "pubsub-outbox-size", 100, "maximum number of events kept in the Pub/Sub outbox, the oldest are dropped when it is full")
+	flag.StringVar(&flPubSubEventsString, "pubsub-events", "", "types of the events published to Pub/Sub separated by commas (rollout, rollback, promotion, candidate, blocked, inconclusive or skipped), all of them if empty")
+	flag.StringVar(&flNotificationWebhooks, "notification-webhooks", "", "URLs of endpoints that receive a JSON notification every time the traffic of a candidate changes separated by commas")
+	flag.StringVar(&flNotificationWebhookEvents, "notification-webhook-events", "", "types of the events sent to -notification-webhooks separated by commas, all of them if empty")
+	flag.DurationVar(&flNotificationWebhookTimeout, "notification-webhook-timeout", notificationwebhook.DefaultTimeout, "maximum time to wait for a notification webhook")
+	flag.BoolVar(&flNotificationLog, "notification-log", false, "write a structured log entry every time the traffic of a candidate changes")
+	flag.StringVar(&flNotificationLogEvents, "notification-log-events", "", "types of the events written to the logs separated by commas, all of them if empty")
+	flag.IntVar(&flNotificationInconclusive, "notification-inconclusive-after", 3, "number of consecutive inconclusive evaluations of a candidate after which an inconclusive notification is sent, 0 to never send it")
+	flag.StringVar(&flSlackWebhooks, "slack-webhooks", "", "URLs of Slack incoming webhooks that receive a message every time the traffic of a candidate changes separated by commas")
+	flag.StringVar(&flSlackEvents, "slack-events", "", "types of the events sent to -slack-webhooks separated by commas, all of them if empty")
+	flag.StringVar(&flSlackTemplate, "slack-template", "", "path to a Go template file of the Slack messages, the default template if empty")
+	flag.StringVar(&flCloudEventsSinks, "cloudevents-sinks", "", "URLs of endpoints that receive a CloudEvent every time the traffic of a candidate changes separated by commas")
+	flag.StringVar(&flCloudEventsModeString, "cloudevents-mode", string(cloudevents.ModeStructured), "content mode of the CloudEvents sent to -cloudevents-sinks (structured or binary)")
+	flag.StringVar(&flCloudEventsEvents, "cloudevents-events", "", "types of the events sent to -cloudevents-sinks separated by commas, all of them if empty")
+	flag.StringVar(&flStateFile, "state-file", "", "file where the rollout state of services is kept instead of their annotations, meant for testing")
 	flag.Float64Var(&flLatencyP99, "latency-p99", 0, "expected max latency for 99th percentile of requests in milliseconds (set 0 to ignore)")
 	flag.Float64Var(&flLatencyP95, "latency-p95", 0, "expected max latency for 95th percentile of requests in milliseconds (set 0 to ignore)")
 	flag.Float64Var(&flLatencyP50, "latency-p50", 0, "expected max latency for 50th percentile of requests in milliseconds (set 0 to ignore)")
+	flag.StringVar(&flMissingData, "missing-data", string(config.MissingDataInconclusive), "how to treat a health criterion without metrics data (inconclusive, healthy or unhealthy)")
+	flag.StringVar(&flHealthExpression, "health-expression", "", "CEL expression over the candidate's metrics that determines if it is healthy, replaces the other health criteria flags (e.g. 'errorRate < 1 && p99 < 800')")
+	flag.BoolVar(&flHealthScoring, "health-scoring", false, "diagnose candidates with a weighted score of the health criteria instead of requiring all of them")
+	flag.Float64Var(&flHealthyScore, "healthy-score", 0.9, "minimum health score (0 to 1) for a candidate to be healthy, only used with -health-scoring")
+	flag.Float64Var(&flUnhealthyScore, "unhealthy-score", 0.5, "health score (0 to 1) below which a candidate is unhealthy, only used with -health-scoring")
+	flag.StringVar(&flAdvisoryString, "advisory", "", "health criteria that only lower the health score when unmet, by flag name separated by commas (e.g. latency-p50)")
+	flag.StringVar(&flWeightsString, "weights", "", "weights of health criteria in the health score, by flag name separated by commas (e.g. max-error-rate=3,latency-p99=2)")
+	flag.StringVar(&flWindowsString, "windows", "", "time windows of health criteria instead of -healthcheck-offset, by flag name separated by commas, since-last-step uses the time since the last traffic change (e.g. max-error-rate=10m,latency-p99=1h,min-requests=since-last-step)")
+	flag.StringVar(&flAlertIncidents, "alert-incidents", "", "action when the service has open incidents of Cloud Monitoring alerting policies (hold or rollback), notified to /incidents by a webhook notification channel, empty to ignore, only with -cli")
+	flag.StringVar(&flAlertPoliciesString, "alert-policies", "", "names of the alerting policies whose incidents are checked separated by commas, all of them if empty, only used with -alert-incidents")
+	flag.StringVar(&flAlertIncidentsToken, "alert-incidents-token", "", "token expected in the token query parameter of incident notifications, only used with -alert-incidents")
+	flag.DurationVar(&flAlertIncidentsWarmUp, "alert-incidents-warm-up", 30*time.Minute, "time after the manager starts during which the open incidents are unknown and the health is inconclusive, should be the renotification interval of the alerting policies, only used with -alert-incidents")
+	flag.StringVar(&flAlertIncidentsServiceLabel, "alert-incidents-service-label", incident.DefaultServiceLabel, "resource label that identifies the service of an incident, only used with -alert-incidents")
+	flag.StringVar(&flAlertIncidentsLocationLabel, "alert-incidents-location-label", incident.DefaultLocationLabel, "resource label that identifies the region of an incident, only used with -alert-incidents")
+	flag.StringVar(&flHealthWebhooks, "health-webhooks", "", "URLs of endpoints that vote on the candidate's health separated by commas, any unhealthy vote rolls back the candidate")
+	flag.DurationVar(&flHealthWebhookTimeout, "health-webhook-timeout", webhook.DefaultTimeout, "maximum time to wait for the vote of a health webhook")
 	flag.StringVar(&flGoogleSheetsID, "google-sheets", "", "ID of public Google sheets document to use as metrics provider")
+	flag.DurationVar(&flMetricsTimeout, "metrics-timeout", 30*time.Second, "maximum time for each attempt of a metrics query, use 0 to disable")
+	flag.IntVar(&flMetricsRetries, "metrics-retries", 2, "number of retries for metrics queries that fail with transient errors")
+	flag.IntVar(&flMetricsBreakerThreshold, "metrics-breaker-threshold", 5, "consecutive failed metrics queries after which the provider is considered unavailable, use 0 to disable")
+	flag.DurationVar(&flMetricsBreakerCooldown, "metrics-breaker-cooldown", 5*time.Minute, "time the metrics provider is considered unavailable before querying it again")
 	flag.Parse()
 
 	args := flag.Args()
-	if len(args) != 0 {
+	if len(args) != 0 && args[0] != historyCommand {
 		logrus.Fatalf("positional arguments not accepted: %v", args)
 	}
 
@@ -149,37 +296,205 @@ func main() {
 	}
 	logger.Debug(flagsToString())
 
+	if args := flag.Args(); len(args) != 0 && args[0] == historyCommand {
+		if err := runHistoryCommand(context.Background(), logger, args[1:], os.Stdout); err != nil {
+			logger.Fatalf("history command failed: %v", err)
+		}
+		return
+	}
+
 	// Configuration.
 	target := config.NewTarget(flProject, flRegions, flLabelSelector)
-	healthCriteria := healthCriteriaFromFlags(flMinRequestCount, flErrorRate, flLatencyP99, flLatencyP95, flLatencyP50)
+	healthCriteria := healthCriteriaFromFlags(flMinRequestCount, flErrorRate, flClientErrorRate, flLatencyP99, flLatencyP95, flLatencyP50, config.MissingDataPolicy(flMissingData))
+	if flMinTrafficShare > 0 {
+		healthCriteria = append(healthCriteria, config.HealthCriterion{
+			Metric:             config.TrafficShareMetricsCheck,
+			Threshold:          flMinTrafficShare,
+			MisroutedThreshold: flMisroutedShare,
+			MissingData:        config.MissingDataPolicy(flMissingData),
+		})
+	}
+	if flSLOTarget > 0 {
+		healthCriteria = withSLOBurnRates(healthCriteria, flSLOTarget, flSLOBurnRates)
+	}
+	healthCriteria = withErrorResponseCodes(healthCriteria, flErrorCodes, flExcludedErrorCodes)
+	healthCriteria = withScoring(healthCriteria, flAdvisory, flWeights)
+	if flAnomalyZScore > 0 {
+		healthCriteria = append(healthCriteria, anomalyCriteriaFromFlags(flAnomalyMetrics, flAnomalyZScore, flAnomalyBaselineSize, config.MissingDataPolicy(flMissingData))...)
+	}
+	healthCriteria = withWindows(healthCriteria, flWindows)
+	if flAlertIncidents != "" {
+		criterion := config.HealthCriterion{Metric: config.OpenIncidentsMetricsCheck, OnIncident: config.IncidentAction(flAlertIncidents)}
+		if flAlertPoliciesString != "" {
+			criterion.AlertPolicies = strings.Split(flAlertPoliciesString, ",")
+		}
+		healthCriteria = append(healthCriteria, criterion)
+	}
+	if flHealthExpression != "" {
+		// The expression replaces the criteria.
+		healthCriteria = nil
+	}
 	printHealthCriteria(logger, healthCriteria)
 	strategy := config.NewStrategy(target, flSteps, flHealthOffset, flTimeBeweenRollouts, healthCriteria)
+	strategy.MetricsQuery = config.MetricsQueryOptions{
+		Timeout:          flMetricsTimeout,
+		MaxRetries:       flMetricsRetries,
+		RetryBackoff:     metricsRetryBackoff,
+		BreakerThreshold: flMetricsBreakerThreshold,
+		BreakerCooldown:  flMetricsBreakerCooldown,
+	}
+	strategy.HealthScoring = config.HealthScoring{
+		Enabled:        flHealthScoring,
+		HealthyScore:   flHealthyScore,
+		UnhealthyScore: flUnhealthyScore,
+	}
+	strategy.HealthExpression = flHealthExpression
+	strategy.InconclusiveThreshold = flNotificationInconclusive
+	if flHealthWebhooks != "" {
+		for _, url := range strings.Split(flHealthWebhooks, ",") {
+			strategy.HealthWebhooks = append(strategy.HealthWebhooks, config.HealthWebhook{URL: url, Timeout: flHealthWebhookTimeout})
+		}
+	}
 	cfg := &config.Config{Strategies: []config.Strategy{strategy}}
 	if err := cfg.Validate(); err != nil {
 		logger.Fatalf("invalid rollout configuration: %v", err)
 	}
 
+	// The metrics provider is kept during the lifetime of the process, so the
+	// state of its circuit breaker is preserved across cycles.
 	ctx := context.Background()
+	// TODO(gvso): Handle all the strategies.
+	metricsProvider, err := chooseMetricsProvider(ctx, logger, cfg.Strategies[0])
+	if err != nil {
+		logger.Fatalf("failed to initialize metrics provider: %v", err)
+	}
+	historyStore, err := chooseHistoryStore(logger)
+	if err != nil {
+		logger.Fatalf("failed to initialize history store: %v", err)
+	}
+	deps := dependencies{
+		metricsProvider: metricsProvider,
+		baselineStore:   chooseBaselineStore(logger),
+		historyStore:    historyStore,
+		stateStore:      chooseStateStore(logger),
+	}
+	var sinks []notification.Sink
+	if flPubSubTopic != "" {
+		ps, err := pubsub.New(ctx, flProject, flPubSubTopic, pubsub.Options{
+			Timeout:    flPubSubTimeout,
+			OutboxPath: flPubSubOutbox,
+			OutboxSize: flPubSubOutboxSize,
+		})
+		if err != nil {
+			logger.Fatalf("failed to initialize Pub/Sub client: %v", err)
+		}
+		deps.publisher = ps
+		sinks = append(sinks, notification.Sink{Name: "pubsub", Notifier: ps, Types: flPubSubEvents})
+	}
+	otherSinks, err := chooseNotificationSinks(logger)
+	if err != nil {
+		logger.Fatalf("failed to initialize notifications: %v", err)
+	}
+	sinks = append(sinks, otherSinks...)
+	if len(sinks) != 0 {
+		deps.notifier = notification.NewFanout(sinks...)
+	}
+
+	// Incidents are notified to the manager and the history is served by it, so
+	// it must listen to requests even as a CLI application.
+	var serveHTTP bool
+	if flAlertIncidents != "" {
+		tracker := incident.NewTracker(logger, incident.TrackerOptions{
+			Token:         flAlertIncidentsToken,
+			WarmUp:        flAlertIncidentsWarmUp,
+			ServiceLabel:  flAlertIncidentsServiceLabel,
+			LocationLabel: flAlertIncidentsLocationLabel,
+		})
+		http.Handle("/incidents", tracker)
+		deps.incidentProvider = tracker
+		serveHTTP = true
+	}
+	if historyStore != nil {
+		http.HandleFunc("/history", makeHistoryHandler(logger, historyStore))
+		serveHTTP = true
+	}
+
+	// The clients above are not created with this context, so they can still
+	// be used once it is canceled (e.g. to publish the outstanding events).
+	runCtx := cancelOnSignal(logger)
 	if flCLI {
-		runDaemon(ctx, logger, cfg)
+		if serveHTTP {
+			go func() {
+				logger.WithField("addr", flHTTPAddr).Infof("starting server for incident notifications and history")
+				logger.Fatal(http.ListenAndServe(flHTTPAddr, nil))
+			}()
+		}
+		runDaemon(runCtx, logger, cfg, deps)
 	} else {
-		http.HandleFunc("/rollout", makeRolloutHandler(logger, cfg))
+		http.HandleFunc("/rollout", makeRolloutHandler(logger, cfg, deps))
 		logger.WithField("addr", flHTTPAddr).Infof("starting server")
-		logger.Fatal(http.ListenAndServe(flHTTPAddr, nil))
+		serve(runCtx, logger, &http.Server{Addr: flHTTPAddr})
+	}
+
+	// Outstanding events are sent before exiting.
+	if deps.publisher != nil {
+		deps.publisher.Stop()
 	}
+	logger.Info("shut down")
 }
 
-func runDaemon(ctx context.Context, logger *logrus.Logger, cfg *config.Config) {
+// runDaemon runs the rollouts every -cli-run-interval until the context is
+// canceled.
+func runDaemon(ctx context.Context, logger *logrus.Logger, cfg *config.Config, deps dependencies) {
 	for {
 		// TODO(gvso): Handle all the strategies.
-		errs := runRollouts(ctx, logger, cfg.Strategies[0])
+		errs := runRollouts(ctx, logger, cfg.Strategies[0], deps)
 		errsStr := rolloutErrsToString(errs)
 		if len(errs) != 0 {
 			logger.Warnf("there were %d errors: \n%s", len(errs), errsStr)
 		}
 
-		time.Sleep(flCLILoopInterval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(flCLILoopInterval):
+		}
+	}
+}
+
+// serve serves the requests until the context is canceled, and then waits for
+// the requests being served to finish. The requests have the context, so the
+// rollouts they run are canceled with it.
+func serve(ctx context.Context, logger *logrus.Logger, srv *http.Server) {
+	srv.BaseContext = func(net.Listener) context.Context {
+		return ctx
 	}
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		if err := srv.Shutdown(context.Background()); err != nil {
+			logger.WithError(err).Warn("failed to shut down server")
+		}
+	}()
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		logger.Fatal(err)
+	}
+	<-shutdown
+}
+
+// cancelOnSignal returns a context that is canceled when the process is
+// interrupted or terminated.
+func cancelOnSignal(logger *logrus.Logger) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.WithField("signal", sig.String()).Info("shutting down after the current rollouts")
+		cancel()
+	}()
+	return ctx
 }
 
 func validateFlags() error {
@@ -203,9 +518,119 @@ func validateFlags() error {
 		}
 	}
 
+	if flSLOTarget > 0 {
+		var err error
+		flSLOBurnRates, err = parseSLOBurnRates(flSLOBurnRatesString)
+		if err != nil {
+			return errors.Wrap(err, "invalid -slo-burn-rates")
+		}
+	}
+
+	flErrorCodes, flExcludedErrorCodes = parseErrorCodes(flErrorCodesString)
+	if len(flErrorCodes) == 0 {
+		return errors.New("-error-codes must include at least one response code")
+	}
+
+	if flAnomalyZScore > 0 {
+		for _, name := range strings.Split(flAnomalyMetrics, ",") {
+			if _, ok := anomalyMetricFromFlag(name); !ok {
+				return errors.Errorf("invalid -anomaly-metrics metric %q", name)
+			}
+		}
+	}
+
+	if flAdvisoryString != "" {
+		flAdvisory = strings.Split(flAdvisoryString, ",")
+	}
+	for _, name := range flAdvisory {
+		if !isCriterionFlag(name) {
+			return errors.Errorf("invalid -advisory criterion %q", name)
+		}
+	}
+	flWeights = make(map[string]float64)
+	if flWeightsString != "" {
+		for _, entry := range strings.Split(flWeightsString, ",") {
+			parts := strings.SplitN(entry, "=", 2)
+			if len(parts) != 2 || !isCriterionFlag(parts[0]) {
+				return errors.Errorf("invalid -weights entry %q, must have the form criterion=weight", entry)
+			}
+			weight, err := strconv.ParseFloat(parts[1], 64)
+			if err != nil {
+				return errors.Wrapf(err, "invalid weight for %q", parts[0])
+			}
+			flWeights[parts[0]] = weight
+		}
+	}
+
+	var err error
+	flWindows, err = parseWindows(flWindowsString)
+	if err != nil {
+		return errors.Wrap(err, "invalid -windows")
+	}
+
+	var historyStores int
+	for _, enabled := range []bool{flHistoryFile != "", flHistoryDB != "", flHistoryAnnotationSize > 0} {
+		if enabled {
+			historyStores++
+		}
+	}
+	if historyStores > 1 {
+		return errors.New("only one of -history-file, -history-db and -history-annotation-size can be used")
+	}
+	if flHistoryAnnotationSize < 0 {
+		return errors.Errorf("history annotation size cannot be negative, got %d", flHistoryAnnotationSize)
+	}
+
+	// The rollout waits for the notifications, so publishing must not block
+	// it for long when Pub/Sub is unavailable.
+	if flPubSubTimeout <= 0 {
+		return errors.Errorf("pubsub timeout must be positive, got %s", flPubSubTimeout)
+	}
+	if flPubSubOutbox != "" && flPubSubOutboxSize < 1 {
+		return errors.Errorf("pubsub outbox size must be at least 1, got %d", flPubSubOutboxSize)
+	}
+	if flPubSubEvents, err = notification.ParseEventTypes(flPubSubEventsString); err != nil {
+		return errors.Wrap(err, "invalid -pubsub-events")
+	}
+	if flNotificationWebhookTypes, err = notification.ParseEventTypes(flNotificationWebhookEvents); err != nil {
+		return errors.Wrap(err, "invalid -notification-webhook-events")
+	}
+	if flNotificationLogTypes, err = notification.ParseEventTypes(flNotificationLogEvents); err != nil {
+		return errors.Wrap(err, "invalid -notification-log-events")
+	}
+	if flSlackTypes, err = notification.ParseEventTypes(flSlackEvents); err != nil {
+		return errors.Wrap(err, "invalid -slack-events")
+	}
+	if flCloudEventsMode, err = cloudevents.ParseMode(flCloudEventsModeString); err != nil {
+		return errors.Wrap(err, "invalid -cloudevents-mode")
+	}
+	if flCloudEventsTypes, err = notification.ParseEventTypes(flCloudEventsEvents); err != nil {
+		return errors.Wrap(err, "invalid -cloudevents-events")
+	}
+
 	if flCLILoopInterval < 0 {
 		return errors.Errorf("cli run interval cannot be negative, got %s", flCLILoopInterval)
 	}
+	// The health expression replaces the health criteria, including the open
+	// incidents criterion.
+	if flAlertIncidents != "" && flHealthExpression != "" {
+		return errors.New("-alert-incidents cannot be combined with -health-expression")
+	}
+	// The open incidents are only known by the process that received their
+	// notifications. In server mode, the requests to /incidents and /rollout
+	// might be served by different instances (e.g. on Cloud Run), so the
+	// incidents would silently be missed.
+	if flAlertIncidents != "" && !flCLI {
+		return errors.New("-alert-incidents can only be used with -cli, since the open incidents are kept in memory")
+	}
+
+	if flAlertIncidentsWarmUp < 0 {
+		return errors.Errorf("alert incidents warm-up cannot be negative, got %s", flAlertIncidentsWarmUp)
+	}
+
+	if flMetricsBreakerThreshold > 0 && flMetricsBreakerCooldown <= 0 {
+		return errors.Errorf("metrics breaker cooldown must be positive, got %s", flMetricsBreakerCooldown)
+	}
 	return nil
 }
 
@@ -217,6 +642,14 @@ func flagsToString() string {
 		str += fmt.Sprintf("-http-addr=%s\n", flHTTPAddr)
 	}
 
+	// The URLs of the health webhooks might hold credentials.
+	var healthWebhooks []string
+	if flHealthWebhooks != "" {
+		for _, url := range strings.Split(flHealthWebhooks, ",") {
+			healthWebhooks = append(healthWebhooks, webhook.RedactURL(url))
+		}
+	}
+
 	regionsStr := "all"
 	if len(flRegions) != 0 {
 		regionsStr = fmt.Sprintf("%v", flRegions)
@@ -229,10 +662,58 @@ func flagsToString() string {
 		"-healthcheck-offset=%s\n"+
 		"-min-wait=%s\n"+
 		"-min-requests=%d\n"+
+		"-min-traffic-share=%.2f\n"+
+		"-misrouted-traffic-share=%.2f\n"+
 		"-max-error-rate=%.2f\n"+
+		"-error-codes=%s\n"+
+		"-slo-target=%.3f\n"+
+		"-slo-burn-rates=%s\n"+
+		"-max-4xx-rate=%.2f\n"+
+		"-max-anomaly-zscore=%.2f\n"+
+		"-anomaly-metrics=%s\n"+
+		"-anomaly-baseline-size=%d\n"+
+		"-baseline-file=%s\n"+
+		"-history-file=%s\n"+
+		"-history-db=%s\n"+
+		"-history-annotation-size=%d\n"+
+		"-state-file=%s\n"+
+		"-pubsub-topic=%s\n"+
+		"-pubsub-timeout=%s\n"+
+		"-pubsub-outbox=%s\n"+
+		"-pubsub-outbox-size=%d\n"+
+		"-pubsub-events=%s\n"+
+		"-notification-webhooks=%s\n"+
+		"-notification-webhook-events=%s\n"+
+		"-notification-webhook-timeout=%s\n"+
+		"-notification-log=%t\n"+
+		"-notification-log-events=%s\n"+
+		"-notification-inconclusive-after=%d\n"+
+		"-slack-webhooks=%s\n"+
+		"-slack-events=%s\n"+
+		"-slack-template=%s\n"+
+		"-cloudevents-sinks=%s\n"+
+		"-cloudevents-mode=%s\n"+
+		"-cloudevents-events=%s\n"+
 		"-latency-p99=%.2f\n"+
 		"-latency-p95=%.2f\n"+
-		"-latency-p50=%.2f\n",
+		"-latency-p50=%.2f\n"+
+		"-missing-data=%s\n"+
+		"-health-expression=%s\n"+
+		"-health-scoring=%t\n"+
+		"-healthy-score=%.2f\n"+
+		"-unhealthy-score=%.2f\n"+
+		"-advisory=%s\n"+
+		"-weights=%s\n"+
+		"-windows=%s\n"+
+		"-alert-incidents=%s\n"+
+		"-alert-policies=%s\n"+
+		"-alert-incidents-warm-up=%s\n"+
+		"-health-webhooks=%s\n"+
+		"-health-webhook-timeout=%s\n"+
+		"-metrics-timeout=%s\n"+
+		"-metrics-retries=%d\n"+
+		"-metrics-breaker-threshold=%d\n"+
+		"-metrics-breaker-cooldown=%s\n",
 		flProject,
 		flLabelSelector,
 		regionsStr,
@@ -240,10 +721,58 @@ func flagsToString() string {
 		flHealthOffset,
 		flTimeBeweenRollouts,
 		flMinRequestCount,
+		flMinTrafficShare,
+		flMisroutedShare,
 		flErrorRate,
+		flErrorCodesString,
+		flSLOTarget,
+		flSLOBurnRatesString,
+		flClientErrorRate,
+		flAnomalyZScore,
+		flAnomalyMetrics,
+		flAnomalyBaselineSize,
+		flBaselineFile,
+		flHistoryFile,
+		flHistoryDB,
+		flHistoryAnnotationSize,
+		flStateFile,
+		flPubSubTopic,
+		flPubSubTimeout,
+		flPubSubOutbox,
+		flPubSubOutboxSize,
+		flPubSubEventsString,
+		flNotificationWebhooks,
+		flNotificationWebhookEvents,
+		flNotificationWebhookTimeout,
+		flNotificationLog,
+		flNotificationLogEvents,
+		flNotificationInconclusive,
+		flSlackWebhooks,
+		flSlackEvents,
+		flSlackTemplate,
+		flCloudEventsSinks,
+		flCloudEventsModeString,
+		flCloudEventsEvents,
 		flLatencyP99,
 		flLatencyP95,
 		flLatencyP50,
+		flMissingData,
+		flHealthExpression,
+		flHealthScoring,
+		flHealthyScore,
+		flUnhealthyScore,
+		flAdvisoryString,
+		flWeightsString,
+		flWindowsString,
+		flAlertIncidents,
+		flAlertPoliciesString,
+		flAlertIncidentsWarmUp,
+		strings.Join(healthWebhooks, ","),
+		flHealthWebhookTimeout,
+		flMetricsTimeout,
+		flMetricsRetries,
+		flMetricsBreakerThreshold,
+		flMetricsBreakerCooldown,
 	)
 
 	return str
@@ -251,12 +780,18 @@ func flagsToString() string {
 
 // healthCriteriaFromFlags checks the metrics-related flags and return an array
 // of config.Metric based on them.
-func healthCriteriaFromFlags(requestCount int, errorRate, latencyP99, latencyP95, latencyP50 float64) []config.HealthCriterion {
+//
+// The missing data policy is applied to all the criteria.
+func healthCriteriaFromFlags(requestCount int, errorRate, clientErrorRate, latencyP99, latencyP95, latencyP50 float64, missingData config.MissingDataPolicy) []config.HealthCriterion {
 	metrics := []config.HealthCriterion{
 		{Metric: config.RequestCountMetricsCheck, Threshold: float64(requestCount)},
 		{Metric: config.ErrorRateMetricsCheck, Threshold: errorRate},
 	}
 
+	if clientErrorRate > 0 {
+		metrics = append(metrics, config.HealthCriterion{Metric: config.ClientErrorRateMetricsCheck, Threshold: clientErrorRate})
+	}
+
 	if latencyP99 > 0 {
 		metrics = append(metrics, config.HealthCriterion{Metric: config.LatencyMetricsCheck, Percentile: 99, Threshold: latencyP99})
 	}
@@ -267,9 +802,243 @@ func healthCriteriaFromFlags(requestCount int, errorRate, latencyP99, latencyP95
 		metrics = append(metrics, config.HealthCriterion{Metric: config.LatencyMetricsCheck, Percentile: 50, Threshold: latencyP50})
 	}
 
+	for i := range metrics {
+		metrics[i].MissingData = missingData
+	}
 	return metrics
 }
 
+// anomalyMetricFromFlag returns the criterion of the metric configured by the
+// flag with the given name, which is compared against previous stable
+// revisions.
+func anomalyMetricFromFlag(name string) (config.HealthCriterion, bool) {
+	switch name {
+	case "max-error-rate":
+		return config.HealthCriterion{AnomalyOf: config.ErrorRateMetricsCheck}, true
+	case "max-4xx-rate":
+		return config.HealthCriterion{AnomalyOf: config.ClientErrorRateMetricsCheck}, true
+	case "latency-p99":
+		return config.HealthCriterion{AnomalyOf: config.LatencyMetricsCheck, Percentile: 99}, true
+	case "latency-p95":
+		return config.HealthCriterion{AnomalyOf: config.LatencyMetricsCheck, Percentile: 95}, true
+	case "latency-p50":
+		return config.HealthCriterion{AnomalyOf: config.LatencyMetricsCheck, Percentile: 50}, true
+	default:
+		return config.HealthCriterion{}, false
+	}
+}
+
+// anomalyCriteriaFromFlags returns an anomaly criterion for each of the
+// metrics, referred to by flag name.
+func anomalyCriteriaFromFlags(metricNames string, maxZScore float64, baselineSize int, missingData config.MissingDataPolicy) []config.HealthCriterion {
+	var criteria []config.HealthCriterion
+	for _, name := range strings.Split(metricNames, ",") {
+		criterion, _ := anomalyMetricFromFlag(name)
+		criterion.Metric = config.AnomalyMetricsCheck
+		criterion.Threshold = maxZScore
+		criterion.BaselineSize = baselineSize
+		criterion.MissingData = missingData
+		criteria = append(criteria, criterion)
+	}
+	return criteria
+}
+
+// sloBurnRate is a maximum error budget burn rate over a short and a long
+// window.
+type sloBurnRate struct {
+	shortWindow time.Duration
+	longWindow  time.Duration
+	maxRate     float64
+}
+
+// parseSLOBurnRates parses a comma-separated list of burn rates with the form
+// short/long=rate (e.g. 5m/1h=14.4).
+func parseSLOBurnRates(s string) ([]sloBurnRate, error) {
+	var burnRates []sloBurnRate
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		windows := strings.SplitN(parts[0], "/", 2)
+		if len(parts) != 2 || len(windows) != 2 {
+			return nil, errors.Errorf("invalid burn rate %q, must have the form short/long=rate", entry)
+		}
+
+		shortWindow, err := time.ParseDuration(windows[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid short window in %q", entry)
+		}
+		longWindow, err := time.ParseDuration(windows[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid long window in %q", entry)
+		}
+		maxRate, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid rate in %q", entry)
+		}
+		burnRates = append(burnRates, sloBurnRate{shortWindow: shortWindow, longWindow: longWindow, maxRate: maxRate})
+	}
+	return burnRates, nil
+}
+
+// withSLOBurnRates replaces the error rate criterion with a burn rate
+// criterion for each of the burn rates.
+func withSLOBurnRates(healthCriteria []config.HealthCriterion, sloTarget float64, burnRates []sloBurnRate) []config.HealthCriterion {
+	var criteria []config.HealthCriterion
+	for _, criterion := range healthCriteria {
+		if criterion.Metric != config.ErrorRateMetricsCheck {
+			criteria = append(criteria, criterion)
+			continue
+		}
+		for _, burnRate := range burnRates {
+			criteria = append(criteria, config.HealthCriterion{
+				Metric:      config.SLOBurnRateMetricsCheck,
+				Threshold:   burnRate.maxRate,
+				SLOTarget:   sloTarget,
+				ShortWindow: burnRate.shortWindow,
+				LongWindow:  burnRate.longWindow,
+				MissingData: criterion.MissingData,
+			})
+		}
+	}
+	return criteria
+}
+
+// parseErrorCodes splits a comma-separated list of response codes into the
+// codes counted as errors and the ones excluded (prefixed with "!").
+func parseErrorCodes(s string) (errorCodes, excluded []string) {
+	for _, code := range strings.Split(s, ",") {
+		code = strings.TrimSpace(code)
+		if code == "" {
+			continue
+		}
+		if strings.HasPrefix(code, "!") {
+			excluded = append(excluded, strings.TrimPrefix(code, "!"))
+			continue
+		}
+		errorCodes = append(errorCodes, code)
+	}
+	return errorCodes, excluded
+}
+
+// withErrorResponseCodes sets the response codes counted by the error rate
+// criteria. Excluded codes also apply to the 4xx rate criterion.
+//
+// The default error codes are left unset, so the criteria that use them are
+// reported without their codes.
+func withErrorResponseCodes(healthCriteria []config.HealthCriterion, errorCodes, excluded []string) []config.HealthCriterion {
+	if (metrics.Query{ErrorResponseCodes: errorCodes}).HasDefaultErrorResponseCodes() {
+		errorCodes = nil
+	}
+	for i, criterion := range healthCriteria {
+		switch criterion.Metric {
+		case config.ErrorRateMetricsCheck, config.SLOBurnRateMetricsCheck:
+			healthCriteria[i].ErrorResponseCodes = errorCodes
+			healthCriteria[i].ExcludedResponseCodes = excluded
+		case config.ClientErrorRateMetricsCheck:
+			healthCriteria[i].ExcludedResponseCodes = excluded
+		}
+	}
+	return healthCriteria
+}
+
+// criterionFlagName returns the name of the flag that configures the criterion,
+// which is used to refer to it in other flags.
+func criterionFlagName(criterion config.HealthCriterion) string {
+	switch criterion.Metric {
+	case config.RequestCountMetricsCheck:
+		return "min-requests"
+	case config.TrafficShareMetricsCheck:
+		return "min-traffic-share"
+	case config.ErrorRateMetricsCheck:
+		return "max-error-rate"
+	case config.ClientErrorRateMetricsCheck:
+		return "max-4xx-rate"
+	case config.LatencyMetricsCheck:
+		return fmt.Sprintf("latency-p%.0f", criterion.Percentile)
+	case config.SLOBurnRateMetricsCheck:
+		return "slo-target"
+	case config.AnomalyMetricsCheck:
+		return "max-anomaly-zscore"
+	default:
+		return string(criterion.Metric)
+	}
+}
+
+// isCriterionFlag determines if the name is the name of a flag that configures
+// a health criterion.
+func isCriterionFlag(name string) bool {
+	switch name {
+	case "min-requests", "min-traffic-share", "max-error-rate", "max-4xx-rate", "slo-target", "max-anomaly-zscore", "latency-p99", "latency-p95", "latency-p50":
+		return true
+	default:
+		return false
+	}
+}
+
+// withScoring sets the severity and weight of the criteria referred to by flag
+// name.
+func withScoring(healthCriteria []config.HealthCriterion, advisory []string, weights map[string]float64) []config.HealthCriterion {
+	for i, criterion := range healthCriteria {
+		name := criterionFlagName(criterion)
+		for _, advisoryName := range advisory {
+			if advisoryName == name {
+				healthCriteria[i].Severity = config.SeverityAdvisory
+			}
+		}
+		healthCriteria[i].Weight = weights[name]
+	}
+	return healthCriteria
+}
+
+// criterionWindow is the time window of a health criterion configured with
+// -windows.
+type criterionWindow struct {
+	window        time.Duration
+	sinceLastStep bool
+}
+
+// sinceLastStepWindow is the value of -windows entries evaluated over the time
+// since the last traffic change.
+const sinceLastStepWindow = "since-last-step"
+
+// parseWindows parses entries of the form criterion=window separated by commas
+// (e.g. max-error-rate=10m,min-requests=since-last-step), where criteria are
+// referred to by flag name.
+func parseWindows(value string) (map[string]criterionWindow, error) {
+	windows := make(map[string]criterionWindow)
+	if value == "" {
+		return windows, nil
+	}
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || !isCriterionFlag(parts[0]) {
+			return nil, errors.Errorf("invalid entry %q, must have the form criterion=window", entry)
+		}
+		if parts[1] == sinceLastStepWindow {
+			windows[parts[0]] = criterionWindow{sinceLastStep: true}
+			continue
+		}
+		window, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid window for %q", parts[0])
+		}
+		windows[parts[0]] = criterionWindow{window: window}
+	}
+	return windows, nil
+}
+
+// withWindows sets the time windows of the criteria referred to by flag name.
+func withWindows(healthCriteria []config.HealthCriterion, windows map[string]criterionWindow) []config.HealthCriterion {
+	for i, criterion := range healthCriteria {
+		window, ok := windows[criterionFlagName(criterion)]
+		if !ok {
+			continue
+		}
+		healthCriteria[i].Window = window.window
+		healthCriteria[i].WindowSinceLastStep = window.sinceLastStep
+	}
+	return healthCriteria
+}
+
 func printHealthCriteria(logger *logrus.Logger, healthCriteria []config.HealthCriterion) {
 	for _, criteria := range healthCriteria {
 		lg := logger.WithFields(logrus.Fields{
@@ -3,20 +3,46 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"strings"
 	"sync"
 
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/baseline"
 	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/history"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/incident"
 	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics/resilient"
 	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics/sheets"
 	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics/stackdriver"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification/cloudevents"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification/pubsub"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification/slack"
+	notificationwebhook "github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification/webhook"
 	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/rollout"
 	runapi "github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/run"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/util"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+// dependencies are the long-lived components shared by the rollouts of all the
+// services.
+type dependencies struct {
+	metricsProvider  metrics.Provider
+	baselineStore    baseline.Store
+	incidentProvider incident.Provider
+	historyStore     history.Store
+	stateStore       rollout.StateStore
+	notifier         notification.Notifier
+
+	// publisher retries the Pub/Sub events that were not published.
+	publisher *pubsub.PubSub
+}
+
 // runRollouts concurrently handles the rollout of the targeted services.
-func runRollouts(ctx context.Context, logger *logrus.Logger, strategy config.Strategy) []error {
+func runRollouts(ctx context.Context, logger *logrus.Logger, strategy config.Strategy, deps dependencies) []error {
 	svcs, err := getTargetedServices(ctx, logger, strategy.Target)
 	if err != nil {
 		return []error{errors.Wrap(err, "failed to get targeted services")}
@@ -25,6 +51,27 @@ func runRollouts(ctx context.Context, logger *logrus.Logger, strategy config.Str
 		logger.Warn("no service matches the targets")
 	}
 
+	// The events that were not published in the previous cycles (or before
+	// the last restart) are published before the events of this cycle.
+	if deps.publisher != nil {
+		if err := deps.publisher.Retry(util.ContextWithLogger(ctx, logrus.NewEntry(logger))); err != nil {
+			logger.WithError(err).Warn("failed to publish the events in the outbox")
+		}
+	}
+
+	// The metrics provider is safe for concurrent use, so a single instance is
+	// shared across all the services.
+	//
+	// If supported, metrics for all the services are retrieved in batches and
+	// cached during this evaluation cycle. The batched queries are canceled
+	// when the cycle ends.
+	if batchProvider, ok := deps.metricsProvider.(metrics.BatchProvider); ok {
+		logger.Debug("using batched metrics queries for this cycle")
+		cycleCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		deps.metricsProvider = metrics.NewSnapshot(cycleCtx, batchProvider)
+	}
+
 	var (
 		errs []error
 		mu   sync.Mutex
@@ -34,7 +81,7 @@ func runRollouts(ctx context.Context, logger *logrus.Logger, strategy config.Str
 		wg.Add(1)
 		go func(ctx context.Context, lg *logrus.Logger, svc *rollout.ServiceRecord, strategy config.Strategy) {
 			defer wg.Done()
-			err := handleRollout(ctx, lg, svc, strategy)
+			err := handleRollout(ctx, lg, deps, svc, strategy)
 			if err != nil {
 				lg.Debugf("rollout error for service %q: %+v", svc.Service.Metadata.Name, err)
 				mu.Lock()
@@ -49,7 +96,7 @@ func runRollouts(ctx context.Context, logger *logrus.Logger, strategy config.Str
 }
 
 // handleRollout manages the rollout process for a single service.
-func handleRollout(ctx context.Context, logger *logrus.Logger, service *rollout.ServiceRecord, strategy config.Strategy) error {
+func handleRollout(ctx context.Context, logger *logrus.Logger, deps dependencies, service *rollout.ServiceRecord, strategy config.Strategy) error {
 	lg := logger.WithFields(logrus.Fields{
 		"project": service.Project,
 		"service": service.Metadata.Name,
@@ -60,11 +107,14 @@ func handleRollout(ctx context.Context, logger *logrus.Logger, service *rollout.
 	if err != nil {
 		return errors.Wrap(err, "failed to initialize Cloud Run API client")
 	}
-	metricsProvider, err := chooseMetricsProvider(ctx, lg, service.Project, service.Region, service.Metadata.Name)
-	if err != nil {
-		return errors.Wrap(err, "failed to initialize metrics provider")
-	}
-	roll := rollout.New(ctx, metricsProvider, service, strategy).WithClient(client).WithLogger(lg.Logger)
+	roll := rollout.New(ctx, deps.metricsProvider, service, strategy).
+		WithClient(client).
+		WithLogger(lg.Logger).
+		WithBaselineStore(deps.baselineStore).
+		WithIncidentProvider(deps.incidentProvider).
+		WithHistoryStore(deps.historyStore).
+		WithStateStore(deps.stateStore).
+		WithNotifier(deps.notifier)
 
 	changed, err := roll.Rollout()
 	if err != nil {
@@ -92,13 +142,113 @@ func rolloutErrsToString(errs []error) (errsStr string) {
 	return errsStr
 }
 
+// chooseBaselineStore checks the CLI flags and determines where the baseline
+// samples of stable revisions are stored.
+func chooseBaselineStore(logger *logrus.Logger) baseline.Store {
+	if flBaselineFile != "" {
+		logger.WithField("path", flBaselineFile).Debug("using file to store baseline samples")
+		return baseline.NewFileStore(flBaselineFile)
+	}
+	logger.Debug("using memory to store baseline samples")
+	return baseline.NewMemoryStore()
+}
+
+// chooseStateStore checks the CLI flags and determines where the rollout state
+// of the services is kept.
+func chooseStateStore(logger *logrus.Logger) rollout.StateStore {
+	if flStateFile != "" {
+		logger.WithField("path", flStateFile).Debug("using file to store rollout state")
+		return rollout.NewFileStateStore(flStateFile)
+	}
+	logger.Debug("using service annotations to store rollout state")
+	return rollout.NewAnnotationStateStore()
+}
+
+// chooseNotificationSinks checks the CLI flags and determines the webhooks,
+// CloudEvents endpoints, Slack channels and logs where the notifications are
+// sent. The Pub/Sub sink is initialized separately, since it must be stopped.
+func chooseNotificationSinks(logger *logrus.Logger) ([]notification.Sink, error) {
+	var sinks []notification.Sink
+	if flNotificationWebhooks != "" {
+		for _, url := range strings.Split(flNotificationWebhooks, ",") {
+			logger.WithField("url", url).Debug("sending notifications to webhook")
+			sinks = append(sinks, notification.Sink{
+				Name:     url,
+				Notifier: notificationwebhook.New(http.DefaultClient, url, flNotificationWebhookTimeout),
+				Types:    flNotificationWebhookTypes,
+			})
+		}
+	}
+	if flCloudEventsSinks != "" {
+		for _, url := range strings.Split(flCloudEventsSinks, ",") {
+			logger.WithField("url", url).Debug("sending notifications as CloudEvents")
+			sinks = append(sinks, notification.Sink{
+				Name:     url,
+				Notifier: cloudevents.New(http.DefaultClient, url, flCloudEventsMode, flNotificationWebhookTimeout),
+				Types:    flCloudEventsTypes,
+			})
+		}
+	}
+	if flSlackWebhooks != "" {
+		tmpl, err := slack.ReadTemplate(flSlackTemplate)
+		if err != nil {
+			return nil, err
+		}
+		for i, url := range strings.Split(flSlackWebhooks, ",") {
+			logger.WithField("index", i).Debug("sending notifications to Slack webhook")
+			sinks = append(sinks, notification.Sink{
+				// The URLs of Slack webhooks are secret, so they are not
+				// used as names.
+				Name:     fmt.Sprintf("slack-%d", i),
+				Notifier: slack.New(http.DefaultClient, url, tmpl, flNotificationWebhookTimeout),
+				Types:    flSlackTypes,
+			})
+		}
+	}
+	if flNotificationLog {
+		logger.Debug("writing notifications to the logs")
+		sinks = append(sinks, notification.Sink{Name: "log", Notifier: notification.NewLogSink(logger), Types: flNotificationLogTypes})
+	}
+	return sinks, nil
+}
+
+// chooseHistoryStore checks the CLI flags and determines where the evaluations
+// of candidates are recorded. It returns nil if they are not recorded.
+func chooseHistoryStore(logger *logrus.Logger) (history.Store, error) {
+	switch {
+	case flHistoryFile != "":
+		logger.WithField("path", flHistoryFile).Debug("using JSON lines file to store history")
+		return history.NewFileStore(flHistoryFile), nil
+	case flHistoryDB != "":
+		logger.WithField("path", flHistoryDB).Debug("using embedded database to store history")
+		return history.NewBoltStore(flHistoryDB)
+	case flHistoryAnnotationSize > 0:
+		logger.Debug("using service annotation to store history")
+		return history.NewAnnotationStore(flHistoryAnnotationSize, func(ctx context.Context, region string) (runapi.Client, error) {
+			return runapi.NewAPIClient(ctx, region)
+		}), nil
+	default:
+		return nil, nil
+	}
+}
+
 // chooseMetricsProvider checks the CLI flags and determine which metrics
 // provider should be used for the rollout.
-func chooseMetricsProvider(ctx context.Context, logger *logrus.Entry, project, region, svcName string) (metrics.Provider, error) {
+//
+// The provider is wrapped to apply the strategy's timeouts, retries and circuit
+// breaking to the queries.
+func chooseMetricsProvider(ctx context.Context, logger *logrus.Logger, strategy config.Strategy) (metrics.Provider, error) {
+	var provider metrics.Provider
+	var err error
 	if flGoogleSheetsID != "" {
 		logger.Debug("using Google Sheets as metrics provider")
-		return sheets.NewProvider(ctx, flGoogleSheetsID, "", region, svcName)
+		provider, err = sheets.NewProvider(ctx, flGoogleSheetsID, "")
+	} else {
+		logger.Debug("using Cloud Monitoring (Stackdriver) as metrics provider")
+		provider, err = stackdriver.NewProvider(ctx, strategy.Target.Project)
+	}
+	if err != nil {
+		return nil, err
 	}
-	logger.Debug("using Cloud Monitoring (Stackdriver) as metrics provider")
-	return stackdriver.NewProvider(ctx, project, region, svcName)
+	return resilient.New(provider, strategy.MetricsQuery), nil
 }
@@ -1,19 +1,22 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/history"
 	"github.com/sirupsen/logrus"
 )
 
 // makeRolloutHandler creates a request handler to perform a rollout process.
-func makeRolloutHandler(logger *logrus.Logger, cfg *config.Config) http.HandlerFunc {
+func makeRolloutHandler(logger *logrus.Logger, cfg *config.Config, deps dependencies) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		ctx := req.Context()
 		// TODO(gvso): Handle all the strategies.
-		errs := runRollouts(ctx, logger, cfg.Strategies[0])
+		errs := runRollouts(ctx, logger, cfg.Strategies[0], deps)
 		errsStr := rolloutErrsToString(errs)
 		if len(errs) != 0 {
 			msg := fmt.Sprintf("there were %d errors: \n%s", len(errs), errsStr)
@@ -23,3 +26,45 @@ func makeRolloutHandler(logger *logrus.Logger, cfg *config.Config) http.HandlerF
 		}
 	}
 }
+
+// makeHistoryHandler creates a request handler that returns the most recent
+// records of a service as JSON.
+//
+// The service is given by the service and region query parameters. The project
+// and limit parameters are optional.
+func makeHistoryHandler(logger *logrus.Logger, store history.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		query := req.URL.Query()
+		key := history.Key{Project: query.Get("project"), Region: query.Get("region"), Service: query.Get("service")}
+		if key.Project == "" {
+			key.Project = flProject
+		}
+		if key.Service == "" || key.Region == "" {
+			http.Error(w, "service and region parameters are required", http.StatusBadRequest)
+			return
+		}
+		limit := defaultHistoryLimit
+		if value := query.Get("limit"); value != "" {
+			var err error
+			if limit, err = strconv.Atoi(value); err != nil {
+				http.Error(w, "invalid limit parameter", http.StatusBadRequest)
+				return
+			}
+		}
+
+		records, err := store.Records(req.Context(), key, limit)
+		if err != nil {
+			logger.WithError(err).Warnf("failed to retrieve history of %s", key)
+			http.Error(w, "failed to retrieve history", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(records); err != nil {
+			logger.WithError(err).Warn("failed to write history response")
+		}
+	}
+}
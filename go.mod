@@ -4,13 +4,18 @@ go 1.14
 
 require (
 	cloud.google.com/go v0.60.0
-	cloud.google.com/go/pubsub v1.3.1
+	cloud.google.com/go/pubsub v1.4.0
 	github.com/TV4/logrus-stackdriver-formatter v0.1.0
 	github.com/go-stack/stack v1.8.0 // indirect
+	github.com/golang/protobuf v1.4.2
+	github.com/google/cel-go v0.4.1
 	github.com/jonboulle/clockwork v0.2.0
 	github.com/mattn/go-isatty v0.0.12
 	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.6.0
 	github.com/stretchr/testify v1.6.1
+	go.etcd.io/bbolt v1.3.5
 	google.golang.org/api v0.28.0
+	google.golang.org/genproto v0.0.0-20200626011028-ee7919e894b5
+	google.golang.org/grpc v1.29.1
 )
@@ -0,0 +1,132 @@
+// Package baseline keeps the steady-state metrics of the revisions that were
+// promoted to stable, which are used to detect anomalies in candidates.
+package baseline
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+)
+
+// MaxSamples is the maximum number of samples kept for each service. Older
+// samples are discarded.
+const MaxSamples = 50
+
+// Sample is the steady-state metrics of a stable revision.
+type Sample struct {
+	Revision   string
+	RecordedAt time.Time
+
+	RequestCount    float64
+	ErrorRate       float64
+	ClientErrorRate float64
+	LatencyP99      float64
+	LatencyP95      float64
+	LatencyP50      float64
+
+	// NoData are the metrics that had no data when the sample was recorded
+	// (see MetricName), whose values are zero but must not be used.
+	NoData []string `json:",omitempty"`
+}
+
+// MetricName returns the name of the metric in the NoData of a sample, e.g.
+// "request-latency-p99" for the 99th percentile of latency.
+func MetricName(metric config.MetricsCheck, percentile float64) string {
+	if metric == config.LatencyMetricsCheck {
+		return fmt.Sprintf("%s-p%.0f", metric, percentile)
+	}
+	return string(metric)
+}
+
+// Value returns the value of the metric in the sample. The second return value
+// is false if the sample does not record the metric or it had no data.
+func (s Sample) Value(metric config.MetricsCheck, percentile float64) (float64, bool) {
+	name := MetricName(metric, percentile)
+	for _, noData := range s.NoData {
+		if noData == name {
+			return 0, false
+		}
+	}
+
+	switch metric {
+	case config.RequestCountMetricsCheck:
+		return s.RequestCount, true
+	case config.ErrorRateMetricsCheck:
+		return s.ErrorRate, true
+	case config.ClientErrorRateMetricsCheck:
+		return s.ClientErrorRate, true
+	case config.LatencyMetricsCheck:
+		switch percentile {
+		case 99:
+			return s.LatencyP99, true
+		case 95:
+			return s.LatencyP95, true
+		case 50:
+			return s.LatencyP50, true
+		}
+	}
+	return 0, false
+}
+
+// Store persists the samples of the services.
+//
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Add records a sample for the service.
+	Add(ctx context.Context, service Key, sample Sample) error
+
+	// Samples returns up to n of the most recent samples for the service,
+	// most recent first.
+	Samples(ctx context.Context, service Key, n int) ([]Sample, error)
+}
+
+// Key identifies a service.
+type Key struct {
+	Project string
+	Region  string
+	Service string
+}
+
+func (k Key) String() string {
+	return fmt.Sprintf("%s/%s/%s", k.Project, k.Region, k.Service)
+}
+
+// minStdDevRatio is the minimum standard deviation relative to the mean. It
+// prevents a few nearly identical samples from making any deviation anomalous.
+const minStdDevRatio = 0.05
+
+// ZScore returns how many standard deviations the value is above the mean of
+// the metric in the samples. Values below the mean return a negative score.
+//
+// The standard deviation is at least 5% of the mean. If no sample records the
+// metric or all values are zero, the second return value is false.
+func ZScore(samples []Sample, metric config.MetricsCheck, percentile float64, value float64) (float64, bool) {
+	var values []float64
+	for _, sample := range samples {
+		if v, ok := sample.Value(metric, percentile); ok {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 {
+		return 0, false
+	}
+
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+
+	var squares float64
+	for _, v := range values {
+		squares += (v - mean) * (v - mean)
+	}
+	stdDev := math.Max(math.Sqrt(squares/float64(len(values))), minStdDevRatio*math.Abs(mean))
+	if stdDev == 0 {
+		return 0, false
+	}
+	return (value - mean) / stdDev, true
+}
@@ -0,0 +1,126 @@
+package baseline_test
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/baseline"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZScore(t *testing.T) {
+	samples := []baseline.Sample{
+		{ErrorRate: 1, LatencyP99: 400},
+		{ErrorRate: 2, LatencyP99: 500},
+		{ErrorRate: 3, LatencyP99: 600},
+	}
+	// Standard deviation of the latency is ~81.65.
+	stdDev := math.Sqrt(20000.0 / 3)
+
+	tests := []struct {
+		name       string
+		samples    []baseline.Sample
+		metric     config.MetricsCheck
+		percentile float64
+		value      float64
+		expected   float64
+		notOK      bool
+	}{
+		{
+			name:       "above the mean",
+			samples:    samples,
+			metric:     config.LatencyMetricsCheck,
+			percentile: 99,
+			value:      700,
+			expected:   200 / stdDev,
+		},
+		{
+			name:     "below the mean",
+			samples:  samples,
+			metric:   config.ErrorRateMetricsCheck,
+			value:    1,
+			expected: -1 / math.Sqrt(2.0/3),
+		},
+		{
+			name:     "minimum standard deviation",
+			samples:  []baseline.Sample{{ErrorRate: 2}, {ErrorRate: 2}},
+			metric:   config.ErrorRateMetricsCheck,
+			value:    2.2,
+			expected: 2,
+		},
+		{
+			name:       "samples without data",
+			samples:    append(samples, baseline.Sample{NoData: []string{"request-latency-p99"}}),
+			metric:     config.LatencyMetricsCheck,
+			percentile: 99,
+			value:      700,
+			expected:   200 / stdDev,
+		},
+		{
+			name:    "zero baseline",
+			samples: []baseline.Sample{{}, {}},
+			metric:  config.ErrorRateMetricsCheck,
+			value:   1,
+			notOK:   true,
+		},
+		{
+			name:   "no samples",
+			metric: config.ErrorRateMetricsCheck,
+			notOK:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			zscore, ok := baseline.ZScore(test.samples, test.metric, test.percentile, test.value)
+			assert.Equal(t, !test.notOK, ok)
+			assert.InDelta(t, test.expected, zscore, 1e-9)
+		})
+	}
+}
+
+func TestStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "baseline")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	stores := map[string]baseline.Store{
+		"memory": baseline.NewMemoryStore(),
+		"file":   baseline.NewFileStore(filepath.Join(dir, "baseline.json")),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			key := baseline.Key{Project: "myproject", Region: "us-east1", Service: "mysvc"}
+			otherKey := baseline.Key{Project: "myproject", Region: "us-west1", Service: "mysvc"}
+			now := time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC)
+
+			samples, err := store.Samples(ctx, key, 5)
+			assert.Nil(t, err)
+			assert.Empty(t, samples)
+
+			for i := 0; i < baseline.MaxSamples+2; i++ {
+				sample := baseline.Sample{RecordedAt: now.Add(time.Duration(i) * time.Hour), ErrorRate: float64(i)}
+				assert.Nil(t, store.Add(ctx, key, sample))
+			}
+			assert.Nil(t, store.Add(ctx, otherKey, baseline.Sample{Revision: "other"}))
+
+			samples, err = store.Samples(ctx, key, 2)
+			assert.Nil(t, err)
+			assert.Equal(t, []baseline.Sample{
+				{RecordedAt: now.Add(time.Duration(baseline.MaxSamples+1) * time.Hour), ErrorRate: float64(baseline.MaxSamples + 1)},
+				{RecordedAt: now.Add(time.Duration(baseline.MaxSamples) * time.Hour), ErrorRate: float64(baseline.MaxSamples)},
+			}, samples)
+
+			samples, err = store.Samples(ctx, key, 1000)
+			assert.Nil(t, err)
+			assert.Len(t, samples, baseline.MaxSamples)
+		})
+	}
+}
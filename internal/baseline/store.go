@@ -0,0 +1,117 @@
+package baseline
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// MemoryStore keeps the samples in memory.
+type MemoryStore struct {
+	mu      sync.Mutex
+	samples map[Key][]Sample
+}
+
+// NewMemoryStore initializes an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{samples: make(map[Key][]Sample)}
+}
+
+// Add records a sample for the service.
+func (s *MemoryStore) Add(ctx context.Context, service Key, sample Sample) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples[service] = prepend(s.samples[service], sample)
+	return nil
+}
+
+// Samples returns up to n of the most recent samples for the service.
+func (s *MemoryStore) Samples(ctx context.Context, service Key, n int) ([]Sample, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return latest(s.samples[service], n), nil
+}
+
+// FileStore keeps the samples in a JSON file, so they are preserved across
+// restarts of the process.
+type FileStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileStore initializes a store that uses the file at the given path. The
+// file is created on the first sample.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Add records a sample for the service.
+func (s *FileStore) Add(ctx context.Context, service Key, sample Sample) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	samples, err := s.read()
+	if err != nil {
+		return err
+	}
+	samples[service.String()] = prepend(samples[service.String()], sample)
+
+	data, err := json.Marshal(samples)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode samples")
+	}
+	// Write to a temporary file first so a crash does not corrupt the store.
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrap(err, "failed to write samples")
+	}
+	return errors.Wrap(os.Rename(tmp, s.path), "failed to replace samples file")
+}
+
+// Samples returns up to n of the most recent samples for the service.
+func (s *FileStore) Samples(ctx context.Context, service Key, n int) ([]Sample, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	samples, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	return latest(samples[service.String()], n), nil
+}
+
+// read returns the samples in the file, indexed by service key.
+func (s *FileStore) read() (map[string][]Sample, error) {
+	samples := make(map[string][]Sample)
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return samples, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read samples")
+	}
+	if err := json.Unmarshal(data, &samples); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode samples in %s", s.path)
+	}
+	return samples, nil
+}
+
+// prepend adds the sample at the beginning and discards the samples exceeding
+// MaxSamples.
+func prepend(samples []Sample, sample Sample) []Sample {
+	samples = append([]Sample{sample}, samples...)
+	if len(samples) > MaxSamples {
+		samples = samples[:MaxSamples]
+	}
+	return samples
+}
+
+// latest returns a copy of up to n samples.
+func latest(samples []Sample, n int) []Sample {
+	if n > len(samples) {
+		n = len(samples)
+	}
+	return append([]Sample(nil), samples[:n]...)
+}
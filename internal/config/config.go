@@ -1,8 +1,10 @@
 package config
 
 import (
+	"net/url"
 	"time"
 
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health/expression"
 	"github.com/pkg/errors"
 )
 
@@ -14,6 +16,66 @@ const (
 	RequestCountMetricsCheck MetricsCheck = "request-count"
 	LatencyMetricsCheck      MetricsCheck = "request-latency"
 	ErrorRateMetricsCheck    MetricsCheck = "error-rate-percent"
+
+	// ClientErrorRateMetricsCheck is the percentage of 4xx responses.
+	ClientErrorRateMetricsCheck MetricsCheck = "4xx-rate-percent"
+
+	// SLOBurnRateMetricsCheck is the rate at which the error budget of an
+	// availability SLO is consumed, checked over a short and a long window.
+	SLOBurnRateMetricsCheck MetricsCheck = "slo-burn-rate"
+
+	// AnomalyMetricsCheck is the z-score of a metric of the candidate against
+	// the same metric of the previous stable revisions.
+	AnomalyMetricsCheck MetricsCheck = "anomaly-zscore"
+
+	// TrafficShareMetricsCheck is the percentage of its expected share of the
+	// service requests served by the candidate, given its current traffic
+	// percentage. Like the request count, it is an expected minimum.
+	TrafficShareMetricsCheck MetricsCheck = "traffic-share-percent"
+
+	// OpenIncidentsMetricsCheck is the number of open incidents of Cloud
+	// Monitoring alerting policies for the service.
+	OpenIncidentsMetricsCheck MetricsCheck = "open-incidents"
+)
+
+// MissingDataPolicy determines how a health criterion is evaluated when the
+// metrics provider has no data for it.
+type MissingDataPolicy string
+
+// Supported missing data policies.
+const (
+	MissingDataInconclusive MissingDataPolicy = "inconclusive"
+	MissingDataHealthy      MissingDataPolicy = "healthy"
+	MissingDataUnhealthy    MissingDataPolicy = "unhealthy"
+)
+
+// Severity determines how an unmet health criterion affects the diagnosis when
+// health scoring is enabled.
+type Severity string
+
+// Supported severities.
+const (
+	// SeverityBlocking makes the candidate unhealthy if the criterion is not
+	// met.
+	SeverityBlocking Severity = "blocking"
+
+	// SeverityAdvisory only lowers the health score if the criterion is not
+	// met.
+	SeverityAdvisory Severity = "advisory"
+)
+
+// IncidentAction determines what happens to the rollout when the open
+// incidents criterion is not met.
+type IncidentAction string
+
+// Supported incident actions.
+const (
+	// IncidentActionHold keeps the candidate's traffic until the incidents are
+	// closed.
+	IncidentActionHold IncidentAction = "hold"
+
+	// IncidentActionRollback makes the candidate unhealthy.
+	IncidentActionRollback IncidentAction = "rollback"
 )
 
 // Target is the configuration to filter services.
@@ -37,6 +99,124 @@ type HealthCriterion struct {
 	Metric     MetricsCheck
 	Percentile float64
 	Threshold  float64
+
+	// MissingData is the policy applied when no metrics data is available for
+	// the criterion. If empty, MissingDataInconclusive is used.
+	MissingData MissingDataPolicy
+
+	// ErrorResponseCodes are the response codes (e.g. "429") or classes (e.g.
+	// "5xx") counted as errors by the error rate criterion. If empty, 5xx
+	// responses are counted.
+	ErrorResponseCodes []string
+
+	// ExcludedResponseCodes are the response codes or classes never counted as
+	// errors by the error rate criteria (e.g. "503" during scale-up).
+	ExcludedResponseCodes []string
+
+	// Weight is the weight of the criterion in the health score. If zero, a
+	// weight of 1 is used. It is ignored unless health scoring is enabled.
+	Weight float64
+
+	// SLOTarget is the availability target in percent (e.g. 99.9) for the SLO
+	// burn rate criterion. The error budget is 100 - SLOTarget.
+	SLOTarget float64
+
+	// ShortWindow and LongWindow are the windows over which the burn rate is
+	// calculated for the SLO burn rate criterion. The criterion is met unless
+	// the burn rate exceeds the threshold over both windows.
+	ShortWindow time.Duration
+	LongWindow  time.Duration
+
+	// AnomalyOf is the metric compared against the previous stable revisions
+	// by the anomaly criterion. For latency, Percentile is also used.
+	AnomalyOf MetricsCheck
+
+	// BaselineSize is the number of previous stable revisions the anomaly
+	// criterion compares against.
+	BaselineSize int
+
+	// MisroutedThreshold is the percentage of its expected share of requests
+	// below which the traffic share criterion reports that the candidate might
+	// be misrouted (e.g. it gets far less traffic than its configured split).
+	// If zero, misrouting is not reported.
+	MisroutedThreshold float64
+
+	// Window is the time window over which the criterion is evaluated. If
+	// zero, the health check offset of the strategy is used.
+	Window time.Duration
+
+	// WindowSinceLastStep makes the criterion evaluated over the time elapsed
+	// since the candidate's traffic last changed (e.g. for the request count).
+	// It cannot be combined with Window.
+	WindowSinceLastStep bool
+
+	// AlertPolicies are the names of the alerting policies whose incidents are
+	// counted by the open incidents criterion. If empty, incidents of all the
+	// policies are counted.
+	AlertPolicies []string
+
+	// OnIncident is the action taken when the open incidents criterion is not
+	// met. If empty, IncidentActionHold is used.
+	OnIncident IncidentAction
+
+	// Severity determines if the criterion blocks the rollout when unmet. If
+	// empty, SeverityBlocking is used. It is ignored unless health scoring is
+	// enabled.
+	Severity Severity
+}
+
+// HealthScoring configures the weighted health scoring model.
+//
+// The health score is the weighted proportion of met criteria, from 0 to 1.
+// An unmet blocking criterion makes the candidate unhealthy regardless of the
+// score.
+type HealthScoring struct {
+	Enabled bool
+
+	// HealthyScore is the minimum score for a candidate to be healthy.
+	HealthyScore float64
+
+	// UnhealthyScore is the score below which a candidate is unhealthy. A
+	// score between UnhealthyScore and HealthyScore is inconclusive, so the
+	// rollout is held.
+	UnhealthyScore float64
+}
+
+// MetricsQueryOptions configures how queries to the metrics provider are
+// made.
+//
+// A zero value disables timeouts, retries and circuit breaking.
+type MetricsQueryOptions struct {
+	// Timeout is the maximum time for a single attempt of a query.
+	Timeout time.Duration
+
+	// MaxRetries is the number of times a query is retried after a transient
+	// error (e.g. 5xx or 429 responses).
+	MaxRetries int
+
+	// RetryBackoff is the time to wait before the first retry. It is doubled
+	// after every retry.
+	RetryBackoff time.Duration
+
+	// BreakerThreshold is the number of consecutive failed queries after which
+	// the provider is considered unavailable.
+	BreakerThreshold int
+
+	// BreakerCooldown is the time the provider is considered unavailable
+	// before a new query is attempted.
+	BreakerCooldown time.Duration
+}
+
+// HealthWebhook is an HTTP endpoint that votes on the health of candidates
+// during the diagnosis.
+type HealthWebhook struct {
+	// URL is the endpoint called with the service, candidate, stable revision
+	// and current traffic percentage of the candidate.
+	URL string
+
+	// Timeout is the maximum time to wait for a vote. If zero, a default
+	// timeout is used.
+	Timeout time.Duration
 }
 
 // Strategy is a rollout configuration for the targeted services.
@@ -46,6 +226,33 @@ type Strategy struct {
 	HealthCriteria      []HealthCriterion
 	HealthCheckOffset   time.Duration
 	TimeBetweenRollouts time.Duration
+	MetricsQuery        MetricsQueryOptions
+	HealthScoring       HealthScoring
+
+	// HealthExpression is a CEL expression that determines if the candidate
+	// is healthy (e.g. "errorRate < 1 && p99 < 800"). If set, it replaces the
+	// health criteria. See the expression package for the available
+	// variables. It is compiled and type-checked by Validate.
+	HealthExpression string
+
+	// healthExpression is HealthExpression compiled by Validate, so it is not
+	// compiled again for every rollout.
+	healthExpression *expression.Expression
+
+	// HealthWebhooks vote on the candidate's health in addition to the
+	// metrics. Any unhealthy vote makes the candidate unhealthy.
+	HealthWebhooks []HealthWebhook
+
+	// InconclusiveThreshold is the number of consecutive inconclusive
+	// evaluations of the candidate after which an inconclusive notification
+	// is sent, 0 to never send it.
+	InconclusiveThreshold int
+}
+
+// CompiledHealthExpression returns the health expression compiled by Validate.
+// It is nil if the strategy has no health expression or was not validated.
+func (strategy Strategy) CompiledHealthExpression() *expression.Expression {
+	return strategy.healthExpression
 }
 
 // Config contains the configuration for the application.
@@ -74,9 +281,9 @@ func NewStrategy(target Target, steps []int64, healthOffset, timeBetweenRollouts
 }
 
 // Validate checks if the configuration is valid.
-func (config Config) Validate() error {
-	for i, strategy := range config.Strategies {
-		err := strategy.Validate()
+func (config *Config) Validate() error {
+	for i := range config.Strategies {
+		err := config.Strategies[i].Validate()
 		if err != nil {
 			return errors.Wrapf(err, "invalid strategy at index %d", i)
 		}
@@ -84,8 +291,9 @@ func (config Config) Validate() error {
 	return nil
 }
 
-// Validate checks if the strategy is valid.
-func (strategy Strategy) Validate() error {
+// Validate checks if the strategy is valid. It compiles the health expression,
+// which is then returned by CompiledHealthExpression.
+func (strategy *Strategy) Validate() error {
 	if strategy.HealthCheckOffset <= 0 {
 		return errors.Errorf("health check offset must be positive, got %d", strategy.HealthCheckOffset)
 	}
@@ -108,6 +316,30 @@ func (strategy Strategy) Validate() error {
 			return errors.Wrapf(err, "invalid metrics criterion at index %d", i)
 		}
 	}
+	if strategy.HealthExpression != "" {
+		if len(strategy.HealthCriteria) != 0 || strategy.HealthScoring.Enabled {
+			return errors.New("health expression cannot be combined with health criteria or scoring")
+		}
+		expr, err := expression.Compile(strategy.HealthExpression)
+		if err != nil {
+			return errors.Wrap(err, "invalid health expression")
+		}
+		strategy.healthExpression = expr
+	}
+	if err := validateHealthScoring(strategy.HealthScoring); err != nil {
+		return errors.Wrap(err, "invalid health scoring")
+	}
+	if err := validateMetricsQueryOptions(strategy.MetricsQuery); err != nil {
+		return errors.Wrap(err, "invalid metrics query options")
+	}
+	for _, webhook := range strategy.HealthWebhooks {
+		if err := validateHealthWebhook(webhook); err != nil {
+			return errors.Wrapf(err, "invalid health webhook %q", webhook.URL)
+		}
+	}
+	if strategy.InconclusiveThreshold < 0 {
+		return errors.Errorf("inconclusive threshold cannot be negative, got %d", strategy.InconclusiveThreshold)
+	}
 	return validateTarget(strategy.Target)
 }
 
@@ -117,8 +349,52 @@ func validateHealthCriterion(criterion HealthCriterion) error {
 		return errors.Errorf("threshold cannot be negative, criterion %q", criterion.Metric)
 	}
 
+	if err := validateMissingDataPolicy(criterion.MissingData); err != nil {
+		return errors.Wrapf(err, "invalid missing data policy for %q", criterion.Metric)
+	}
+
+	for _, code := range append(criterion.ErrorResponseCodes, criterion.ExcludedResponseCodes...) {
+		if !isValidResponseCode(code) {
+			return errors.Errorf("invalid response code %q for %q, must be a code (e.g. 429) or a class (e.g. 5xx)", code, criterion.Metric)
+		}
+	}
+	if criterion.Weight < 0 {
+		return errors.Errorf("weight cannot be negative, criterion %q", criterion.Metric)
+	}
+	switch criterion.Severity {
+	case "", SeverityBlocking:
+	case SeverityAdvisory:
+		if criterion.Metric == RequestCountMetricsCheck || criterion.Metric == TrafficShareMetricsCheck {
+			return errors.Errorf("%q cannot be advisory", criterion.Metric)
+		}
+	default:
+		return errors.Errorf("unsupported severity %q for %q", criterion.Severity, criterion.Metric)
+	}
+
+	if len(criterion.ErrorResponseCodes) != 0 && criterion.Metric != ErrorRateMetricsCheck && criterion.Metric != SLOBurnRateMetricsCheck {
+		return errors.Errorf("error response codes are not supported for %q", criterion.Metric)
+	}
+	if len(criterion.ExcludedResponseCodes) != 0 && criterion.Metric != ErrorRateMetricsCheck && criterion.Metric != ClientErrorRateMetricsCheck && criterion.Metric != SLOBurnRateMetricsCheck {
+		return errors.Errorf("excluded response codes are not supported for %q", criterion.Metric)
+	}
+	if criterion.Window < 0 {
+		return errors.Errorf("window cannot be negative, criterion %q", criterion.Metric)
+	}
+	if criterion.Window != 0 && criterion.WindowSinceLastStep {
+		return errors.Errorf("window and window since last step cannot be combined, criterion %q", criterion.Metric)
+	}
+	if (criterion.Window != 0 || criterion.WindowSinceLastStep) && criterion.Metric == SLOBurnRateMetricsCheck {
+		return errors.Errorf("%q uses its short and long windows, a window is not supported", criterion.Metric)
+	}
+	if (len(criterion.AlertPolicies) != 0 || criterion.OnIncident != "") && criterion.Metric != OpenIncidentsMetricsCheck {
+		return errors.Errorf("alert policies and incident actions are not supported for %q", criterion.Metric)
+	}
+	if criterion.MisroutedThreshold != 0 && criterion.Metric != TrafficShareMetricsCheck {
+		return errors.Errorf("misrouted threshold is not supported for %q", criterion.Metric)
+	}
+
 	switch criterion.Metric {
-	case ErrorRateMetricsCheck:
+	case ErrorRateMetricsCheck, ClientErrorRateMetricsCheck:
 		if threshold > 100 {
 			return errors.Errorf("threshold must be greater than 0 and less than 100 for %q", criterion.Metric)
 		}
@@ -127,6 +403,39 @@ func validateHealthCriterion(criterion HealthCriterion) error {
 		if percentile != 99 && percentile != 95 && percentile != 50 {
 			return errors.Errorf("invalid percentile for %.2f", criterion.Percentile)
 		}
+	case SLOBurnRateMetricsCheck:
+		if criterion.SLOTarget <= 0 || criterion.SLOTarget >= 100 {
+			return errors.Errorf("SLO target must be greater than 0 and less than 100 for %q, got %.3f", criterion.Metric, criterion.SLOTarget)
+		}
+		if criterion.ShortWindow <= 0 || criterion.LongWindow <= criterion.ShortWindow {
+			return errors.Errorf("windows must satisfy 0 < short window (%s) < long window (%s) for %q", criterion.ShortWindow, criterion.LongWindow, criterion.Metric)
+		}
+	case AnomalyMetricsCheck:
+		switch criterion.AnomalyOf {
+		case ErrorRateMetricsCheck, ClientErrorRateMetricsCheck:
+		case LatencyMetricsCheck:
+			if p := criterion.Percentile; p != 99 && p != 95 && p != 50 {
+				return errors.Errorf("invalid percentile for %.2f", criterion.Percentile)
+			}
+		default:
+			return errors.Errorf("unsupported metric %q for %q", criterion.AnomalyOf, criterion.Metric)
+		}
+		if criterion.BaselineSize < 2 {
+			return errors.Errorf("baseline size must be at least 2 for %q, got %d", criterion.Metric, criterion.BaselineSize)
+		}
+	case TrafficShareMetricsCheck:
+		if threshold == 0 || threshold > 100 {
+			return errors.Errorf("threshold must be greater than 0 and at most 100 for %q", criterion.Metric)
+		}
+		if criterion.MisroutedThreshold < 0 || criterion.MisroutedThreshold > threshold {
+			return errors.Errorf("misrouted threshold must satisfy 0 <= misrouted threshold (%.2f) <= threshold (%.2f) for %q", criterion.MisroutedThreshold, threshold, criterion.Metric)
+		}
+	case OpenIncidentsMetricsCheck:
+		switch criterion.OnIncident {
+		case "", IncidentActionHold, IncidentActionRollback:
+		default:
+			return errors.Errorf("unsupported incident action %q for %q", criterion.OnIncident, criterion.Metric)
+		}
 	case RequestCountMetricsCheck:
 		return nil
 	default:
@@ -136,6 +445,66 @@ func validateHealthCriterion(criterion HealthCriterion) error {
 	return nil
 }
 
+func validateHealthScoring(scoring HealthScoring) error {
+	if !scoring.Enabled {
+		return nil
+	}
+	if scoring.UnhealthyScore < 0 || scoring.HealthyScore > 1 || scoring.UnhealthyScore > scoring.HealthyScore {
+		return errors.Errorf("scores must satisfy 0 <= unhealthy score (%.2f) <= healthy score (%.2f) <= 1", scoring.UnhealthyScore, scoring.HealthyScore)
+	}
+	return nil
+}
+
+// isValidResponseCode checks if the code is an HTTP response code (e.g. 429) or
+// a response code class (e.g. 5xx).
+func isValidResponseCode(code string) bool {
+	if len(code) != 3 || code[0] < '1' || code[0] > '5' {
+		return false
+	}
+	if code[1:] == "xx" {
+		return true
+	}
+	return code[1] >= '0' && code[1] <= '9' && code[2] >= '0' && code[2] <= '9'
+}
+
+func validateMetricsQueryOptions(opts MetricsQueryOptions) error {
+	if opts.Timeout < 0 || opts.RetryBackoff < 0 || opts.BreakerCooldown < 0 {
+		return errors.New("durations cannot be negative")
+	}
+	if opts.MaxRetries < 0 {
+		return errors.Errorf("max retries cannot be negative, got %d", opts.MaxRetries)
+	}
+	if opts.BreakerThreshold < 0 {
+		return errors.Errorf("breaker threshold cannot be negative, got %d", opts.BreakerThreshold)
+	}
+	return nil
+}
+
+func validateHealthWebhook(webhook HealthWebhook) error {
+	u, err := url.Parse(webhook.URL)
+	if err != nil {
+		return errors.Wrap(err, "invalid url")
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https url")
+	}
+	if webhook.Timeout < 0 {
+		return errors.Errorf("timeout cannot be negative, got %s", webhook.Timeout)
+	}
+	return nil
+}
+
+// validateMissingDataPolicy checks if the missing data policy is supported. An
+// empty policy is valid and considered inconclusive.
+func validateMissingDataPolicy(policy MissingDataPolicy) error {
+	switch policy {
+	case "", MissingDataInconclusive, MissingDataHealthy, MissingDataUnhealthy:
+		return nil
+	default:
+		return errors.Errorf("unsupported policy %q", policy)
+	}
+}
+
 func validateTarget(target Target) error {
 	if target.Project == "" {
 		return errors.Errorf("project must be specified")
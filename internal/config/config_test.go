@@ -16,6 +16,11 @@ func TestStrategy_Validate(t *testing.T) {
 		healthOffset        time.Duration
 		timeBetweenRollouts time.Duration
 		healthCriteria      []config.HealthCriterion
+		metricsQuery        config.MetricsQueryOptions
+		healthScoring       config.HealthScoring
+		healthExpression    string
+		healthWebhooks      []config.HealthWebhook
+		inconclusive        int
 		shouldErr           bool
 	}{
 		{
@@ -101,6 +106,356 @@ func TestStrategy_Validate(t *testing.T) {
 			},
 			shouldErr: true,
 		},
+		{
+			name:                "invalid missing data policy",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.ErrorRateMetricsCheck, Threshold: 1, MissingData: "ignore"},
+			},
+			shouldErr: true,
+		},
+		{
+			name:                "custom error response codes",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.ErrorRateMetricsCheck, Threshold: 1, ErrorResponseCodes: []string{"5xx", "429"}, ExcludedResponseCodes: []string{"503"}},
+				{Metric: config.ClientErrorRateMetricsCheck, Threshold: 10, ExcludedResponseCodes: []string{"404"}},
+			},
+		},
+		{
+			name:                "invalid error response code",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.ErrorRateMetricsCheck, Threshold: 1, ErrorResponseCodes: []string{"6xx"}},
+			},
+			shouldErr: true,
+		},
+		{
+			name:                "error response codes for 4xx rate",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.ClientErrorRateMetricsCheck, Threshold: 1, ErrorResponseCodes: []string{"429"}},
+			},
+			shouldErr: true,
+		},
+		{
+			name:                "4xx rate greater than 100",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.ClientErrorRateMetricsCheck, Threshold: 101},
+			},
+			shouldErr: true,
+		},
+		{
+			name:                "health scoring",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.ErrorRateMetricsCheck, Threshold: 1, Weight: 3},
+				{Metric: config.LatencyMetricsCheck, Percentile: 50, Threshold: 100, Severity: config.SeverityAdvisory},
+			},
+			healthScoring: config.HealthScoring{Enabled: true, HealthyScore: 0.9, UnhealthyScore: 0.5},
+		},
+		{
+			name:                "unhealthy score greater than healthy score",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.ErrorRateMetricsCheck, Threshold: 1},
+			},
+			healthScoring: config.HealthScoring{Enabled: true, HealthyScore: 0.5, UnhealthyScore: 0.9},
+			shouldErr:     true,
+		},
+		{
+			name:                "advisory request count",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.RequestCountMetricsCheck, Threshold: 100, Severity: config.SeverityAdvisory},
+			},
+			shouldErr: true,
+		},
+		{
+			name:                "negative weight",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.ErrorRateMetricsCheck, Threshold: 1, Weight: -1},
+			},
+			shouldErr: true,
+		},
+		{
+			name:                "health expression",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthExpression:    "errorRate < 1 && (p99 < 800 || requestCount < 100)",
+		},
+		{
+			name:                "invalid health expression",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthExpression:    "errorRate + 1",
+			shouldErr:           true,
+		},
+		{
+			name:                "health expression with health criteria",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.ErrorRateMetricsCheck, Threshold: 1},
+			},
+			healthExpression: "errorRate < 1",
+			shouldErr:        true,
+		},
+		{
+			name:                "SLO burn rate",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.SLOBurnRateMetricsCheck, Threshold: 14.4, SLOTarget: 99.9, ShortWindow: 5 * time.Minute, LongWindow: time.Hour},
+			},
+		},
+		{
+			name:                "invalid SLO target",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.SLOBurnRateMetricsCheck, Threshold: 14.4, SLOTarget: 100, ShortWindow: 5 * time.Minute, LongWindow: time.Hour},
+			},
+			shouldErr: true,
+		},
+		{
+			name:                "SLO short window not shorter than long window",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.SLOBurnRateMetricsCheck, Threshold: 14.4, SLOTarget: 99.9, ShortWindow: time.Hour, LongWindow: time.Hour},
+			},
+			shouldErr: true,
+		},
+		{
+			name:                "anomaly",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.AnomalyMetricsCheck, AnomalyOf: config.LatencyMetricsCheck, Percentile: 99, Threshold: 3, BaselineSize: 5},
+			},
+		},
+		{
+			name:                "anomaly of unsupported metric",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.AnomalyMetricsCheck, AnomalyOf: config.RequestCountMetricsCheck, Threshold: 3, BaselineSize: 5},
+			},
+			shouldErr: true,
+		},
+		{
+			name:                "anomaly with small baseline",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.AnomalyMetricsCheck, AnomalyOf: config.ErrorRateMetricsCheck, Threshold: 3, BaselineSize: 1},
+			},
+			shouldErr: true,
+		},
+		{
+			name:                "traffic share",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.TrafficShareMetricsCheck, Threshold: 90, MisroutedThreshold: 25},
+			},
+		},
+		{
+			name:                "misrouted threshold greater than traffic share",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.TrafficShareMetricsCheck, Threshold: 50, MisroutedThreshold: 60},
+			},
+			shouldErr: true,
+		},
+		{
+			name:                "misrouted threshold for error rate",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.ErrorRateMetricsCheck, Threshold: 1, MisroutedThreshold: 25},
+			},
+			shouldErr: true,
+		},
+		{
+			name:                "criterion windows",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.RequestCountMetricsCheck, Threshold: 100, WindowSinceLastStep: true},
+				{Metric: config.ErrorRateMetricsCheck, Threshold: 1, Window: 10 * time.Minute},
+				{Metric: config.LatencyMetricsCheck, Percentile: 99, Threshold: 750, Window: time.Hour},
+			},
+		},
+		{
+			name:                "negative criterion window",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.ErrorRateMetricsCheck, Threshold: 1, Window: -time.Minute},
+			},
+			shouldErr: true,
+		},
+		{
+			name:                "window and window since last step",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.RequestCountMetricsCheck, Threshold: 100, Window: time.Minute, WindowSinceLastStep: true},
+			},
+			shouldErr: true,
+		},
+		{
+			name:                "window for SLO burn rate",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.SLOBurnRateMetricsCheck, Threshold: 14.4, SLOTarget: 99.9, ShortWindow: 5 * time.Minute, LongWindow: time.Hour, Window: time.Hour},
+			},
+			shouldErr: true,
+		},
+		{
+			name:                "health webhooks",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthWebhooks: []config.HealthWebhook{
+				{URL: "https://e2e.example.com/vote", Timeout: time.Minute},
+				{URL: "http://kpi.internal:8080/vote"},
+			},
+		},
+		{
+			name:                "relative health webhook url",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthWebhooks:      []config.HealthWebhook{{URL: "/vote"}},
+			shouldErr:           true,
+		},
+		{
+			name:                "negative health webhook timeout",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthWebhooks:      []config.HealthWebhook{{URL: "https://e2e.example.com/vote", Timeout: -time.Second}},
+			shouldErr:           true,
+		},
+		{
+			name:                "negative inconclusive threshold",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			inconclusive:        -1,
+			shouldErr:           true,
+		},
+		{
+			name:                "open incidents",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.OpenIncidentsMetricsCheck, AlertPolicies: []string{"High latency"}, OnIncident: config.IncidentActionRollback},
+			},
+		},
+		{
+			name:                "unsupported incident action",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.OpenIncidentsMetricsCheck, OnIncident: "page"},
+			},
+			shouldErr: true,
+		},
+		{
+			name:                "alert policies for error rate",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.ErrorRateMetricsCheck, Threshold: 1, AlertPolicies: []string{"High latency"}},
+			},
+			shouldErr: true,
+		},
+		{
+			name:                "negative metrics retries",
+			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
+			steps:               []int64{5, 30, 60},
+			healthOffset:        20,
+			timeBetweenRollouts: 10 * time.Minute,
+			metricsQuery:        config.MetricsQueryOptions{MaxRetries: -1},
+			shouldErr:           true,
+		},
 		{
 			name:                "invalid latency percentile",
 			target:              config.NewTarget("myproject", []string{"us-east1", "us-west1"}, "team=backend"),
@@ -128,11 +483,17 @@ func TestStrategy_Validate(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.name, func(tt *testing.T) {
 			strategy := config.NewStrategy(test.target, test.steps, test.healthOffset, test.timeBetweenRollouts, test.healthCriteria)
+			strategy.MetricsQuery = test.metricsQuery
+			strategy.HealthScoring = test.healthScoring
+			strategy.HealthExpression = test.healthExpression
+			strategy.HealthWebhooks = test.healthWebhooks
+			strategy.InconclusiveThreshold = test.inconclusive
 			err := strategy.Validate()
 			if test.shouldErr {
 				assert.NotNil(tt, err)
 			} else {
 				assert.Nil(tt, err)
+				assert.Equal(tt, test.healthExpression != "", strategy.CompiledHealthExpression() != nil)
 			}
 		})
 	}
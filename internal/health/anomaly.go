@@ -0,0 +1,109 @@
+package health
+
+import (
+	"context"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/baseline"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/util"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// minBaselineSamples is the minimum number of samples needed to check an
+// anomaly criterion.
+const minBaselineSamples = 2
+
+// sampleCriteria are the criteria collected to record a baseline sample.
+var sampleCriteria = []config.HealthCriterion{
+	{Metric: config.RequestCountMetricsCheck},
+	{Metric: config.ErrorRateMetricsCheck},
+	{Metric: config.ClientErrorRateMetricsCheck},
+	{Metric: config.LatencyMetricsCheck, Percentile: 99},
+	{Metric: config.LatencyMetricsCheck, Percentile: 95},
+	{Metric: config.LatencyMetricsCheck, Percentile: 50},
+}
+
+// CollectSample gets the steady-state metrics of a revision to be recorded as
+// a baseline sample. Metrics without data are recorded as zero and listed in
+// the sample's NoData, so they are not used as baseline.
+func CollectSample(ctx context.Context, provider metrics.Provider, query metrics.Query, recordedAt time.Time) (baseline.Sample, error) {
+	values, err := CollectMetrics(ctx, provider, query, sampleCriteria)
+	if err != nil {
+		return baseline.Sample{}, errors.Wrap(err, "failed to collect metrics for baseline sample")
+	}
+
+	var noData []string
+	for i, value := range values {
+		if value.NoData {
+			noData = append(noData, baseline.MetricName(sampleCriteria[i].Metric, sampleCriteria[i].Percentile))
+		}
+	}
+	return baseline.Sample{
+		NoData:          noData,
+		Revision:        query.Revision,
+		RecordedAt:      recordedAt,
+		RequestCount:    values[0].Value,
+		ErrorRate:       values[1].Value,
+		ClientErrorRate: values[2].Value,
+		LatencyP99:      values[3].Value,
+		LatencyP95:      values[4].Value,
+		LatencyP50:      values[5].Value,
+	}, nil
+}
+
+// BaselineSize returns the number of baseline samples needed by the health
+// criteria, or zero if there is no anomaly criterion.
+func BaselineSize(healthCriteria []config.HealthCriterion) int {
+	var size int
+	for _, criteria := range healthCriteria {
+		if criteria.Metric == config.AnomalyMetricsCheck && criteria.BaselineSize > size {
+			size = criteria.BaselineSize
+		}
+	}
+	return size
+}
+
+// anomalyZScore returns the z-score of the candidate's metric against the most
+// recent samples.
+//
+// If there are not enough samples, metrics.ErrNoData is returned.
+func anomalyZScore(ctx context.Context, provider metrics.Provider, query metrics.Query, criteria config.HealthCriterion, samples []baseline.Sample) (float64, error) {
+	logger := util.LoggerFrom(ctx).WithFields(logrus.Fields{
+		"anomalyOf": criteria.AnomalyOf,
+		"samples":   len(samples),
+	})
+	if len(samples) > criteria.BaselineSize {
+		samples = samples[:criteria.BaselineSize]
+	}
+	// Samples without data for the metric do not count as baseline.
+	var withData []baseline.Sample
+	for _, sample := range samples {
+		if _, ok := sample.Value(criteria.AnomalyOf, criteria.Percentile); ok {
+			withData = append(withData, sample)
+		}
+	}
+	samples = withData
+	if len(samples) < minBaselineSamples {
+		logger.Debug("not enough baseline samples for anomaly detection")
+		return 0, metrics.ErrNoData
+	}
+
+	metricCriterion := criteria
+	metricCriterion.Metric = criteria.AnomalyOf
+	value, err := collectValue(ctx, provider, query, metricCriterion)
+	if err != nil {
+		return 0, err
+	}
+
+	zscore, ok := baseline.ZScore(samples, criteria.AnomalyOf, criteria.Percentile, value)
+	if !ok {
+		// All the previous stable revisions had a value of zero.
+		logger.Debug("baseline is zero, anomaly cannot be calculated")
+		return 0, metrics.ErrNoData
+	}
+	logger.WithFields(logrus.Fields{"value": value, "zscore": zscore}).Debug("anomaly z-score calculated")
+	return zscore, nil
+}
@@ -0,0 +1,106 @@
+package health_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/baseline"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics"
+	metricsMocker "github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics/mock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectMetricsWithSources_Anomaly(t *testing.T) {
+	metricsMock := &metricsMocker.Metrics{}
+	metricsMock.LatencyFn = func(ctx context.Context, q metrics.Query) (float64, error) {
+		return 700, nil
+	}
+	metricsMock.ErrorRateFn = func(ctx context.Context, q metrics.Query) (float64, error) {
+		return 0.01, nil
+	}
+	latencyAnomaly := config.HealthCriterion{Metric: config.AnomalyMetricsCheck, AnomalyOf: config.LatencyMetricsCheck, Percentile: 99, Threshold: 2, BaselineSize: 2}
+	errorRateAnomaly := config.HealthCriterion{Metric: config.AnomalyMetricsCheck, AnomalyOf: config.ErrorRateMetricsCheck, Threshold: 2, BaselineSize: 2}
+
+	tests := []struct {
+		name     string
+		criteria []config.HealthCriterion
+		samples  []baseline.Sample
+		expected []health.MetricsValue
+	}{
+		{
+			name:     "anomalies",
+			criteria: []config.HealthCriterion{latencyAnomaly, errorRateAnomaly},
+			samples: []baseline.Sample{
+				{LatencyP99: 400, ErrorRate: 1},
+				{LatencyP99: 600, ErrorRate: 1},
+				// Not part of the baseline.
+				{LatencyP99: 10000, ErrorRate: 50},
+			},
+			expected: []health.MetricsValue{{Value: 2}, {Value: 0}},
+		},
+		{
+			name:     "not enough samples",
+			criteria: []config.HealthCriterion{latencyAnomaly},
+			samples:  []baseline.Sample{{LatencyP99: 400}},
+			expected: []health.MetricsValue{{NoData: true}},
+		},
+		{
+			name:     "samples without data are not part of the baseline",
+			criteria: []config.HealthCriterion{latencyAnomaly},
+			samples: []baseline.Sample{
+				{LatencyP99: 400},
+				{NoData: []string{"request-latency-p99"}},
+			},
+			expected: []health.MetricsValue{{NoData: true}},
+		},
+		{
+			name:     "zero baseline",
+			criteria: []config.HealthCriterion{errorRateAnomaly},
+			samples:  []baseline.Sample{{}, {}},
+			expected: []health.MetricsValue{{NoData: true}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			results, err := health.CollectMetricsWithSources(context.Background(), metricsMock, metrics.Query{}, test.criteria, health.Sources{Baseline: test.samples})
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, results)
+		})
+	}
+}
+
+func TestBaselineSize(t *testing.T) {
+	criteria := []config.HealthCriterion{
+		{Metric: config.ErrorRateMetricsCheck, Threshold: 1},
+		{Metric: config.AnomalyMetricsCheck, AnomalyOf: config.ErrorRateMetricsCheck, BaselineSize: 3},
+		{Metric: config.AnomalyMetricsCheck, AnomalyOf: config.LatencyMetricsCheck, Percentile: 99, BaselineSize: 5},
+	}
+	assert.Equal(t, 5, health.BaselineSize(criteria))
+	assert.Equal(t, 0, health.BaselineSize(criteria[:1]))
+}
+
+func TestCollectSample(t *testing.T) {
+	metricsMock := &metricsMocker.Metrics{}
+	metricsMock.RequestCountFn = func(ctx context.Context, q metrics.Query) (int64, error) {
+		return 0, nil
+	}
+	metricsMock.LatencyFn = func(ctx context.Context, q metrics.Query) (float64, error) {
+		return 0, metrics.ErrNoData
+	}
+	metricsMock.ErrorRateFn = func(ctx context.Context, q metrics.Query) (float64, error) {
+		return 0, metrics.ErrNoData
+	}
+
+	sample, err := health.CollectSample(context.Background(), metricsMock, metrics.Query{Revision: "test-001"}, time.Time{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"error-rate-percent", "4xx-rate-percent", "request-latency-p99", "request-latency-p95", "request-latency-p50"}, sample.NoData)
+	_, ok := sample.Value(config.LatencyMetricsCheck, 99)
+	assert.False(t, ok)
+	value, ok := sample.Value(config.RequestCountMetricsCheck, 0)
+	assert.True(t, ok)
+	assert.Equal(t, 0.0, value)
+}
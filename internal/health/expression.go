@@ -0,0 +1,96 @@
+package health
+
+import (
+	"context"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health/expression"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/util"
+	"github.com/pkg/errors"
+)
+
+// Binding is the value of a variable of a health expression.
+type Binding struct {
+	Name   string
+	Value  float64
+	NoData bool
+}
+
+// ExpressionCriteria returns the health criteria used to collect the values of
+// the variables referenced by the expression, in the same order as
+// expr.Variables().
+//
+// The thresholds of the returned criteria are meaningless.
+func ExpressionCriteria(expr *expression.Expression) []config.HealthCriterion {
+	var criteria []config.HealthCriterion
+	for _, name := range expr.Variables() {
+		criteria = append(criteria, variableCriterion(name))
+	}
+	return criteria
+}
+
+// DiagnoseExpression determines the health of a revision by evaluating the
+// expression with the metrics values collected for ExpressionCriteria.
+//
+// The diagnosis is Healthy if the expression evaluates to true and Unhealthy
+// otherwise. If the result depends on variables without data, the diagnosis is
+// Inconclusive.
+func DiagnoseExpression(ctx context.Context, expr *expression.Expression, actualValues []MetricsValue) (Diagnosis, error) {
+	logger := util.LoggerFrom(ctx).WithField("expression", expr.String())
+	variables := expr.Variables()
+	if len(variables) != len(actualValues) {
+		return Diagnosis{OverallResult: Unknown}, errors.New("the number of variables of the expression is not the same to the size of the actual metrics values")
+	}
+
+	values := make(map[string]float64)
+	var bindings []Binding
+	var noData []string
+	for i, name := range variables {
+		value := actualValues[i]
+		bindings = append(bindings, Binding{Name: name, Value: value.Value, NoData: value.NoData})
+		if value.NoData {
+			noData = append(noData, name)
+			continue
+		}
+		values[name] = value.Value
+	}
+
+	diagnosis := Diagnosis{Expression: expr.String(), Bindings: bindings}
+	result, err := expr.Eval(values)
+	if err != nil {
+		if len(noData) == 0 {
+			return Diagnosis{OverallResult: Unknown}, errors.Wrap(err, "failed to evaluate health expression")
+		}
+		logger.WithError(err).Debug("expression depends on variables without data, inconclusive")
+		diagnosis.OverallResult = Inconclusive
+		diagnosis.Reason = "no data for " + strings.Join(noData, ", ")
+		return diagnosis, nil
+	}
+
+	diagnosis.OverallResult = Unhealthy
+	if result {
+		diagnosis.OverallResult = Healthy
+	}
+	logger.WithField("result", result).Debug("health expression evaluated")
+	return diagnosis, nil
+}
+
+// variableCriterion returns the health criterion used to collect the value of
+// an expression variable.
+func variableCriterion(name string) config.HealthCriterion {
+	switch name {
+	case expression.RequestCount:
+		return config.HealthCriterion{Metric: config.RequestCountMetricsCheck}
+	case expression.ErrorRate:
+		return config.HealthCriterion{Metric: config.ErrorRateMetricsCheck}
+	case expression.ClientErrorRate:
+		return config.HealthCriterion{Metric: config.ClientErrorRateMetricsCheck}
+	case expression.LatencyP99:
+		return config.HealthCriterion{Metric: config.LatencyMetricsCheck, Percentile: 99}
+	case expression.LatencyP95:
+		return config.HealthCriterion{Metric: config.LatencyMetricsCheck, Percentile: 95}
+	default:
+		return config.HealthCriterion{Metric: config.LatencyMetricsCheck, Percentile: 50}
+	}
+}
@@ -0,0 +1,222 @@
+// Package expression implements health policies defined as CEL expressions
+// over the metrics of a revision.
+//
+// An expression must evaluate to a boolean, true meaning the revision is
+// healthy. For example,
+//
+//	errorRate < 1 && (p99 < 800 || requestCount < 100)
+//
+// See https://github.com/google/cel-spec for the language definition.
+package expression
+
+import (
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/interpreter/functions"
+	"github.com/pkg/errors"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// Variables available in expressions. All of them are doubles.
+const (
+	RequestCount    = "requestCount"
+	ErrorRate       = "errorRate"
+	ClientErrorRate = "clientErrorRate"
+	LatencyP99      = "p99"
+	LatencyP95      = "p95"
+	LatencyP50      = "p50"
+)
+
+// Variables is the list of all the variables available in expressions.
+var Variables = []string{RequestCount, ErrorRate, ClientErrorRate, LatencyP99, LatencyP95, LatencyP50}
+
+// Expression is a compiled and type-checked health expression.
+type Expression struct {
+	source    string
+	program   cel.Program
+	variables []string
+}
+
+// Compile parses and type-checks a health expression.
+func Compile(source string) (*Expression, error) {
+	env, err := newEnv()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize expression environment")
+	}
+
+	ast, issues := env.Compile(source)
+	if issues != nil && issues.Err() != nil {
+		return nil, errors.Errorf("invalid expression: %v", issues.Err())
+	}
+	if !proto.Equal(ast.ResultType(), decls.Bool) {
+		return nil, errors.Errorf("expression must evaluate to a boolean, got %v", ast.ResultType())
+	}
+	checked, err := cel.AstToCheckedExpr(ast)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to check expression")
+	}
+	variables := referencedVariables(checked)
+	if len(variables) == 0 {
+		return nil, errors.New("expression must reference at least one metric")
+	}
+
+	program, err := env.Program(ast, cel.Functions(mixedComparisons()...))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to plan expression")
+	}
+
+	return &Expression{
+		source:    source,
+		program:   program,
+		variables: variables,
+	}, nil
+}
+
+// String returns the source of the expression.
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Variables returns the variables referenced by the expression, in the order
+// they are listed in Variables.
+func (e *Expression) Variables() []string {
+	return e.variables
+}
+
+// Eval evaluates the expression with the given values for its variables.
+//
+// Variables without a value are unknown. If the result depends on them, an
+// error is returned. However, an unknown value does not matter if the result
+// is determined by other parts of the expression (e.g. the right side of
+// `true || p99 < 800`).
+func (e *Expression) Eval(values map[string]float64) (bool, error) {
+	activation := make(map[string]interface{}, len(values))
+	for name, value := range values {
+		activation[name] = value
+	}
+
+	out, _, err := e.program.Eval(activation)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to evaluate expression")
+	}
+	result, ok := out.Value().(bool)
+	if !ok {
+		return false, errors.Errorf("expression evaluated to %v, not a boolean", out.Value())
+	}
+	return result, nil
+}
+
+func newEnv() (*cel.Env, error) {
+	var declarations []*exprpb.Decl
+	for _, name := range Variables {
+		declarations = append(declarations, decls.NewIdent(name, decls.Double, nil))
+	}
+	declarations = append(declarations, mixedComparisonDecls()...)
+	return cel.NewEnv(cel.Declarations(declarations...))
+}
+
+// referencedVariables returns the variables referenced in the checked
+// expression.
+func referencedVariables(checked *exprpb.CheckedExpr) []string {
+	referenced := make(map[string]bool)
+	for _, reference := range checked.GetReferenceMap() {
+		if reference.GetName() != "" {
+			referenced[reference.GetName()] = true
+		}
+	}
+
+	var variables []string
+	for _, name := range Variables {
+		if referenced[name] {
+			variables = append(variables, name)
+		}
+	}
+	return variables
+}
+
+// comparisonOperators are the operators that support comparing doubles with
+// ints, which allows expressions such as `errorRate < 1` instead of requiring
+// `errorRate < 1.0`.
+var comparisonOperators = map[string]string{
+	operators.Less:          "less",
+	operators.LessEquals:    "less_equals",
+	operators.Greater:       "greater",
+	operators.GreaterEquals: "greater_equals",
+}
+
+// mixedComparisonDecls returns the declarations of the comparison overloads
+// between doubles and ints.
+func mixedComparisonDecls() []*exprpb.Decl {
+	var declarations []*exprpb.Decl
+	for _, operator := range sortedOperators() {
+		name := comparisonOperators[operator]
+		declarations = append(declarations, decls.NewFunction(operator,
+			decls.NewOverload(name+"_double_int", []*exprpb.Type{decls.Double, decls.Int}, decls.Bool),
+			decls.NewOverload(name+"_int_double", []*exprpb.Type{decls.Int, decls.Double}, decls.Bool),
+		))
+	}
+	return declarations
+}
+
+// mixedComparisons returns the implementation of the comparison overloads
+// between doubles and ints.
+func mixedComparisons() []*functions.Overload {
+	var overloads []*functions.Overload
+	for _, operator := range sortedOperators() {
+		name := comparisonOperators[operator]
+		compare := comparison(operator)
+		overloads = append(overloads,
+			&functions.Overload{Operator: name + "_double_int", Binary: compare},
+			&functions.Overload{Operator: name + "_int_double", Binary: compare},
+		)
+	}
+	return overloads
+}
+
+// comparison returns a function that compares two numbers with the operator.
+func comparison(operator string) functions.BinaryOp {
+	return func(lhs, rhs ref.Val) ref.Val {
+		l, lok := toDouble(lhs)
+		r, rok := toDouble(rhs)
+		if !lok || !rok {
+			return types.ValOrErr(lhs, "no such overload")
+		}
+		switch operator {
+		case operators.Less:
+			return types.Bool(l < r)
+		case operators.LessEquals:
+			return types.Bool(l <= r)
+		case operators.Greater:
+			return types.Bool(l > r)
+		default:
+			return types.Bool(l >= r)
+		}
+	}
+}
+
+// toDouble converts a numeric value to a double.
+func toDouble(value ref.Val) (types.Double, bool) {
+	switch v := value.(type) {
+	case types.Double:
+		return v, true
+	case types.Int:
+		return types.Double(v), true
+	default:
+		return 0, false
+	}
+}
+
+func sortedOperators() []string {
+	var ops []string
+	for operator := range comparisonOperators {
+		ops = append(ops, operator)
+	}
+	sort.Strings(ops)
+	return ops
+}
@@ -0,0 +1,121 @@
+package expression_test
+
+import (
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health/expression"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name      string
+		source    string
+		variables []string
+		shouldErr bool
+	}{
+		{
+			name:      "single variable",
+			source:    "errorRate < 1.0",
+			variables: []string{expression.ErrorRate},
+		},
+		{
+			name:      "mixed numeric types",
+			source:    "errorRate < 1 && (p99 < 800 || requestCount < 100)",
+			variables: []string{expression.RequestCount, expression.ErrorRate, expression.LatencyP99},
+		},
+		{
+			name:      "int on the left",
+			source:    "100 <= requestCount",
+			variables: []string{expression.RequestCount},
+		},
+		{
+			name:      "syntax error",
+			source:    "errorRate <",
+			shouldErr: true,
+		},
+		{
+			name:      "unknown variable",
+			source:    "p90 < 100",
+			shouldErr: true,
+		},
+		{
+			name:      "no variables",
+			source:    "true",
+			shouldErr: true,
+		},
+		{
+			name:      "non-boolean result",
+			source:    "errorRate + 1.0",
+			shouldErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expr, err := expression.Compile(test.source)
+			if test.shouldErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.variables, expr.Variables())
+			assert.Equal(t, test.source, expr.String())
+		})
+	}
+}
+
+func TestExpression_Eval(t *testing.T) {
+	source := "errorRate < 1 && (p99 < 800 || requestCount < 100)"
+	tests := []struct {
+		name      string
+		values    map[string]float64
+		expected  bool
+		shouldErr bool
+	}{
+		{
+			name:     "all met",
+			values:   map[string]float64{"errorRate": 0.5, "p99": 500, "requestCount": 1000},
+			expected: true,
+		},
+		{
+			name:     "high latency with few requests",
+			values:   map[string]float64{"errorRate": 0.5, "p99": 900, "requestCount": 50},
+			expected: true,
+		},
+		{
+			name:     "high latency",
+			values:   map[string]float64{"errorRate": 0.5, "p99": 900, "requestCount": 1000},
+			expected: false,
+		},
+		{
+			name:     "boundary",
+			values:   map[string]float64{"errorRate": 1, "p99": 500, "requestCount": 1000},
+			expected: false,
+		},
+		{
+			name:     "unknown value not needed",
+			values:   map[string]float64{"errorRate": 0.5, "requestCount": 50},
+			expected: true,
+		},
+		{
+			name:      "unknown value needed",
+			values:    map[string]float64{"errorRate": 0.5, "requestCount": 1000},
+			shouldErr: true,
+		},
+	}
+
+	expr, err := expression.Compile(source)
+	assert.Nil(t, err)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := expr.Eval(test.values)
+			if test.shouldErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, result)
+		})
+	}
+}
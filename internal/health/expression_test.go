@@ -0,0 +1,104 @@
+package health_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health/expression"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpressionCriteria(t *testing.T) {
+	expr, err := expression.Compile("errorRate < 1 && (p99 < 800 || requestCount < 100)")
+	assert.Nil(t, err)
+
+	expected := []config.HealthCriterion{
+		{Metric: config.RequestCountMetricsCheck},
+		{Metric: config.ErrorRateMetricsCheck},
+		{Metric: config.LatencyMetricsCheck, Percentile: 99},
+	}
+	assert.Equal(t, expected, health.ExpressionCriteria(expr))
+}
+
+func TestDiagnoseExpression(t *testing.T) {
+	// Values are in the order of the variables: requestCount, errorRate, p99.
+	tests := []struct {
+		name      string
+		values    []health.MetricsValue
+		expected  health.Diagnosis
+		shouldErr bool
+	}{
+		{
+			name:   "healthy",
+			values: []health.MetricsValue{{Value: 1000}, {Value: 0.5}, {Value: 500}},
+			expected: health.Diagnosis{
+				OverallResult: health.Healthy,
+				Bindings: []health.Binding{
+					{Name: "requestCount", Value: 1000},
+					{Name: "errorRate", Value: 0.5},
+					{Name: "p99", Value: 500},
+				},
+			},
+		},
+		{
+			name:   "unhealthy",
+			values: []health.MetricsValue{{Value: 1000}, {Value: 2}, {Value: 500}},
+			expected: health.Diagnosis{
+				OverallResult: health.Unhealthy,
+				Bindings: []health.Binding{
+					{Name: "requestCount", Value: 1000},
+					{Name: "errorRate", Value: 2},
+					{Name: "p99", Value: 500},
+				},
+			},
+		},
+		{
+			name:   "no data not needed for the result",
+			values: []health.MetricsValue{{Value: 50}, {Value: 0.5}, {NoData: true}},
+			expected: health.Diagnosis{
+				OverallResult: health.Healthy,
+				Bindings: []health.Binding{
+					{Name: "requestCount", Value: 50},
+					{Name: "errorRate", Value: 0.5},
+					{Name: "p99", NoData: true},
+				},
+			},
+		},
+		{
+			name:   "no data, inconclusive",
+			values: []health.MetricsValue{{Value: 1000}, {Value: 0.5}, {NoData: true}},
+			expected: health.Diagnosis{
+				OverallResult: health.Inconclusive,
+				Reason:        "no data for p99",
+				Bindings: []health.Binding{
+					{Name: "requestCount", Value: 1000},
+					{Name: "errorRate", Value: 0.5},
+					{Name: "p99", NoData: true},
+				},
+			},
+		},
+		{
+			name:      "should err, different sizes for variables and values",
+			values:    []health.MetricsValue{{Value: 1000}},
+			shouldErr: true,
+		},
+	}
+
+	source := "errorRate < 1 && (p99 < 800 || requestCount < 100)"
+	expr, err := expression.Compile(source)
+	assert.Nil(t, err)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diagnosis, err := health.DiagnoseExpression(context.Background(), expr, test.values)
+			if test.shouldErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			test.expected.Expression = source
+			assert.Equal(t, test.expected, diagnosis)
+		})
+	}
+}
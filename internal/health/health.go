@@ -2,9 +2,13 @@ package health
 
 import (
 	"context"
+	"fmt"
+	"math"
 	"time"
 
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/baseline"
 	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/incident"
 	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics"
 	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/util"
 	"github.com/pkg/errors"
@@ -39,6 +43,24 @@ func (d DiagnosisResult) String() string {
 type Diagnosis struct {
 	OverallResult DiagnosisResult
 	CheckResults  []CheckResult
+
+	// Reason explains the overall result when it was not determined by the
+	// health criteria checks (e.g. metrics could not be retrieved).
+	Reason string
+
+	// Score is the weighted health score, from 0 to 1. It is only set if Scored
+	// is true.
+	Score  float64
+	Scored bool
+
+	// Expression is the health expression that determined the result, if
+	// any. In that case, Bindings has the values of its variables and
+	// CheckResults is empty.
+	Expression string
+	Bindings   []Binding
+
+	// Votes are the votes of external voters merged into the diagnosis.
+	Votes []Vote
 }
 
 // CheckResult is information about a metrics criteria check.
@@ -46,6 +68,18 @@ type CheckResult struct {
 	Threshold     float64
 	ActualValue   float64
 	IsCriteriaMet bool
+
+	// NoData is true if the metrics provider had no data for the criterion.
+	NoData bool
+}
+
+// MetricsValue is the metrics value collected for a health criterion.
+type MetricsValue struct {
+	Value float64
+
+	// NoData is true if the metrics provider had no data for the criterion, in
+	// which case Value is meaningless.
+	NoData bool
 }
 
 // Diagnose attempts to determine the health of a revision.
@@ -57,19 +91,24 @@ type CheckResult struct {
 // Otherwise, all metrics criteria are checked to determine the diagnosis:
 // healthy, unhealthy, or inconclusive.
 //
-// If the minimum number of requests is not met, the diagnosis is Inconclusive
-// even though all other criteria are met.
+// If the minimum number of requests or the minimum traffic share is not met,
+// the diagnosis is Inconclusive even though all other criteria are met. If the
+// traffic share is so low that the candidate might be misrouted, the reason of
+// the diagnosis says so.
 //
 // However, if any criteria other than the request count is not met, the
 // diagnosis is unhealthy independent on the request count criteria. That is,
 // Unhealthy has precedence over Inconclusive.
-func Diagnose(ctx context.Context, healthCriteria []config.HealthCriterion, actualValues []float64) (Diagnosis, error) {
+//
+// If there was no data for a criterion, its missing data policy determines if
+// the criterion is considered met, unmet or makes the diagnosis inconclusive.
+func Diagnose(ctx context.Context, healthCriteria []config.HealthCriterion, actualValues []MetricsValue) (Diagnosis, error) {
 	logger := util.LoggerFrom(ctx)
 	if len(healthCriteria) != len(actualValues) {
-		return Diagnosis{Unknown, nil}, errors.New("the size of health criteria is not the same to the size of the actual metrics values")
+		return Diagnosis{OverallResult: Unknown}, errors.New("the size of health criteria is not the same to the size of the actual metrics values")
 	}
 	if len(healthCriteria) == 0 {
-		return Diagnosis{Unknown, nil}, errors.New("health criteria must be specified")
+		return Diagnosis{OverallResult: Unknown}, errors.New("health criteria must be specified")
 	}
 
 	diagnosis := Unknown
@@ -79,19 +118,26 @@ func Diagnose(ctx context.Context, healthCriteria []config.HealthCriterion, actu
 		logger := logger.WithFields(logrus.Fields{
 			"metrics":       criteria.Metric,
 			"expectedValue": criteria.Threshold,
-			"actualValue":   value,
+			"actualValue":   value.Value,
 		})
 		if criteria.Metric == config.LatencyMetricsCheck {
 			logger = logger.WithField("percentile", criteria.Percentile)
 		}
 
-		isMet := isCriteriaMet(criteria.Metric, criteria.Threshold, value)
-		result := CheckResult{Threshold: criteria.Threshold, ActualValue: value, IsCriteriaMet: isMet}
+		result, noDataInconclusive := checkCriterion(criteria, value)
 		results = append(results, result)
+		if noDataInconclusive {
+			logger.WithField("missingDataPolicy", criteria.MissingData).Debug("no data for criterion, inconclusive")
+			if diagnosis != Unhealthy {
+				diagnosis = Inconclusive
+			}
+			continue
+		}
+		isMet := result.IsCriteriaMet
 
 		// For unmet request count, return inconclusive unless diagnosis is
 		// unhealthy.
-		if !isMet && criteria.Metric == config.RequestCountMetricsCheck {
+		if !isMet && holdsWhenUnmet(criteria) {
 			logger.Debug("unmet request count criterion")
 			if diagnosis != Unhealthy {
 				diagnosis = Inconclusive
@@ -106,67 +152,228 @@ func Diagnose(ctx context.Context, healthCriteria []config.HealthCriterion, actu
 		}
 
 		// Only switch to healthy once a first criteria is met.
-		if diagnosis == Unknown && criteria.Metric != config.RequestCountMetricsCheck {
+		if diagnosis == Unknown && !isRequestVolumeCriterion(criteria.Metric) {
 			diagnosis = Healthy
 		}
-		result.IsCriteriaMet = true
 		logger.Debug("met criterion")
 	}
 
-	return Diagnosis{diagnosis, results}, nil
+	return Diagnosis{OverallResult: diagnosis, CheckResults: results, Reason: misrouting(ctx, healthCriteria, results)}, nil
+}
+
+// collectValue gets the metrics value for a health criterion.
+func collectValue(ctx context.Context, provider metrics.Provider, query metrics.Query, criteria config.HealthCriterion) (float64, error) {
+	switch criteria.Metric {
+	case config.RequestCountMetricsCheck:
+		return requestCount(ctx, provider, query)
+	case config.LatencyMetricsCheck:
+		return latency(ctx, provider, query, criteria.Percentile)
+	case config.ErrorRateMetricsCheck:
+		query.ErrorResponseCodes = criteria.ErrorResponseCodes
+		query.ExcludedResponseCodes = criteria.ExcludedResponseCodes
+		return errorRatePercent(ctx, provider, query)
+	case config.ClientErrorRateMetricsCheck:
+		query.ErrorResponseCodes = clientErrorResponseCodes
+		query.ExcludedResponseCodes = criteria.ExcludedResponseCodes
+		return errorRatePercent(ctx, provider, query)
+	case config.SLOBurnRateMetricsCheck:
+		query.ErrorResponseCodes = criteria.ErrorResponseCodes
+		query.ExcludedResponseCodes = criteria.ExcludedResponseCodes
+		return sloBurnRate(ctx, provider, query, criteria)
+	case config.TrafficShareMetricsCheck:
+		return trafficShare(ctx, provider, query)
+	default:
+		return 0, errors.Errorf("unimplemented metrics %q", criteria.Metric)
+	}
 }
 
+// clientErrorResponseCodes are the response codes counted by the client error
+// rate criterion.
+var clientErrorResponseCodes = []string{"4xx"}
+
 // CollectMetrics gets a metrics value for each of the given health criteria and
 // returns a result for each criterion.
-func CollectMetrics(ctx context.Context, provider metrics.Provider, offset time.Duration, healthCriteria []config.HealthCriterion) ([]float64, error) {
+//
+// The query determines the service, revision and time window for which metrics
+// are retrieved, although criteria with their own window use it instead. If the
+// provider has no data for a criterion, the result is marked as such instead of
+// failing.
+func CollectMetrics(ctx context.Context, provider metrics.Provider, query metrics.Query, healthCriteria []config.HealthCriterion) ([]MetricsValue, error) {
+	return CollectMetricsWithSources(ctx, provider, query, healthCriteria, Sources{})
+}
+
+// Sources are the values, other than the metrics of the revision, needed by
+// some health criteria.
+type Sources struct {
+	// Baseline are the samples of previous stable revisions, most recent first,
+	// against which anomaly criteria are checked. If there are not enough
+	// samples, anomaly criteria have no data.
+	Baseline []baseline.Sample
+
+	// Incidents are the open incidents of the service counted by the open
+	// incidents criteria.
+	Incidents []incident.Incident
+
+	// NoIncidentData means the open incidents of the service are unknown (e.g.
+	// the incident tracker just started), so open incidents criteria have no
+	// data.
+	NoIncidentData bool
+}
+
+// CollectMetricsWithSources is like CollectMetrics, but criteria that are not
+// only based on the metrics of the revision use the given sources.
+func CollectMetricsWithSources(ctx context.Context, provider metrics.Provider, query metrics.Query, healthCriteria []config.HealthCriterion, sources Sources) ([]MetricsValue, error) {
 	if len(healthCriteria) == 0 {
 		return nil, errors.New("health criteria must be specified")
 	}
-	var metricsValues []float64
+	var metricsValues []MetricsValue
 	for _, criteria := range healthCriteria {
+		criterionQuery := query
+		if criteria.Window > 0 {
+			criterionQuery.Window = criteria.Window
+		}
+
 		var metricsValue float64
 		var err error
-
 		switch criteria.Metric {
-		case config.RequestCountMetricsCheck:
-			metricsValue, err = requestCount(ctx, provider, offset)
-		case config.LatencyMetricsCheck:
-			metricsValue, err = latency(ctx, provider, offset, criteria.Percentile)
-		case config.ErrorRateMetricsCheck:
-			metricsValue, err = errorRatePercent(ctx, provider, offset)
+		case config.AnomalyMetricsCheck:
+			metricsValue, err = anomalyZScore(ctx, provider, criterionQuery, criteria, sources.Baseline)
+		case config.OpenIncidentsMetricsCheck:
+			if sources.NoIncidentData {
+				err = metrics.ErrNoData
+				break
+			}
+			metricsValue = openIncidents(ctx, criteria, sources.Incidents)
 		default:
-			return nil, errors.Errorf("unimplemented metrics %q", criteria.Metric)
+			metricsValue, err = collectValue(ctx, provider, criterionQuery, criteria)
 		}
 
+		if errors.Is(err, metrics.ErrNoData) {
+			util.LoggerFrom(ctx).WithField("metrics", criteria.Metric).Debug("no metrics data available")
+			metricsValues = append(metricsValues, MetricsValue{NoData: true})
+			continue
+		}
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to obtain metrics %q", criteria.Metric)
 		}
-		metricsValues = append(metricsValues, metricsValue)
+		metricsValues = append(metricsValues, MetricsValue{Value: metricsValue})
 	}
 
 	return metricsValues, nil
 }
 
+// checkCriterion checks if a criterion is met by the metrics value.
+//
+// If there was no data and the missing data policy does not determine if the
+// criterion is met, noDataInconclusive is true.
+func checkCriterion(criteria config.HealthCriterion, value MetricsValue) (result CheckResult, noDataInconclusive bool) {
+	if !value.NoData {
+		isMet := isCriteriaMet(criteria.Metric, criteria.Threshold, value.Value)
+		return CheckResult{Threshold: criteria.Threshold, ActualValue: value.Value, IsCriteriaMet: isMet}, false
+	}
+
+	result = CheckResult{Threshold: criteria.Threshold, NoData: true}
+	switch criteria.MissingData {
+	case config.MissingDataHealthy:
+		result.IsCriteriaMet = true
+	case config.MissingDataUnhealthy:
+		result.IsCriteriaMet = false
+	default:
+		return result, true
+	}
+	return result, false
+}
+
 // isCriteriaMet concludes if metrics criteria was met.
 func isCriteriaMet(metricsType config.MetricsCheck, threshold float64, actualValue float64) bool {
-	// Of all the supported metrics, only the threshold for request count has an
-	// expected minimum value.
-	if metricsType == config.RequestCountMetricsCheck {
+	// Of all the supported metrics, only the thresholds for the request volume
+	// have an expected minimum value.
+	if isRequestVolumeCriterion(metricsType) {
 		return actualValue >= threshold
 	}
 	return actualValue <= threshold
 }
 
-// requestCount returns the number of requests during the given offset.
-func requestCount(ctx context.Context, provider metrics.Provider, offset time.Duration) (float64, error) {
+// holdsWhenUnmet determines if the criterion makes the diagnosis inconclusive
+// instead of unhealthy when it is not met.
+func holdsWhenUnmet(criteria config.HealthCriterion) bool {
+	if criteria.Metric == config.OpenIncidentsMetricsCheck {
+		return criteria.OnIncident != config.IncidentActionRollback
+	}
+	return isRequestVolumeCriterion(criteria.Metric)
+}
+
+// isRequestVolumeCriterion determines if the metrics check is about the number
+// of requests served by the revision, in which case an unmet criterion means
+// the diagnosis is inconclusive instead of unhealthy.
+func isRequestVolumeCriterion(metricsType config.MetricsCheck) bool {
+	return metricsType == config.RequestCountMetricsCheck || metricsType == config.TrafficShareMetricsCheck
+}
+
+// requestCount returns the number of requests for the given query.
+func requestCount(ctx context.Context, provider metrics.Provider, query metrics.Query) (float64, error) {
 	logger := util.LoggerFrom(ctx)
 	logger.Debug("querying for request count metrics")
-	count, err := provider.RequestCount(ctx, offset)
+	count, err := provider.RequestCount(ctx, query)
 	return float64(count), errors.Wrap(err, "failed to get request count metrics")
 }
 
-// latency returns the latency for the given offset and percentile.
-func latency(ctx context.Context, provider metrics.Provider, offset time.Duration, percentile float64) (float64, error) {
+// trafficShare returns the percentage of its expected share of the service
+// requests served by the revision. The expected share is the number of
+// requests for the entire service times the traffic percentage of the revision.
+//
+// The current traffic percentage is used, so the share is underestimated if
+// the percentage increased during the time window.
+func trafficShare(ctx context.Context, provider metrics.Provider, query metrics.Query) (float64, error) {
+	logger := util.LoggerFrom(ctx).WithField("trafficPercent", query.TrafficPercent)
+	if query.TrafficPercent <= 0 {
+		return 0, errors.Wrap(metrics.ErrNoData, "revision does not receive traffic")
+	}
+
+	logger.Debug("querying for request count metrics")
+	count, err := provider.RequestCount(ctx, query)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get request count metrics")
+	}
+	serviceQuery := query
+	serviceQuery.Revision = ""
+	total, err := provider.RequestCount(ctx, serviceQuery)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get request count metrics for service")
+	}
+	if total == 0 {
+		return 0, errors.Wrap(metrics.ErrNoData, "service did not receive requests")
+	}
+
+	expected := float64(total) * float64(query.TrafficPercent) / 100
+	share := float64(count) / expected * 100
+	logger.WithFields(logrus.Fields{"expected": expected, "value": share}).Debug("traffic share successfully calculated")
+	return share, nil
+}
+
+// misrouting returns a reason if a traffic share criterion shows the revision
+// gets far less traffic than its configured split, which points to a routing
+// problem rather than to a lack of requests. Otherwise, it returns an empty
+// string.
+func misrouting(ctx context.Context, healthCriteria []config.HealthCriterion, results []CheckResult) string {
+	for i, criteria := range healthCriteria {
+		result := results[i]
+		if criteria.Metric != config.TrafficShareMetricsCheck || criteria.MisroutedThreshold == 0 || result.NoData {
+			continue
+		}
+		if result.ActualValue < criteria.MisroutedThreshold {
+			util.LoggerFrom(ctx).WithFields(logrus.Fields{
+				"actualValue":        result.ActualValue,
+				"misroutedThreshold": criteria.MisroutedThreshold,
+			}).Warn("candidate gets far less traffic than its configured split")
+			return fmt.Sprintf("candidate served %.2f%% of its expected share of requests, traffic might be misrouted", result.ActualValue)
+		}
+	}
+	return ""
+}
+
+// latency returns the latency for the given query and percentile.
+func latency(ctx context.Context, provider metrics.Provider, query metrics.Query, percentile float64) (float64, error) {
 	alignerReducer, err := metrics.PercentileToAlignReduce(percentile)
 	if err != nil {
 		return 0, errors.Wrap(err, "failed to parse percentile")
@@ -174,7 +381,8 @@ func latency(ctx context.Context, provider metrics.Provider, offset time.Duratio
 
 	logger := util.LoggerFrom(ctx).WithField("percentile", percentile)
 	logger.Debug("querying for latency metrics")
-	latency, err := provider.Latency(ctx, offset, alignerReducer)
+	query.AlignReduce = alignerReducer
+	latency, err := provider.Latency(ctx, query)
 	if err != nil {
 		return 0, errors.Wrap(err, "failed to get latency metrics")
 	}
@@ -183,11 +391,36 @@ func latency(ctx context.Context, provider metrics.Provider, offset time.Duratio
 	return latency, nil
 }
 
-// errorRatePercent returns the percentage of errors during the given offset.
-func errorRatePercent(ctx context.Context, provider metrics.Provider, offset time.Duration) (float64, error) {
+// sloBurnRate returns the lowest of the error budget burn rates over the short
+// and long windows of the criterion. That is, the value only exceeds the
+// threshold if the burn rate exceeds it over both windows.
+//
+// The burn rate is the error rate divided by the error budget, so a burn rate
+// of 1 consumes the error budget exactly at the end of the SLO period.
+func sloBurnRate(ctx context.Context, provider metrics.Provider, query metrics.Query, criteria config.HealthCriterion) (float64, error) {
+	errorBudget := (100 - criteria.SLOTarget) / 100
+	logger := util.LoggerFrom(ctx).WithField("sloTarget", criteria.SLOTarget)
+
+	var burnRates []float64
+	for _, window := range []time.Duration{criteria.ShortWindow, criteria.LongWindow} {
+		query.Window = window
+		rate, err := provider.ErrorRate(ctx, query)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to get error rate metrics for window %s", window)
+		}
+		burnRate := rate / errorBudget
+		logger.WithFields(logrus.Fields{"window": window, "value": burnRate}).Debug("burn rate successfully calculated")
+		burnRates = append(burnRates, burnRate)
+	}
+
+	return math.Min(burnRates[0], burnRates[1]), nil
+}
+
+// errorRatePercent returns the percentage of errors for the given query.
+func errorRatePercent(ctx context.Context, provider metrics.Provider, query metrics.Query) (float64, error) {
 	logger := util.LoggerFrom(ctx)
 	logger.Debug("querying for error rate metrics")
-	rate, err := provider.ErrorRate(ctx, offset)
+	rate, err := provider.ErrorRate(ctx, query)
 	if err != nil {
 		return 0, errors.Wrap(err, "failed to get error rate metrics")
 	}
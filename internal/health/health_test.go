@@ -16,7 +16,7 @@ func TestDiagnosis(t *testing.T) {
 	tests := []struct {
 		name           string
 		healthCriteria []config.HealthCriterion
-		results        []float64
+		results        []health.MetricsValue
 		expected       health.Diagnosis
 		shouldErr      bool
 	}{
@@ -26,7 +26,7 @@ func TestDiagnosis(t *testing.T) {
 				{Metric: config.LatencyMetricsCheck, Percentile: 99, Threshold: 750},
 				{Metric: config.ErrorRateMetricsCheck, Threshold: 5},
 			},
-			results: []float64{500.0, 1.0},
+			results: []health.MetricsValue{{Value: 500.0}, {Value: 1.0}},
 			expected: health.Diagnosis{
 				OverallResult: health.Healthy,
 				CheckResults: []health.CheckResult{
@@ -41,7 +41,7 @@ func TestDiagnosis(t *testing.T) {
 				{Metric: config.LatencyMetricsCheck, Percentile: 99, Threshold: 500},
 				{Metric: config.ErrorRateMetricsCheck, Threshold: 1},
 			},
-			results: []float64{500.0, 1.0},
+			results: []health.MetricsValue{{Value: 500.0}, {Value: 1.0}},
 			expected: health.Diagnosis{
 				OverallResult: health.Healthy,
 				CheckResults: []health.CheckResult{
@@ -56,7 +56,7 @@ func TestDiagnosis(t *testing.T) {
 				{Metric: config.RequestCountMetricsCheck, Threshold: 1000},
 				{Metric: config.LatencyMetricsCheck, Percentile: 99, Threshold: 1000},
 			},
-			results: []float64{800, 750.0},
+			results: []health.MetricsValue{{Value: 800}, {Value: 750.0}},
 			expected: health.Diagnosis{
 				OverallResult: health.Inconclusive,
 				CheckResults: []health.CheckResult{
@@ -65,12 +65,43 @@ func TestDiagnosis(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "low traffic share, inconclusive",
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.TrafficShareMetricsCheck, Threshold: 90, MisroutedThreshold: 25},
+				{Metric: config.ErrorRateMetricsCheck, Threshold: 1},
+			},
+			results: []health.MetricsValue{{Value: 80}, {Value: 0.5}},
+			expected: health.Diagnosis{
+				OverallResult: health.Inconclusive,
+				CheckResults: []health.CheckResult{
+					{Threshold: 90, ActualValue: 80, IsCriteriaMet: false},
+					{Threshold: 1, ActualValue: 0.5, IsCriteriaMet: true},
+				},
+			},
+		},
+		{
+			name: "misrouted candidate, inconclusive with reason",
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.TrafficShareMetricsCheck, Threshold: 90, MisroutedThreshold: 25},
+				{Metric: config.ErrorRateMetricsCheck, Threshold: 1},
+			},
+			results: []health.MetricsValue{{Value: 10}, {Value: 0.5}},
+			expected: health.Diagnosis{
+				OverallResult: health.Inconclusive,
+				CheckResults: []health.CheckResult{
+					{Threshold: 90, ActualValue: 10, IsCriteriaMet: false},
+					{Threshold: 1, ActualValue: 0.5, IsCriteriaMet: true},
+				},
+				Reason: "candidate served 10.00% of its expected share of requests, traffic might be misrouted",
+			},
+		},
 		{
 			name: "only request count criteria, unknown",
 			healthCriteria: []config.HealthCriterion{
 				{Metric: config.RequestCountMetricsCheck, Threshold: 1000},
 			},
-			results: []float64{1500},
+			results: []health.MetricsValue{{Value: 1500}},
 			expected: health.Diagnosis{
 				OverallResult: health.Unknown,
 				CheckResults: []health.CheckResult{
@@ -83,7 +114,7 @@ func TestDiagnosis(t *testing.T) {
 			healthCriteria: []config.HealthCriterion{
 				{Metric: config.LatencyMetricsCheck, Percentile: 99, Threshold: 499},
 			},
-			results: []float64{500.0},
+			results: []health.MetricsValue{{Value: 500.0}},
 			expected: health.Diagnosis{
 				OverallResult: health.Unhealthy,
 				CheckResults: []health.CheckResult{
@@ -96,7 +127,7 @@ func TestDiagnosis(t *testing.T) {
 			healthCriteria: []config.HealthCriterion{
 				{Metric: config.ErrorRateMetricsCheck, Threshold: 0.95},
 			},
-			results: []float64{1.0},
+			results: []health.MetricsValue{{Value: 1.0}},
 			expected: health.Diagnosis{
 				OverallResult: health.Unhealthy,
 				CheckResults: []health.CheckResult{
@@ -110,7 +141,7 @@ func TestDiagnosis(t *testing.T) {
 				{Metric: config.ErrorRateMetricsCheck, Threshold: 0.95},
 				{Metric: config.RequestCountMetricsCheck, Threshold: 1000},
 			},
-			results: []float64{1.0, 500},
+			results: []health.MetricsValue{{Value: 1.0}, {Value: 500}},
 			expected: health.Diagnosis{
 				OverallResult: health.Unhealthy,
 				CheckResults: []health.CheckResult{
@@ -125,7 +156,7 @@ func TestDiagnosis(t *testing.T) {
 				{Metric: config.LatencyMetricsCheck, Percentile: 99, Threshold: 0},
 				{Metric: config.ErrorRateMetricsCheck, Threshold: 0},
 			},
-			results: []float64{500.0, 1.0},
+			results: []health.MetricsValue{{Value: 500.0}, {Value: 1.0}},
 			expected: health.Diagnosis{
 				OverallResult: health.Unhealthy,
 				CheckResults: []health.CheckResult{
@@ -140,7 +171,7 @@ func TestDiagnosis(t *testing.T) {
 				{Metric: config.LatencyMetricsCheck, Percentile: 99, Threshold: 750},
 				{Metric: config.ErrorRateMetricsCheck, Threshold: 5},
 			},
-			results: []float64{0, 0},
+			results: []health.MetricsValue{{Value: 0}, {Value: 0}},
 			expected: health.Diagnosis{
 				OverallResult: health.Healthy,
 				CheckResults: []health.CheckResult{
@@ -149,12 +180,57 @@ func TestDiagnosis(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "no data, inconclusive by default",
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.LatencyMetricsCheck, Percentile: 99, Threshold: 750},
+				{Metric: config.ErrorRateMetricsCheck, Threshold: 5},
+			},
+			results: []health.MetricsValue{{NoData: true}, {Value: 1.0}},
+			expected: health.Diagnosis{
+				OverallResult: health.Inconclusive,
+				CheckResults: []health.CheckResult{
+					{Threshold: 750, NoData: true},
+					{Threshold: 5, ActualValue: 1.0, IsCriteriaMet: true},
+				},
+			},
+		},
+		{
+			name: "no data, healthy policy",
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.LatencyMetricsCheck, Percentile: 99, Threshold: 750, MissingData: config.MissingDataHealthy},
+				{Metric: config.ErrorRateMetricsCheck, Threshold: 5},
+			},
+			results: []health.MetricsValue{{NoData: true}, {Value: 1.0}},
+			expected: health.Diagnosis{
+				OverallResult: health.Healthy,
+				CheckResults: []health.CheckResult{
+					{Threshold: 750, IsCriteriaMet: true, NoData: true},
+					{Threshold: 5, ActualValue: 1.0, IsCriteriaMet: true},
+				},
+			},
+		},
+		{
+			name: "no data, unhealthy policy",
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.LatencyMetricsCheck, Percentile: 99, Threshold: 750},
+				{Metric: config.ErrorRateMetricsCheck, Threshold: 5, MissingData: config.MissingDataUnhealthy},
+			},
+			results: []health.MetricsValue{{NoData: true}, {NoData: true}},
+			expected: health.Diagnosis{
+				OverallResult: health.Unhealthy,
+				CheckResults: []health.CheckResult{
+					{Threshold: 750, NoData: true},
+					{Threshold: 5, NoData: true},
+				},
+			},
+		},
 		{
 			name: "should err, different sizes for criteria and results",
 			healthCriteria: []config.HealthCriterion{
 				{Metric: config.ErrorRateMetricsCheck, Threshold: 0.95},
 			},
-			results:   []float64{},
+			results:   []health.MetricsValue{},
 			shouldErr: true,
 		},
 		{
@@ -179,27 +255,188 @@ func TestDiagnosis(t *testing.T) {
 // TestCollectMetrics tests that health.CollectMetrics returns values using the
 // metrics provider.
 func TestCollectMetrics(t *testing.T) {
+	query := metrics.Query{
+		Region:   "us-east1",
+		Service:  "mysvc",
+		Revision: "mysvc-002",
+		Window:   5 * time.Minute,
+	}
+
 	metricsMock := &metricsMocker.Metrics{}
-	metricsMock.RequestCountFn = func(ctx context.Context, offset time.Duration) (int64, error) {
+	metricsMock.RequestCountFn = func(ctx context.Context, q metrics.Query) (int64, error) {
+		assert.Equal(t, query, q)
 		return 1000, nil
 	}
-	metricsMock.LatencyFn = func(ctx context.Context, offset time.Duration, alignReduceType metrics.AlignReduce) (float64, error) {
+	metricsMock.LatencyFn = func(ctx context.Context, q metrics.Query) (float64, error) {
+		expected := query
+		expected.AlignReduce = metrics.Align99Reduce99
+		assert.Equal(t, expected, q)
 		return 500, nil
 	}
-	metricsMock.ErrorRateFn = func(ctx context.Context, offset time.Duration) (float64, error) {
+	metricsMock.ErrorRateFn = func(ctx context.Context, q metrics.Query) (float64, error) {
+		assert.Equal(t, query, q)
 		return 0.01, nil
 	}
 
 	ctx := context.Background()
-	offset := 5 * time.Minute
 	healthCriteria := []config.HealthCriterion{
 		{Metric: config.RequestCountMetricsCheck},
 		{Metric: config.LatencyMetricsCheck, Percentile: 99},
 		{Metric: config.ErrorRateMetricsCheck},
 	}
-	expected := []float64{1000, 500.0, 1.0}
+	expected := []health.MetricsValue{{Value: 1000}, {Value: 500.0}, {Value: 1.0}}
+
+	results, err := health.CollectMetrics(ctx, metricsMock, query, healthCriteria)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, results)
+}
+
+// TestCollectMetrics_ErrorResponseCodes tests that the response codes of the
+// error rate criteria are passed in the query.
+func TestCollectMetrics_ErrorResponseCodes(t *testing.T) {
+	var queries []metrics.Query
+	metricsMock := &metricsMocker.Metrics{}
+	metricsMock.ErrorRateFn = func(ctx context.Context, q metrics.Query) (float64, error) {
+		queries = append(queries, q)
+		return 0.01, nil
+	}
+
+	healthCriteria := []config.HealthCriterion{
+		{Metric: config.ErrorRateMetricsCheck, ErrorResponseCodes: []string{"5xx", "429"}, ExcludedResponseCodes: []string{"503"}},
+		{Metric: config.ClientErrorRateMetricsCheck, ExcludedResponseCodes: []string{"404"}},
+	}
+	expected := []metrics.Query{
+		{Service: "mysvc", ErrorResponseCodes: []string{"5xx", "429"}, ExcludedResponseCodes: []string{"503"}},
+		{Service: "mysvc", ErrorResponseCodes: []string{"4xx"}, ExcludedResponseCodes: []string{"404"}},
+	}
+
+	results, err := health.CollectMetrics(context.Background(), metricsMock, metrics.Query{Service: "mysvc"}, healthCriteria)
+	assert.Nil(t, err)
+	assert.Equal(t, []health.MetricsValue{{Value: 1}, {Value: 1}}, results)
+	assert.Equal(t, expected, queries)
+}
+
+// TestCollectMetrics_SLOBurnRate tests that the burn rate is calculated over
+// the windows of the criterion and the lowest one is returned.
+func TestCollectMetrics_SLOBurnRate(t *testing.T) {
+	errorRates := map[time.Duration]float64{
+		5 * time.Minute: 0.02,
+		time.Hour:       0.005,
+	}
+	metricsMock := &metricsMocker.Metrics{}
+	metricsMock.ErrorRateFn = func(ctx context.Context, q metrics.Query) (float64, error) {
+		rate, ok := errorRates[q.Window]
+		if !ok {
+			return 0, metrics.ErrNoData
+		}
+		return rate, nil
+	}
+
+	healthCriteria := []config.HealthCriterion{
+		{Metric: config.SLOBurnRateMetricsCheck, Threshold: 14.4, SLOTarget: 99.9, ShortWindow: 5 * time.Minute, LongWindow: time.Hour},
+		{Metric: config.SLOBurnRateMetricsCheck, Threshold: 6, SLOTarget: 99.9, ShortWindow: 30 * time.Minute, LongWindow: 6 * time.Hour},
+	}
+
+	results, err := health.CollectMetrics(context.Background(), metricsMock, metrics.Query{Window: 30 * time.Minute}, healthCriteria)
+	assert.Nil(t, err)
+	assert.Len(t, results, 2)
+	assert.InDelta(t, 5.0, results[0].Value, 1e-9)
+	assert.Equal(t, health.MetricsValue{NoData: true}, results[1])
+}
+
+// TestCollectMetrics_TrafficShare tests that the traffic share is calculated
+// from the requests of the revision and the service.
+func TestCollectMetrics_TrafficShare(t *testing.T) {
+	tests := []struct {
+		name           string
+		trafficPercent int64
+		serviceCount   int64
+		expected       health.MetricsValue
+	}{
+		{
+			name:           "expected share",
+			trafficPercent: 20,
+			serviceCount:   1000,
+			expected:       health.MetricsValue{Value: 90},
+		},
+		{
+			name:           "no traffic for revision",
+			trafficPercent: 0,
+			serviceCount:   1000,
+			expected:       health.MetricsValue{NoData: true},
+		},
+		{
+			name:           "no requests for service",
+			trafficPercent: 20,
+			serviceCount:   0,
+			expected:       health.MetricsValue{NoData: true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metricsMock := &metricsMocker.Metrics{}
+			metricsMock.RequestCountFn = func(ctx context.Context, q metrics.Query) (int64, error) {
+				if q.Revision == "" {
+					return test.serviceCount, nil
+				}
+				return 180, nil
+			}
+
+			query := metrics.Query{Service: "mysvc", Revision: "mysvc-002", TrafficPercent: test.trafficPercent}
+			healthCriteria := []config.HealthCriterion{{Metric: config.TrafficShareMetricsCheck, Threshold: 90}}
+			results, err := health.CollectMetrics(context.Background(), metricsMock, query, healthCriteria)
+			assert.Nil(t, err)
+			assert.Equal(t, []health.MetricsValue{test.expected}, results)
+		})
+	}
+}
+
+// TestCollectMetrics_Windows tests that criteria with their own window are
+// collected over it instead of the query's.
+func TestCollectMetrics_Windows(t *testing.T) {
+	metricsMock := &metricsMocker.Metrics{}
+	metricsMock.RequestCountFn = func(ctx context.Context, q metrics.Query) (int64, error) {
+		assert.Equal(t, 12*time.Minute, q.Window)
+		return 1000, nil
+	}
+	metricsMock.LatencyFn = func(ctx context.Context, q metrics.Query) (float64, error) {
+		assert.Equal(t, time.Hour, q.Window)
+		return 500, nil
+	}
+	metricsMock.ErrorRateFn = func(ctx context.Context, q metrics.Query) (float64, error) {
+		assert.Equal(t, 30*time.Minute, q.Window)
+		return 0.01, nil
+	}
+
+	healthCriteria := []config.HealthCriterion{
+		{Metric: config.RequestCountMetricsCheck, Window: 12 * time.Minute},
+		{Metric: config.LatencyMetricsCheck, Percentile: 99, Window: time.Hour},
+		{Metric: config.ErrorRateMetricsCheck},
+	}
+	results, err := health.CollectMetrics(context.Background(), metricsMock, metrics.Query{Window: 30 * time.Minute}, healthCriteria)
+	assert.Nil(t, err)
+	assert.Equal(t, []health.MetricsValue{{Value: 1000}, {Value: 500}, {Value: 1}}, results)
+}
+
+// TestCollectMetrics_NoData tests that health.CollectMetrics marks the criteria
+// for which the provider has no data.
+func TestCollectMetrics_NoData(t *testing.T) {
+	metricsMock := &metricsMocker.Metrics{}
+	metricsMock.LatencyFn = func(ctx context.Context, q metrics.Query) (float64, error) {
+		return 0, metrics.ErrNoData
+	}
+	metricsMock.ErrorRateFn = func(ctx context.Context, q metrics.Query) (float64, error) {
+		return 0.02, nil
+	}
+
+	healthCriteria := []config.HealthCriterion{
+		{Metric: config.LatencyMetricsCheck, Percentile: 99},
+		{Metric: config.ErrorRateMetricsCheck},
+	}
+	expected := []health.MetricsValue{{NoData: true}, {Value: 2.0}}
 
-	results, err := health.CollectMetrics(ctx, metricsMock, offset, healthCriteria)
+	results, err := health.CollectMetrics(context.Background(), metricsMock, metrics.Query{}, healthCriteria)
 	assert.Nil(t, err)
 	assert.Equal(t, expected, results)
 }
@@ -0,0 +1,42 @@
+package health
+
+import (
+	"context"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/incident"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/util"
+	"github.com/sirupsen/logrus"
+)
+
+// UsesIncidents determines if any of the health criteria needs the open
+// incidents of the service.
+func UsesIncidents(healthCriteria []config.HealthCriterion) bool {
+	for _, criteria := range healthCriteria {
+		if criteria.Metric == config.OpenIncidentsMetricsCheck {
+			return true
+		}
+	}
+	return false
+}
+
+// openIncidents returns the number of open incidents of the alerting policies
+// of the criterion.
+func openIncidents(ctx context.Context, criteria config.HealthCriterion, incidents []incident.Incident) float64 {
+	logger := util.LoggerFrom(ctx)
+	query := incident.Query{Policies: criteria.AlertPolicies}
+
+	var count float64
+	for _, inc := range incidents {
+		if !query.MatchesPolicy(inc) {
+			continue
+		}
+		logger.WithFields(logrus.Fields{
+			"incident": inc.ID,
+			"policy":   inc.Policy,
+			"summary":  inc.Summary,
+		}).Debug("open incident")
+		count++
+	}
+	return count
+}
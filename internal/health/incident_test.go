@@ -0,0 +1,84 @@
+package health_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/incident"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectMetricsWithSources_Incidents(t *testing.T) {
+	incidents := []incident.Incident{
+		{ID: "0.1", Policy: "High latency"},
+		{ID: "0.2", Policy: "High error rate"},
+		{ID: "0.3", Policy: "High latency"},
+	}
+	criteria := []config.HealthCriterion{
+		{Metric: config.OpenIncidentsMetricsCheck},
+		{Metric: config.OpenIncidentsMetricsCheck, AlertPolicies: []string{"High latency"}},
+		{Metric: config.OpenIncidentsMetricsCheck, AlertPolicies: []string{"Low traffic"}},
+	}
+
+	results, err := health.CollectMetricsWithSources(context.Background(), nil, metrics.Query{}, criteria, health.Sources{Incidents: incidents})
+	assert.Nil(t, err)
+	assert.Equal(t, []health.MetricsValue{{Value: 3}, {Value: 2}, {Value: 0}}, results)
+
+	// The open incidents are unknown, so they have no data.
+	results, err = health.CollectMetricsWithSources(context.Background(), nil, metrics.Query{}, criteria, health.Sources{NoIncidentData: true})
+	assert.Nil(t, err)
+	assert.Equal(t, []health.MetricsValue{{NoData: true}, {NoData: true}, {NoData: true}}, results)
+}
+
+func TestDiagnose_Incidents(t *testing.T) {
+	tests := []struct {
+		name     string
+		action   config.IncidentAction
+		expected health.DiagnosisResult
+	}{
+		{
+			name:     "hold by default",
+			expected: health.Inconclusive,
+		},
+		{
+			name:     "hold",
+			action:   config.IncidentActionHold,
+			expected: health.Inconclusive,
+		},
+		{
+			name:     "rollback",
+			action:   config.IncidentActionRollback,
+			expected: health.Unhealthy,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			criteria := []config.HealthCriterion{
+				{Metric: config.ErrorRateMetricsCheck, Threshold: 1},
+				{Metric: config.OpenIncidentsMetricsCheck, OnIncident: test.action},
+			}
+			values := []health.MetricsValue{{Value: 0.5}, {Value: 1}}
+
+			diagnosis, err := health.Diagnose(context.Background(), criteria, values)
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, diagnosis.OverallResult)
+
+			diagnosis, err = health.Score(context.Background(), criteria, values, config.HealthScoring{Enabled: true, HealthyScore: 0.9, UnhealthyScore: 0.5})
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, diagnosis.OverallResult)
+		})
+	}
+
+	// Without open incidents, the criterion is met.
+	criteria := []config.HealthCriterion{
+		{Metric: config.ErrorRateMetricsCheck, Threshold: 1},
+		{Metric: config.OpenIncidentsMetricsCheck},
+	}
+	diagnosis, err := health.Diagnose(context.Background(), criteria, []health.MetricsValue{{Value: 0.5}, {Value: 0}})
+	assert.Nil(t, err)
+	assert.Equal(t, health.Healthy, diagnosis.OverallResult)
+}
@@ -0,0 +1,167 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+	"github.com/pkg/errors"
+)
+
+// ReportVersion is the version of the format of Report. It is increased when
+// the format changes in a way that is not backward compatible.
+const ReportVersion = 1
+
+// Report is a machine-readable report of the diagnosis of a candidate.
+//
+// The fields about the rollout (e.g. the decision) are set by the caller.
+type Report struct {
+	Version    int               `json:"version"`
+	Result     string            `json:"result"`
+	Reason     string            `json:"reason,omitempty"`
+	Score      *float64          `json:"score,omitempty"`
+	Expression string            `json:"expression,omitempty"`
+	Criteria   []CriterionReport `json:"criteria"`
+	Variables  []VariableReport  `json:"variables,omitempty"`
+	Votes      []VoteReport      `json:"votes,omitempty"`
+
+	Candidate string `json:"candidate,omitempty"`
+	Stable    string `json:"stable,omitempty"`
+
+	// TrafficPercent is the candidate's traffic percentage when diagnosed and
+	// NewTrafficPercent is the one after the decision.
+	TrafficPercent    int64 `json:"trafficPercent"`
+	NewTrafficPercent int64 `json:"newTrafficPercent"`
+
+	Decision  string          `json:"decision"`
+	Progress  *ProgressReport `json:"progress,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+// ProgressReport is how far along the rollout of the candidate is.
+type ProgressReport struct {
+	// Step is the number of steps the candidate went through out of Steps,
+	// the last of which sends all the traffic to the candidate.
+	Step  int `json:"step"`
+	Steps int `json:"steps"`
+
+	// NextStepAt is when the candidate is expected to go through the next step
+	// and ETA is when it is expected to receive all the traffic, if it stays
+	// healthy. They are nil if it already receives all the traffic.
+	NextStepAt *time.Time `json:"nextStepAt,omitempty"`
+	ETA        *time.Time `json:"eta,omitempty"`
+}
+
+func (p ProgressReport) String() string {
+	str := fmt.Sprintf("step %d of %d", p.Step, p.Steps)
+	if p.ETA != nil {
+		str += fmt.Sprintf(", all the traffic expected at %s", p.ETA.Format(time.RFC3339))
+	}
+	return str
+}
+
+// CriterionReport is the result of the check of a health criterion.
+type CriterionReport struct {
+	Metric      string  `json:"metric"`
+	AnomalyOf   string  `json:"anomalyOf,omitempty"`
+	Percentile  float64 `json:"percentile,omitempty"`
+	Threshold   float64 `json:"threshold"`
+	ActualValue float64 `json:"actualValue"`
+	NoData      bool    `json:"noData,omitempty"`
+	Met         bool    `json:"met"`
+
+	// WindowSeconds is the window over which the criterion was checked. SLO
+	// burn-rate criteria are checked over two windows instead, which are
+	// ShortWindowSeconds and LongWindowSeconds. Open incidents criteria do
+	// not have a window.
+	WindowSeconds      float64 `json:"windowSeconds,omitempty"`
+	ShortWindowSeconds float64 `json:"shortWindowSeconds,omitempty"`
+	LongWindowSeconds  float64 `json:"longWindowSeconds,omitempty"`
+
+	// ErrorResponseCodes and ExcludedResponseCodes are the response codes
+	// configured for the criterion. They are empty if it counts the default
+	// ones.
+	ErrorResponseCodes    []string `json:"errorResponseCodes,omitempty"`
+	ExcludedResponseCodes []string `json:"excludedResponseCodes,omitempty"`
+}
+
+// VariableReport is the value of a variable of a health expression.
+type VariableReport struct {
+	Name   string  `json:"name"`
+	Value  float64 `json:"value"`
+	NoData bool    `json:"noData,omitempty"`
+}
+
+// VoteReport is the vote of an external voter.
+type VoteReport struct {
+	Voter  string `json:"voter"`
+	Result string `json:"result,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Failed bool   `json:"failed,omitempty"`
+}
+
+// NewReport returns the machine-readable report of the diagnosis.
+//
+// The window of criteria without their own window is the default window.
+func NewReport(healthCriteria []config.HealthCriterion, diagnosis Diagnosis, defaultWindow time.Duration) Report {
+	report := Report{
+		Version:    ReportVersion,
+		Result:     diagnosis.OverallResult.String(),
+		Reason:     diagnosis.Reason,
+		Expression: diagnosis.Expression,
+		Criteria:   []CriterionReport{},
+	}
+	if diagnosis.Scored {
+		score := diagnosis.Score
+		report.Score = &score
+	}
+
+	for i, result := range diagnosis.CheckResults {
+		criteria := healthCriteria[i]
+		criterionReport := CriterionReport{
+			Metric:                string(criteria.Metric),
+			AnomalyOf:             string(criteria.AnomalyOf),
+			Percentile:            criteria.Percentile,
+			Threshold:             criteria.Threshold,
+			ActualValue:           result.ActualValue,
+			NoData:                result.NoData,
+			Met:                   result.IsCriteriaMet,
+			ErrorResponseCodes:    criteria.ErrorResponseCodes,
+			ExcludedResponseCodes: criteria.ExcludedResponseCodes,
+		}
+		switch criteria.Metric {
+		case config.SLOBurnRateMetricsCheck:
+			criterionReport.ShortWindowSeconds = criteria.ShortWindow.Seconds()
+			criterionReport.LongWindowSeconds = criteria.LongWindow.Seconds()
+		case config.OpenIncidentsMetricsCheck:
+		default:
+			window := defaultWindow
+			if criteria.Window > 0 {
+				window = criteria.Window
+			}
+			criterionReport.WindowSeconds = window.Seconds()
+		}
+		report.Criteria = append(report.Criteria, criterionReport)
+	}
+	for _, binding := range diagnosis.Bindings {
+		report.Variables = append(report.Variables, VariableReport{Name: binding.Name, Value: binding.Value, NoData: binding.NoData})
+	}
+	for _, vote := range diagnosis.Votes {
+		voteReport := VoteReport{Voter: vote.Voter, Reason: vote.Reason, Failed: vote.Failed}
+		if !vote.Failed {
+			voteReport.Result = string(vote.Result)
+		}
+		report.Votes = append(report.Votes, voteReport)
+	}
+	return report
+}
+
+// JSON returns the JSON encoding of the report.
+func (r Report) JSON() (string, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal report")
+	}
+	return string(data), nil
+}
@@ -0,0 +1,176 @@
+package health_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewReport(t *testing.T) {
+	score := 0.75
+
+	tests := []struct {
+		name           string
+		healthCriteria []config.HealthCriterion
+		diagnosis      health.Diagnosis
+		expected       health.Report
+	}{
+		{
+			name: "criteria",
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.RequestCountMetricsCheck, Threshold: 1000, Window: 10 * time.Minute},
+				{Metric: config.LatencyMetricsCheck, Percentile: 99, Threshold: 750},
+			},
+			diagnosis: health.Diagnosis{
+				OverallResult: health.Inconclusive,
+				CheckResults: []health.CheckResult{
+					{Threshold: 1000, ActualValue: 500},
+					{Threshold: 750, NoData: true, IsCriteriaMet: true},
+				},
+			},
+			expected: health.Report{
+				Version: health.ReportVersion,
+				Result:  "inconclusive",
+				Criteria: []health.CriterionReport{
+					{Metric: "request-count", Threshold: 1000, ActualValue: 500, WindowSeconds: 600},
+					{Metric: "request-latency", Percentile: 99, Threshold: 750, NoData: true, Met: true, WindowSeconds: 300},
+				},
+			},
+		},
+		{
+			name: "criteria without a single window",
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.SLOBurnRateMetricsCheck, Threshold: 14.4, SLOTarget: 99.9, ShortWindow: 5 * time.Minute, LongWindow: time.Hour},
+				{Metric: config.OpenIncidentsMetricsCheck},
+			},
+			diagnosis: health.Diagnosis{
+				OverallResult: health.Healthy,
+				CheckResults: []health.CheckResult{
+					{Threshold: 14.4, ActualValue: 2, IsCriteriaMet: true},
+					{IsCriteriaMet: true},
+				},
+			},
+			expected: health.Report{
+				Version: health.ReportVersion,
+				Result:  "healthy",
+				Criteria: []health.CriterionReport{
+					{Metric: "slo-burn-rate", Threshold: 14.4, ActualValue: 2, Met: true, ShortWindowSeconds: 300, LongWindowSeconds: 3600},
+					{Metric: "open-incidents", Met: true},
+				},
+			},
+		},
+		{
+			name: "anomaly and response codes",
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.AnomalyMetricsCheck, AnomalyOf: config.LatencyMetricsCheck, Percentile: 99, Threshold: 3},
+				{Metric: config.ErrorRateMetricsCheck, Threshold: 1, ErrorResponseCodes: []string{"5xx", "429"}, ExcludedResponseCodes: []string{"503"}},
+			},
+			diagnosis: health.Diagnosis{
+				OverallResult: health.Healthy,
+				CheckResults: []health.CheckResult{
+					{Threshold: 3, ActualValue: 1.5, IsCriteriaMet: true},
+					{Threshold: 1, ActualValue: 0.5, IsCriteriaMet: true},
+				},
+			},
+			expected: health.Report{
+				Version: health.ReportVersion,
+				Result:  "healthy",
+				Criteria: []health.CriterionReport{
+					{Metric: "anomaly-zscore", AnomalyOf: "request-latency", Percentile: 99, Threshold: 3, ActualValue: 1.5, Met: true, WindowSeconds: 300},
+					{Metric: "error-rate-percent", Threshold: 1, ActualValue: 0.5, Met: true, WindowSeconds: 300, ErrorResponseCodes: []string{"5xx", "429"}, ExcludedResponseCodes: []string{"503"}},
+				},
+			},
+		},
+		{
+			name: "score and votes",
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.ErrorRateMetricsCheck, Threshold: 1, Weight: 1},
+			},
+			diagnosis: health.Diagnosis{
+				OverallResult: health.Unhealthy,
+				Reason:        "unhealthy vote",
+				Score:         score,
+				Scored:        true,
+				CheckResults: []health.CheckResult{
+					{Threshold: 1, ActualValue: 0.5, IsCriteriaMet: true},
+				},
+				Votes: []health.Vote{
+					{Voter: "https://a.example.com", Result: health.VoteUnhealthy, Reason: "e2e failed"},
+					{Voter: "https://b.example.com", Reason: "timeout", Failed: true},
+				},
+			},
+			expected: health.Report{
+				Version: health.ReportVersion,
+				Result:  "unhealthy",
+				Reason:  "unhealthy vote",
+				Score:   &score,
+				Criteria: []health.CriterionReport{
+					{Metric: "error-rate-percent", Threshold: 1, ActualValue: 0.5, Met: true, WindowSeconds: 300},
+				},
+				Votes: []health.VoteReport{
+					{Voter: "https://a.example.com", Result: "unhealthy", Reason: "e2e failed"},
+					{Voter: "https://b.example.com", Reason: "timeout", Failed: true},
+				},
+			},
+		},
+		{
+			name: "expression",
+			diagnosis: health.Diagnosis{
+				OverallResult: health.Healthy,
+				Expression:    "errorRate < 1",
+				Bindings: []health.Binding{
+					{Name: "errorRate", Value: 0.5},
+				},
+			},
+			expected: health.Report{
+				Version:    health.ReportVersion,
+				Result:     "healthy",
+				Expression: "errorRate < 1",
+				Criteria:   []health.CriterionReport{},
+				Variables: []health.VariableReport{
+					{Name: "errorRate", Value: 0.5},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			report := health.NewReport(test.healthCriteria, test.diagnosis, 5*time.Minute)
+			assert.Equal(t, test.expected, report)
+		})
+	}
+}
+
+func TestReport_JSON(t *testing.T) {
+	report := health.Report{
+		Version:           health.ReportVersion,
+		Result:            "healthy",
+		Criteria:          []health.CriterionReport{{Metric: "request-count", Threshold: 100, ActualValue: 150, Met: true, WindowSeconds: 300}},
+		Candidate:         "mysvc-002",
+		Stable:            "mysvc-001",
+		TrafficPercent:    10,
+		NewTrafficPercent: 40,
+		Decision:          "roll-forward",
+		Timestamp:         time.Date(2020, 7, 1, 10, 0, 0, 0, time.UTC),
+	}
+
+	data, err := report.JSON()
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{
+		"version": 1,
+		"result": "healthy",
+		"criteria": [
+			{"metric": "request-count", "threshold": 100, "actualValue": 150, "met": true, "windowSeconds": 300}
+		],
+		"candidate": "mysvc-002",
+		"stable": "mysvc-001",
+		"trafficPercent": 10,
+		"newTrafficPercent": 40,
+		"decision": "roll-forward",
+		"timestamp": "2020-07-01T10:00:00Z"
+	}`, data)
+}
@@ -2,36 +2,141 @@ package health
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics"
 )
 
 // StringReport returns a human-readable report of the diagnosis.
-func StringReport(healthCriteria []config.HealthCriterion, diagnosis Diagnosis, enoughTimeSinceLastRollout bool) string {
+//
+// The window of each criterion is shown, which is the health check offset if
+// the criterion does not have its own.
+func StringReport(healthCriteria []config.HealthCriterion, diagnosis Diagnosis, enoughTimeSinceLastRollout bool, healthCheckOffset time.Duration) string {
 	report := fmt.Sprintf("status: %s", diagnosis.OverallResult.String())
 
 	// If no enough time has passed, add the information in the status.
 	if diagnosis.OverallResult == Healthy && !enoughTimeSinceLastRollout {
 		report += ", but no enough time since last rollout"
 	}
+	if diagnosis.Reason != "" {
+		report += fmt.Sprintf("\nreason: %s", diagnosis.Reason)
+	}
+	if diagnosis.Scored {
+		report += fmt.Sprintf("\nscore: %.2f", diagnosis.Score)
+	}
+
+	if diagnosis.Expression != "" {
+		report += fmt.Sprintf("\nexpression: %s", diagnosis.Expression)
+		report += "\nmetrics:"
+		for _, binding := range diagnosis.Bindings {
+			value := fmt.Sprintf("%.2f", binding.Value)
+			if binding.NoData {
+				value = "no data"
+			}
+			report += fmt.Sprintf("\n- %s: %s", binding.Name, value)
+		}
+		return report + votesReport(diagnosis.Votes)
+	}
 
 	report += "\nmetrics:"
 	for i, result := range diagnosis.CheckResults {
 		criteria := healthCriteria[i]
 
 		// Include percentile value for latency criteria.
+		name := string(criteria.Metric)
 		if criteria.Metric == config.LatencyMetricsCheck {
-			report += fmt.Sprintf("\n- %s[p%.0f]: %.2f (needs %.2f)", criteria.Metric, criteria.Percentile, result.ActualValue, criteria.Threshold)
-			continue
+			name = fmt.Sprintf("%s[p%.0f]", criteria.Metric, criteria.Percentile)
+		}
+
+		// Include the response codes if they are not the default ones.
+		if codes := responseCodes(criteria); codes != "" {
+			name = fmt.Sprintf("%s[%s]", criteria.Metric, codes)
 		}
 
-		format := "\n- %s: %.2f (needs %.2f)"
-		if criteria.Metric == config.RequestCountMetricsCheck {
-			// No decimals for request count.
-			format = "\n- %s: %.0f (needs %.0f)"
+		// Include the compared metric for anomaly criteria.
+		if criteria.Metric == config.AnomalyMetricsCheck {
+			name = fmt.Sprintf("%s[%s]", criteria.Metric, criteria.AnomalyOf)
+			if criteria.AnomalyOf == config.LatencyMetricsCheck {
+				name = fmt.Sprintf("%s[%s,p%.0f]", criteria.Metric, criteria.AnomalyOf, criteria.Percentile)
+			}
+		}
+
+		// Include the SLO target and windows for burn rate criteria.
+		if criteria.Metric == config.SLOBurnRateMetricsCheck {
+			name = fmt.Sprintf("%s[%g%%,%s/%s]", criteria.Metric, criteria.SLOTarget, criteria.ShortWindow, criteria.LongWindow)
+		}
+
+		// Include the alerting policies for open incidents criteria.
+		if criteria.Metric == config.OpenIncidentsMetricsCheck && len(criteria.AlertPolicies) != 0 {
+			name = fmt.Sprintf("%s[%s]", criteria.Metric, strings.Join(criteria.AlertPolicies, ","))
+		}
+
+		format := "%.2f"
+		if criteria.Metric == config.RequestCountMetricsCheck || criteria.Metric == config.OpenIncidentsMetricsCheck {
+			// No decimals for counts.
+			format = "%.0f"
+		}
+		value := fmt.Sprintf(format, result.ActualValue)
+		if result.NoData {
+			value = "no data"
+		}
+		needs := fmt.Sprintf(format, criteria.Threshold)
+		// Burn rate criteria show their windows in their name, and open
+		// incidents are not measured over a window.
+		if criteria.Metric != config.SLOBurnRateMetricsCheck && criteria.Metric != config.OpenIncidentsMetricsCheck {
+			window := criteria.Window
+			if window <= 0 {
+				window = healthCheckOffset
+			}
+			needs += fmt.Sprintf(", over %s", window)
 		}
-		report += fmt.Sprintf(format, criteria.Metric, result.ActualValue, criteria.Threshold)
+		if diagnosis.Scored && criteria.Severity == config.SeverityAdvisory {
+			needs += ", advisory"
+		}
+		report += fmt.Sprintf("\n- %s: %s (needs %s)", name, value, needs)
+	}
+
+	return report + votesReport(diagnosis.Votes)
+}
+
+// votesReport returns the report of the votes of external voters, if any.
+func votesReport(votes []Vote) string {
+	if len(votes) == 0 {
+		return ""
 	}
 
+	report := "\nvotes:"
+	for _, vote := range votes {
+		result := string(vote.Result)
+		if vote.Failed {
+			result = "failed"
+		}
+		if vote.Reason != "" {
+			result += fmt.Sprintf(" (%s)", vote.Reason)
+		}
+		report += fmt.Sprintf("\n- %s: %s", vote.Voter, result)
+	}
 	return report
 }
+
+// responseCodes returns the response codes counted by an error rate criterion
+// (e.g. "5xx,429,!503") or an empty string if there is nothing to show.
+func responseCodes(criterion config.HealthCriterion) string {
+	if criterion.Metric != config.ErrorRateMetricsCheck && criterion.Metric != config.ClientErrorRateMetricsCheck {
+		return ""
+	}
+	if len(criterion.ErrorResponseCodes) == 0 && len(criterion.ExcludedResponseCodes) == 0 {
+		return ""
+	}
+
+	codes := criterion.ErrorResponseCodes
+	if len(codes) == 0 && criterion.Metric == config.ErrorRateMetricsCheck {
+		codes = metrics.DefaultErrorResponseCodes
+	}
+	for _, excluded := range criterion.ExcludedResponseCodes {
+		codes = append(codes[:len(codes):len(codes)], "!"+excluded)
+	}
+	return strings.Join(codes, ",")
+}
@@ -2,6 +2,7 @@ package health_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
 	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
@@ -29,7 +30,7 @@ func TestStringReport(t *testing.T) {
 			},
 			expected: "status: unhealthy\n" +
 				"metrics:" +
-				"\n- request-latency[p99]: 1000.00 (needs 750.00)",
+				"\n- request-latency[p99]: 1000.00 (needs 750.00, over 5m0s)",
 		},
 		{
 			name: "more than one metrics",
@@ -49,9 +50,146 @@ func TestStringReport(t *testing.T) {
 			enoughTimeSinceLastRollout: true,
 			expected: "status: healthy\n" +
 				"metrics:" +
-				"\n- request-count: 1500 (needs 1000)" +
-				"\n- request-latency[p99]: 500.00 (needs 750.00)" +
-				"\n- error-rate-percent: 2.00 (needs 5.00)",
+				"\n- request-count: 1500 (needs 1000, over 5m0s)" +
+				"\n- request-latency[p99]: 500.00 (needs 750.00, over 5m0s)" +
+				"\n- error-rate-percent: 2.00 (needs 5.00, over 5m0s)",
+		},
+		{
+			name: "criterion windows",
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.RequestCountMetricsCheck, Threshold: 1000, Window: 12 * time.Minute, WindowSinceLastStep: true},
+				{Metric: config.LatencyMetricsCheck, Percentile: 99, Threshold: 750, Window: time.Hour},
+				{Metric: config.ErrorRateMetricsCheck, Threshold: 5},
+			},
+			diagnosis: health.Diagnosis{
+				OverallResult: health.Healthy,
+				CheckResults: []health.CheckResult{
+					{Threshold: 1000, ActualValue: 1500, IsCriteriaMet: true},
+					{Threshold: 750, ActualValue: 500, IsCriteriaMet: true},
+					{Threshold: 5, ActualValue: 2, IsCriteriaMet: true},
+				},
+			},
+			enoughTimeSinceLastRollout: true,
+			expected: "status: healthy\n" +
+				"metrics:" +
+				"\n- request-count: 1500 (needs 1000, over 12m0s)" +
+				"\n- request-latency[p99]: 500.00 (needs 750.00, over 1h0m0s)" +
+				"\n- error-rate-percent: 2.00 (needs 5.00, over 5m0s)",
+		},
+		{
+			name: "votes",
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.ErrorRateMetricsCheck, Threshold: 5},
+			},
+			diagnosis: health.Diagnosis{
+				OverallResult: health.Unhealthy,
+				CheckResults: []health.CheckResult{
+					{Threshold: 5, ActualValue: 2, IsCriteriaMet: true},
+				},
+				Votes: []health.Vote{
+					{Voter: "https://e2e.example.com", Result: health.VoteUnhealthy, Reason: "checkout failed"},
+					{Voter: "https://kpi.example.com", Result: health.VoteAbstain},
+					{Voter: "https://slow.example.com", Failed: true, Reason: "request failed"},
+				},
+			},
+			expected: "status: unhealthy\n" +
+				"metrics:" +
+				"\n- error-rate-percent: 2.00 (needs 5.00, over 5m0s)" +
+				"\nvotes:" +
+				"\n- https://e2e.example.com: unhealthy (checkout failed)" +
+				"\n- https://kpi.example.com: abstain" +
+				"\n- https://slow.example.com: failed (request failed)",
+		},
+		{
+			name: "open incidents",
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.OpenIncidentsMetricsCheck, AlertPolicies: []string{"High latency", "High error rate"}},
+				{Metric: config.OpenIncidentsMetricsCheck},
+			},
+			diagnosis: health.Diagnosis{
+				OverallResult: health.Inconclusive,
+				CheckResults: []health.CheckResult{
+					{Threshold: 0, ActualValue: 1, IsCriteriaMet: false},
+					{Threshold: 0, ActualValue: 2, IsCriteriaMet: false},
+				},
+			},
+			expected: "status: inconclusive\n" +
+				"metrics:" +
+				"\n- open-incidents[High latency,High error rate]: 1 (needs 0)" +
+				"\n- open-incidents: 2 (needs 0)",
+		},
+		{
+			name: "health expression",
+			diagnosis: health.Diagnosis{
+				OverallResult: health.Inconclusive,
+				Reason:        "no data for p99",
+				Expression:    "errorRate < 1 && p99 < 800",
+				Bindings: []health.Binding{
+					{Name: "errorRate", Value: 0.5},
+					{Name: "p99", NoData: true},
+				},
+			},
+			expected: "status: inconclusive\n" +
+				"reason: no data for p99\n" +
+				"expression: errorRate < 1 && p99 < 800\n" +
+				"metrics:" +
+				"\n- errorRate: 0.50" +
+				"\n- p99: no data",
+		},
+		{
+			name: "SLO burn rate",
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.SLOBurnRateMetricsCheck, Threshold: 14.4, SLOTarget: 99.9, ShortWindow: 5 * time.Minute, LongWindow: time.Hour},
+			},
+			diagnosis: health.Diagnosis{
+				OverallResult: health.Unhealthy,
+				CheckResults: []health.CheckResult{
+					{Threshold: 14.4, ActualValue: 20},
+				},
+			},
+			expected: "status: unhealthy\n" +
+				"metrics:" +
+				"\n- slo-burn-rate[99.9%,5m0s/1h0m0s]: 20.00 (needs 14.40)",
+		},
+		{
+			name: "health score",
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.ErrorRateMetricsCheck, Threshold: 5},
+				{Metric: config.LatencyMetricsCheck, Percentile: 50, Threshold: 100, Severity: config.SeverityAdvisory},
+			},
+			diagnosis: health.Diagnosis{
+				OverallResult: health.Inconclusive,
+				CheckResults: []health.CheckResult{
+					{Threshold: 5, ActualValue: 2, IsCriteriaMet: true},
+					{Threshold: 100, ActualValue: 150},
+				},
+				Score:  0.5,
+				Scored: true,
+			},
+			expected: "status: inconclusive\n" +
+				"score: 0.50\n" +
+				"metrics:" +
+				"\n- error-rate-percent: 2.00 (needs 5.00, over 5m0s)" +
+				"\n- request-latency[p50]: 150.00 (needs 100.00, over 5m0s, advisory)",
+		},
+		{
+			name: "custom error response codes",
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.ErrorRateMetricsCheck, Threshold: 5, ErrorResponseCodes: []string{"5xx", "429"}, ExcludedResponseCodes: []string{"503"}},
+				{Metric: config.ClientErrorRateMetricsCheck, Threshold: 10, ExcludedResponseCodes: []string{"404"}},
+			},
+			diagnosis: health.Diagnosis{
+				OverallResult: health.Healthy,
+				CheckResults: []health.CheckResult{
+					{Threshold: 5, ActualValue: 2, IsCriteriaMet: true},
+					{Threshold: 10, ActualValue: 3, IsCriteriaMet: true},
+				},
+			},
+			enoughTimeSinceLastRollout: true,
+			expected: "status: healthy\n" +
+				"metrics:" +
+				"\n- error-rate-percent[5xx,429,!503]: 2.00 (needs 5.00, over 5m0s)" +
+				"\n- 4xx-rate-percent[!404]: 3.00 (needs 10.00, over 5m0s)",
 		},
 		{
 			name: "healthy but no enough time elapsed",
@@ -69,8 +207,39 @@ func TestStringReport(t *testing.T) {
 			enoughTimeSinceLastRollout: false,
 			expected: "status: healthy, but no enough time since last rollout\n" +
 				"metrics:" +
-				"\n- request-count: 1500 (needs 1000)" +
-				"\n- request-latency[p99]: 500.00 (needs 750.00)",
+				"\n- request-count: 1500 (needs 1000, over 5m0s)" +
+				"\n- request-latency[p99]: 500.00 (needs 750.00, over 5m0s)",
+		},
+		{
+			name: "metrics with no data",
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.RequestCountMetricsCheck, Threshold: 1000},
+				{Metric: config.LatencyMetricsCheck, Percentile: 99, Threshold: 750},
+				{Metric: config.ErrorRateMetricsCheck, Threshold: 5},
+			},
+			diagnosis: health.Diagnosis{
+				OverallResult: health.Inconclusive,
+				CheckResults: []health.CheckResult{
+					{Threshold: 1000, ActualValue: 1500, IsCriteriaMet: true},
+					{Threshold: 750, NoData: true},
+					{Threshold: 5, NoData: true},
+				},
+			},
+			expected: "status: inconclusive\n" +
+				"metrics:" +
+				"\n- request-count: 1500 (needs 1000, over 5m0s)" +
+				"\n- request-latency[p99]: no data (needs 750.00, over 5m0s)" +
+				"\n- error-rate-percent: no data (needs 5.00, over 5m0s)",
+		},
+		{
+			name: "inconclusive with reason",
+			diagnosis: health.Diagnosis{
+				OverallResult: health.Inconclusive,
+				Reason:        "metrics provider unavailable",
+			},
+			expected: "status: inconclusive\n" +
+				"reason: metrics provider unavailable\n" +
+				"metrics:",
 		},
 		{
 			name:     "no metrics",
@@ -80,7 +249,7 @@ func TestStringReport(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.name, func(tt *testing.T) {
-			report := health.StringReport(test.healthCriteria, test.diagnosis, test.enoughTimeSinceLastRollout)
+			report := health.StringReport(test.healthCriteria, test.diagnosis, test.enoughTimeSinceLastRollout, 5*time.Minute)
 			assert.Equal(tt, test.expected, report)
 		})
 	}
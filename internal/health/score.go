@@ -0,0 +1,114 @@
+package health
+
+import (
+	"context"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/util"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Score attempts to determine the health of a revision using a weighted score
+// of the health criteria.
+//
+// The score is the sum of the weights of the met criteria divided by the sum of
+// the weights of all the checked criteria. Request count, traffic share and
+// open incidents criteria with the hold action hold the rollout when unmet, so
+// they are not part of the score. Criteria without data are ignored unless
+// their missing data policy determines if they are met.
+//
+// The diagnosis is determined as follows, in order of precedence:
+//   - Unhealthy if any blocking criterion is not met.
+//   - Unhealthy if the score is lower than the unhealthy score.
+//   - Inconclusive if a criterion that holds the rollout is not met or a
+//     criterion had no data.
+//   - Healthy if the score is at least the healthy score.
+//   - Inconclusive otherwise, so the rollout is held.
+//
+// As with Diagnose, the diagnosis is Unknown and an error is returned if no
+// health criteria is specified or the size of the health criteria and the
+// actual values are not the same.
+func Score(ctx context.Context, healthCriteria []config.HealthCriterion, actualValues []MetricsValue, scoring config.HealthScoring) (Diagnosis, error) {
+	logger := util.LoggerFrom(ctx)
+	if len(healthCriteria) != len(actualValues) {
+		return Diagnosis{OverallResult: Unknown}, errors.New("the size of health criteria is not the same to the size of the actual metrics values")
+	}
+	if len(healthCriteria) == 0 {
+		return Diagnosis{OverallResult: Unknown}, errors.New("health criteria must be specified")
+	}
+
+	var results []CheckResult
+	var totalWeight, metWeight float64
+	var blockingUnmet, inconclusive bool
+	for i, value := range actualValues {
+		criteria := healthCriteria[i]
+		logger := logger.WithFields(logrus.Fields{
+			"metrics":       criteria.Metric,
+			"expectedValue": criteria.Threshold,
+			"actualValue":   value.Value,
+			"severity":      criteria.Severity,
+		})
+
+		result, noDataInconclusive := checkCriterion(criteria, value)
+		results = append(results, result)
+		if noDataInconclusive {
+			logger.Debug("no data for criterion, inconclusive")
+			inconclusive = true
+			continue
+		}
+
+		if holdsWhenUnmet(criteria) {
+			if !result.IsCriteriaMet {
+				logger.Debug("unmet criterion, inconclusive")
+				inconclusive = true
+			}
+			continue
+		}
+
+		weight := criterionWeight(criteria)
+		totalWeight += weight
+		if result.IsCriteriaMet {
+			logger.Debug("met criterion")
+			metWeight += weight
+			continue
+		}
+
+		logger.Debug("unmet criterion")
+		if criteria.Severity != config.SeverityAdvisory {
+			blockingUnmet = true
+		}
+	}
+
+	reason := misrouting(ctx, healthCriteria, results)
+
+	// Only the request volume criteria or criteria without data were checked.
+	if totalWeight == 0 {
+		diagnosis := Unknown
+		if inconclusive {
+			diagnosis = Inconclusive
+		}
+		return Diagnosis{OverallResult: diagnosis, CheckResults: results, Reason: reason}, nil
+	}
+
+	score := metWeight / totalWeight
+	logger.WithField("score", score).Debug("health score calculated")
+	diagnosis := Diagnosis{CheckResults: results, Score: score, Scored: true, Reason: reason}
+	switch {
+	case blockingUnmet, score < scoring.UnhealthyScore:
+		diagnosis.OverallResult = Unhealthy
+	case inconclusive, score < scoring.HealthyScore:
+		diagnosis.OverallResult = Inconclusive
+	default:
+		diagnosis.OverallResult = Healthy
+	}
+	return diagnosis, nil
+}
+
+// criterionWeight returns the weight of the criterion in the health score.
+func criterionWeight(criteria config.HealthCriterion) float64 {
+	if criteria.Weight == 0 {
+		return 1
+	}
+	return criteria.Weight
+}
@@ -0,0 +1,112 @@
+package health_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScore(t *testing.T) {
+	scoring := config.HealthScoring{Enabled: true, HealthyScore: 0.9, UnhealthyScore: 0.5}
+	criteria := []config.HealthCriterion{
+		{Metric: config.RequestCountMetricsCheck, Threshold: 100},
+		{Metric: config.ErrorRateMetricsCheck, Threshold: 1, Weight: 3},
+		{Metric: config.LatencyMetricsCheck, Percentile: 99, Threshold: 750, Severity: config.SeverityAdvisory},
+		{Metric: config.LatencyMetricsCheck, Percentile: 50, Threshold: 100, Severity: config.SeverityAdvisory},
+	}
+
+	tests := []struct {
+		name           string
+		healthCriteria []config.HealthCriterion
+		results        []health.MetricsValue
+		expected       health.DiagnosisResult
+		expectedScore  float64
+		shouldErr      bool
+	}{
+		{
+			name:           "all criteria met",
+			healthCriteria: criteria,
+			results:        []health.MetricsValue{{Value: 200}, {Value: 0.5}, {Value: 500}, {Value: 50}},
+			expected:       health.Healthy,
+			expectedScore:  1,
+		},
+		{
+			name:           "advisory breach holds the rollout",
+			healthCriteria: criteria,
+			results:        []health.MetricsValue{{Value: 200}, {Value: 0.5}, {Value: 500}, {Value: 150}},
+			expected:       health.Inconclusive,
+			expectedScore:  0.8,
+		},
+		{
+			name:           "multiple advisory breaches hold the rollout",
+			healthCriteria: criteria,
+			results:        []health.MetricsValue{{Value: 200}, {Value: 0.5}, {Value: 1000}, {Value: 150}},
+			expected:       health.Inconclusive,
+			expectedScore:  0.6,
+		},
+		{
+			name: "low score, unhealthy",
+			healthCriteria: []config.HealthCriterion{
+				{Metric: config.LatencyMetricsCheck, Percentile: 99, Threshold: 750, Severity: config.SeverityAdvisory},
+				{Metric: config.LatencyMetricsCheck, Percentile: 50, Threshold: 100, Severity: config.SeverityAdvisory, Weight: 2},
+			},
+			results:       []health.MetricsValue{{Value: 500}, {Value: 150}},
+			expected:      health.Unhealthy,
+			expectedScore: 1.0 / 3,
+		},
+		{
+			name:           "blocking breach, unhealthy",
+			healthCriteria: criteria,
+			results:        []health.MetricsValue{{Value: 200}, {Value: 2}, {Value: 500}, {Value: 50}},
+			expected:       health.Unhealthy,
+			expectedScore:  0.4,
+		},
+		{
+			name:           "no enough requests, inconclusive",
+			healthCriteria: criteria,
+			results:        []health.MetricsValue{{Value: 50}, {Value: 0.5}, {Value: 500}, {Value: 50}},
+			expected:       health.Inconclusive,
+			expectedScore:  1,
+		},
+		{
+			name:           "no data, inconclusive",
+			healthCriteria: criteria,
+			results:        []health.MetricsValue{{Value: 200}, {Value: 0.5}, {NoData: true}, {Value: 50}},
+			expected:       health.Inconclusive,
+			expectedScore:  1,
+		},
+		{
+			name:           "only request count criteria, unknown",
+			healthCriteria: criteria[:1],
+			results:        []health.MetricsValue{{Value: 200}},
+			expected:       health.Unknown,
+		},
+		{
+			name:           "should err, different sizes for criteria and results",
+			healthCriteria: criteria,
+			results:        []health.MetricsValue{{Value: 200}},
+			shouldErr:      true,
+		},
+		{
+			name:      "should err, empty health criteria",
+			shouldErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(tt *testing.T) {
+			diagnosis, err := health.Score(context.Background(), test.healthCriteria, test.results, scoring)
+			if test.shouldErr {
+				assert.NotNil(tt, err)
+				return
+			}
+			assert.Nil(tt, err)
+			assert.Equal(tt, test.expected, diagnosis.OverallResult)
+			assert.InDelta(tt, test.expectedScore, diagnosis.Score, 1e-9)
+			assert.Len(tt, diagnosis.CheckResults, len(test.healthCriteria))
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package health
+
+import (
+	"context"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/util"
+	"github.com/sirupsen/logrus"
+)
+
+// VoteResult is the answer of an external voter about the health of a
+// revision.
+type VoteResult string
+
+// Possible vote results.
+const (
+	VoteHealthy   VoteResult = "healthy"
+	VoteUnhealthy VoteResult = "unhealthy"
+	VoteAbstain   VoteResult = "abstain"
+)
+
+// Vote is the vote of an external voter (e.g. a health webhook).
+type Vote struct {
+	// Voter identifies who voted (e.g. the URL of the webhook).
+	Voter  string
+	Result VoteResult
+	Reason string
+
+	// Failed is true if the vote could not be obtained, in which case Reason
+	// explains why and Result is meaningless.
+	Failed bool
+}
+
+// MergeVotes merges the votes of external voters into the diagnosis.
+//
+// Any unhealthy vote makes the diagnosis Unhealthy. Otherwise, if any vote
+// could not be obtained, a Healthy diagnosis becomes Inconclusive so the
+// rollout is held until all the voters answer. Healthy votes and abstentions
+// do not change the diagnosis.
+func MergeVotes(ctx context.Context, diagnosis Diagnosis, votes []Vote) Diagnosis {
+	logger := util.LoggerFrom(ctx)
+	diagnosis.Votes = votes
+	for _, vote := range votes {
+		logger := logger.WithFields(logrus.Fields{
+			"voter":  vote.Voter,
+			"result": vote.Result,
+			"reason": vote.Reason,
+		})
+		switch {
+		case vote.Failed:
+			logger.Debug("vote failed")
+			if diagnosis.OverallResult == Healthy {
+				diagnosis.OverallResult = Inconclusive
+			}
+		case vote.Result == VoteUnhealthy:
+			logger.Debug("unhealthy vote")
+			diagnosis.OverallResult = Unhealthy
+		default:
+			logger.Debug("vote does not change the diagnosis")
+		}
+	}
+	return diagnosis
+}
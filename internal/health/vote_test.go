@@ -0,0 +1,68 @@
+package health_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeVotes(t *testing.T) {
+	tests := []struct {
+		name      string
+		diagnosis health.DiagnosisResult
+		votes     []health.Vote
+		expected  health.DiagnosisResult
+	}{
+		{
+			name:      "no votes",
+			diagnosis: health.Healthy,
+			expected:  health.Healthy,
+		},
+		{
+			name:      "healthy and abstain votes",
+			diagnosis: health.Healthy,
+			votes:     []health.Vote{{Result: health.VoteHealthy}, {Result: health.VoteAbstain}},
+			expected:  health.Healthy,
+		},
+		{
+			name:      "healthy vote does not override metrics",
+			diagnosis: health.Inconclusive,
+			votes:     []health.Vote{{Result: health.VoteHealthy}},
+			expected:  health.Inconclusive,
+		},
+		{
+			name:      "unhealthy vote vetoes",
+			diagnosis: health.Healthy,
+			votes:     []health.Vote{{Result: health.VoteHealthy}, {Result: health.VoteUnhealthy, Reason: "e2e failed"}},
+			expected:  health.Unhealthy,
+		},
+		{
+			name:      "unhealthy vote over inconclusive",
+			diagnosis: health.Inconclusive,
+			votes:     []health.Vote{{Result: health.VoteUnhealthy}},
+			expected:  health.Unhealthy,
+		},
+		{
+			name:      "failed vote holds healthy",
+			diagnosis: health.Healthy,
+			votes:     []health.Vote{{Failed: true, Reason: "timeout"}},
+			expected:  health.Inconclusive,
+		},
+		{
+			name:      "failed vote does not hide unhealthy",
+			diagnosis: health.Unhealthy,
+			votes:     []health.Vote{{Failed: true}},
+			expected:  health.Unhealthy,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diagnosis := health.MergeVotes(context.Background(), health.Diagnosis{OverallResult: test.diagnosis}, test.votes)
+			assert.Equal(t, test.expected, diagnosis.OverallResult)
+			assert.Equal(t, test.votes, diagnosis.Votes)
+		})
+	}
+}
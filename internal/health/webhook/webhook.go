@@ -0,0 +1,137 @@
+// Package webhook implements health votes from external HTTP endpoints.
+//
+// During the diagnosis, the endpoint receives a POST request with a JSON body
+// describing the rollout, for example
+//
+//	{
+//	  "project": "myproject",
+//	  "region": "us-east1",
+//	  "service": "mysvc",
+//	  "candidateRevision": "mysvc-002",
+//	  "stableRevision": "mysvc-001",
+//	  "candidatePercent": 20
+//	}
+//
+// and must answer with a 2xx response and a JSON body with its vote, which is
+// one of "healthy", "unhealthy" or "abstain", and an optional reason:
+//
+//	{"vote": "unhealthy", "reason": "checkout e2e test failed"}
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
+	"github.com/pkg/errors"
+)
+
+// DefaultTimeout is the maximum time to wait for a vote if the webhook does
+// not specify a timeout.
+const DefaultTimeout = 30 * time.Second
+
+// maxResponseSize is the maximum size of a response body that is read.
+const maxResponseSize = 64 << 10
+
+// Request is the body of the request sent to the webhooks.
+type Request struct {
+	Project           string `json:"project"`
+	Region            string `json:"region"`
+	Service           string `json:"service"`
+	CandidateRevision string `json:"candidateRevision"`
+	StableRevision    string `json:"stableRevision"`
+	CandidatePercent  int64  `json:"candidatePercent"`
+}
+
+// response is the body of the response of the webhooks.
+type response struct {
+	Vote   health.VoteResult `json:"vote"`
+	Reason string            `json:"reason"`
+}
+
+// Client calls the webhooks.
+type Client struct {
+	httpClient *http.Client
+}
+
+// NewClient returns a client that makes the requests with the HTTP client.
+func NewClient(httpClient *http.Client) *Client {
+	return &Client{httpClient: httpClient}
+}
+
+// RedactURL returns the URL of a webhook without its user information, query
+// and fragment, which might hold credentials, so it can be logged and reported
+// as the voter.
+func RedactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "invalid URL"
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+// redactError redacts the URL of the webhook if the error includes it.
+func redactError(err error) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		urlErr.URL = RedactURL(urlErr.URL)
+	}
+	return err
+}
+
+// Vote calls the webhook and returns its vote. The voter is the redacted URL
+// of the webhook, which the errors include instead of the URL.
+func (c *Client) Vote(ctx context.Context, webhook config.HealthWebhook, req Request) (health.Vote, error) {
+	vote := health.Vote{Voter: RedactURL(webhook.URL)}
+	timeout := webhook.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return vote, errors.Wrap(err, "failed to marshal request")
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return vote, errors.Wrap(redactError(err), "failed to create request")
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return vote, errors.Wrap(redactError(err), "request failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return vote, errors.Errorf("unexpected response status %q", resp.Status)
+	}
+	var answer response
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&answer); err != nil {
+		return vote, errors.Wrap(err, "failed to decode response")
+	}
+	// Drain the body so the connection can be reused.
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxResponseSize))
+
+	switch answer.Vote {
+	case health.VoteHealthy, health.VoteUnhealthy, health.VoteAbstain:
+	default:
+		return vote, errors.Errorf("invalid vote %q", answer.Vote)
+	}
+	vote.Result = answer.Vote
+	vote.Reason = answer.Reason
+	return vote, nil
+}
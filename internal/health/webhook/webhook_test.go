@@ -0,0 +1,119 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health/webhook"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_Vote(t *testing.T) {
+	req := webhook.Request{
+		Project:           "myproject",
+		Region:            "us-east1",
+		Service:           "mysvc",
+		CandidateRevision: "mysvc-002",
+		StableRevision:    "mysvc-001",
+		CandidatePercent:  20,
+	}
+
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		delay     time.Duration
+		expected  health.Vote
+		shouldErr bool
+	}{
+		{
+			name:     "healthy",
+			status:   http.StatusOK,
+			body:     `{"vote": "healthy"}`,
+			expected: health.Vote{Result: health.VoteHealthy},
+		},
+		{
+			name:     "unhealthy with reason",
+			status:   http.StatusOK,
+			body:     `{"vote": "unhealthy", "reason": "checkout e2e test failed"}`,
+			expected: health.Vote{Result: health.VoteUnhealthy, Reason: "checkout e2e test failed"},
+		},
+		{
+			name:     "abstain",
+			status:   http.StatusOK,
+			body:     `{"vote": "abstain", "reason": "not enough orders"}`,
+			expected: health.Vote{Result: health.VoteAbstain, Reason: "not enough orders"},
+		},
+		{
+			name:      "invalid vote",
+			status:    http.StatusOK,
+			body:      `{"vote": "maybe"}`,
+			shouldErr: true,
+		},
+		{
+			name:      "invalid body",
+			status:    http.StatusOK,
+			body:      `healthy`,
+			shouldErr: true,
+		},
+		{
+			name:      "error status",
+			status:    http.StatusInternalServerError,
+			body:      `{"vote": "healthy"}`,
+			shouldErr: true,
+		},
+		{
+			name:      "timeout",
+			status:    http.StatusOK,
+			body:      `{"vote": "healthy"}`,
+			delay:     time.Second,
+			shouldErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, http.MethodPost, r.Method)
+				var got webhook.Request
+				assert.Nil(t, json.NewDecoder(r.Body).Decode(&got))
+				assert.Equal(t, req, got)
+
+				select {
+				case <-time.After(test.delay):
+				case <-r.Context().Done():
+					return
+				}
+				w.WriteHeader(test.status)
+				fmt.Fprint(w, test.body)
+			}))
+			defer server.Close()
+
+			// The credentials in the URL are not reported.
+			u, err := url.Parse(server.URL + "/vote?token=secret")
+			assert.Nil(t, err)
+			u.User = url.UserPassword("voter", "secret")
+			hook := config.HealthWebhook{URL: u.String(), Timeout: 100 * time.Millisecond}
+			client := webhook.NewClient(server.Client())
+			vote, err := client.Vote(context.Background(), hook, req)
+			assert.Equal(t, server.URL+"/vote", vote.Voter)
+			if test.shouldErr {
+				if assert.NotNil(t, err) {
+					assert.NotContains(t, err.Error(), "secret")
+				}
+				return
+			}
+			assert.Nil(t, err)
+			test.expected.Voter = server.URL + "/vote"
+			assert.Equal(t, test.expected, vote)
+		})
+	}
+}
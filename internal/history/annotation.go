@@ -0,0 +1,110 @@
+package history
+
+import (
+	"context"
+	"encoding/json"
+
+	runapi "github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/run"
+	"github.com/pkg/errors"
+	"google.golang.org/api/run/v1"
+)
+
+// Annotation is the annotation of a service with its most recent records.
+const Annotation = "rollout.cloud.run/history"
+
+// DefaultAnnotationSize is the default number of records kept in the
+// annotation.
+const DefaultAnnotationSize = 10
+
+// ClientFunc returns a Cloud Run API client for the region.
+type ClientFunc func(ctx context.Context, region string) (runapi.Client, error)
+
+// AnnotationStore keeps the most recent records of each service in an
+// annotation of the service, as a ring buffer. It does not need any storage
+// besides the service, but annotations have a limited size, so only a few
+// records can be kept.
+type AnnotationStore struct {
+	size   int
+	client ClientFunc
+}
+
+// NewAnnotationStore initializes a store that keeps up to size records in each
+// service. The services are retrieved and updated with the clients returned by
+// the function.
+func NewAnnotationStore(size int, client ClientFunc) *AnnotationStore {
+	if size <= 0 {
+		size = DefaultAnnotationSize
+	}
+	return &AnnotationStore{size: size, client: client}
+}
+
+// Append adds the record to the annotation of its service and updates the
+// service.
+func (s *AnnotationStore) Append(ctx context.Context, record Record) error {
+	client, err := s.client(ctx, record.Region)
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize Cloud Run API client")
+	}
+	svc, err := client.Service(record.Project, record.Service)
+	if err != nil {
+		return errors.Wrapf(err, "failed to retrieve service %q", record.Service)
+	}
+	if err := s.AppendToService(svc, record); err != nil {
+		return err
+	}
+	_, err = client.ReplaceService(record.Project, record.Service, svc)
+	return errors.Wrapf(err, "failed to update service %q", record.Service)
+}
+
+// AppendToService adds the record to the service's annotation, discarding the
+// oldest records if there are more than the size of the store.
+func (s *AnnotationStore) AppendToService(svc *run.Service, record Record) error {
+	// An annotation that cannot be decoded (e.g. edited by hand) is replaced,
+	// so it does not prevent recording the history.
+	records, _ := annotationRecords(svc)
+	records = append(records, record)
+	if len(records) > s.size {
+		records = records[len(records)-s.size:]
+	}
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode records")
+	}
+	if svc.Metadata.Annotations == nil {
+		svc.Metadata.Annotations = make(map[string]string)
+	}
+	svc.Metadata.Annotations[Annotation] = string(data)
+	return nil
+}
+
+// Records returns up to n of the most recent records of the service.
+func (s *AnnotationStore) Records(ctx context.Context, service Key, n int) ([]Record, error) {
+	client, err := s.client(ctx, service.Region)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize Cloud Run API client")
+	}
+	svc, err := client.Service(service.Project, service.Service)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to retrieve service %q", service.Service)
+	}
+	records, err := annotationRecords(svc)
+	if err != nil {
+		return nil, err
+	}
+	return latest(records, n), nil
+}
+
+// annotationRecords returns the records in the service's annotation, in the
+// order they were appended.
+func annotationRecords(svc *run.Service) ([]Record, error) {
+	value, ok := svc.Metadata.Annotations[Annotation]
+	if !ok {
+		return nil, nil
+	}
+	var records []Record
+	if err := json.Unmarshal([]byte(value), &records); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode annotation %s", Annotation)
+	}
+	return records, nil
+}
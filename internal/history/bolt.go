@@ -0,0 +1,119 @@
+package history
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// historyBucket is the bucket that holds a nested bucket with the records of
+// each service.
+var historyBucket = []byte("history")
+
+// boltOpenTimeout is the maximum time to wait for the lock of the database
+// file, which is held by the process that opened it.
+const boltOpenTimeout = 5 * time.Second
+
+// BoltStore keeps the records in an embedded key-value database (bbolt).
+//
+// Records are indexed by service, so retrieving the history of a service does
+// not read the records of the others.
+//
+// The database file is locked while it is open, so it is only opened for the
+// duration of each operation. This lets the history command read the records
+// while the manager is running.
+type BoltStore struct {
+	path string
+}
+
+// NewBoltStore returns a store for the database at the given path, creating it
+// if needed.
+func NewBoltStore(path string) (*BoltStore, error) {
+	s := &BoltStore{path: path}
+	db, err := s.open(false)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(historyBucket)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize history database")
+	}
+	return s, nil
+}
+
+// open opens the database. A read-only database shares the lock of the file
+// with other readers.
+func (s *BoltStore) open(readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(s.path, 0644, &bolt.Options{Timeout: boltOpenTimeout, ReadOnly: readOnly})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open history database %s", s.path)
+	}
+	return db, nil
+}
+
+// Append adds the record to the service's bucket, under the next sequence
+// number of the bucket.
+func (s *BoltStore) Append(ctx context.Context, record Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode record")
+	}
+	db, err := s.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(historyBucket).CreateBucketIfNotExists([]byte(record.Key().String()))
+		if err != nil {
+			return err
+		}
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return bucket.Put(key, data)
+	})
+	return errors.Wrap(err, "failed to store record")
+}
+
+// Records returns up to n of the most recent records of the service.
+func (s *BoltStore) Records(ctx context.Context, service Key, n int) ([]Record, error) {
+	db, err := s.open(true)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	records := []Record{}
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historyBucket).Bucket([]byte(service.String()))
+		if bucket == nil {
+			return nil
+		}
+		// Keys are big-endian sequence numbers, so the last key is the most
+		// recent record.
+		cursor := bucket.Cursor()
+		for k, v := cursor.Last(); k != nil && (n <= 0 || len(records) < n); k, v = cursor.Prev() {
+			var record Record
+			if err := json.Unmarshal(v, &record); err != nil {
+				return errors.Wrapf(err, "failed to decode record %d", binary.BigEndian.Uint64(k))
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read records")
+	}
+	return records, nil
+}
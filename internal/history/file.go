@@ -0,0 +1,84 @@
+package history
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// maxLineSize is the maximum size of a record in a JSON lines file.
+const maxLineSize = 1 << 20
+
+// FileStore appends the records to a file with a JSON document per line
+// (JSON lines), which can also be processed by other tools.
+//
+// The file is never truncated, so its rotation must be handled externally.
+type FileStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileStore initializes a store that uses the file at the given path. The
+// file is created on the first record.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Append adds the record at the end of the file.
+func (s *FileStore) Append(ctx context.Context, record Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode record")
+	}
+	data = append(data, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to open history file")
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return errors.Wrap(err, "failed to write record")
+	}
+	return errors.Wrap(file.Close(), "failed to close history file")
+}
+
+// Records returns up to n of the most recent records of the service.
+func (s *FileStore) Records(ctx context.Context, service Key, n int) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return []Record{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open history file")
+	}
+	defer file.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), maxLineSize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, errors.Wrapf(err, "failed to decode record in %s:%d", s.path, line)
+		}
+		if record.Key() == service {
+			records = append(records, record)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read history file")
+	}
+	return latest(records, n), nil
+}
@@ -0,0 +1,118 @@
+// Package history keeps an audit log of the rollout decisions.
+//
+// The annotations of a service only show the last evaluation, so a record is
+// appended to the history every time a candidate is evaluated, whether its
+// traffic changed or not.
+package history
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
+	"google.golang.org/api/run/v1"
+)
+
+// Record is the evaluation of a candidate and the decision made about it.
+type Record struct {
+	Project string `json:"project"`
+	Region  string `json:"region"`
+	Service string `json:"service"`
+
+	// Diagnosis is the health report of the candidate, which includes the
+	// revisions, the reason of the result and the decision made.
+	Diagnosis health.Report `json:"diagnosis"`
+
+	TrafficBefore []Target `json:"trafficBefore"`
+	TrafficAfter  []Target `json:"trafficAfter"`
+
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Key returns the key of the record's service.
+func (r Record) Key() Key {
+	return Key{Project: r.Project, Region: r.Region, Service: r.Service}
+}
+
+// TrafficChanged determines if the traffic configuration changed as a result
+// of the evaluation.
+func (r Record) TrafficChanged() bool {
+	if len(r.TrafficBefore) != len(r.TrafficAfter) {
+		return true
+	}
+	for i := range r.TrafficBefore {
+		if r.TrafficBefore[i] != r.TrafficAfter[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// Target is a traffic target of a service.
+type Target struct {
+	Revision       string `json:"revision,omitempty"`
+	LatestRevision bool   `json:"latestRevision,omitempty"`
+	Tag            string `json:"tag,omitempty"`
+	Percent        int64  `json:"percent"`
+}
+
+// NewTraffic returns a copy of the traffic configuration of a service.
+func NewTraffic(traffic []*run.TrafficTarget) []Target {
+	targets := []Target{}
+	for _, target := range traffic {
+		targets = append(targets, Target{
+			Revision:       target.RevisionName,
+			LatestRevision: target.LatestRevision,
+			Tag:            target.Tag,
+			Percent:        target.Percent,
+		})
+	}
+	return targets
+}
+
+// Key identifies a service.
+type Key struct {
+	Project string
+	Region  string
+	Service string
+}
+
+func (k Key) String() string {
+	return fmt.Sprintf("%s/%s/%s", k.Project, k.Region, k.Service)
+}
+
+// Store persists the history of the services.
+//
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Append adds the record to the history of its service.
+	Append(ctx context.Context, record Record) error
+
+	// Records returns up to n of the most recent records of the service, most
+	// recent first. All the records are returned if n is not positive.
+	Records(ctx context.Context, service Key, n int) ([]Record, error)
+}
+
+// ServiceStore is implemented by stores that keep the history in the service
+// itself. The record is added to the service before the service is replaced,
+// instead of making another update to it.
+type ServiceStore interface {
+	Store
+
+	// AppendToService adds the record to the history kept in the service.
+	AppendToService(svc *run.Service, record Record) error
+}
+
+// latest returns up to n records, most recent first, from records in the
+// order they were appended.
+func latest(records []Record, n int) []Record {
+	if n <= 0 || n > len(records) {
+		n = len(records)
+	}
+	result := make([]Record, 0, n)
+	for i := len(records) - 1; i >= len(records)-n; i-- {
+		result = append(result, records[i])
+	}
+	return result
+}
@@ -0,0 +1,166 @@
+package history_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/history"
+	runapi "github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/run"
+	runmock "github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/run/mock"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/run/v1"
+)
+
+// record returns the i-th record of the service.
+func record(key history.Key, i int) history.Record {
+	timestamp := time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(i) * time.Hour)
+	return history.Record{
+		Project: key.Project,
+		Region:  key.Region,
+		Service: key.Service,
+		Diagnosis: health.Report{
+			Version:   health.ReportVersion,
+			Result:    "healthy",
+			Criteria:  []health.CriterionReport{},
+			Decision:  "roll-forward",
+			Timestamp: timestamp,
+		},
+		TrafficBefore: []history.Target{{Revision: "mysvc-001", Percent: 100 - int64(i)}, {Revision: "mysvc-002", Percent: int64(i)}},
+		TrafficAfter:  []history.Target{{Revision: "mysvc-001", Percent: 99 - int64(i)}, {Revision: "mysvc-002", Percent: int64(i) + 1}},
+		Timestamp:     timestamp,
+	}
+}
+
+func TestStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	boltStore, err := history.NewBoltStore(filepath.Join(dir, "history.db"))
+	assert.Nil(t, err)
+
+	stores := map[string]history.Store{
+		"file": history.NewFileStore(filepath.Join(dir, "history.jsonl")),
+		"bolt": boltStore,
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			key := history.Key{Project: "myproject", Region: "us-east1", Service: "mysvc"}
+			otherKey := history.Key{Project: "myproject", Region: "us-west1", Service: "mysvc"}
+
+			records, err := store.Records(ctx, key, 5)
+			assert.Nil(t, err)
+			assert.Empty(t, records)
+
+			for i := 0; i < 5; i++ {
+				assert.Nil(t, store.Append(ctx, record(key, i)))
+			}
+			assert.Nil(t, store.Append(ctx, record(otherKey, 10)))
+
+			records, err = store.Records(ctx, key, 2)
+			assert.Nil(t, err)
+			assert.Equal(t, []history.Record{record(key, 4), record(key, 3)}, records)
+
+			records, err = store.Records(ctx, key, 0)
+			assert.Nil(t, err)
+			assert.Len(t, records, 5)
+
+			records, err = store.Records(ctx, otherKey, 1000)
+			assert.Nil(t, err)
+			assert.Equal(t, []history.Record{record(otherKey, 10)}, records)
+		})
+	}
+}
+
+func TestBoltStore_SharedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// The manager and the history command open the same file.
+	path := filepath.Join(dir, "history.db")
+	manager, err := history.NewBoltStore(path)
+	assert.Nil(t, err)
+	command, err := history.NewBoltStore(path)
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	key := history.Key{Project: "myproject", Region: "us-east1", Service: "mysvc"}
+	assert.Nil(t, manager.Append(ctx, record(key, 0)))
+	records, err := command.Records(ctx, key, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []history.Record{record(key, 0)}, records)
+
+	assert.Nil(t, manager.Append(ctx, record(key, 1)))
+	records, err = command.Records(ctx, key, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []history.Record{record(key, 1), record(key, 0)}, records)
+}
+
+func TestAnnotationStore(t *testing.T) {
+	ctx := context.Background()
+	key := history.Key{Project: "myproject", Region: "us-east1", Service: "mysvc"}
+	svc := &run.Service{Metadata: &run.ObjectMeta{Name: "mysvc"}}
+
+	runclient := &runmock.RunAPI{}
+	runclient.ServiceFn = func(namespace, serviceID string) (*run.Service, error) {
+		assert.Equal(t, "myproject", namespace)
+		assert.Equal(t, "mysvc", serviceID)
+		return svc, nil
+	}
+	runclient.ReplaceServiceFn = func(namespace, serviceID string, s *run.Service) (*run.Service, error) {
+		svc = s
+		return s, nil
+	}
+	store := history.NewAnnotationStore(3, func(ctx context.Context, region string) (runapi.Client, error) {
+		assert.Equal(t, "us-east1", region)
+		return runclient, nil
+	})
+
+	records, err := store.Records(ctx, key, 0)
+	assert.Nil(t, err)
+	assert.Empty(t, records)
+
+	assert.Nil(t, store.Append(ctx, record(key, 0)))
+	assert.True(t, runclient.ReplaceServiceInvoked)
+	for i := 1; i < 5; i++ {
+		assert.Nil(t, store.AppendToService(svc, record(key, i)))
+	}
+
+	// Only the most recent records are kept.
+	records, err = store.Records(ctx, key, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []history.Record{record(key, 4), record(key, 3), record(key, 2)}, records)
+
+	records, err = store.Records(ctx, key, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []history.Record{record(key, 4)}, records)
+
+	// An invalid annotation is replaced.
+	svc.Metadata.Annotations[history.Annotation] = "invalid"
+	_, err = store.Records(ctx, key, 0)
+	assert.NotNil(t, err)
+	assert.Nil(t, store.AppendToService(svc, record(key, 5)))
+	records, err = store.Records(ctx, key, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []history.Record{record(key, 5)}, records)
+}
+
+func TestRecord_TrafficChanged(t *testing.T) {
+	key := history.Key{Project: "myproject", Region: "us-east1", Service: "mysvc"}
+	changed := record(key, 1)
+	assert.True(t, changed.TrafficChanged())
+
+	unchanged := record(key, 1)
+	unchanged.TrafficAfter = history.NewTraffic([]*run.TrafficTarget{
+		{RevisionName: "mysvc-001", Percent: 99},
+		{RevisionName: "mysvc-002", Percent: 1},
+	})
+	assert.False(t, unchanged.TrafficChanged())
+}
@@ -0,0 +1,98 @@
+// Package incident provides the open incidents of Cloud Monitoring alerting
+// policies.
+//
+// The Cloud Monitoring API does not expose incidents, so they are tracked from
+// the notifications sent by a webhook notification channel added to the
+// alerting policies. See
+// https://cloud.google.com/monitoring/support/notification-options#webhooks.
+package incident
+
+import (
+	"context"
+	"time"
+)
+
+// Incident is an open incident of an alerting policy.
+type Incident struct {
+	ID      string
+	Project string
+	Policy  string
+	Summary string
+	URL     string
+	Started time.Time
+
+	// ResourceLabels are the labels of the monitored resource that caused the
+	// incident (e.g. service_name for a Cloud Run revision).
+	ResourceLabels map[string]string
+}
+
+// Default resource labels that identify the service and the region of an
+// incident, which are the labels of Cloud Run revisions.
+const (
+	DefaultServiceLabel  = "service_name"
+	DefaultLocationLabel = "location"
+)
+
+// Query holds the parameters used to retrieve the open incidents of a service.
+type Query struct {
+	Project string
+	Region  string
+	Service string
+
+	// Policies are the names of the alerting policies whose incidents are
+	// considered. If empty, incidents of all the policies are considered.
+	Policies []string
+
+	// ServiceLabel and LocationLabel are the resource labels that identify the
+	// service and the region of an incident. If empty, DefaultServiceLabel
+	// and DefaultLocationLabel are used.
+	ServiceLabel  string
+	LocationLabel string
+}
+
+// Matches determines if the incident is considered by the query.
+//
+// Incidents on resources without a service or location label (e.g. a load
+// balancer) apply to all the services of the project.
+func (q Query) Matches(incident Incident) bool {
+	serviceLabel, locationLabel := q.ServiceLabel, q.LocationLabel
+	if serviceLabel == "" {
+		serviceLabel = DefaultServiceLabel
+	}
+	if locationLabel == "" {
+		locationLabel = DefaultLocationLabel
+	}
+
+	if incident.Project != "" && incident.Project != q.Project {
+		return false
+	}
+	if service, ok := incident.ResourceLabels[serviceLabel]; ok && service != q.Service {
+		return false
+	}
+	if location, ok := incident.ResourceLabels[locationLabel]; ok && q.Region != "" && location != q.Region {
+		return false
+	}
+	return q.MatchesPolicy(incident)
+}
+
+// MatchesPolicy determines if the incident belongs to one of the alerting
+// policies of the query.
+func (q Query) MatchesPolicy(incident Incident) bool {
+	if len(q.Policies) == 0 {
+		return true
+	}
+	for _, policy := range q.Policies {
+		if policy == incident.Policy {
+			return true
+		}
+	}
+	return false
+}
+
+// Provider represents a source of open incidents.
+//
+// Implementations must be safe for concurrent use.
+type Provider interface {
+	// Returns the open incidents that match the query.
+	OpenIncidents(ctx context.Context, query Query) ([]Incident, error)
+}
@@ -0,0 +1,20 @@
+package mock
+
+import (
+	"context"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/incident"
+)
+
+// Provider is a mock implementation of incident.Provider.
+type Provider struct {
+	OpenIncidentsFn      func(ctx context.Context, query incident.Query) ([]incident.Incident, error)
+	OpenIncidentsInvoked bool
+}
+
+// OpenIncidents invokes the mock implementation and marks the function as
+// invoked.
+func (p *Provider) OpenIncidents(ctx context.Context, query incident.Query) ([]incident.Incident, error) {
+	p.OpenIncidentsInvoked = true
+	return p.OpenIncidentsFn(ctx, query)
+}
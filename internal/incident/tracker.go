@@ -0,0 +1,184 @@
+package incident
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// maxNotificationSize is the maximum size of a notification that is read.
+const maxNotificationSize = 1 << 20
+
+// Incident states in notifications.
+const (
+	stateOpen   = "open"
+	stateClosed = "closed"
+)
+
+// notification is the body of a notification sent by a webhook notification
+// channel (schema version 1.2).
+type notification struct {
+	Version  string `json:"version"`
+	Incident struct {
+		ID        string `json:"incident_id"`
+		Project   string `json:"scoping_project_id"`
+		URL       string `json:"url"`
+		StartedAt int64  `json:"started_at"`
+		State     string `json:"state"`
+		Resource  struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"resource"`
+		PolicyName string `json:"policy_name"`
+		Summary    string `json:"summary"`
+	} `json:"incident"`
+}
+
+// TrackerOptions configures a Tracker.
+type TrackerOptions struct {
+	// Token, if not empty, is the value that the token query parameter of the
+	// URL of the notifications must have.
+	Token string
+
+	// WarmUp is the time after the tracker starts during which the open
+	// incidents are unknown. It should be the renotification interval of the
+	// alerting policies, after which the incidents opened before the tracker
+	// started have been notified again.
+	WarmUp time.Duration
+
+	// ServiceLabel and LocationLabel are the resource labels that identify the
+	// service and the region of an incident, used by the queries that do not
+	// set them.
+	ServiceLabel  string
+	LocationLabel string
+
+	// Clock is used to determine when the warm-up ends, the real clock if nil.
+	Clock clockwork.Clock
+}
+
+// Tracker keeps the open incidents reported by the notifications it receives
+// as an HTTP handler.
+//
+// Incidents are kept in memory, so incidents opened before the tracker started
+// are unknown until they are notified again (e.g. by configuring the alerting
+// policies to renotify open incidents). Until the warm-up ends, the open
+// incidents are reported as unknown. For the same reason, the tracker must run
+// in the same process as the rollouts that check it, which rules out servers
+// with several instances or that scale to zero.
+type Tracker struct {
+	opts    TrackerOptions
+	logger  *logrus.Logger
+	started time.Time
+
+	mu        sync.Mutex
+	incidents map[string]Incident
+}
+
+// NewTracker returns a tracker without open incidents, whose warm-up starts
+// now.
+func NewTracker(logger *logrus.Logger, opts TrackerOptions) *Tracker {
+	if opts.Clock == nil {
+		opts.Clock = clockwork.NewRealClock()
+	}
+	return &Tracker{
+		opts:      opts,
+		logger:    logger,
+		started:   opts.Clock.Now(),
+		incidents: make(map[string]Incident),
+	}
+}
+
+// ServeHTTP handles a notification about an incident.
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if t.opts.Token != "" && subtle.ConstantTimeCompare([]byte(req.URL.Query().Get("token")), []byte(t.opts.Token)) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var n notification
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxNotificationSize)).Decode(&n); err != nil {
+		http.Error(w, "invalid notification", http.StatusBadRequest)
+		return
+	}
+	if err := t.update(n); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+// update opens or closes the incident in the notification.
+func (t *Tracker) update(n notification) error {
+	if n.Incident.ID == "" {
+		return errors.New("missing incident id")
+	}
+	logger := t.logger.WithFields(logrus.Fields{
+		"incident": n.Incident.ID,
+		"policy":   n.Incident.PolicyName,
+		"state":    n.Incident.State,
+	})
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch n.Incident.State {
+	case stateOpen:
+		logger.Info("alert incident opened")
+		t.incidents[n.Incident.ID] = Incident{
+			ID:             n.Incident.ID,
+			Project:        n.Incident.Project,
+			Policy:         n.Incident.PolicyName,
+			Summary:        n.Incident.Summary,
+			URL:            n.Incident.URL,
+			Started:        time.Unix(n.Incident.StartedAt, 0),
+			ResourceLabels: n.Incident.Resource.Labels,
+		}
+	case stateClosed:
+		logger.Info("alert incident closed")
+		delete(t.incidents, n.Incident.ID)
+	default:
+		return errors.Errorf("unsupported incident state %q", n.Incident.State)
+	}
+	return nil
+}
+
+// OpenIncidents returns the open incidents that match the query, sorted by ID.
+//
+// It returns metrics.ErrNoData during the warm-up, since the incidents opened
+// before the tracker started might not have been notified again yet.
+func (t *Tracker) OpenIncidents(ctx context.Context, query Query) ([]Incident, error) {
+	if elapsed := t.opts.Clock.Since(t.started); elapsed < t.opts.WarmUp {
+		return nil, errors.Wrapf(metrics.ErrNoData, "incident tracker started %s ago, warm-up is %s", elapsed, t.opts.WarmUp)
+	}
+	if query.ServiceLabel == "" {
+		query.ServiceLabel = t.opts.ServiceLabel
+	}
+	if query.LocationLabel == "" {
+		query.LocationLabel = t.opts.LocationLabel
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var incidents []Incident
+	for _, incident := range t.incidents {
+		if query.Matches(incident) {
+			incidents = append(incidents, incident)
+		}
+	}
+	sort.Slice(incidents, func(i, j int) bool {
+		return incidents[i].ID < incidents[j].ID
+	})
+	return incidents, nil
+}
@@ -0,0 +1,163 @@
+package incident_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/incident"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// notification returns the body of a notification like the ones sent by Cloud
+// Monitoring webhook notification channels.
+func notification(id, state, policy, service string) string {
+	return fmt.Sprintf(`{
+		"version": "1.2",
+		"incident": {
+			"incident_id": %q,
+			"scoping_project_id": "myproject",
+			"url": "https://console.cloud.google.com/monitoring/alerting/incidents/%s",
+			"started_at": 1577840461,
+			"ended_at": null,
+			"state": %q,
+			"resource": {
+				"type": "cloud_run_revision",
+				"labels": {"service_name": %q, "location": "us-east1"}
+			},
+			"policy_name": %q,
+			"summary": "Request latency for %s is above the threshold"
+		}
+	}`, id, id, state, service, policy, service)
+}
+
+// notify sends a notification to the tracker through a local server, as Cloud
+// Monitoring would.
+func notify(t *testing.T, server *httptest.Server, path, body string) int {
+	resp, err := http.Post(server.URL+path, "application/json", strings.NewReader(body))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	return resp.StatusCode
+}
+
+func TestTracker(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	tracker := incident.NewTracker(logger, incident.TrackerOptions{})
+	server := httptest.NewServer(tracker)
+	defer server.Close()
+
+	assert.Equal(t, http.StatusOK, notify(t, server, "/", notification("0.1", "open", "High latency", "mysvc")))
+	assert.Equal(t, http.StatusOK, notify(t, server, "/", notification("0.2", "open", "High error rate", "mysvc")))
+	assert.Equal(t, http.StatusOK, notify(t, server, "/", notification("0.3", "open", "High latency", "othersvc")))
+	assert.Equal(t, http.StatusOK, notify(t, server, "/", notification("0.4", "open", "High latency", "mysvc")))
+	assert.Equal(t, http.StatusOK, notify(t, server, "/", notification("0.4", "closed", "High latency", "mysvc")))
+
+	tests := []struct {
+		name     string
+		query    incident.Query
+		expected []string
+	}{
+		{
+			name:     "all policies",
+			query:    incident.Query{Project: "myproject", Region: "us-east1", Service: "mysvc"},
+			expected: []string{"0.1", "0.2"},
+		},
+		{
+			name:     "filtered by policy",
+			query:    incident.Query{Project: "myproject", Region: "us-east1", Service: "mysvc", Policies: []string{"High latency"}},
+			expected: []string{"0.1"},
+		},
+		{
+			name:  "other region",
+			query: incident.Query{Project: "myproject", Region: "us-west1", Service: "mysvc"},
+		},
+		{
+			name:  "other project",
+			query: incident.Query{Project: "otherproject", Region: "us-east1", Service: "mysvc"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			incidents, err := tracker.OpenIncidents(context.Background(), test.query)
+			assert.Nil(t, err)
+			var ids []string
+			for _, incident := range incidents {
+				ids = append(ids, incident.ID)
+			}
+			assert.Equal(t, test.expected, ids)
+		})
+	}
+}
+
+func TestTracker_InvalidNotifications(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	tracker := incident.NewTracker(logger, incident.TrackerOptions{Token: "secret"})
+	server := httptest.NewServer(tracker)
+	defer server.Close()
+
+	assert.Equal(t, http.StatusUnauthorized, notify(t, server, "/", notification("0.1", "open", "High latency", "mysvc")))
+	assert.Equal(t, http.StatusUnauthorized, notify(t, server, "/?token=wrong", notification("0.1", "open", "High latency", "mysvc")))
+	assert.Equal(t, http.StatusBadRequest, notify(t, server, "/?token=secret", "not json"))
+	assert.Equal(t, http.StatusBadRequest, notify(t, server, "/?token=secret", notification("0.1", "acknowledged", "High latency", "mysvc")))
+	assert.Equal(t, http.StatusOK, notify(t, server, "/?token=secret", notification("0.1", "open", "High latency", "mysvc")))
+
+	incidents, err := tracker.OpenIncidents(context.Background(), incident.Query{Project: "myproject", Service: "mysvc"})
+	assert.Nil(t, err)
+	assert.Len(t, incidents, 1)
+	assert.Equal(t, "High latency", incidents[0].Policy)
+	assert.Equal(t, map[string]string{"service_name": "mysvc", "location": "us-east1"}, incidents[0].ResourceLabels)
+}
+
+func TestTracker_WarmUp(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	clock := clockwork.NewFakeClock()
+	tracker := incident.NewTracker(logger, incident.TrackerOptions{WarmUp: 30 * time.Minute, Clock: clock})
+	server := httptest.NewServer(tracker)
+	defer server.Close()
+	assert.Equal(t, http.StatusOK, notify(t, server, "/", notification("0.1", "open", "High latency", "mysvc")))
+
+	// Incidents opened before the tracker started might not be notified yet.
+	query := incident.Query{Project: "myproject", Region: "us-east1", Service: "mysvc"}
+	_, err := tracker.OpenIncidents(context.Background(), query)
+	assert.True(t, errors.Is(err, metrics.ErrNoData))
+
+	clock.Advance(30 * time.Minute)
+	incidents, err := tracker.OpenIncidents(context.Background(), query)
+	assert.Nil(t, err)
+	assert.Len(t, incidents, 1)
+}
+
+func TestTracker_Labels(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	tracker := incident.NewTracker(logger, incident.TrackerOptions{ServiceLabel: "backend_service", LocationLabel: "region"})
+	server := httptest.NewServer(tracker)
+	defer server.Close()
+
+	// The default labels are not used to match the incidents.
+	body := strings.Replace(notification("0.1", "open", "High latency", "othersvc"), `"location"`, `"region"`, 1)
+	body = strings.Replace(body, `"service_name": "othersvc"`, `"service_name": "othersvc", "backend_service": "mysvc"`, 1)
+	assert.Equal(t, http.StatusOK, notify(t, server, "/", body))
+
+	incidents, err := tracker.OpenIncidents(context.Background(), incident.Query{Project: "myproject", Region: "us-east1", Service: "mysvc"})
+	assert.Nil(t, err)
+	assert.Len(t, incidents, 1)
+
+	incidents, err = tracker.OpenIncidents(context.Background(), incident.Query{Project: "myproject", Region: "us-west1", Service: "mysvc"})
+	assert.Nil(t, err)
+	assert.Empty(t, incidents)
+}
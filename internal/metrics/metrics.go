@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -19,26 +20,151 @@ const (
 	Align50Reduce50
 )
 
-// Provider represents a metrics Provider such as Stackdriver.
-type Provider interface {
-	// Sets the candidate revision name for which the provider should get
-	// metrics.
-	// TODO: Consider removing this method and making revisionName part of other
-	// method signatures.
-	SetCandidateRevision(revisionName string)
+// ErrNoData is returned by a Provider when there are no data points for the
+// queried metrics (e.g. the revision did not serve any request in the window).
+var ErrNoData = errors.New("no metrics data available")
+
+// ErrUnavailable is returned when the metrics provider consistently fails to
+// answer queries (e.g. all the retries failed or the circuit breaker is open).
+var ErrUnavailable = errors.New("metrics provider unavailable")
+
+// Query holds the parameters used to retrieve metrics for a revision.
+//
+// Every call to a Provider receives its own query, so a single provider can be
+// shared across services and revisions.
+type Query struct {
+	// Region and Service identify the Cloud Run service.
+	Region  string
+	Service string
+
+	// Revision is the name of the revision for which metrics are retrieved.
+	// If empty, metrics for the entire service are considered.
+	Revision string
 
-	// Returns the number of requests for the given offset and query.
-	RequestCount(ctx context.Context, offset time.Duration) (int64, error)
+	// Window is the time window to look back from the current time.
+	Window time.Duration
+
+	// AlignReduce is the series aligner and cross series reducer used for
+	// latency queries. It is ignored by the other metrics.
+	AlignReduce AlignReduce
+
+	// ErrorResponseCodes are the response codes (e.g. "429") or classes (e.g.
+	// "5xx") counted as errors for error rate queries. If empty,
+	// DefaultErrorResponseCodes is used.
+	ErrorResponseCodes []string
+
+	// ExcludedResponseCodes are the response codes or classes that are not
+	// counted as errors for error rate queries, even if they match
+	// ErrorResponseCodes. They still count towards the total of responses.
+	ExcludedResponseCodes []string
+
+	// TrafficPercent is the percentage of the service traffic currently routed
+	// to the revision. Providers ignore it, it is only used by health checks
+	// that compare the requests of the revision with the service's.
+	TrafficPercent int64
+}
 
-	// Returns the request latency after applying the specified series aligner
-	// and cross series reducer. The result is in milliseconds.
+// DefaultErrorResponseCodes are the response codes counted as errors if a
+// query does not specify any.
+var DefaultErrorResponseCodes = []string{"5xx"}
+
+// IsErrorResponse determines if a response code (e.g. "503") counts as an
+// error for the query.
+func (q Query) IsErrorResponse(code string) bool {
+	for _, excluded := range q.ExcludedResponseCodes {
+		if matchesResponseCode(excluded, code) {
+			return false
+		}
+	}
+
+	errorCodes := q.ErrorResponseCodes
+	if len(errorCodes) == 0 {
+		errorCodes = DefaultErrorResponseCodes
+	}
+	for _, errorCode := range errorCodes {
+		if matchesResponseCode(errorCode, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasDefaultErrorResponseCodes determines if the query counts errors the
+// default way (5xx responses).
+func (q Query) HasDefaultErrorResponseCodes() bool {
+	if len(q.ExcludedResponseCodes) != 0 {
+		return false
+	}
+	if len(q.ErrorResponseCodes) == 0 {
+		return true
+	}
+	return len(q.ErrorResponseCodes) == len(DefaultErrorResponseCodes) &&
+		q.ErrorResponseCodes[0] == DefaultErrorResponseCodes[0]
+}
+
+// matchesResponseCode determines if a response code matches the pattern,
+// which is either a response code or a response code class.
+func matchesResponseCode(pattern, code string) bool {
+	if len(pattern) == 3 && strings.HasSuffix(pattern, "xx") {
+		return len(code) == 3 && code[0] == pattern[0]
+	}
+	return pattern == code
+}
+
+// Provider represents a metrics Provider such as Stackdriver.
+//
+// Implementations must be safe for concurrent use.
+type Provider interface {
+	// Returns the number of requests for the given query.
 	// It returns 0 if no request was made during the interval.
-	Latency(ctx context.Context, offset time.Duration, alignReduceType AlignReduce) (float64, error)
+	RequestCount(ctx context.Context, query Query) (int64, error)
+
+	// Returns the request latency after applying the series aligner and cross
+	// series reducer specified in the query. The result is in milliseconds.
+	// It returns ErrNoData if no request was made during the interval.
+	Latency(ctx context.Context, query Query) (float64, error)
 
 	// Gets all the server responses and calculates the error rate by performing
-	// the operation (5xx responses / all responses).
-	// It returns 0 if no request was made during the interval.
-	ErrorRate(ctx context.Context, offset time.Duration) (float64, error)
+	// the operation (error responses / all responses). The response codes
+	// considered errors are determined by the query (5xx by default).
+	// It returns ErrNoData if no request was made during the interval.
+	ErrorRate(ctx context.Context, query Query) (float64, error)
+}
+
+// RevisionKey identifies a revision of a service in batched metrics results.
+type RevisionKey struct {
+	Service  string
+	Revision string
+}
+
+// BatchProvider is a Provider that can also retrieve metrics for all the
+// revisions in a region with a single query.
+//
+// The Service and Revision fields in the query are ignored. Revisions without
+// any data point in the window are not included in the results.
+type BatchProvider interface {
+	Provider
+
+	// Returns the number of requests for every revision in the region.
+	RequestCountByRevision(ctx context.Context, query Query) (map[RevisionKey]int64, error)
+
+	// Returns the request latency for every revision in the region after
+	// applying the series aligner and cross series reducer in the query.
+	LatencyByRevision(ctx context.Context, query Query) (map[RevisionKey]float64, error)
+
+	// Returns the error rate for every revision in the region.
+	ErrorRateByRevision(ctx context.Context, query Query) (map[RevisionKey]float64, error)
+}
+
+// InstanceCountProvider is implemented by the providers that can also retrieve
+// the number of container instances of a revision.
+//
+// Implementations must be safe for concurrent use.
+type InstanceCountProvider interface {
+	// Returns the maximum number of instances of the revision during the
+	// window. It returns 0 if the revision had no instances, and ErrNoData if
+	// the instances are unknown.
+	InstanceCount(ctx context.Context, query Query) (int64, error)
 }
 
 // PercentileToAlignReduce takes a percentile value maps it to a AlignReduce
@@ -67,3 +67,46 @@ func TestPercentileToAlignReduce(t *testing.T) {
 		})
 	}
 }
+
+func TestQuery_IsErrorResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    metrics.Query
+		code     string
+		expected bool
+	}{
+		{name: "default, 5xx", code: "503", expected: true},
+		{name: "default, 4xx", code: "429", expected: false},
+		{name: "default, 2xx", code: "200", expected: false},
+		{
+			name:     "specific code",
+			query:    metrics.Query{ErrorResponseCodes: []string{"5xx", "429"}},
+			code:     "429",
+			expected: true,
+		},
+		{
+			name:     "code not in list",
+			query:    metrics.Query{ErrorResponseCodes: []string{"5xx", "429"}},
+			code:     "404",
+			expected: false,
+		},
+		{
+			name:     "excluded code",
+			query:    metrics.Query{ExcludedResponseCodes: []string{"503"}},
+			code:     "503",
+			expected: false,
+		},
+		{
+			name:     "excluded class has precedence",
+			query:    metrics.Query{ErrorResponseCodes: []string{"429"}, ExcludedResponseCodes: []string{"4xx"}},
+			code:     "429",
+			expected: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, test.query.IsErrorResponse(test.code))
+		})
+	}
+}
@@ -2,56 +2,88 @@ package mock
 
 import (
 	"context"
-	"time"
 
 	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics"
 )
 
-// Metrics is a mock implementation of metrics.Metrics.
+// Metrics is a mock implementation of metrics.Provider.
 type Metrics struct {
-	SetCandidateRevisionFn      func(revisionName string)
-	SetCandidateRevisionInvoked bool
-
-	RequestCountFn      func(ctx context.Context, offset time.Duration) (int64, error)
+	RequestCountFn      func(ctx context.Context, query metrics.Query) (int64, error)
 	RequestCountInvoked bool
 
-	LatencyFn      func(ctx context.Context, offset time.Duration, alignReduceType metrics.AlignReduce) (float64, error)
+	LatencyFn      func(ctx context.Context, query metrics.Query) (float64, error)
 	LatencyInvoked bool
 
-	ErrorRateFn      func(ctx context.Context, offset time.Duration) (float64, error)
+	ErrorRateFn      func(ctx context.Context, query metrics.Query) (float64, error)
 	ErrorRateInvoked bool
 }
 
-// Query is a mock implementation of metrics.Query.
-type Query struct{}
-
-// SetCandidateRevision invokes the mock implementation and marks the function
-// as invoked.
-func (m *Metrics) SetCandidateRevision(revisionName string) {
-	m.SetCandidateRevisionInvoked = true
-	m.SetCandidateRevisionFn(revisionName)
-}
-
 // RequestCount invokes the mock implementation and marks the function as
 // invoked.
-func (m *Metrics) RequestCount(ctx context.Context, offset time.Duration) (int64, error) {
+func (m *Metrics) RequestCount(ctx context.Context, query metrics.Query) (int64, error) {
 	m.RequestCountInvoked = true
-	return m.RequestCountFn(ctx, offset)
+	return m.RequestCountFn(ctx, query)
 }
 
 // Latency invokes the mock implementation and marks the function as invoked.
-func (m *Metrics) Latency(ctx context.Context, offset time.Duration, alignReduceType metrics.AlignReduce) (float64, error) {
+func (m *Metrics) Latency(ctx context.Context, query metrics.Query) (float64, error) {
 	m.LatencyInvoked = true
-	return m.LatencyFn(ctx, offset, alignReduceType)
+	return m.LatencyFn(ctx, query)
 }
 
 // ErrorRate invokes the mock implementation and marks the function as invoked.
-func (m *Metrics) ErrorRate(ctx context.Context, offset time.Duration) (float64, error) {
+func (m *Metrics) ErrorRate(ctx context.Context, query metrics.Query) (float64, error) {
 	m.ErrorRateInvoked = true
-	return m.ErrorRateFn(ctx, offset)
+	return m.ErrorRateFn(ctx, query)
+}
+
+// InstanceMetrics is a mock implementation of metrics.Provider and
+// metrics.InstanceCountProvider.
+type InstanceMetrics struct {
+	Metrics
+
+	InstanceCountFn      func(ctx context.Context, query metrics.Query) (int64, error)
+	InstanceCountInvoked bool
+}
+
+// InstanceCount invokes the mock implementation and marks the function as
+// invoked.
+func (m *InstanceMetrics) InstanceCount(ctx context.Context, query metrics.Query) (int64, error) {
+	m.InstanceCountInvoked = true
+	return m.InstanceCountFn(ctx, query)
+}
+
+// BatchMetrics is a mock implementation of metrics.BatchProvider.
+type BatchMetrics struct {
+	Metrics
+
+	RequestCountByRevisionFn      func(ctx context.Context, query metrics.Query) (map[metrics.RevisionKey]int64, error)
+	RequestCountByRevisionInvoked int
+
+	LatencyByRevisionFn      func(ctx context.Context, query metrics.Query) (map[metrics.RevisionKey]float64, error)
+	LatencyByRevisionInvoked int
+
+	ErrorRateByRevisionFn      func(ctx context.Context, query metrics.Query) (map[metrics.RevisionKey]float64, error)
+	ErrorRateByRevisionInvoked int
+}
+
+// RequestCountByRevision invokes the mock implementation and increments the
+// number of invocations.
+func (m *BatchMetrics) RequestCountByRevision(ctx context.Context, query metrics.Query) (map[metrics.RevisionKey]int64, error) {
+	m.RequestCountByRevisionInvoked++
+	return m.RequestCountByRevisionFn(ctx, query)
+}
+
+// LatencyByRevision invokes the mock implementation and increments the number
+// of invocations.
+func (m *BatchMetrics) LatencyByRevision(ctx context.Context, query metrics.Query) (map[metrics.RevisionKey]float64, error) {
+	m.LatencyByRevisionInvoked++
+	return m.LatencyByRevisionFn(ctx, query)
 }
 
-// Query returns an empty string to comply with the interface.
-func (q Query) Query() string {
-	return ""
+// ErrorRateByRevision invokes the mock implementation and increments the
+// number of invocations.
+func (m *BatchMetrics) ErrorRateByRevision(ctx context.Context, query metrics.Query) (map[metrics.RevisionKey]float64, error) {
+	m.ErrorRateByRevisionInvoked++
+	return m.ErrorRateByRevisionFn(ctx, query)
 }
@@ -0,0 +1,77 @@
+package resilient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+)
+
+// breaker is a circuit breaker that opens after a number of consecutive
+// failures.
+//
+// Once the cooldown elapses, a single query is let through. If it succeeds, the
+// breaker closes; otherwise, it stays open for another cooldown.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	time      clockwork.Clock
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	lastErr   error
+}
+
+// newBreaker initializes a circuit breaker. A non-positive threshold disables
+// the breaker.
+func newBreaker(threshold int, cooldown time.Duration, clock clockwork.Clock) *breaker {
+	return &breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		time:      clock,
+	}
+}
+
+// allow returns an error wrapping metrics.ErrUnavailable if the breaker is
+// open.
+func (b *breaker) allow() error {
+	if b.threshold <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return nil
+	}
+	now := b.time.Now()
+	if now.Before(b.openUntil) {
+		return errors.Wrapf(metrics.ErrUnavailable, "circuit breaker open after %d consecutive failures (last error: %v)", b.failures, b.lastErr)
+	}
+
+	// Let this query through and keep rejecting others until it finishes.
+	b.openUntil = now.Add(b.cooldown)
+	return nil
+}
+
+// success records a successful query.
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.lastErr = nil
+}
+
+// failure records a failed query.
+func (b *breaker) failure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.lastErr = err
+	if b.threshold > 0 && b.failures >= b.threshold {
+		b.openUntil = b.time.Now().Add(b.cooldown)
+	}
+}
@@ -0,0 +1,206 @@
+// Package resilient provides a metrics provider middleware that adds timeouts,
+// retries and circuit breaking to the queries of another provider.
+package resilient
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/util"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+// Provider wraps a metrics provider to make its queries resilient.
+//
+// The circuit breaker state is shared by all the queries, so the same instance
+// should be kept across evaluation cycles.
+type Provider struct {
+	provider metrics.Provider
+	opts     config.MetricsQueryOptions
+	breaker  *breaker
+	time     clockwork.Clock
+}
+
+// BatchProvider wraps a batch metrics provider to make its queries resilient.
+type BatchProvider struct {
+	*Provider
+	batchProvider metrics.BatchProvider
+}
+
+// New wraps the provider with the given options.
+//
+// If the provider implements metrics.BatchProvider, the returned provider also
+// does.
+func New(provider metrics.Provider, opts config.MetricsQueryOptions) metrics.Provider {
+	p := newProvider(provider, opts)
+	if batchProvider, ok := provider.(metrics.BatchProvider); ok {
+		return &BatchProvider{Provider: p, batchProvider: batchProvider}
+	}
+	return p
+}
+
+func newProvider(provider metrics.Provider, opts config.MetricsQueryOptions) *Provider {
+	clock := clockwork.NewRealClock()
+	return &Provider{
+		provider: provider,
+		opts:     opts,
+		breaker:  newBreaker(opts.BreakerThreshold, opts.BreakerCooldown, clock),
+		time:     clock,
+	}
+}
+
+// withClock updates the clock used for backoffs and the circuit breaker.
+func (p *Provider) withClock(clock clockwork.Clock) *Provider {
+	p.time = clock
+	p.breaker.time = clock
+	return p
+}
+
+// RequestCount returns the number of requests for the given query.
+func (p *Provider) RequestCount(ctx context.Context, query metrics.Query) (count int64, err error) {
+	err = p.call(ctx, "request-count", func(ctx context.Context) error {
+		count, err = p.provider.RequestCount(ctx, query)
+		return err
+	})
+	return count, err
+}
+
+// Latency returns the request latency for the given query.
+func (p *Provider) Latency(ctx context.Context, query metrics.Query) (latency float64, err error) {
+	err = p.call(ctx, "latency", func(ctx context.Context) error {
+		latency, err = p.provider.Latency(ctx, query)
+		return err
+	})
+	return latency, err
+}
+
+// ErrorRate returns the error rate for the given query.
+func (p *Provider) ErrorRate(ctx context.Context, query metrics.Query) (rate float64, err error) {
+	err = p.call(ctx, "error-rate", func(ctx context.Context) error {
+		rate, err = p.provider.ErrorRate(ctx, query)
+		return err
+	})
+	return rate, err
+}
+
+// InstanceCount returns the number of instances for the given query. It returns
+// metrics.ErrNoData if the wrapped provider does not retrieve instance counts.
+func (p *Provider) InstanceCount(ctx context.Context, query metrics.Query) (count int64, err error) {
+	provider, ok := p.provider.(metrics.InstanceCountProvider)
+	if !ok {
+		return 0, errors.Wrap(metrics.ErrNoData, "metrics provider does not retrieve instance counts")
+	}
+	err = p.call(ctx, "instance-count", func(ctx context.Context) error {
+		count, err = provider.InstanceCount(ctx, query)
+		return err
+	})
+	return count, err
+}
+
+// RequestCountByRevision returns the number of requests for every revision in
+// the region.
+func (p *BatchProvider) RequestCountByRevision(ctx context.Context, query metrics.Query) (counts map[metrics.RevisionKey]int64, err error) {
+	err = p.call(ctx, "request-count", func(ctx context.Context) error {
+		counts, err = p.batchProvider.RequestCountByRevision(ctx, query)
+		return err
+	})
+	return counts, err
+}
+
+// LatencyByRevision returns the latency for every revision in the region.
+func (p *BatchProvider) LatencyByRevision(ctx context.Context, query metrics.Query) (latencies map[metrics.RevisionKey]float64, err error) {
+	err = p.call(ctx, "latency", func(ctx context.Context) error {
+		latencies, err = p.batchProvider.LatencyByRevision(ctx, query)
+		return err
+	})
+	return latencies, err
+}
+
+// ErrorRateByRevision returns the error rate for every revision in the region.
+func (p *BatchProvider) ErrorRateByRevision(ctx context.Context, query metrics.Query) (rates map[metrics.RevisionKey]float64, err error) {
+	err = p.call(ctx, "error-rate", func(ctx context.Context) error {
+		rates, err = p.batchProvider.ErrorRateByRevision(ctx, query)
+		return err
+	})
+	return rates, err
+}
+
+// call performs a query with a timeout for every attempt, retrying transient
+// errors with exponential backoff.
+//
+// If the circuit breaker is open or all the attempts failed with transient
+// errors, the returned error wraps metrics.ErrUnavailable.
+func (p *Provider) call(ctx context.Context, metricsName string, fn func(ctx context.Context) error) error {
+	logger := util.LoggerFrom(ctx).WithField("metrics", metricsName)
+	if err := p.breaker.allow(); err != nil {
+		logger.WithError(err).Debug("skipping query to metrics provider")
+		return err
+	}
+
+	backoff := p.opts.RetryBackoff
+	var err error
+	for attempt := 0; attempt <= p.opts.MaxRetries; attempt++ {
+		if attempt > 0 {
+			logger.WithFields(logrus.Fields{"attempt": attempt, "backoff": backoff}).Debug("retrying query to metrics provider")
+			if err := p.wait(ctx, backoff); err != nil {
+				break
+			}
+			backoff *= 2
+		}
+
+		err = p.attempt(ctx, fn)
+		if err == nil || errors.Is(err, metrics.ErrNoData) {
+			p.breaker.success()
+			return err
+		}
+		if ctx.Err() != nil || !isTransient(err) {
+			break
+		}
+		logger.WithError(err).Debug("transient error from metrics provider")
+	}
+
+	p.breaker.failure(err)
+	if isTransient(err) {
+		return errors.Wrapf(metrics.ErrUnavailable, "query failed after %d retries (last error: %v)", p.opts.MaxRetries, err)
+	}
+	return err
+}
+
+// attempt performs a single attempt of a query, applying the timeout if
+// configured.
+func (p *Provider) attempt(ctx context.Context, fn func(ctx context.Context) error) error {
+	if p.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.opts.Timeout)
+		defer cancel()
+	}
+	return fn(ctx)
+}
+
+// wait blocks for the given duration or until the context is done.
+func (p *Provider) wait(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	select {
+	case <-p.time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isTransient determines if an error is worth retrying.
+func isTransient(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= http.StatusInternalServerError
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,174 @@
+package resilient
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics"
+	metricsmock "github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics/mock"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/googleapi"
+)
+
+func TestProvider_Retries(t *testing.T) {
+	tests := []struct {
+		name            string
+		errs            []error
+		expectedCalls   int
+		expectedErr     error
+		shouldBeUnavail bool
+	}{
+		{
+			name:          "success",
+			errs:          []error{nil},
+			expectedCalls: 1,
+		},
+		{
+			name:          "no data is not retried",
+			errs:          []error{metrics.ErrNoData},
+			expectedCalls: 1,
+			expectedErr:   metrics.ErrNoData,
+		},
+		{
+			name: "transient errors are retried",
+			errs: []error{
+				&googleapi.Error{Code: http.StatusServiceUnavailable},
+				&googleapi.Error{Code: http.StatusTooManyRequests},
+				nil,
+			},
+			expectedCalls: 3,
+		},
+		{
+			name: "timeouts are retried",
+			errs: []error{
+				errors.Wrap(context.DeadlineExceeded, "failed to query"),
+				nil,
+			},
+			expectedCalls: 2,
+		},
+		{
+			name:          "non-transient errors are not retried",
+			errs:          []error{&googleapi.Error{Code: http.StatusForbidden}},
+			expectedCalls: 1,
+		},
+		{
+			name: "retries exhausted",
+			errs: []error{
+				&googleapi.Error{Code: http.StatusInternalServerError},
+				&googleapi.Error{Code: http.StatusInternalServerError},
+				&googleapi.Error{Code: http.StatusInternalServerError},
+			},
+			expectedCalls:   3,
+			shouldBeUnavail: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int
+			metricsMock := &metricsmock.Metrics{}
+			metricsMock.ErrorRateFn = func(ctx context.Context, query metrics.Query) (float64, error) {
+				err := test.errs[calls]
+				calls++
+				return 0.01, err
+			}
+
+			opts := config.MetricsQueryOptions{MaxRetries: 2}
+			provider := newProvider(metricsMock, opts)
+			_, err := provider.ErrorRate(context.Background(), metrics.Query{})
+			assert.Equal(t, test.expectedCalls, calls)
+			if test.shouldBeUnavail {
+				assert.True(t, errors.Is(err, metrics.ErrUnavailable))
+				return
+			}
+			if test.expectedErr != nil {
+				assert.Equal(t, test.expectedErr, err)
+				return
+			}
+			if len(test.errs) == test.expectedCalls && test.errs[len(test.errs)-1] == nil {
+				assert.Nil(t, err)
+			} else {
+				assert.NotNil(t, err)
+				assert.False(t, errors.Is(err, metrics.ErrUnavailable))
+			}
+		})
+	}
+}
+
+func TestProvider_Timeout(t *testing.T) {
+	metricsMock := &metricsmock.Metrics{}
+	metricsMock.LatencyFn = func(ctx context.Context, query metrics.Query) (float64, error) {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+
+	opts := config.MetricsQueryOptions{Timeout: time.Millisecond}
+	provider := newProvider(metricsMock, opts)
+	_, err := provider.Latency(context.Background(), metrics.Query{})
+	assert.True(t, errors.Is(err, metrics.ErrUnavailable))
+}
+
+func TestProvider_CircuitBreaker(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	var calls int
+	var fail bool
+	metricsMock := &metricsmock.Metrics{}
+	metricsMock.RequestCountFn = func(ctx context.Context, query metrics.Query) (int64, error) {
+		calls++
+		if fail {
+			return 0, &googleapi.Error{Code: http.StatusBadGateway}
+		}
+		return 100, nil
+	}
+
+	opts := config.MetricsQueryOptions{BreakerThreshold: 2, BreakerCooldown: time.Minute}
+	provider := newProvider(metricsMock, opts).withClock(clock)
+	ctx := context.Background()
+
+	// Two consecutive failures open the breaker.
+	fail = true
+	for i := 0; i < 2; i++ {
+		_, err := provider.RequestCount(ctx, metrics.Query{})
+		assert.NotNil(t, err)
+	}
+	assert.Equal(t, 2, calls)
+
+	// Queries are rejected while the breaker is open.
+	_, err := provider.RequestCount(ctx, metrics.Query{})
+	assert.True(t, errors.Is(err, metrics.ErrUnavailable))
+	assert.Equal(t, 2, calls)
+
+	// After the cooldown, a failed query keeps the breaker open.
+	clock.Advance(time.Minute)
+	_, err = provider.RequestCount(ctx, metrics.Query{})
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, calls)
+	_, err = provider.RequestCount(ctx, metrics.Query{})
+	assert.True(t, errors.Is(err, metrics.ErrUnavailable))
+	assert.Equal(t, 3, calls)
+
+	// A successful query after the cooldown closes the breaker.
+	clock.Advance(time.Minute)
+	fail = false
+	count, err := provider.RequestCount(ctx, metrics.Query{})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), count)
+	_, err = provider.RequestCount(ctx, metrics.Query{})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, calls)
+}
+
+func TestNew_BatchProvider(t *testing.T) {
+	provider := New(&metricsmock.BatchMetrics{}, config.MetricsQueryOptions{})
+	_, ok := provider.(metrics.BatchProvider)
+	assert.True(t, ok)
+
+	provider = New(&metricsmock.Metrics{}, config.MetricsQueryOptions{})
+	_, ok = provider.(metrics.BatchProvider)
+	assert.False(t, ok)
+}
@@ -8,12 +8,19 @@
 //
 // Example
 // us-east1, tester, 1000, 0.01, 1000, 750, 500
+//
+// Optionally, an eighth column can contain the number of responses per response
+// code, which is needed to calculate error rates that do not count 5xx
+// responses as errors (e.g. 4xx rate).
+//
+// Example
+// us-east1, tester, 1000, 0.01, 1000, 750, 500, 200=950 404=40 503=10
 package sheets
 
 import (
 	"context"
 	"strconv"
-	"time"
+	"strings"
 
 	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics"
 	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/util"
@@ -31,19 +38,18 @@ const (
 	colLatencyP99
 	colLatencyP95
 	colLatencyP50
+	colResponseCodes
 )
 
 // Provider is a metrics provider for Google Sheets.
 type Provider struct {
-	client      *sheets.Service
-	sheetsID    string
-	sheetName   string
-	region      string
-	serviceName string
+	client    *sheets.Service
+	sheetsID  string
+	sheetName string
 }
 
 // NewProvider initializes a connection to Google Sheets
-func NewProvider(ctx context.Context, sheetsID, sheetName, region, serviceName string) (*Provider, error) {
+func NewProvider(ctx context.Context, sheetsID, sheetName string) (*Provider, error) {
 	client, err := sheets.NewService(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not initialize Google Sheets client")
@@ -53,34 +59,27 @@ func NewProvider(ctx context.Context, sheetsID, sheetName, region, serviceName s
 	}
 
 	return &Provider{
-		client:      client,
-		sheetsID:    sheetsID,
-		sheetName:   sheetName,
-		region:      region,
-		serviceName: serviceName,
+		client:    client,
+		sheetsID:  sheetsID,
+		sheetName: sheetName,
 	}, nil
 }
 
-// SetCandidateRevision sets the candidate revision name for which the provider
-// should get metrics.
+// RequestCount returns the number of requests for the given query.
 //
-// For Google Sheets, ignore this since the data in the document is always for
-// the candidate revision.
-func (p *Provider) SetCandidateRevision(revisionName string) {}
-
-// RequestCount returns the number of requests for the given offset.
-func (p *Provider) RequestCount(ctx context.Context, offset time.Duration) (int64, error) {
+// For Google Sheets, the revision and window in the query are ignored since the
+// data in the document is always for the candidate revision.
+func (p *Provider) RequestCount(ctx context.Context, query metrics.Query) (int64, error) {
 	logger := util.LoggerFrom(ctx)
 	logger.Debug("querying google sheet for request count")
-	serviceRow, err := p.retrieveServiceRow(logger)
+	serviceRow, err := p.retrieveServiceRow(ctx, logger, query.Region, query.Service)
 	if err != nil {
 		return 0, errors.Wrap(err, "failed to retrieve metrics for the service")
 	}
 
-	col := serviceRow[colRequestCount]
-	requestCount, ok := col.(string)
-	if !ok {
-		return 0, errors.Errorf("invalid request count value, must be a string but has value %v of type %T", col, col)
+	requestCount, err := cellValue(serviceRow, colRequestCount, "request count")
+	if err != nil {
+		return 0, err
 	}
 	value, err := strconv.ParseInt(requestCount, 10, 64)
 	if err != nil {
@@ -89,31 +88,30 @@ func (p *Provider) RequestCount(ctx context.Context, offset time.Duration) (int6
 	return value, nil
 }
 
-// Latency returns the latency for the resource for the given offset.
-func (p *Provider) Latency(ctx context.Context, offset time.Duration, alignReduceType metrics.AlignReduce) (float64, error) {
+// Latency returns the latency for the resource for the given query.
+func (p *Provider) Latency(ctx context.Context, query metrics.Query) (float64, error) {
 	logger := util.LoggerFrom(ctx)
 	logger.Debug("querying google sheet for request count")
-	serviceRow, err := p.retrieveServiceRow(logger)
+	serviceRow, err := p.retrieveServiceRow(ctx, logger, query.Region, query.Service)
 	if err != nil {
 		return 0, errors.Wrap(err, "failed to retrieve metrics for the service")
 	}
 
-	var col interface{}
-	switch alignReduceType {
+	var col int
+	switch query.AlignReduce {
 	case metrics.Align99Reduce99:
-		col = serviceRow[colLatencyP99]
-		break
+		col = colLatencyP99
 	case metrics.Align95Reduce95:
-		col = serviceRow[colLatencyP95]
-		break
+		col = colLatencyP95
 	case metrics.Align50Reduce50:
-		col = serviceRow[colLatencyP50]
-		break
+		col = colLatencyP50
+	default:
+		return 0, errors.Errorf("unsupported aligner and reducer %v", query.AlignReduce)
 	}
 
-	latency, ok := col.(string)
-	if !ok {
-		return 0, errors.Errorf("invalid latency value, must be a string but has value %v of type %T", col, col)
+	latency, err := cellValue(serviceRow, col, "latency")
+	if err != nil {
+		return 0, err
 	}
 	value, err := strconv.ParseFloat(latency, 64)
 	if err != nil {
@@ -122,19 +120,30 @@ func (p *Provider) Latency(ctx context.Context, offset time.Duration, alignReduc
 	return value, nil
 }
 
-// ErrorRate returns the rate of 5xx errors for the resource matching the filter.
-func (p *Provider) ErrorRate(ctx context.Context, offset time.Duration) (float64, error) {
+// ErrorRate returns the rate of errors for the resource matching the query.
+//
+// If the query counts errors the default way (5xx responses), the error rate
+// column is used. Otherwise, the rate is calculated from the number of
+// responses per response code.
+func (p *Provider) ErrorRate(ctx context.Context, query metrics.Query) (float64, error) {
 	logger := util.LoggerFrom(ctx)
 	logger.Debug("querying google sheet for request count")
-	serviceRow, err := p.retrieveServiceRow(logger)
+	serviceRow, err := p.retrieveServiceRow(ctx, logger, query.Region, query.Service)
 	if err != nil {
 		return 0, errors.Wrap(err, "failed to retrieve metrics for the service")
 	}
 
-	col := serviceRow[colErrorRate]
-	errorRate, ok := col.(string)
-	if !ok {
-		return 0, errors.Errorf("invalid error rate value, must be a string but has value %v of type %T", col, col)
+	if !query.HasDefaultErrorResponseCodes() {
+		responseCodes, err := cellValue(serviceRow, colResponseCodes, "response codes")
+		if err != nil {
+			return 0, err
+		}
+		return calculateErrorResponseRate(responseCodes, query)
+	}
+
+	errorRate, err := cellValue(serviceRow, colErrorRate, "error rate")
+	if err != nil {
+		return 0, err
 	}
 	value, err := strconv.ParseFloat(errorRate, 64)
 	if err != nil {
@@ -143,31 +152,75 @@ func (p *Provider) ErrorRate(ctx context.Context, offset time.Duration) (float64
 	return value, nil
 }
 
+// calculateErrorResponseRate calculates the rate of error responses from a list
+// of response counts with the form "200=950 503=10".
+func calculateErrorResponseRate(responseCodes string, query metrics.Query) (float64, error) {
+	var errorResponseCount, totalResponses int64
+	for _, entry := range strings.Fields(responseCodes) {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return 0, errors.Errorf("invalid response code count %q, must have the form code=count", entry)
+		}
+		count, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to parse count for response code %q", parts[0])
+		}
+
+		totalResponses += count
+		if query.IsErrorResponse(parts[0]) {
+			errorResponseCount += count
+		}
+	}
+
+	if totalResponses == 0 {
+		return 0, metrics.ErrNoData
+	}
+	return float64(errorResponseCount) / float64(totalResponses), nil
+}
+
+// cellValue returns the string value of a column in the row.
+//
+// Since the Google Sheets API omits trailing empty cells, a missing or empty
+// cell is reported as metrics.ErrNoData.
+func cellValue(row []interface{}, col int, name string) (string, error) {
+	if col >= len(row) {
+		return "", metrics.ErrNoData
+	}
+	value, ok := row[col].(string)
+	if !ok {
+		return "", errors.Errorf("invalid %s value, must be a string but has value %v of type %T", name, row[col], row[col])
+	}
+	if value == "" {
+		return "", metrics.ErrNoData
+	}
+	return value, nil
+}
+
 // retrieveServiceRow returns the row that contains the information about the
 // service
-func (p *Provider) retrieveServiceRow(logger *logrus.Entry) ([]interface{}, error) {
-	values, err := p.retrieveValues(logger)
+func (p *Provider) retrieveServiceRow(ctx context.Context, logger *logrus.Entry, region, serviceName string) ([]interface{}, error) {
+	values, err := p.retrieveValues(ctx, logger)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to retrieve values")
 	}
 
-	serviceRow, err := p.filterServiceRow(values)
+	serviceRow, err := filterServiceRow(values, region, serviceName)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to filter service row")
 	}
 	if serviceRow == nil {
-		return nil, errors.Errorf("no service matched the query, region=%q service=%q", p.region, p.serviceName)
+		return nil, errors.Errorf("no service matched the query, region=%q service=%q", region, serviceName)
 	}
 	return serviceRow, nil
 }
 
 // retrieveValues get all the metrics values starting at row 2.
-func (p *Provider) retrieveValues(logger *logrus.Entry) ([][]interface{}, error) {
-	readRange := "A2:G"
+func (p *Provider) retrieveValues(ctx context.Context, logger *logrus.Entry) ([][]interface{}, error) {
+	readRange := "A2:H"
 	if p.sheetName != "" {
 		readRange = p.sheetName + "!" + readRange
 	}
-	resp, err := p.client.Spreadsheets.Values.Get(p.sheetsID, readRange).Do()
+	resp, err := p.client.Spreadsheets.Values.Get(p.sheetsID, readRange).Context(ctx).Do()
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to retrieve data from sheet")
 	}
@@ -178,7 +231,7 @@ func (p *Provider) retrieveValues(logger *logrus.Entry) ([][]interface{}, error)
 
 // filterServiceRow returns the first row that matches the region and service
 // name.
-func (p *Provider) filterServiceRow(values [][]interface{}) ([]interface{}, error) {
+func filterServiceRow(values [][]interface{}, wantRegion, wantServiceName string) ([]interface{}, error) {
 	for _, row := range values {
 		col := row[colRegion]
 		region, ok := col.(string)
@@ -190,7 +243,7 @@ func (p *Provider) filterServiceRow(values [][]interface{}) ([]interface{}, erro
 		if !ok {
 			return nil, errors.Errorf("invalid service name value, must be a string but has value %v of type %T", col, col)
 		}
-		if region == p.region && serviceName == p.serviceName {
+		if region == wantRegion && serviceName == wantServiceName {
 			return row, nil
 		}
 	}
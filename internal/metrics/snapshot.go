@@ -0,0 +1,193 @@
+package metrics
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/util"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Metrics kinds in a snapshot.
+const (
+	requestCountKind = "request-count"
+	latencyKind      = "latency"
+	errorRateKind    = "error-rate"
+)
+
+// snapshotKey identifies a batched query in a snapshot.
+type snapshotKey struct {
+	kind        string
+	region      string
+	window      time.Duration
+	alignReduce AlignReduce
+	codes       string
+}
+
+// snapshotResult holds the results of a batched query.
+type snapshotResult struct {
+	counts map[RevisionKey]int64
+	values map[RevisionKey]float64
+	err    error
+}
+
+// snapshotEntry is a batched query in a snapshot. Its result is kept once the
+// query is done.
+type snapshotEntry struct {
+	mu     sync.Mutex
+	done   bool
+	result snapshotResult
+}
+
+// Snapshot is a Provider that serves metrics for individual revisions from
+// batched queries.
+//
+// The first time metrics of a kind are requested for a region and window, a
+// single query retrieves them for all the services and revisions in the region.
+// The results are cached for the lifetime of the snapshot, so a new snapshot
+// should be created for every evaluation cycle.
+type Snapshot struct {
+	// ctx is the context of the evaluation cycle, which the batched queries
+	// run with.
+	ctx      context.Context
+	provider BatchProvider
+
+	mu      sync.Mutex
+	entries map[snapshotKey]*snapshotEntry
+}
+
+// NewSnapshot initializes an empty snapshot on top of the batch provider. The
+// batched queries run with the given context, which should be canceled when
+// the evaluation cycle ends.
+func NewSnapshot(ctx context.Context, provider BatchProvider) *Snapshot {
+	return &Snapshot{
+		ctx:      ctx,
+		provider: provider,
+		entries:  make(map[snapshotKey]*snapshotEntry),
+	}
+}
+
+// RequestCount returns the number of requests for the revision in the query.
+// It returns 0 if the revision had no requests during the window.
+func (s *Snapshot) RequestCount(ctx context.Context, query Query) (int64, error) {
+	if query.Revision == "" {
+		return s.provider.RequestCount(ctx, query)
+	}
+
+	result := s.entry(ctx, requestCountKind, query, func(ctx context.Context) (map[RevisionKey]int64, map[RevisionKey]float64, error) {
+		counts, err := s.provider.RequestCountByRevision(ctx, query)
+		return counts, nil, err
+	})
+	if result.err != nil {
+		return 0, errors.Wrap(result.err, "failed to retrieve batched request count")
+	}
+	return result.counts[revisionKey(query)], nil
+}
+
+// Latency returns the latency for the revision in the query.
+// It returns ErrNoData if the revision had no requests during the window.
+func (s *Snapshot) Latency(ctx context.Context, query Query) (float64, error) {
+	if query.Revision == "" {
+		return s.provider.Latency(ctx, query)
+	}
+
+	result := s.entry(ctx, latencyKind, query, func(ctx context.Context) (map[RevisionKey]int64, map[RevisionKey]float64, error) {
+		values, err := s.provider.LatencyByRevision(ctx, query)
+		return nil, values, err
+	})
+	if result.err != nil {
+		return 0, errors.Wrap(result.err, "failed to retrieve batched latency")
+	}
+	return result.value(query)
+}
+
+// ErrorRate returns the error rate for the revision in the query.
+// It returns ErrNoData if the revision had no requests during the window.
+func (s *Snapshot) ErrorRate(ctx context.Context, query Query) (float64, error) {
+	if query.Revision == "" {
+		return s.provider.ErrorRate(ctx, query)
+	}
+
+	result := s.entry(ctx, errorRateKind, query, func(ctx context.Context) (map[RevisionKey]int64, map[RevisionKey]float64, error) {
+		values, err := s.provider.ErrorRateByRevision(ctx, query)
+		return nil, values, err
+	})
+	if result.err != nil {
+		return 0, errors.Wrap(result.err, "failed to retrieve batched error rate")
+	}
+	return result.value(query)
+}
+
+// InstanceCount returns the number of instances for the revision in the query.
+// Instance counts are not batched. It returns ErrNoData if the batch provider
+// does not retrieve them.
+func (s *Snapshot) InstanceCount(ctx context.Context, query Query) (int64, error) {
+	provider, ok := s.provider.(InstanceCountProvider)
+	if !ok {
+		return 0, errors.Wrap(ErrNoData, "metrics provider does not retrieve instance counts")
+	}
+	return provider.InstanceCount(ctx, query)
+}
+
+// entry returns the result of the snapshot entry for the query, running the
+// batched query if this is the first time the entry is requested.
+//
+// Concurrent callers requesting the same entry wait for a single batched
+// query to finish. The query is shared by all of them, so it runs with the
+// context of the snapshot rather than the one of the caller that happens to run
+// it: if that caller was canceled, the query would fail for the others too.
+// Timeouts and cancellations are not kept, so the query is run again by the
+// next caller.
+func (s *Snapshot) entry(ctx context.Context, kind string, query Query, fetch func(ctx context.Context) (map[RevisionKey]int64, map[RevisionKey]float64, error)) snapshotResult {
+	key := snapshotKey{kind: kind, region: query.Region, window: query.Window}
+	switch kind {
+	case latencyKind:
+		key.alignReduce = query.AlignReduce
+	case errorRateKind:
+		key.codes = strings.Join(query.ErrorResponseCodes, ",") + ";" + strings.Join(query.ExcludedResponseCodes, ",")
+	}
+
+	s.mu.Lock()
+	entry, ok := s.entries[key]
+	if !ok {
+		entry = &snapshotEntry{}
+		s.entries[key] = entry
+	}
+	s.mu.Unlock()
+
+	logger := util.LoggerFrom(ctx).WithFields(logrus.Fields{
+		"metrics": kind,
+		"region":  query.Region,
+	})
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.done {
+		logger.Debug("using metrics from snapshot")
+		return entry.result
+	}
+
+	logger.Debug("running batched metrics query")
+	var result snapshotResult
+	result.counts, result.values, result.err = fetch(util.ContextWithLogger(s.ctx, logger))
+	entry.result = result
+	entry.done = !errors.Is(result.err, context.Canceled) && !errors.Is(result.err, context.DeadlineExceeded)
+	return result
+}
+
+// value returns the value for the revision in the query or ErrNoData if the
+// batched results do not include the revision.
+func (r snapshotResult) value(query Query) (float64, error) {
+	value, ok := r.values[revisionKey(query)]
+	if !ok {
+		return 0, ErrNoData
+	}
+	return value, nil
+}
+
+// revisionKey returns the key of the revision in the query.
+func revisionKey(query Query) RevisionKey {
+	return RevisionKey{Service: query.Service, Revision: query.Revision}
+}
@@ -0,0 +1,154 @@
+package metrics_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics"
+	metricsmock "github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics/mock"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	provider := &metricsmock.BatchMetrics{}
+	provider.RequestCountByRevisionFn = func(ctx context.Context, query metrics.Query) (map[metrics.RevisionKey]int64, error) {
+		return map[metrics.RevisionKey]int64{
+			{Service: "svc1", Revision: "svc1-002"}: 1000,
+			{Service: "svc2", Revision: "svc2-005"}: 50,
+		}, nil
+	}
+	provider.LatencyByRevisionFn = func(ctx context.Context, query metrics.Query) (map[metrics.RevisionKey]float64, error) {
+		latency := 500.0
+		if query.AlignReduce == metrics.Align50Reduce50 {
+			latency = 100
+		}
+		return map[metrics.RevisionKey]float64{
+			{Service: "svc1", Revision: "svc1-002"}: latency,
+		}, nil
+	}
+	provider.ErrorRateByRevisionFn = func(ctx context.Context, query metrics.Query) (map[metrics.RevisionKey]float64, error) {
+		return nil, errors.New("failed to query")
+	}
+
+	ctx := context.Background()
+	snapshot := metrics.NewSnapshot(context.Background(), provider)
+	window := 30 * time.Minute
+	svc1 := metrics.Query{Region: "us-east1", Service: "svc1", Revision: "svc1-002", Window: window}
+	svc2 := metrics.Query{Region: "us-east1", Service: "svc2", Revision: "svc2-005", Window: window}
+	svc3 := metrics.Query{Region: "us-east1", Service: "svc3", Revision: "svc3-001", Window: window}
+
+	// Concurrent requests for the same region and window share the query.
+	var wg sync.WaitGroup
+	counts := make([]int64, 3)
+	for i, query := range []metrics.Query{svc1, svc2, svc3} {
+		wg.Add(1)
+		go func(i int, query metrics.Query) {
+			defer wg.Done()
+			count, err := snapshot.RequestCount(ctx, query)
+			assert.Nil(t, err)
+			counts[i] = count
+		}(i, query)
+	}
+	wg.Wait()
+	assert.Equal(t, []int64{1000, 50, 0}, counts)
+	assert.Equal(t, 1, provider.RequestCountByRevisionInvoked)
+
+	// A different window requires a new query.
+	other := svc1
+	other.Window = time.Hour
+	_, err := snapshot.RequestCount(ctx, other)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, provider.RequestCountByRevisionInvoked)
+
+	// Latency is cached per aligner and reducer.
+	svc1.AlignReduce = metrics.Align99Reduce99
+	latency, err := snapshot.Latency(ctx, svc1)
+	assert.Nil(t, err)
+	assert.Equal(t, 500.0, latency)
+	svc1.AlignReduce = metrics.Align50Reduce50
+	latency, err = snapshot.Latency(ctx, svc1)
+	assert.Nil(t, err)
+	assert.Equal(t, 100.0, latency)
+	_, err = snapshot.Latency(ctx, svc1)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, provider.LatencyByRevisionInvoked)
+
+	// Revisions not in the batched results have no data.
+	svc2.AlignReduce = metrics.Align50Reduce50
+	_, err = snapshot.Latency(ctx, svc2)
+	assert.Equal(t, metrics.ErrNoData, err)
+	assert.Equal(t, 2, provider.LatencyByRevisionInvoked)
+
+	// Errors are cached as well.
+	_, err = snapshot.ErrorRate(ctx, svc1)
+	assert.NotNil(t, err)
+	_, err = snapshot.ErrorRate(ctx, svc2)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, provider.ErrorRateByRevisionInvoked)
+}
+
+func TestSnapshot_ServiceQuery(t *testing.T) {
+	provider := &metricsmock.BatchMetrics{}
+	provider.RequestCountFn = func(ctx context.Context, query metrics.Query) (int64, error) {
+		return 2000, nil
+	}
+
+	snapshot := metrics.NewSnapshot(context.Background(), provider)
+	count, err := snapshot.RequestCount(context.Background(), metrics.Query{Region: "us-east1", Service: "svc1"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2000), count)
+	assert.True(t, provider.RequestCountInvoked)
+	assert.Equal(t, 0, provider.RequestCountByRevisionInvoked)
+}
+
+// TestSnapshot_Context tests that the batched query does not depend on the
+// context of the caller that runs it and that timeouts are not kept.
+func TestSnapshot_Context(t *testing.T) {
+	provider := &metricsmock.BatchMetrics{}
+	provider.RequestCountByRevisionFn = func(ctx context.Context, query metrics.Query) (map[metrics.RevisionKey]int64, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if provider.RequestCountByRevisionInvoked == 1 {
+			return nil, errors.Wrap(context.DeadlineExceeded, "query timed out")
+		}
+		return map[metrics.RevisionKey]int64{{Service: "svc1", Revision: "svc1-002"}: 1000}, nil
+	}
+
+	snapshot := metrics.NewSnapshot(context.Background(), provider)
+	query := metrics.Query{Region: "us-east1", Service: "svc1", Revision: "svc1-002", Window: 30 * time.Minute}
+
+	// The first query times out, so it is run again by the next caller.
+	_, err := snapshot.RequestCount(context.Background(), query)
+	assert.NotNil(t, err)
+
+	// The caller was canceled, but the query still runs for the others.
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	count, err := snapshot.RequestCount(canceled, query)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1000), count)
+
+	count, err = snapshot.RequestCount(context.Background(), query)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1000), count)
+	assert.Equal(t, 2, provider.RequestCountByRevisionInvoked)
+}
+
+// TestSnapshot_CycleContext tests that the batched queries end with the
+// context of the snapshot.
+func TestSnapshot_CycleContext(t *testing.T) {
+	provider := &metricsmock.BatchMetrics{}
+	provider.RequestCountByRevisionFn = func(ctx context.Context, query metrics.Query) (map[metrics.RevisionKey]int64, error) {
+		return nil, ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	snapshot := metrics.NewSnapshot(ctx, provider)
+	_, err := snapshot.RequestCount(context.Background(), metrics.Query{Region: "us-east1", Service: "svc1", Revision: "svc1-002"})
+	assert.True(t, errors.Is(err, context.Canceled))
+}
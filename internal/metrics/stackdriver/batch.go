@@ -0,0 +1,165 @@
+package stackdriver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/util"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	monitoring "google.golang.org/api/monitoring/v3"
+)
+
+// Labels used to group time series by revision.
+const (
+	serviceNameLabel  = "service_name"
+	revisionNameLabel = "revision_name"
+)
+
+// RequestCountByRevision returns the number of requests for every revision in
+// the region.
+func (p *Provider) RequestCountByRevision(ctx context.Context, q metrics.Query) (map[metrics.RevisionKey]int64, error) {
+	filter := newRegionQuery(p.project, q.Region).addFilter("metric.type", requestCount)
+	logger := util.LoggerFrom(ctx).WithField("metrics", "request-count")
+	timeSeries, err := p.listTimeSeriesByRevision(ctx, logger, filter, q.Window, "ALIGN_DELTA", "REDUCE_SUM")
+	if err != nil {
+		return nil, errors.Wrap(err, "error when querying for time series")
+	}
+
+	counts := make(map[metrics.RevisionKey]int64)
+	for _, series := range timeSeries {
+		if len(series.Points) == 0 {
+			continue
+		}
+		counts[revisionKeyFromSeries(series)] = *(series.Points[0].Value.Int64Value)
+	}
+	return counts, nil
+}
+
+// LatencyByRevision returns the latency for every revision in the region.
+func (p *Provider) LatencyByRevision(ctx context.Context, q metrics.Query) (map[metrics.RevisionKey]float64, error) {
+	filter := newRegionQuery(p.project, q.Region).addFilter("metric.type", requestLatencies)
+	aligner, reducer := alignerAndReducer(q.AlignReduce)
+	logger := util.LoggerFrom(ctx).WithFields(logrus.Fields{
+		"metrics": "latency",
+		"aligner": aligner,
+		"reducer": reducer,
+	})
+	timeSeries, err := p.listTimeSeriesByRevision(ctx, logger, filter, q.Window, aligner, reducer)
+	if err != nil {
+		return nil, errors.Wrap(err, "error when querying for time series")
+	}
+
+	latencies := make(map[metrics.RevisionKey]float64)
+	for _, series := range timeSeries {
+		if len(series.Points) == 0 {
+			continue
+		}
+		latencies[revisionKeyFromSeries(series)] = *(series.Points[0].Value.DoubleValue)
+	}
+	return latencies, nil
+}
+
+// ErrorRateByRevision returns the rate of errors for every revision in the
+// region.
+func (p *Provider) ErrorRateByRevision(ctx context.Context, q metrics.Query) (map[metrics.RevisionKey]float64, error) {
+	filter := newRegionQuery(p.project, q.Region).addFilter("metric.type", requestCount)
+	logger := util.LoggerFrom(ctx).WithField("metrics", "error-rate")
+	timeSeries, err := p.listTimeSeriesByRevision(ctx, logger, filter, q.Window, "ALIGN_DELTA", "REDUCE_SUM", "metric.labels."+responseCodeLabel)
+	if err != nil {
+		return nil, errors.Wrap(err, "error when querying for time series")
+	}
+
+	seriesByRevision := make(map[metrics.RevisionKey][]*monitoring.TimeSeries)
+	for _, series := range timeSeries {
+		if len(series.Points) == 0 {
+			continue
+		}
+		key := revisionKeyFromSeries(series)
+		seriesByRevision[key] = append(seriesByRevision[key], series)
+	}
+
+	rates := make(map[metrics.RevisionKey]float64)
+	for key, series := range seriesByRevision {
+		rate, err := calculateErrorResponseRate(series, q)
+		if err == metrics.ErrNoData {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to calculate error rate for revision %q", key.Revision)
+		}
+		rates[key] = rate
+	}
+	return rates, nil
+}
+
+// listTimeSeriesByRevision retrieves all the pages of time series that match
+// the filter, aggregated per service and revision (and any additional group by
+// field).
+func (p *Provider) listTimeSeriesByRevision(ctx context.Context, logger *logrus.Entry, filter query, window time.Duration, aligner, reducer string, groupBy ...string) ([]*monitoring.TimeSeries, error) {
+	endTime := time.Now()
+	endTimeString := endTime.Format(time.RFC3339Nano)
+	startTime := endTime.Add(-1 * window)
+	startTimeString := startTime.Format(time.RFC3339Nano)
+	offsetString := fmt.Sprintf("%fs", window.Seconds())
+
+	groupBy = append([]string{
+		"resource.labels." + serviceNameLabel,
+		"resource.labels." + revisionNameLabel,
+	}, groupBy...)
+	req := p.metricsClient.Projects.TimeSeries.List("projects/" + p.project).
+		Filter(string(filter)).
+		IntervalStartTime(startTimeString).
+		IntervalEndTime(endTimeString).
+		AggregationAlignmentPeriod(offsetString).
+		AggregationPerSeriesAligner(aligner).
+		AggregationGroupByFields(groupBy...).
+		AggregationCrossSeriesReducer(reducer)
+
+	logger = logger.WithFields(logrus.Fields{
+		"intervalStartTime": startTimeString,
+		"intervalEndTime":   endTimeString,
+	})
+	logger.Debug("querying Cloud Monitoring API for all revisions")
+
+	var timeSeries []*monitoring.TimeSeries
+	err := req.Pages(ctx, func(resp *monitoring.ListTimeSeriesResponse) error {
+		if len(resp.ExecutionErrors) != 0 {
+			for _, execError := range resp.ExecutionErrors {
+				logger.WithField("message", execError.Message).Warn("execution error occurred")
+			}
+			return errors.Errorf("execution errors occurred")
+		}
+		timeSeries = append(timeSeries, resp.TimeSeries...)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error when retrieving time series")
+	}
+
+	logger.WithField("n", len(timeSeries)).Debug("finished retrieving time series")
+	return timeSeries, nil
+}
+
+// revisionKeyFromSeries returns the revision that a time series aggregated by
+// service and revision belongs to.
+func revisionKeyFromSeries(series *monitoring.TimeSeries) metrics.RevisionKey {
+	var labels map[string]string
+	if series.Resource != nil {
+		labels = series.Resource.Labels
+	}
+	return metrics.RevisionKey{
+		Service:  labels[serviceNameLabel],
+		Revision: labels[revisionNameLabel],
+	}
+}
+
+// newRegionQuery initializes a query to filter the metrics for all the
+// services in a region.
+func newRegionQuery(project, region string) query {
+	var q query
+	return q.addFilter("resource.labels.project_id", project).
+		addFilter("resource.labels.location", region)
+}
@@ -19,22 +19,27 @@ import (
 type query string
 
 // Provider is a metrics provider for Cloud Monitoring.
+//
+// It does not hold any state about the resource being queried, so it can be
+// used concurrently for different services and revisions in the project.
 type Provider struct {
 	metricsClient *monitoring.Service
 	project       string
-
-	// query is used to filter the metrics for the wanted resource.
-	query
 }
 
 // Metric types.
 const (
 	requestLatencies = "run.googleapis.com/request_latencies"
 	requestCount     = "run.googleapis.com/request_count"
+	instanceCount    = "run.googleapis.com/container/instance_count"
 )
 
+// responseCodeLabel is the label of the request count metrics with the HTTP
+// response code.
+const responseCodeLabel = "response_code"
+
 // NewProvider initializes the provider for Cloud Monitoring.
-func NewProvider(ctx context.Context, project string, region string, serviceName string) (*Provider, error) {
+func NewProvider(ctx context.Context, project string) (*Provider, error) {
 	client, err := monitoring.NewService(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not initialize Cloud Metics client")
@@ -43,24 +48,17 @@ func NewProvider(ctx context.Context, project string, region string, serviceName
 	return &Provider{
 		metricsClient: client,
 		project:       project,
-		query:         newQuery(project, region, serviceName),
 	}, nil
 }
 
-// SetCandidateRevision sets the candidate revision name for which the provider
-// should get metrics.
-func (p *Provider) SetCandidateRevision(revisionName string) {
-	p.query = p.query.addFilter("resource.labels.revision_name", revisionName)
-}
-
-// RequestCount count returns the number of requests for the given offset.
-func (p *Provider) RequestCount(ctx context.Context, offset time.Duration) (int64, error) {
-	query := p.addFilter("metric.type", requestCount)
+// RequestCount count returns the number of requests for the given query.
+func (p *Provider) RequestCount(ctx context.Context, q metrics.Query) (int64, error) {
+	query := newQuery(p.project, q).addFilter("metric.type", requestCount)
 	endTime := time.Now()
 	endTimeString := endTime.Format(time.RFC3339Nano)
-	startTime := endTime.Add(-1 * offset)
+	startTime := endTime.Add(-1 * q.Window)
 	startTimeString := startTime.Format(time.RFC3339Nano)
-	offsetString := fmt.Sprintf("%fs", offset.Seconds())
+	offsetString := fmt.Sprintf("%fs", q.Window.Seconds())
 
 	req := p.metricsClient.Projects.TimeSeries.List("projects/" + p.project).
 		Filter(string(query)).
@@ -77,7 +75,7 @@ func (p *Provider) RequestCount(ctx context.Context, offset time.Duration) (int6
 		"metrics":           "request-count",
 	})
 	logger.Debug("querying Cloud Monitoring API")
-	timeSeries, err := makeRequestForTimeSeries(logger, req)
+	timeSeries, err := makeRequestForTimeSeries(ctx, logger, req)
 	if err != nil {
 		return 0, errors.Wrap(err, "error when querying for time series")
 	}
@@ -90,21 +88,21 @@ func (p *Provider) RequestCount(ctx context.Context, offset time.Duration) (int6
 	// series and a point is returned. There's no need for a loop.
 	series := timeSeries[0]
 	if len(series.Points) == 0 {
-		return 0, errors.New("no data point was retrieved")
+		return 0, errors.Wrap(metrics.ErrNoData, "no data point was retrieved")
 	}
 	return *(series.Points[0].Value.Int64Value), nil
 }
 
-// Latency returns the latency for the resource for the given offset.
-// It returns 0 if no request was made during the interval.
-func (p *Provider) Latency(ctx context.Context, offset time.Duration, alignReduceType metrics.AlignReduce) (float64, error) {
-	query := p.query.addFilter("metric.type", requestLatencies)
+// Latency returns the latency for the resource for the given query.
+// It returns metrics.ErrNoData if no request was made during the interval.
+func (p *Provider) Latency(ctx context.Context, q metrics.Query) (float64, error) {
+	query := newQuery(p.project, q).addFilter("metric.type", requestLatencies)
 	endTime := time.Now()
 	endTimeString := endTime.Format(time.RFC3339Nano)
-	startTime := endTime.Add(-1 * offset)
+	startTime := endTime.Add(-1 * q.Window)
 	startTimeString := startTime.Format(time.RFC3339Nano)
-	aligner, reducer := alignerAndReducer(alignReduceType)
-	offsetString := fmt.Sprintf("%fs", offset.Seconds())
+	aligner, reducer := alignerAndReducer(q.AlignReduce)
+	offsetString := fmt.Sprintf("%fs", q.Window.Seconds())
 
 	req := p.metricsClient.Projects.TimeSeries.List("projects/" + p.project).
 		Filter(string(query)).
@@ -123,33 +121,33 @@ func (p *Provider) Latency(ctx context.Context, offset time.Duration, alignReduc
 		"reducer":           reducer,
 	})
 	logger.Debug("querying Cloud Monitoring API")
-	timeSeries, err := makeRequestForTimeSeries(logger, req)
+	timeSeries, err := makeRequestForTimeSeries(ctx, logger, req)
 	if err != nil {
 		return 0, errors.Wrap(err, "error when querying for time series")
 	}
 
 	// This happens when no request was made during the given offset.
 	if len(timeSeries) == 0 {
-		return 0, nil
+		return 0, metrics.ErrNoData
 	}
 	// The request count is aggregated for the entire service, so only one time
 	// series and a point is returned. There's no need for a loop.
 	series := timeSeries[0]
 	if len(series.Points) == 0 {
-		return 0, errors.New("no data point was retrieved")
+		return 0, errors.Wrap(metrics.ErrNoData, "no data point was retrieved")
 	}
 	return *(series.Points[0].Value.DoubleValue), nil
 }
 
-// ErrorRate returns the rate of 5xx errors for the resource in the given offset.
-// It returns 0 if no request was made during the interval.
-func (p *Provider) ErrorRate(ctx context.Context, offset time.Duration) (float64, error) {
-	query := p.query.addFilter("metric.type", requestCount)
+// ErrorRate returns the rate of errors for the resource in the given query.
+// It returns metrics.ErrNoData if no request was made during the interval.
+func (p *Provider) ErrorRate(ctx context.Context, q metrics.Query) (float64, error) {
+	query := newQuery(p.project, q).addFilter("metric.type", requestCount)
 	endTime := time.Now()
 	endTimeString := endTime.Format(time.RFC3339Nano)
-	startTime := endTime.Add(-1 * offset)
+	startTime := endTime.Add(-1 * q.Window)
 	startTimeString := startTime.Format(time.RFC3339Nano)
-	offsetString := fmt.Sprintf("%fs", offset.Seconds())
+	offsetString := fmt.Sprintf("%fs", q.Window.Seconds())
 
 	req := p.metricsClient.Projects.TimeSeries.List("projects/" + p.project).
 		Filter(string(query)).
@@ -157,7 +155,7 @@ func (p *Provider) ErrorRate(ctx context.Context, offset time.Duration) (float64
 		IntervalEndTime(endTimeString).
 		AggregationAlignmentPeriod(offsetString).
 		AggregationPerSeriesAligner("ALIGN_DELTA").
-		AggregationGroupByFields("metric.labels.response_code_class").
+		AggregationGroupByFields("metric.labels." + responseCodeLabel).
 		AggregationCrossSeriesReducer("REDUCE_SUM")
 
 	logger := util.LoggerFrom(ctx).WithFields(logrus.Fields{
@@ -166,20 +164,59 @@ func (p *Provider) ErrorRate(ctx context.Context, offset time.Duration) (float64
 		"metrics":           "error-rate",
 	})
 	logger.Debug("querying Cloud Monitoring API")
-	timeSeries, err := makeRequestForTimeSeries(logger, req)
+	timeSeries, err := makeRequestForTimeSeries(ctx, logger, req)
 	if err != nil {
 		return 0, errors.Wrap(err, "error when querying for time series")
 	}
 
 	// This happens when no request was made during the given offset.
 	if len(timeSeries) == 0 {
+		return 0, metrics.ErrNoData
+	}
+	return calculateErrorResponseRate(timeSeries, q)
+}
+
+// InstanceCount returns the maximum number of instances of the revision in the
+// given query during the window, which is 0 if there were none.
+func (p *Provider) InstanceCount(ctx context.Context, q metrics.Query) (int64, error) {
+	query := newQuery(p.project, q).addFilter("metric.type", instanceCount)
+	endTime := time.Now()
+	endTimeString := endTime.Format(time.RFC3339Nano)
+	startTime := endTime.Add(-1 * q.Window)
+	startTimeString := startTime.Format(time.RFC3339Nano)
+	offsetString := fmt.Sprintf("%fs", q.Window.Seconds())
+
+	// The instances are counted by state (active or idle), so the maximum of
+	// every state is added.
+	req := p.metricsClient.Projects.TimeSeries.List("projects/" + p.project).
+		Filter(string(query)).
+		IntervalStartTime(startTimeString).
+		IntervalEndTime(endTimeString).
+		AggregationAlignmentPeriod(offsetString).
+		AggregationPerSeriesAligner("ALIGN_MAX").
+		AggregationGroupByFields("resource.labels.service_name").
+		AggregationCrossSeriesReducer("REDUCE_SUM")
+
+	logger := util.LoggerFrom(ctx).WithFields(logrus.Fields{
+		"intervalStartTime": startTimeString,
+		"intervalEndTime":   endTimeString,
+		"metrics":           "instance-count",
+	})
+	logger.Debug("querying Cloud Monitoring API")
+	timeSeries, err := makeRequestForTimeSeries(ctx, logger, req)
+	if err != nil {
+		return 0, errors.Wrap(err, "error when querying for time series")
+	}
+
+	// Instances are only reported while they exist.
+	if len(timeSeries) == 0 || len(timeSeries[0].Points) == 0 {
 		return 0, nil
 	}
-	return calculateErrorResponseRate(timeSeries)
+	return *(timeSeries[0].Points[0].Value.Int64Value), nil
 }
 
-func makeRequestForTimeSeries(logger *logrus.Entry, req *monitoring.ProjectsTimeSeriesListCall) ([]*monitoring.TimeSeries, error) {
-	resp, err := req.Do()
+func makeRequestForTimeSeries(ctx context.Context, logger *logrus.Entry, req *monitoring.ProjectsTimeSeriesListCall) ([]*monitoring.TimeSeries, error) {
+	resp, err := req.Context(ctx).Do()
 	if err != nil {
 		return nil, errors.Wrap(err, "error when retrieving time series")
 	}
@@ -193,27 +230,29 @@ func makeRequestForTimeSeries(logger *logrus.Entry, req *monitoring.ProjectsTime
 	return resp.TimeSeries, nil
 }
 
-// calculateErrorResponseRate calculates the percentage of 5xx error response.
+// calculateErrorResponseRate calculates the percentage of error responses.
 //
 // It gets all the server responses and calculates the error rate by performing
-// the operation (5xx responses / all responses). Then, it divides the number of
-// error responses by the total.
-func calculateErrorResponseRate(timeSeries []*monitoring.TimeSeries) (float64, error) {
+// the operation (error responses / all responses). Then, it divides the number
+// of error responses by the total. The query determines which response codes
+// are errors.
+//
+// If there are no responses at all, metrics.ErrNoData is returned.
+func calculateErrorResponseRate(timeSeries []*monitoring.TimeSeries, q metrics.Query) (float64, error) {
 	var errorResponseCount, totalResponses int64
 	for _, series := range timeSeries {
 		// Because the interval and the series aligner are the same, only one
 		// point is returned per time series.
-		switch series.Metric.Labels["response_code_class"] {
-		case "5xx":
+		if q.IsErrorResponse(series.Metric.Labels[responseCodeLabel]) {
 			errorResponseCount += *(series.Points[0].Value.Int64Value)
-		default:
+		} else {
 			totalResponses += *(series.Points[0].Value.Int64Value)
 		}
 	}
 
 	totalResponses += errorResponseCount
 	if totalResponses == 0 {
-		return 0, nil
+		return 0, metrics.ErrNoData
 	}
 
 	rate := float64(errorResponseCount) / float64(totalResponses)
@@ -236,12 +275,17 @@ func alignerAndReducer(alignReduceType metrics.AlignReduce) (aligner string, red
 	return
 }
 
-// newQuery initializes a query.
-func newQuery(project, region, serviceName string) query {
+// newQuery initializes a query to filter the metrics for the resource in the
+// metrics query.
+func newQuery(project string, mq metrics.Query) query {
 	var q query
-	return q.addFilter("resource.labels.project_id", project).
-		addFilter("resource.labels.location", region).
-		addFilter("resource.labels.service_name", serviceName)
+	q = q.addFilter("resource.labels.project_id", project).
+		addFilter("resource.labels.location", mq.Region).
+		addFilter("resource.labels.service_name", mq.Service)
+	if mq.Revision != "" {
+		q = q.addFilter("resource.labels.revision_name", mq.Revision)
+	}
+	return q
 }
 
 // addFilter adds a filter to the query.
@@ -3,7 +3,10 @@ package stackdriver
 import (
 	"testing"
 
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics"
+
 	"github.com/stretchr/testify/assert"
+	monitoring "google.golang.org/api/monitoring/v3"
 )
 
 func TestQuery_addFilter(t *testing.T) {
@@ -37,3 +40,93 @@ func TestQuery_addFilter(t *testing.T) {
 		})
 	}
 }
+
+func TestNewQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    metrics.Query
+		expected string
+	}{
+		{
+			name:  "service",
+			query: metrics.Query{Region: "us-east1", Service: "mysvc"},
+			expected: `resource.labels.project_id="myproject" AND ` +
+				`resource.labels.location="us-east1" AND ` +
+				`resource.labels.service_name="mysvc"`,
+		},
+		{
+			name:  "revision",
+			query: metrics.Query{Region: "us-east1", Service: "mysvc", Revision: "mysvc-002"},
+			expected: `resource.labels.project_id="myproject" AND ` +
+				`resource.labels.location="us-east1" AND ` +
+				`resource.labels.service_name="mysvc" AND ` +
+				`resource.labels.revision_name="mysvc-002"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := newQuery("myproject", test.query)
+			assert.Equal(t, test.expected, string(q))
+		})
+	}
+}
+
+func TestCalculateErrorResponseRate(t *testing.T) {
+	timeSeries := []*monitoring.TimeSeries{
+		responseCodeSeries("200", 900),
+		responseCodeSeries("404", 40),
+		responseCodeSeries("429", 10),
+		responseCodeSeries("500", 20),
+		responseCodeSeries("503", 30),
+	}
+
+	tests := []struct {
+		name       string
+		timeSeries []*monitoring.TimeSeries
+		query      metrics.Query
+		expected   float64
+		noData     bool
+	}{
+		{
+			name:       "default response codes",
+			timeSeries: timeSeries,
+			expected:   0.05,
+		},
+		{
+			name:       "custom response codes",
+			timeSeries: timeSeries,
+			query:      metrics.Query{ErrorResponseCodes: []string{"5xx", "429"}, ExcludedResponseCodes: []string{"503"}},
+			expected:   0.03,
+		},
+		{
+			name:       "4xx responses",
+			timeSeries: timeSeries,
+			query:      metrics.Query{ErrorResponseCodes: []string{"4xx"}},
+			expected:   0.05,
+		},
+		{
+			name:   "no responses",
+			noData: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rate, err := calculateErrorResponseRate(test.timeSeries, test.query)
+			if test.noData {
+				assert.Equal(t, metrics.ErrNoData, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.InDelta(t, test.expected, rate, 1e-9)
+		})
+	}
+}
+
+func responseCodeSeries(code string, count int64) *monitoring.TimeSeries {
+	return &monitoring.TimeSeries{
+		Metric: &monitoring.Metric{Labels: map[string]string{responseCodeLabel: code}},
+		Points: []*monitoring.Point{{Value: &monitoring.TypedValue{Int64Value: &count}}},
+	}
+}
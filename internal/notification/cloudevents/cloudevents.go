@@ -0,0 +1,230 @@
+// Package cloudevents sends rollout notifications to HTTP endpoints as
+// CloudEvents 1.0 (see https://cloudevents.io), so they can be consumed by
+// event routers and other CloudEvents tooling.
+//
+// The events are sent in the structured or the binary content mode of the HTTP
+// protocol binding. In both modes, the data of an event is the JSON encoding of
+// Data, whose schema only changes in backwards-compatible ways unless its
+// version is increased.
+package cloudevents
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification/webhook"
+	"github.com/pkg/errors"
+)
+
+// SpecVersion is the version of the CloudEvents specification of the events.
+const SpecVersion = "1.0"
+
+// DataVersion is the version of the schema of Data.
+const DataVersion = 1
+
+// Event types.
+const (
+	// TypeProgressed means the candidate received more traffic.
+	TypeProgressed = "run.rollout.progressed"
+
+	// TypeRolledBack means all the traffic was sent back to the stable
+	// revision.
+	TypeRolledBack = "run.rollout.rolledback"
+
+	// TypePromoted means the candidate became the stable revision.
+	TypePromoted = "run.rollout.promoted"
+
+	// TypeCandidateDetected means a new candidate was detected.
+	TypeCandidateDetected = "run.rollout.candidatedetected"
+
+	// TypeBlocked means the candidate is healthy, but its rollout cannot
+	// progress yet.
+	TypeBlocked = "run.rollout.blocked"
+
+	// TypeInconclusive means the candidate's health has been inconclusive for
+	// a number of consecutive evaluations.
+	TypeInconclusive = "run.rollout.inconclusive"
+
+	// TypeSkipped means the latest revision is not rolled out because it was
+	// rolled back before.
+	TypeSkipped = "run.rollout.skipped"
+)
+
+// Mode is a content mode of the HTTP protocol binding.
+type Mode string
+
+// Content modes.
+const (
+	// ModeStructured sends the whole event as the JSON body of the request.
+	ModeStructured Mode = "structured"
+
+	// ModeBinary sends the attributes of the event as ce-* headers and the
+	// data as the body of the request.
+	ModeBinary Mode = "binary"
+)
+
+// ParseMode parses a content mode.
+func ParseMode(value string) (Mode, error) {
+	switch mode := Mode(value); mode {
+	case ModeStructured, ModeBinary:
+		return mode, nil
+	default:
+		return "", errors.Errorf("invalid content mode %q, must be %s or %s", value, ModeStructured, ModeBinary)
+	}
+}
+
+// Event is a CloudEvent in its JSON format.
+type Event struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject,omitempty"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            Data      `json:"data"`
+}
+
+// Data is the data of a rollout event.
+type Data struct {
+	Version int    `json:"version"`
+	Project string `json:"project"`
+	Region  string `json:"region"`
+	Service string `json:"service"`
+
+	Candidate Candidate `json:"candidate"`
+	Stable    string    `json:"stable,omitempty"`
+
+	// Result is the diagnosis of the candidate's health and Reason explains
+	// it if available.
+	Result   string                   `json:"result"`
+	Reason   string                   `json:"reason,omitempty"`
+	Criteria []health.CriterionReport `json:"criteria,omitempty"`
+	Progress *health.ProgressReport   `json:"progress,omitempty"`
+
+	// EventReason explains why a blocked, inconclusive or skipped event was
+	// sent.
+	EventReason string `json:"eventReason,omitempty"`
+}
+
+// Candidate is the candidate revision of a rollout event.
+type Candidate struct {
+	Name string `json:"name"`
+	URL  string `json:"url,omitempty"`
+
+	// PreviousPercent is the candidate's traffic percentage before the event
+	// and Percent is the one after it.
+	PreviousPercent int64 `json:"previousPercent"`
+	Percent         int64 `json:"percent"`
+}
+
+// NewEvent returns the CloudEvent of a rollout notification. The CloudEvent has
+// the ID of the notification.
+func NewEvent(event notification.Event) (Event, error) {
+	if event.ID == "" {
+		return Event{}, errors.New("notification has no ID")
+	}
+
+	report := event.Report
+	return Event{
+		SpecVersion: SpecVersion,
+		ID:          event.ID,
+		// The source is the resource name of the service.
+		Source:          fmt.Sprintf("//run.googleapis.com/projects/%s/locations/%s/services/%s", event.Project, event.Region, event.Service),
+		Type:            eventType(event.Type),
+		Subject:         report.Candidate,
+		Time:            event.Time,
+		DataContentType: "application/json",
+		Data: Data{
+			Version: DataVersion,
+			Project: event.Project,
+			Region:  event.Region,
+			Service: event.Service,
+			Candidate: Candidate{
+				Name:            report.Candidate,
+				URL:             event.CandidateURL,
+				PreviousPercent: report.TrafficPercent,
+				Percent:         report.NewTrafficPercent,
+			},
+			Stable:      report.Stable,
+			Result:      report.Result,
+			Reason:      report.Reason,
+			Criteria:    report.Criteria,
+			Progress:    report.Progress,
+			EventReason: event.Reason,
+		},
+	}, nil
+}
+
+// eventType returns the CloudEvent type of a notification type.
+func eventType(t notification.EventType) string {
+	switch t {
+	case notification.EventRollback:
+		return TypeRolledBack
+	case notification.EventPromotion:
+		return TypePromoted
+	case notification.EventCandidate:
+		return TypeCandidateDetected
+	case notification.EventBlocked:
+		return TypeBlocked
+	case notification.EventInconclusive:
+		return TypeInconclusive
+	case notification.EventSkipped:
+		return TypeSkipped
+	default:
+		return TypeProgressed
+	}
+}
+
+// Sink sends the notifications to an HTTP endpoint as CloudEvents.
+type Sink struct {
+	httpClient *http.Client
+	url        string
+	mode       Mode
+	timeout    time.Duration
+}
+
+// New returns a sink that sends the notifications to the URL with the HTTP
+// client in the given content mode. If timeout is 0, webhook.DefaultTimeout is
+// used.
+func New(httpClient *http.Client, url string, mode Mode, timeout time.Duration) *Sink {
+	if timeout == 0 {
+		timeout = webhook.DefaultTimeout
+	}
+	return &Sink{httpClient: httpClient, url: url, mode: mode, timeout: timeout}
+}
+
+// Notify sends the CloudEvent of the notification to the endpoint.
+func (s *Sink) Notify(ctx context.Context, event notification.Event) error {
+	ce, err := NewEvent(event)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	var body []byte
+	if s.mode == ModeBinary {
+		header.Set("Content-Type", ce.DataContentType)
+		header.Set("ce-specversion", ce.SpecVersion)
+		header.Set("ce-id", ce.ID)
+		header.Set("ce-source", ce.Source)
+		header.Set("ce-type", ce.Type)
+		if ce.Subject != "" {
+			header.Set("ce-subject", ce.Subject)
+		}
+		header.Set("ce-time", ce.Time.Format(time.RFC3339Nano))
+		body, err = json.Marshal(ce.Data)
+	} else {
+		header.Set("Content-Type", "application/cloudevents+json")
+		body, err = json.Marshal(ce)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal event")
+	}
+	return webhook.Post(ctx, s.httpClient, s.url, s.timeout, header, body)
+}
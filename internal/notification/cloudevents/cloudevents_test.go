@@ -0,0 +1,140 @@
+package cloudevents_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification/cloudevents"
+	"github.com/stretchr/testify/assert"
+)
+
+var testTime = time.Date(2020, 8, 13, 19, 35, 10, 0, time.UTC)
+
+func testEvent(eventType notification.EventType) notification.Event {
+	return notification.Event{
+		ID:           "3f2b8c1e9d4a7f6b0c5e2a1d8b9f4e7c",
+		Type:         eventType,
+		Project:      "myproject",
+		Region:       "us-east1",
+		Service:      "hello",
+		CandidateURL: "https://candidate---hello-abcdefgh-ue.a.run.app",
+		Report: health.Report{
+			Version:           1,
+			Result:            "healthy",
+			Criteria:          []health.CriterionReport{{Metric: "error-rate-percent", Threshold: 1, ActualValue: 0.1, Met: true}},
+			Candidate:         "hello-002",
+			Stable:            "hello-001",
+			TrafficPercent:    20,
+			NewTrafficPercent: 50,
+			Decision:          "roll forward",
+		},
+		Time: testTime,
+	}
+}
+
+func TestNewEvent(t *testing.T) {
+	tests := []struct {
+		eventType notification.EventType
+		expected  string
+	}{
+		{eventType: notification.EventRollout, expected: cloudevents.TypeProgressed},
+		{eventType: notification.EventRollback, expected: cloudevents.TypeRolledBack},
+		{eventType: notification.EventPromotion, expected: cloudevents.TypePromoted},
+		{eventType: notification.EventCandidate, expected: cloudevents.TypeCandidateDetected},
+		{eventType: notification.EventBlocked, expected: cloudevents.TypeBlocked},
+		{eventType: notification.EventInconclusive, expected: cloudevents.TypeInconclusive},
+		{eventType: notification.EventSkipped, expected: cloudevents.TypeSkipped},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.eventType), func(t *testing.T) {
+			event, err := cloudevents.NewEvent(testEvent(test.eventType))
+			assert.Nil(t, err)
+			assert.Equal(t, cloudevents.Event{
+				SpecVersion:     "1.0",
+				ID:              "3f2b8c1e9d4a7f6b0c5e2a1d8b9f4e7c",
+				Source:          "//run.googleapis.com/projects/myproject/locations/us-east1/services/hello",
+				Type:            test.expected,
+				Subject:         "hello-002",
+				Time:            testTime,
+				DataContentType: "application/json",
+				Data: cloudevents.Data{
+					Version: cloudevents.DataVersion,
+					Project: "myproject",
+					Region:  "us-east1",
+					Service: "hello",
+					Candidate: cloudevents.Candidate{
+						Name:            "hello-002",
+						URL:             "https://candidate---hello-abcdefgh-ue.a.run.app",
+						PreviousPercent: 20,
+						Percent:         50,
+					},
+					Stable:   "hello-001",
+					Result:   "healthy",
+					Criteria: []health.CriterionReport{{Metric: "error-rate-percent", Threshold: 1, ActualValue: 0.1, Met: true}},
+				},
+			}, event)
+		})
+	}
+}
+
+func TestSink_Notify(t *testing.T) {
+	var (
+		header http.Header
+		body   []byte
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		assert.Nil(t, err)
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	t.Run("structured", func(t *testing.T) {
+		sink := cloudevents.New(srv.Client(), srv.URL, cloudevents.ModeStructured, time.Second)
+		assert.Nil(t, sink.Notify(ctx, testEvent(notification.EventRollback)))
+		assert.Equal(t, "application/cloudevents+json", header.Get("Content-Type"))
+		assert.Empty(t, header.Get("ce-type"))
+
+		var event map[string]interface{}
+		assert.Nil(t, json.Unmarshal(body, &event))
+		assert.Equal(t, "1.0", event["specversion"])
+		assert.Equal(t, cloudevents.TypeRolledBack, event["type"])
+		assert.Equal(t, "2020-08-13T19:35:10Z", event["time"])
+		assert.Equal(t, "hello-002", event["data"].(map[string]interface{})["candidate"].(map[string]interface{})["name"])
+	})
+
+	t.Run("binary", func(t *testing.T) {
+		sink := cloudevents.New(srv.Client(), srv.URL, cloudevents.ModeBinary, time.Second)
+		assert.Nil(t, sink.Notify(ctx, testEvent(notification.EventPromotion)))
+		assert.Equal(t, "application/json", header.Get("Content-Type"))
+		assert.Equal(t, "1.0", header.Get("ce-specversion"))
+		assert.NotEmpty(t, header.Get("ce-id"))
+		assert.Equal(t, "//run.googleapis.com/projects/myproject/locations/us-east1/services/hello", header.Get("ce-source"))
+		assert.Equal(t, cloudevents.TypePromoted, header.Get("ce-type"))
+		assert.Equal(t, "hello-002", header.Get("ce-subject"))
+		assert.Equal(t, "2020-08-13T19:35:10Z", header.Get("ce-time"))
+
+		var data cloudevents.Data
+		assert.Nil(t, json.Unmarshal(body, &data))
+		assert.Equal(t, "hello", data.Service)
+		assert.Equal(t, int64(50), data.Candidate.Percent)
+	})
+}
+
+func TestParseMode(t *testing.T) {
+	mode, err := cloudevents.ParseMode("binary")
+	assert.Nil(t, err)
+	assert.Equal(t, cloudevents.ModeBinary, mode)
+	_, err = cloudevents.ParseMode("batched")
+	assert.NotNil(t, err)
+}
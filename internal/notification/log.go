@@ -0,0 +1,42 @@
+package notification
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LogSink writes the notifications to the logs as structured entries.
+type LogSink struct {
+	logger *logrus.Logger
+}
+
+// NewLogSink returns a sink that writes the notifications with the logger.
+func NewLogSink(logger *logrus.Logger) *LogSink {
+	return &LogSink{logger: logger}
+}
+
+// Notify writes the event to the logs.
+func (s *LogSink) Notify(ctx context.Context, event Event) error {
+	fields := logrus.Fields{
+		"event":             event.Type,
+		"project":           event.Project,
+		"region":            event.Region,
+		"service":           event.Service,
+		"candidate":         event.Report.Candidate,
+		"stable":            event.Report.Stable,
+		"trafficPercent":    event.Report.TrafficPercent,
+		"newTrafficPercent": event.Report.NewTrafficPercent,
+		"result":            event.Report.Result,
+	}
+	if event.Reason != "" {
+		fields["reason"] = event.Reason
+	} else if event.Report.Reason != "" {
+		fields["reason"] = event.Report.Reason
+	}
+	if event.Report.Progress != nil {
+		fields["progress"] = event.Report.Progress.String()
+	}
+	s.logger.WithFields(fields).Info("rollout event")
+	return nil
+}
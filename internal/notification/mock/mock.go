@@ -0,0 +1,19 @@
+package mock
+
+import (
+	"context"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification"
+)
+
+// Notifier is a mock implementation of notification.Notifier.
+type Notifier struct {
+	NotifyFn      func(ctx context.Context, event notification.Event) error
+	NotifyInvoked bool
+}
+
+// Notify invokes the mock implementation and marks the function as invoked.
+func (n *Notifier) Notify(ctx context.Context, event notification.Event) error {
+	n.NotifyInvoked = true
+	return n.NotifyFn(ctx, event)
+}
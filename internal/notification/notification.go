@@ -0,0 +1,226 @@
+// Package notification sends notifications about the rollouts of the services
+// to sinks such as Pub/Sub topics, HTTP webhooks or the logs.
+package notification
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/util"
+	"github.com/pkg/errors"
+	"google.golang.org/api/run/v1"
+)
+
+// EventType is the type of a rollout event.
+type EventType string
+
+// Event types.
+const (
+	// EventRollout means the candidate received more traffic.
+	EventRollout EventType = "rollout"
+
+	// EventRollback means all the traffic was sent back to the stable
+	// revision.
+	EventRollback EventType = "rollback"
+
+	// EventPromotion means the candidate became the stable revision.
+	EventPromotion EventType = "promotion"
+
+	// EventCandidate means a new candidate was detected. It is sent before the
+	// rollout event of its first traffic.
+	EventCandidate EventType = "candidate"
+
+	// EventBlocked means the candidate is healthy, but its rollout cannot
+	// progress yet. The reason of the event tells why. ReasonMinWait is the
+	// only reason: approvals are not required for the steps and there are no
+	// freeze windows, so they never block a rollout.
+	EventBlocked EventType = "blocked"
+
+	// EventInconclusive means the candidate's health has been inconclusive for
+	// a number of consecutive evaluations.
+	EventInconclusive EventType = "inconclusive"
+
+	// EventSkipped means the latest revision is not rolled out because it was
+	// rolled back before.
+	EventSkipped EventType = "skipped"
+)
+
+// EventTypes are all the event types.
+var EventTypes = []EventType{EventRollout, EventRollback, EventPromotion, EventCandidate, EventBlocked, EventInconclusive, EventSkipped}
+
+// ReasonMinWait is the reason of a blocked event when not enough time has
+// elapsed since the candidate's traffic last increased.
+const ReasonMinWait = "min-wait"
+
+// ParseEventTypes parses event types separated by commas.
+func ParseEventTypes(value string) ([]EventType, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var types []EventType
+	for _, name := range strings.Split(value, ",") {
+		eventType := EventType(name)
+		if !isEventType(eventType) {
+			return nil, errors.Errorf("invalid event type %q", name)
+		}
+		types = append(types, eventType)
+	}
+	return types, nil
+}
+
+func isEventType(eventType EventType) bool {
+	for _, t := range EventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is a notification about the rollout of a service.
+type Event struct {
+	// ID identifies the event, so the consumers can detect duplicates. An
+	// event sent again keeps its ID.
+	ID      string    `json:"id"`
+	Type    EventType `json:"type"`
+	Project string    `json:"project"`
+	Region  string    `json:"region"`
+	Service string    `json:"service"`
+
+	// CandidateURL is the URL of the candidate's tag.
+	CandidateURL string `json:"candidateURL,omitempty"`
+
+	// Reason explains why a blocked, inconclusive or skipped event was sent.
+	Reason string `json:"reason,omitempty"`
+
+	// Report is the JSON health report of the evaluation of the candidate,
+	// which includes the revisions, the traffic and the progress.
+	Report health.Report `json:"report"`
+	Time   time.Time     `json:"time"`
+
+	// ServiceObject is the service after the update and Diagnosis is the
+	// result of the evaluation of the candidate.
+	ServiceObject *run.Service           `json:"-"`
+	Diagnosis     health.DiagnosisResult `json:"-"`
+
+	// SentTo are the names of the sinks that already received the event, so
+	// Fanout does not send it to them again.
+	SentTo []string `json:"-"`
+}
+
+// NewEventID returns a random ID for an event.
+func NewEventID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Notifier sends notifications.
+type Notifier interface {
+	Notify(ctx context.Context, event Event) error
+}
+
+// Sink is a destination of notifications.
+type Sink struct {
+	// Name identifies the sink in logs and errors.
+	Name     string
+	Notifier Notifier
+
+	// Types are the event types sent to the sink, all of them if empty.
+	Types []EventType
+}
+
+// accepts determines if the event type is sent to the sink.
+func (s Sink) accepts(eventType EventType) bool {
+	if len(s.Types) == 0 {
+		return true
+	}
+	for _, t := range s.Types {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// FanoutError is the error of a notification that could not be sent to some
+// of the sinks.
+type FanoutError struct {
+	// SentTo are the names of the sinks that received the event, including the
+	// ones that had already received it.
+	SentTo []string
+
+	errs []string
+}
+
+func (e *FanoutError) Error() string {
+	return fmt.Sprintf("failed to send notification to %d sinks: %s", len(e.errs), strings.Join(e.errs, "; "))
+}
+
+// Fanout sends every notification to multiple sinks.
+type Fanout struct {
+	sinks []Sink
+}
+
+// NewFanout returns a notifier that sends the notifications to the sinks.
+func NewFanout(sinks ...Sink) *Fanout {
+	return &Fanout{sinks: sinks}
+}
+
+// Notify concurrently sends the event to the sinks that accept its type and
+// waits for them. Every sink applies its own timeout, so a sink that is down
+// delays the rollout for at most its timeout. The sinks in the event's SentTo
+// are skipped.
+//
+// A sink failing does not prevent the others from receiving the event. If any
+// of them fails, a *FanoutError with the errors of all the sinks that failed
+// and the sinks that received the event is returned.
+func (f *Fanout) Notify(ctx context.Context, event Event) error {
+	logger := util.LoggerFrom(ctx)
+	sent := make(map[string]bool)
+	for _, name := range event.SentTo {
+		sent[name] = true
+	}
+	var (
+		errs   []string
+		sentTo = append([]string(nil), event.SentTo...)
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+	)
+	for _, sink := range f.sinks {
+		if !sink.accepts(event.Type) || sent[sink.Name] {
+			continue
+		}
+
+		wg.Add(1)
+		go func(sink Sink) {
+			defer wg.Done()
+			err := sink.Notifier.Notify(ctx, event)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				logger.WithError(err).WithField("sink", sink.Name).Debug("failed to send notification")
+				errs = append(errs, fmt.Sprintf("%s: %v", sink.Name, err))
+				return
+			}
+			sentTo = append(sentTo, sink.Name)
+		}(sink)
+	}
+	wg.Wait()
+
+	if len(errs) != 0 {
+		sort.Strings(sentTo)
+		return &FanoutError{SentTo: sentTo, errs: errs}
+	}
+	return nil
+}
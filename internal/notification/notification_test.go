@@ -0,0 +1,127 @@
+package notification_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification/mock"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEventTypes(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected []notification.EventType
+		err      bool
+	}{
+		{value: "", expected: nil},
+		{value: "rollback", expected: []notification.EventType{notification.EventRollback}},
+		{value: "rollout,promotion", expected: []notification.EventType{notification.EventRollout, notification.EventPromotion}},
+		{value: "rollout,unknown", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			types, err := notification.ParseEventTypes(test.value)
+			if test.err {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, types)
+		})
+	}
+}
+
+func TestNewEventID(t *testing.T) {
+	id, err := notification.NewEventID()
+	assert.Nil(t, err)
+	assert.Len(t, id, 32)
+	other, err := notification.NewEventID()
+	assert.Nil(t, err)
+	assert.NotEqual(t, id, other)
+}
+
+func TestFanout(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received []string
+	)
+	sink := func(name string, err error, types ...notification.EventType) notification.Sink {
+		notifier := &mock.Notifier{}
+		notifier.NotifyFn = func(ctx context.Context, event notification.Event) error {
+			mu.Lock()
+			defer mu.Unlock()
+			received = append(received, name)
+			return err
+		}
+		return notification.Sink{Name: name, Notifier: notifier, Types: types}
+	}
+
+	fanout := notification.NewFanout(
+		sink("all", nil),
+		sink("failing", errors.New("connection refused")),
+		sink("rollbacks", nil, notification.EventRollback),
+	)
+
+	err := fanout.Notify(context.Background(), notification.Event{Type: notification.EventRollout})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "failing: connection refused")
+	assert.ElementsMatch(t, []string{"all", "failing"}, received)
+
+	fanoutErr, ok := err.(*notification.FanoutError)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"all"}, fanoutErr.SentTo)
+
+	received = nil
+	err = fanout.Notify(context.Background(), notification.Event{Type: notification.EventRollback})
+	assert.NotNil(t, err)
+	assert.ElementsMatch(t, []string{"all", "failing", "rollbacks"}, received)
+
+	// The sinks that already received the event are skipped.
+	received = nil
+	err = fanout.Notify(context.Background(), notification.Event{Type: notification.EventRollback, SentTo: []string{"all"}})
+	assert.NotNil(t, err)
+	assert.ElementsMatch(t, []string{"failing", "rollbacks"}, received)
+	assert.Equal(t, []string{"all", "rollbacks"}, err.(*notification.FanoutError).SentTo)
+}
+
+func TestLogSink(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+
+	sink := notification.NewLogSink(logger)
+	err := sink.Notify(context.Background(), notification.Event{
+		Type:    notification.EventRollback,
+		Project: "myproject",
+		Region:  "us-east1",
+		Service: "hello",
+		Report: health.Report{
+			Result:            "unhealthy",
+			Candidate:         "hello-002",
+			Stable:            "hello-001",
+			TrafficPercent:    20,
+			NewTrafficPercent: 0,
+		},
+	})
+	assert.Nil(t, err)
+
+	var entry map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "rollout event", entry["msg"])
+	assert.Equal(t, "rollback", entry["event"])
+	assert.Equal(t, "hello", entry["service"])
+	assert.Equal(t, "hello-002", entry["candidate"])
+	assert.Equal(t, "unhealthy", entry["result"])
+	assert.Equal(t, float64(20), entry["trafficPercent"])
+	assert.NotContains(t, entry, "progress")
+}
@@ -0,0 +1,129 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Entry is an event waiting in the outbox to be published.
+type Entry struct {
+	ID          string          `json:"id"`
+	OrderingKey string          `json:"orderingKey"`
+	Data        json.RawMessage `json:"data"`
+	CreatedAt   time.Time       `json:"createdAt"`
+}
+
+// Outbox keeps the events that were not published yet in a JSON file, so they
+// are retried even if the process restarts.
+//
+// It holds a limited number of events. When it is full, the oldest events are
+// dropped.
+type Outbox struct {
+	path string
+	size int
+	mu   sync.Mutex
+}
+
+// NewOutbox initializes an outbox that keeps at most size events in the file
+// at the given path. The file is created when the first event is added.
+func NewOutbox(path string, size int) *Outbox {
+	return &Outbox{path: path, size: size}
+}
+
+// Add adds an event to the outbox and returns the number of events that were
+// dropped to make room for it. If the outbox has an event with the same ID, it
+// is replaced and keeps its place.
+func (o *Outbox) Add(entry Entry) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	entries, err := o.read()
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range entries {
+		if entries[i].ID == entry.ID {
+			entries[i] = entry
+			return 0, o.write(entries)
+		}
+	}
+	entries = append(entries, entry)
+	var dropped int
+	if len(entries) > o.size {
+		dropped = len(entries) - o.size
+		entries = entries[dropped:]
+	}
+	return dropped, o.write(entries)
+}
+
+// Entries returns the events in the outbox, from the oldest to the newest.
+func (o *Outbox) Entries() ([]Entry, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.read()
+}
+
+// Remove removes the events with the given IDs from the outbox.
+func (o *Outbox) Remove(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	entries, err := o.read()
+	if err != nil {
+		return err
+	}
+
+	removed := make(map[string]bool)
+	for _, id := range ids {
+		removed[id] = true
+	}
+	var kept []Entry
+	for _, entry := range entries {
+		if !removed[entry.ID] {
+			kept = append(kept, entry)
+		}
+	}
+	return o.write(kept)
+}
+
+// read returns the events in the file.
+func (o *Outbox) read() ([]Entry, error) {
+	data, err := ioutil.ReadFile(o.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read outbox")
+	}
+
+	var entries []Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode outbox %s", o.path)
+	}
+	return entries, nil
+}
+
+// write replaces the events in the file.
+func (o *Outbox) write(entries []Entry) error {
+	if entries == nil {
+		entries = []Entry{}
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode outbox")
+	}
+	// Write to a temporary file first so a crash does not corrupt the outbox.
+	tmp := o.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrap(err, "failed to write outbox")
+	}
+	return errors.Wrap(os.Rename(tmp, o.path), "failed to replace outbox file")
+}
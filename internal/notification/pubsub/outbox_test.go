@@ -0,0 +1,60 @@
+package pubsub_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification/pubsub"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "outbox.json")
+
+	outbox := pubsub.NewOutbox(path, 2)
+	entries, err := outbox.Entries()
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+
+	for _, id := range []string{"1", "2", "3"} {
+		_, err := outbox.Add(pubsub.Entry{ID: id, OrderingKey: "hello/us-east1", Data: json.RawMessage(`{}`)})
+		assert.Nil(t, err)
+	}
+
+	// The oldest event was dropped, and the events are kept across instances.
+	entries, err = pubsub.NewOutbox(path, 2).Entries()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"2", "3"}, entryIDs(entries))
+
+	dropped, err := outbox.Add(pubsub.Entry{ID: "4", Data: json.RawMessage(`{}`)})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, dropped)
+
+	// An event with the same ID replaces the one in the outbox.
+	dropped, err = outbox.Add(pubsub.Entry{ID: "3", Data: json.RawMessage(`{"retried":true}`)})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, dropped)
+	entries, err = outbox.Entries()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"3", "4"}, entryIDs(entries))
+	assert.Equal(t, json.RawMessage(`{"retried":true}`), entries[0].Data)
+
+	assert.Nil(t, outbox.Remove([]string{"4", "unknown"}))
+	entries, err = outbox.Entries()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"3"}, entryIDs(entries))
+}
+
+func entryIDs(entries []pubsub.Entry) []string {
+	var ids []string
+	for _, entry := range entries {
+		ids = append(ids, entry.ID)
+	}
+	return ids
+}
@@ -3,14 +3,19 @@ package pubsub
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/url"
 	"regexp"
+	"sync"
+	"time"
 
 	cloudpubsub "cloud.google.com/go/pubsub"
 	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification"
 	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/util"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/api/option"
 	"google.golang.org/api/run/v1"
 )
 
@@ -20,14 +25,43 @@ const (
 	rollbackEvent = "rollback"
 )
 
-// Client represents a client to Google Cloud Pub/Sub.
-type Client interface {
-	Publish(ctx context.Context, event RolloutEvent) error
-}
+// DefaultTimeout is the maximum time to wait for an event to be published if no
+// timeout is given. Notifications are sent while the rollout waits for them, so
+// publishing always has a deadline.
+const DefaultTimeout = 10 * time.Second
+
+// EventIDAttribute is the message attribute with the ID of the event. An event
+// might be published more than once, so consumers can use it to detect
+// duplicates.
+const EventIDAttribute = "eventId"
 
 // PubSub is a Google Cloud Pub/Sub client to publish messages.
+//
+// The events of a service are published in order, using the service name and
+// region as ordering key.
 type PubSub struct {
-	topic *cloudpubsub.Topic
+	topic   *cloudpubsub.Topic
+	timeout time.Duration
+	outbox  *Outbox
+
+	// publishing holds the IDs of the events of the outbox that are being
+	// published, so concurrent calls do not publish them twice.
+	publishing map[string]bool
+	mu         sync.Mutex
+}
+
+// Options configures how the events are published.
+type Options struct {
+	// Timeout is the maximum time to wait for an event to be published. If it
+	// is 0, DefaultTimeout is used.
+	Timeout time.Duration
+
+	// OutboxPath is the file where the events are kept until they are
+	// published, so the ones that failed are retried. Empty to not retry them.
+	OutboxPath string
+
+	// OutboxSize is the maximum number of events in the outbox.
+	OutboxSize int
 }
 
 // RolloutEvent is the format of an event published to Pub/Sub.
@@ -38,27 +72,46 @@ type RolloutEvent struct {
 	CandidateRevisionURL         string       `json:"candidateRevisionURL"`
 	CandidateWasPromotedToStable bool         `json:"candidateWasPromotedToStable"`
 	Service                      *run.Service `json:"service"`
+	Region                       string       `json:"region"`
+
+	// Reason explains why a blocked, inconclusive or skipped event was
+	// published.
+	Reason string `json:"reason,omitempty"`
+
+	// Progress is how far along the rollout of the candidate is. It is not
+	// set once the candidate was rolled back or promoted.
+	Progress *health.ProgressReport `json:"progress,omitempty"`
 }
 
 // New initializes a PubSub client to a topic in a project.
-func New(ctx context.Context, projectID string, topicName string) (ps PubSub, err error) {
+func New(ctx context.Context, projectID string, topicName string, opts Options, clientOpts ...option.ClientOption) (*PubSub, error) {
 	logger := util.LoggerFrom(ctx)
-	client, err := cloudpubsub.NewClient(ctx, projectID)
+	client, err := cloudpubsub.NewClient(ctx, projectID, clientOpts...)
 	if err != nil {
-		return ps, errors.Wrap(err, "failed to initialize Pub/Sub client")
+		return nil, errors.Wrap(err, "failed to initialize Pub/Sub client")
 	}
 
 	match := regexp.MustCompile(`projects/([^/]*)/topics/([^/]*)`).FindStringSubmatch(topicName)
 	if len(match) != 3 {
-		return ps, errors.Errorf("invalid topic name %s", topicName)
+		return nil, errors.Errorf("invalid topic name %s", topicName)
 	}
 	project := match[1]
 	topicID := match[2]
 	logger.WithFields(logrus.Fields{"topicProject": project, "topicID": topicID}).Debug("parsed pubsub topic configuration")
 
-	return PubSub{
-		topic: client.TopicInProject(topicID, project),
-	}, nil
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	ps := &PubSub{
+		topic:      client.TopicInProject(topicID, project),
+		timeout:    opts.Timeout,
+		publishing: make(map[string]bool),
+	}
+	ps.topic.EnableMessageOrdering = true
+	if opts.OutboxPath != "" {
+		ps.outbox = NewOutbox(opts.OutboxPath, opts.OutboxSize)
+	}
+	return ps, nil
 }
 
 // NewRolloutEvent initializes an event to publish to PubSub.
@@ -92,18 +145,120 @@ func NewRolloutEvent(svc *run.Service, diagnosis health.DiagnosisResult, candida
 	}, nil
 }
 
-// Publish publishes message to the topic.
-func (ps PubSub) Publish(ctx context.Context, event RolloutEvent) error {
+// Publish publishes message to the topic with the given event ID and waits
+// until it is published.
+//
+// If there is an outbox, the event is added to it and only this event is
+// published, so the events that failed before are left to Retry. If the event
+// is not published, it stays in the outbox to be retried. It is not published
+// either if an earlier event of the same service is still in the outbox, since
+// it would be published out of order. An event published again with the same
+// ID replaces the one in the outbox.
+func (ps *PubSub) Publish(ctx context.Context, id string, event RolloutEvent) error {
 	data, err := json.Marshal(event)
 	if err != nil {
 		return errors.Wrap(err, "failed to marshal message")
 	}
+	entry := Entry{ID: id, OrderingKey: orderingKey(event), Data: data, CreatedAt: time.Now().UTC()}
 
-	logger := util.LoggerFrom(ctx)
-	ps.topic.Publish(ctx, &cloudpubsub.Message{
-		Data: data,
-	})
-	logger.WithField("size", len(data)).Debug("event published to Pub/Sub")
+	logger := util.LoggerFrom(ctx).WithField("eventId", id)
+	if ps.outbox == nil {
+		return errors.Wrap(ps.publish(ctx, []Entry{entry})[id], "failed to publish event")
+	}
+
+	dropped, err := ps.outbox.Add(entry)
+	if err != nil {
+		// The event can still be published, but it is not retried.
+		logger.WithError(err).Warn("failed to add event to the outbox")
+		return errors.Wrap(ps.publish(ctx, []Entry{entry})[id], "failed to publish event")
+	}
+	if dropped > 0 {
+		logger.WithField("dropped", dropped).Warn("outbox is full, dropped the oldest events")
+	}
+
+	entries, err := ps.outbox.Entries()
+	if err != nil {
+		return err
+	}
+	if len(ps.claim(entries, map[string]bool{id: true})) == 0 {
+		return errors.New("an earlier event of the service was not published yet or the event is being published, the event will be retried")
+	}
+	defer ps.release([]Entry{entry})
+	if err := ps.publish(ctx, []Entry{entry})[id]; err != nil {
+		return errors.Wrap(err, "failed to publish event, it will be retried")
+	}
+	if err := ps.outbox.Remove([]string{id}); err != nil {
+		// The event is published again by the next retry.
+		logger.WithError(err).Warn("failed to remove published event from the outbox")
+	}
+	return nil
+}
+
+// Notify publishes the rollout event of a notification with the ID of the
+// notification. It makes PubSub a notification sink.
+//
+// The events about changes in the traffic are published as created by
+// NewRolloutEvent. The other ones have their type as event and describe the
+// candidate from the report, since the candidate might not be tagged (e.g. a
+// skipped revision).
+func (ps *PubSub) Notify(ctx context.Context, event notification.Event) error {
+	if event.ID == "" {
+		return errors.New("notification has no ID")
+	}
+	var rolloutEvent RolloutEvent
+	switch event.Type {
+	case notification.EventRollout, notification.EventRollback, notification.EventPromotion:
+		var err error
+		rolloutEvent, err = NewRolloutEvent(event.ServiceObject, event.Diagnosis, event.Type == notification.EventPromotion)
+		if err != nil {
+			return errors.Wrap(err, "failed to create rollout event")
+		}
+	default:
+		rolloutEvent = RolloutEvent{
+			Event:                    string(event.Type),
+			CandidateRevisionName:    event.Report.Candidate,
+			CandidateRevisionPercent: int(event.Report.NewTrafficPercent),
+			CandidateRevisionURL:     event.CandidateURL,
+			Service:                  event.ServiceObject,
+		}
+	}
+	rolloutEvent.Region = event.Region
+	rolloutEvent.Progress = event.Report.Progress
+	rolloutEvent.Reason = event.Reason
+	return ps.Publish(ctx, event.ID, rolloutEvent)
+}
+
+// Retry publishes the events in the outbox that were not published yet and
+// removes the ones that were published. It is meant to be called once per
+// rollout cycle. It returns an error if any of them could not be published.
+//
+// The events that are being published by another call are skipped, along with
+// the later events of the same services.
+func (ps *PubSub) Retry(ctx context.Context) error {
+	if ps.outbox == nil {
+		return nil
+	}
+	entries, err := ps.outbox.Entries()
+	if err != nil {
+		return err
+	}
+	claimed := ps.claim(entries, nil)
+	defer ps.release(claimed)
+	errs := ps.publish(ctx, claimed)
+
+	var published []string
+	for _, entry := range claimed {
+		if _, ok := errs[entry.ID]; !ok {
+			published = append(published, entry.ID)
+		}
+	}
+	if err := ps.outbox.Remove(published); err != nil {
+		// The events are published again on the next retry.
+		util.LoggerFrom(ctx).WithError(err).Warn("failed to remove published events from the outbox")
+	}
+	if len(errs) != 0 {
+		return errors.Errorf("failed to publish %d events, they will be retried", len(errs))
+	}
 	return nil
 }
 
@@ -112,10 +267,87 @@ func (ps PubSub) Publish(ctx context.Context, event RolloutEvent) error {
 // It sends all remaining published messages and stop goroutines created for
 // handling publishing. Returns once all outstanding messages have been sent or
 // have failed to be sent.
-func (ps PubSub) Stop() {
+func (ps *PubSub) Stop() {
 	ps.topic.Stop()
 }
 
+// claim marks as being published the entries with the given IDs (all of them
+// if ids is nil) that can be published now, and returns them.
+//
+// An entry cannot be published while another call publishes it, or if an
+// earlier entry with the same ordering key is in the outbox and is not claimed
+// with it, since the events would be published out of order. entries are the
+// events in the outbox, from the oldest to the newest.
+func (ps *PubSub) claim(entries []Entry, ids map[string]bool) []Entry {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var claimed []Entry
+	blocked := make(map[string]bool)
+	for _, entry := range entries {
+		if blocked[entry.OrderingKey] || ps.publishing[entry.ID] || (ids != nil && !ids[entry.ID]) {
+			blocked[entry.OrderingKey] = true
+			continue
+		}
+		ps.publishing[entry.ID] = true
+		claimed = append(claimed, entry)
+	}
+	return claimed
+}
+
+// release unmarks the entries as being published.
+func (ps *PubSub) release(entries []Entry) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, entry := range entries {
+		delete(ps.publishing, entry.ID)
+	}
+}
+
+// publish publishes the events and waits for the results. It returns the
+// errors of the events that were not published, indexed by event ID.
+//
+// If an event is not published, the next events with the same ordering key are
+// not published either, so publishing is resumed for that key.
+func (ps *PubSub) publish(ctx context.Context, entries []Entry) map[string]error {
+	logger := util.LoggerFrom(ctx)
+	ctx, cancel := context.WithTimeout(ctx, ps.timeout)
+	defer cancel()
+
+	results := make([]*cloudpubsub.PublishResult, len(entries))
+	for i, entry := range entries {
+		results[i] = ps.topic.Publish(ctx, &cloudpubsub.Message{
+			Data:        entry.Data,
+			Attributes:  map[string]string{EventIDAttribute: entry.ID},
+			OrderingKey: entry.OrderingKey,
+		})
+	}
+
+	errs := make(map[string]error)
+	failedKeys := make(map[string]bool)
+	for i, result := range results {
+		entry := entries[i]
+		if _, err := result.Get(ctx); err != nil {
+			errs[entry.ID] = err
+			failedKeys[entry.OrderingKey] = true
+			continue
+		}
+		logger.WithFields(logrus.Fields{"eventId": entry.ID, "size": len(entry.Data)}).Debug("event published to Pub/Sub")
+	}
+	for key := range failedKeys {
+		ps.topic.ResumePublish(key)
+	}
+	return errs
+}
+
+// orderingKey returns the key of the events of the service of the event,
+// which is its name and region.
+func orderingKey(event RolloutEvent) string {
+	if event.Service == nil || event.Service.Metadata == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s", event.Service.Metadata.Name, event.Region)
+}
+
 // findRevisionWithTag scans the service's traffic configuration and returns the
 // revision that has the given tag.
 //
@@ -0,0 +1,220 @@
+package pubsub_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cloudpubsub "cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification/pubsub"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/option"
+	"google.golang.org/api/run/v1"
+	"google.golang.org/grpc"
+)
+
+const (
+	testProject = "myproject"
+	testTopic   = "rollouts"
+)
+
+// newTestPubSub returns a client to the topic of a fake Pub/Sub server and a
+// function that creates the topic.
+func newTestPubSub(t *testing.T, srv *pstest.Server, opts pubsub.Options) (*pubsub.PubSub, func()) {
+	ctx := context.Background()
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	assert.Nil(t, err)
+
+	ps, err := pubsub.New(ctx, testProject, "projects/"+testProject+"/topics/"+testTopic, opts, option.WithGRPCConn(conn))
+	assert.Nil(t, err)
+
+	createTopic := func() {
+		client, err := cloudpubsub.NewClient(ctx, testProject, option.WithGRPCConn(conn))
+		assert.Nil(t, err)
+		_, err = client.CreateTopic(ctx, testTopic)
+		assert.Nil(t, err)
+	}
+	return ps, createTopic
+}
+
+func testEvent() pubsub.RolloutEvent {
+	return pubsub.RolloutEvent{
+		Event:                    "rollout",
+		CandidateRevisionName:    "hello-002",
+		CandidateRevisionPercent: 20,
+		Service:                  &run.Service{Metadata: &run.ObjectMeta{Name: "hello"}},
+		Region:                   "us-east1",
+	}
+}
+
+func TestPublish(t *testing.T) {
+	srv := pstest.NewServer()
+	defer srv.Close()
+	ps, createTopic := newTestPubSub(t, srv, pubsub.Options{Timeout: 10 * time.Second})
+	defer ps.Stop()
+	createTopic()
+
+	assert.Nil(t, ps.Publish(context.Background(), "1", testEvent()))
+
+	messages := srv.Messages()
+	assert.Len(t, messages, 1)
+	assert.Equal(t, "1", messages[0].Attributes[pubsub.EventIDAttribute])
+	var event pubsub.RolloutEvent
+	assert.Nil(t, json.Unmarshal(messages[0].Data, &event))
+	assert.Equal(t, testEvent(), event)
+}
+
+func TestPublish_Error(t *testing.T) {
+	srv := pstest.NewServer()
+	defer srv.Close()
+	ps, _ := newTestPubSub(t, srv, pubsub.Options{Timeout: 10 * time.Second})
+	defer ps.Stop()
+
+	assert.NotNil(t, ps.Publish(context.Background(), "1", testEvent()))
+	assert.Nil(t, ps.Retry(context.Background()))
+}
+
+func TestPublish_Outbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "outbox.json")
+
+	srv := pstest.NewServer()
+	defer srv.Close()
+	ps, createTopic := newTestPubSub(t, srv, pubsub.Options{Timeout: 10 * time.Second, OutboxPath: path, OutboxSize: 10})
+	defer ps.Stop()
+
+	// The topic does not exist, so the events stay in the outbox.
+	ctx := context.Background()
+	assert.NotNil(t, ps.Publish(ctx, "1", testEvent()))
+	assert.NotNil(t, ps.Publish(ctx, "2", testEvent()))
+	assert.NotNil(t, ps.Retry(ctx))
+	// An event sent again keeps its ID and is not added twice.
+	assert.NotNil(t, ps.Publish(ctx, "2", testEvent()))
+	entries, err := pubsub.NewOutbox(path, 10).Entries()
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "hello/us-east1", entries[0].OrderingKey)
+
+	createTopic()
+	assert.Nil(t, ps.Retry(ctx))
+	entries, err = pubsub.NewOutbox(path, 10).Entries()
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+
+	messages := srv.Messages()
+	assert.Len(t, messages, 2)
+	assert.NotEqual(t, messages[0].Attributes[pubsub.EventIDAttribute], messages[1].Attributes[pubsub.EventIDAttribute])
+}
+
+func TestPublish_OutboxOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "outbox.json")
+
+	srv := pstest.NewServer()
+	defer srv.Close()
+	ps, createTopic := newTestPubSub(t, srv, pubsub.Options{Timeout: 10 * time.Second, OutboxPath: path, OutboxSize: 10})
+	defer ps.Stop()
+
+	ctx := context.Background()
+	assert.NotNil(t, ps.Publish(ctx, "1", testEvent()))
+	createTopic()
+
+	// The event waits for the earlier event of the service, but the event of
+	// another service is published right away.
+	assert.NotNil(t, ps.Publish(ctx, "2", testEvent()))
+	other := testEvent()
+	other.Service = &run.Service{Metadata: &run.ObjectMeta{Name: "other"}}
+	assert.Nil(t, ps.Publish(ctx, "3", other))
+	messages := srv.Messages()
+	assert.Len(t, messages, 1)
+	entries, err := pubsub.NewOutbox(path, 10).Entries()
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+
+	assert.Nil(t, ps.Retry(ctx))
+	entries, err = pubsub.NewOutbox(path, 10).Entries()
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+	assert.Len(t, srv.Messages(), 3)
+}
+
+func TestNotify(t *testing.T) {
+	srv := pstest.NewServer()
+	defer srv.Close()
+	ps, createTopic := newTestPubSub(t, srv, pubsub.Options{Timeout: 10 * time.Second})
+	defer ps.Stop()
+	createTopic()
+
+	svc := &run.Service{
+		Metadata: &run.ObjectMeta{Name: "hello"},
+		Spec: &run.ServiceSpec{Traffic: []*run.TrafficTarget{
+			{RevisionName: "hello-001", Percent: 100, Tag: "stable"},
+			{RevisionName: "hello-002", Percent: 0, Tag: "candidate"},
+		}},
+		Status: &run.ServiceStatus{Url: "https://hello-abcdefgh-ue.a.run.app"},
+	}
+	err := ps.Notify(context.Background(), notification.Event{
+		ID:            "1",
+		Type:          notification.EventRollback,
+		Region:        "us-east1",
+		ServiceObject: svc,
+		Diagnosis:     health.Unhealthy,
+	})
+	assert.Nil(t, err)
+
+	messages := srv.Messages()
+	assert.Len(t, messages, 1)
+	assert.Equal(t, "1", messages[0].Attributes[pubsub.EventIDAttribute])
+	var event pubsub.RolloutEvent
+	assert.Nil(t, json.Unmarshal(messages[0].Data, &event))
+	assert.Equal(t, "rollback", event.Event)
+	assert.Equal(t, "hello-002", event.CandidateRevisionName)
+	assert.Equal(t, "https://candidate---hello-abcdefgh-ue.a.run.app", event.CandidateRevisionURL)
+	assert.False(t, event.CandidateWasPromotedToStable)
+	assert.Equal(t, "us-east1", event.Region)
+}
+
+func TestNotify_Skipped(t *testing.T) {
+	srv := pstest.NewServer()
+	defer srv.Close()
+	ps, createTopic := newTestPubSub(t, srv, pubsub.Options{Timeout: 10 * time.Second})
+	defer ps.Stop()
+	createTopic()
+
+	// The skipped revision does not have the candidate tag.
+	svc := &run.Service{
+		Metadata: &run.ObjectMeta{Name: "hello"},
+		Spec: &run.ServiceSpec{Traffic: []*run.TrafficTarget{
+			{RevisionName: "hello-001", Percent: 100, Tag: "stable"},
+		}},
+	}
+	err := ps.Notify(context.Background(), notification.Event{
+		ID:            "1",
+		Type:          notification.EventSkipped,
+		Region:        "us-east1",
+		Reason:        "revision hello-002 was rolled back before",
+		Report:        health.Report{Candidate: "hello-002", Stable: "hello-001"},
+		ServiceObject: svc,
+		Diagnosis:     health.Unknown,
+	})
+	assert.Nil(t, err)
+
+	messages := srv.Messages()
+	assert.Len(t, messages, 1)
+	var event pubsub.RolloutEvent
+	assert.Nil(t, json.Unmarshal(messages[0].Data, &event))
+	assert.Equal(t, "skipped", event.Event)
+	assert.Equal(t, "hello-002", event.CandidateRevisionName)
+	assert.Equal(t, "revision hello-002 was rolled back before", event.Reason)
+}
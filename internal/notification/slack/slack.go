@@ -0,0 +1,192 @@
+// Package slack sends rollout notifications to Slack incoming webhooks, or to
+// any chat service with compatible webhooks.
+//
+// The messages are rendered from Go templates (see text/template) whose data
+// is a TemplateData. Besides the builtin functions, the templates can use:
+//
+//	metric  the short name of a health criterion's metric, e.g. "p99"
+//	value   a value of a criterion's metric with its unit, e.g. "412ms"
+//	check   the result of a criterion, e.g. "p99 412ms (needs 800ms)"
+package slack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification/webhook"
+	"github.com/pkg/errors"
+)
+
+// DefaultTemplate is the template of the messages if none is specified.
+const DefaultTemplate = `
+{{- if eq .Type "rollback" -}}
+:rotating_light: *{{.Service}}* ({{.Region}}): {{.Report.Candidate}} was rolled back to {{.Report.Stable}}{{with .Report.Reason}}: {{.}}{{end}}
+{{- else if eq .Type "promotion" -}}
+:white_check_mark: *{{.Service}}* ({{.Region}}): {{.Report.Candidate}} is now stable
+{{- else if eq .Type "candidate" -}}
+:new: *{{.Service}}* ({{.Region}}): new candidate {{.Report.Candidate}}
+{{- else if eq .Type "blocked" -}}
+:hourglass: *{{.Service}}* ({{.Region}}): {{.Report.Candidate}} waiting at {{.Report.NewTrafficPercent}}% ({{.Reason}})
+{{- else if eq .Type "inconclusive" -}}
+:grey_question: *{{.Service}}* ({{.Region}}): {{.Report.Candidate}} held at {{.Report.NewTrafficPercent}}%, {{.Reason}}
+{{- else if eq .Type "skipped" -}}
+:no_entry_sign: *{{.Service}}* ({{.Region}}): {{.Reason}}
+{{- else -}}
+:arrow_up: *{{.Service}}* ({{.Region}}): {{.Report.Candidate}} now at {{.Report.NewTrafficPercent}}%
+{{- end -}}
+{{range .Report.Criteria}}, {{check .}}{{end}}
+{{- with .Report.Progress}}{{with .ETA}}, all the traffic expected at {{.Format "15:04 MST"}}{{end}}{{end}}
+{{- if and .CandidateURL (ne .Type "rollback") (ne .Type "skipped")}} (<{{.CandidateURL}}|open>){{end}}`
+
+// TemplateData is the data of the message templates.
+type TemplateData struct {
+	notification.Event
+
+	// Traffic is the traffic split of the service after the update.
+	Traffic []Target
+}
+
+// Target is a revision receiving traffic.
+type Target struct {
+	Revision string
+	Tag      string
+	Percent  int64
+}
+
+// funcs are the functions available to the templates.
+var funcs = template.FuncMap{
+	"metric": metricName,
+	"value":  formatValue,
+	"check":  check,
+}
+
+// ParseTemplate parses a message template.
+func ParseTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("message").Funcs(funcs).Parse(text)
+	return tmpl, errors.Wrap(err, "failed to parse message template")
+}
+
+// ReadTemplate reads and parses the message template in a file. It returns
+// the default template if path is empty.
+func ReadTemplate(path string) (*template.Template, error) {
+	if path == "" {
+		return ParseTemplate(DefaultTemplate)
+	}
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read message template")
+	}
+	return ParseTemplate(string(text))
+}
+
+// Sink sends the notifications to a Slack incoming webhook.
+type Sink struct {
+	httpClient *http.Client
+	url        string
+	tmpl       *template.Template
+	timeout    time.Duration
+}
+
+// New returns a sink that posts the messages rendered from the template to the
+// webhook URL with the HTTP client. If timeout is 0, webhook.DefaultTimeout is
+// used.
+func New(httpClient *http.Client, url string, tmpl *template.Template, timeout time.Duration) *Sink {
+	if timeout == 0 {
+		timeout = webhook.DefaultTimeout
+	}
+	return &Sink{httpClient: httpClient, url: url, tmpl: tmpl, timeout: timeout}
+}
+
+// Notify renders the message of the event and posts it to the webhook.
+func (s *Sink) Notify(ctx context.Context, event notification.Event) error {
+	text, err := s.Render(event)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal message")
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	return webhook.Post(ctx, s.httpClient, s.url, s.timeout, header, body)
+}
+
+// Render returns the message of the event.
+func (s *Sink) Render(event notification.Event) (string, error) {
+	data := TemplateData{Event: event}
+	if event.ServiceObject != nil && event.ServiceObject.Spec != nil {
+		for _, target := range event.ServiceObject.Spec.Traffic {
+			if target.Percent == 0 {
+				continue
+			}
+			revision := target.RevisionName
+			if target.LatestRevision {
+				revision = "latest"
+			}
+			data.Traffic = append(data.Traffic, Target{Revision: revision, Tag: target.Tag, Percent: target.Percent})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := s.tmpl.Execute(&buf, data); err != nil {
+		return "", errors.Wrap(err, "failed to render message")
+	}
+	text := strings.TrimSpace(buf.String())
+	if text == "" {
+		return "", errors.New("message is empty")
+	}
+	return text, nil
+}
+
+// metricName returns the short name of the metric of a criterion.
+func metricName(criterion health.CriterionReport) string {
+	switch config.MetricsCheck(criterion.Metric) {
+	case config.LatencyMetricsCheck:
+		return fmt.Sprintf("p%.0f", criterion.Percentile)
+	case config.ErrorRateMetricsCheck:
+		return "error rate"
+	case config.ClientErrorRateMetricsCheck:
+		return "4xx rate"
+	case config.RequestCountMetricsCheck:
+		return "requests"
+	case config.TrafficShareMetricsCheck:
+		return "traffic share"
+	default:
+		return criterion.Metric
+	}
+}
+
+// formatValue returns a value of the metric of a criterion with its unit.
+func formatValue(criterion health.CriterionReport, value float64) string {
+	switch config.MetricsCheck(criterion.Metric) {
+	case config.LatencyMetricsCheck:
+		return fmt.Sprintf("%.0fms", value)
+	case config.ErrorRateMetricsCheck, config.ClientErrorRateMetricsCheck, config.TrafficShareMetricsCheck:
+		return fmt.Sprintf("%.2f%%", value)
+	case config.RequestCountMetricsCheck, config.OpenIncidentsMetricsCheck:
+		return fmt.Sprintf("%.0f", value)
+	default:
+		return fmt.Sprintf("%.2f", value)
+	}
+}
+
+// check returns the result of a criterion.
+func check(criterion health.CriterionReport) string {
+	value := formatValue(criterion, criterion.ActualValue)
+	if criterion.NoData {
+		value = "no data"
+	}
+	return fmt.Sprintf("%s %s (needs %s)", metricName(criterion), value, formatValue(criterion, criterion.Threshold))
+}
@@ -0,0 +1,137 @@
+package slack_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification/slack"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/run/v1"
+)
+
+func testEvent(eventType notification.EventType) notification.Event {
+	eta := time.Date(2020, 8, 13, 20, 35, 10, 0, time.UTC)
+	return notification.Event{
+		Type:         eventType,
+		Project:      "myproject",
+		Region:       "us-east1",
+		Service:      "hello",
+		CandidateURL: "https://candidate---hello-abcdefgh-ue.a.run.app",
+		Report: health.Report{
+			Result: "healthy",
+			Criteria: []health.CriterionReport{
+				{Metric: "request-latency", Percentile: 99, Threshold: 800, ActualValue: 412.3, Met: true},
+				{Metric: "error-rate-percent", Threshold: 1, ActualValue: 0.1, Met: true},
+			},
+			Candidate:         "hello-002",
+			Stable:            "hello-001",
+			TrafficPercent:    20,
+			NewTrafficPercent: 50,
+			Progress:          &health.ProgressReport{Step: 3, Steps: 5, ETA: &eta},
+		},
+		ServiceObject: &run.Service{Spec: &run.ServiceSpec{Traffic: []*run.TrafficTarget{
+			{RevisionName: "hello-001", Percent: 50, Tag: "stable"},
+			{RevisionName: "hello-002", Percent: 50, Tag: "candidate"},
+			{LatestRevision: true, Tag: "latest"},
+		}}},
+	}
+}
+
+func TestSink_Render(t *testing.T) {
+	rollback := testEvent(notification.EventRollback)
+	rollback.Report.Result = "unhealthy"
+	rollback.Report.Reason = "health webhook voted unhealthy"
+	rollback.Report.NewTrafficPercent = 0
+	rollback.Report.Progress = nil
+	rollback.Report.Criteria = []health.CriterionReport{
+		{Metric: "error-rate-percent", Threshold: 1, ActualValue: 3.5},
+		{Metric: "request-count", Threshold: 100, NoData: true},
+	}
+
+	promotion := testEvent(notification.EventPromotion)
+	promotion.Report.Criteria = nil
+	promotion.Report.Progress = nil
+
+	tests := []struct {
+		name     string
+		template string
+		event    notification.Event
+		expected string
+		wantErr  bool
+	}{
+		{
+			name:     "rollout",
+			event:    testEvent(notification.EventRollout),
+			expected: ":arrow_up: *hello* (us-east1): hello-002 now at 50%, p99 412ms (needs 800ms), error rate 0.10% (needs 1.00%), all the traffic expected at 20:35 UTC (<https://candidate---hello-abcdefgh-ue.a.run.app|open>)",
+		},
+		{
+			name:     "rollback",
+			event:    rollback,
+			expected: ":rotating_light: *hello* (us-east1): hello-002 was rolled back to hello-001: health webhook voted unhealthy, error rate 3.50% (needs 1.00%), requests no data (needs 100)",
+		},
+		{
+			name:     "promotion",
+			event:    promotion,
+			expected: ":white_check_mark: *hello* (us-east1): hello-002 is now stable (<https://candidate---hello-abcdefgh-ue.a.run.app|open>)",
+		},
+		{
+			name:     "custom template",
+			template: `{{.Service}}:{{range .Traffic}} {{.Revision}}={{.Percent}}%{{end}}{{range .Report.Criteria}} {{metric .}}={{value . .ActualValue}}{{end}}`,
+			event:    testEvent(notification.EventRollout),
+			expected: "hello: hello-001=50% hello-002=50% p99=412ms error rate=0.10%",
+		},
+		{
+			name:     "empty message",
+			template: `{{if eq .Type "rollback"}}rolled back{{end}}`,
+			event:    testEvent(notification.EventRollout),
+			wantErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			text := test.template
+			if text == "" {
+				text = slack.DefaultTemplate
+			}
+			tmpl, err := slack.ParseTemplate(text)
+			assert.Nil(t, err)
+
+			message, err := slack.New(http.DefaultClient, "", tmpl, 0).Render(test.event)
+			if test.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, message)
+		})
+	}
+}
+
+func TestSink_Notify(t *testing.T) {
+	var body map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+	}))
+	defer srv.Close()
+
+	tmpl, err := slack.ParseTemplate(`{{.Report.Candidate}} now at {{.Report.NewTrafficPercent}}%`)
+	assert.Nil(t, err)
+	sink := slack.New(srv.Client(), srv.URL, tmpl, time.Second)
+	assert.Nil(t, sink.Notify(context.Background(), testEvent(notification.EventRollout)))
+	assert.Equal(t, map[string]string{"text": "hello-002 now at 50%"}, body)
+}
+
+func TestParseTemplate(t *testing.T) {
+	_, err := slack.ParseTemplate(`{{.Service`)
+	assert.NotNil(t, err)
+	_, err = slack.ParseTemplate(`{{unknown .Service}}`)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,81 @@
+// Package webhook sends rollout notifications to HTTP endpoints.
+//
+// The endpoint receives a POST request with the JSON encoding of the event
+// (see notification.Event) and must answer with a 2xx response.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification"
+	"github.com/pkg/errors"
+)
+
+// DefaultTimeout is the maximum time to wait for the endpoint if no timeout is
+// specified.
+const DefaultTimeout = 10 * time.Second
+
+// maxResponseSize is the maximum size of a response body that is read.
+const maxResponseSize = 64 << 10
+
+// Sink sends the notifications to an HTTP endpoint.
+type Sink struct {
+	httpClient *http.Client
+	url        string
+	timeout    time.Duration
+}
+
+// New returns a sink that sends the notifications to the URL with the HTTP
+// client. If timeout is 0, DefaultTimeout is used.
+func New(httpClient *http.Client, url string, timeout time.Duration) *Sink {
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	return &Sink{httpClient: httpClient, url: url, timeout: timeout}
+}
+
+// Notify sends the event to the endpoint.
+func (s *Sink) Notify(ctx context.Context, event notification.Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal event")
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	return Post(ctx, s.httpClient, s.url, s.timeout, header, body)
+}
+
+// Post sends the body with the header to the URL and checks that the response
+// is successful.
+func Post(ctx context.Context, httpClient *http.Client, url string, timeout time.Duration, header http.Header, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	req = req.WithContext(ctx)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "request failed")
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection can be reused.
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxResponseSize))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("unexpected response status %q", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification/webhook"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSink_Notify(t *testing.T) {
+	event := notification.Event{
+		Type:    notification.EventPromotion,
+		Project: "myproject",
+		Region:  "us-east1",
+		Service: "hello",
+		Report:  health.Report{Candidate: "hello-002", NewTrafficPercent: 100},
+		Time:    time.Date(2020, 8, 13, 19, 35, 10, 0, time.UTC),
+	}
+
+	tests := []struct {
+		name    string
+		status  int
+		delay   time.Duration
+		wantErr bool
+	}{
+		{name: "success", status: http.StatusNoContent},
+		{name: "error status", status: http.StatusInternalServerError, wantErr: true},
+		{name: "timeout", status: http.StatusOK, delay: 100 * time.Millisecond, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var received notification.Event
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, http.MethodPost, r.Method)
+				assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+				assert.Nil(t, json.NewDecoder(r.Body).Decode(&received))
+				time.Sleep(test.delay)
+				w.WriteHeader(test.status)
+			}))
+			defer srv.Close()
+
+			sink := webhook.New(srv.Client(), srv.URL, 50*time.Millisecond)
+			err := sink.Notify(context.Background(), event)
+			if test.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, event, received)
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package rollout
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
+	"google.golang.org/api/run/v1"
+)
+
+// ConditionsAnnotation is the annotation with the status conditions of the
+// rollout of a service, as a JSON array of Condition.
+const ConditionsAnnotation = "rollout.cloud.run/conditions"
+
+// ConditionType is the type of a status condition.
+type ConditionType string
+
+// Types of status conditions, which are always published in this order.
+const (
+	// ConditionProgressing is true while a candidate is being rolled out.
+	ConditionProgressing ConditionType = "RolloutProgressing"
+
+	// ConditionPaused is true while the candidate's traffic is held because
+	// its health could not be determined.
+	ConditionPaused ConditionType = "RolloutPaused"
+
+	// ConditionDegraded is true if the last candidate was rolled back.
+	ConditionDegraded ConditionType = "RolloutDegraded"
+
+	// ConditionComplete is true if the last candidate became stable.
+	ConditionComplete ConditionType = "RolloutComplete"
+)
+
+var conditionTypes = []ConditionType{ConditionProgressing, ConditionPaused, ConditionDegraded, ConditionComplete}
+
+// ConditionStatus is the status of a condition.
+type ConditionStatus string
+
+// Condition statuses.
+const (
+	ConditionTrue    ConditionStatus = "True"
+	ConditionFalse   ConditionStatus = "False"
+	ConditionUnknown ConditionStatus = "Unknown"
+)
+
+// Condition is a status condition of the rollout, similar to the conditions
+// of Kubernetes resources.
+//
+// The reason and message explain the status of the condition after the last
+// decision about the candidate, and the last transition time is when the status
+// last changed.
+type Condition struct {
+	Type               ConditionType   `json:"type"`
+	Status             ConditionStatus `json:"status"`
+	Reason             string          `json:"reason"`
+	Message            string          `json:"message"`
+	LastTransitionTime time.Time       `json:"lastTransitionTime"`
+}
+
+// Condition reasons.
+const (
+	reasonNewCandidate       = "NewCandidate"
+	reasonRolledForward      = "RolledForward"
+	reasonWaitingForNextStep = "WaitingForNextStep"
+	reasonHealthInconclusive = "HealthInconclusive"
+	reasonHeld               = "Held"
+	reasonNotHeld            = "TrafficNotHeld"
+	reasonUnhealthy          = "CandidateUnhealthy"
+	reasonRolledBack         = "CandidateRolledBack"
+	reasonNotRolledBack      = "CandidateNotRolledBack"
+	reasonPromoted           = "CandidatePromoted"
+	reasonInProgress         = "RolloutInProgress"
+	reasonUnknown            = "DecisionUnknown"
+)
+
+// newConditions returns the status conditions after the decision in the
+// report. Each condition has its own reason and message, which explain its
+// status.
+func newConditions(report health.Report) map[ConditionType]Condition {
+	candidate, percent := report.Candidate, report.NewTrafficPercent
+	var progress, explanation string
+	if report.Progress != nil {
+		progress = fmt.Sprintf(" (%s)", report.Progress)
+	}
+	if report.Reason != "" {
+		explanation = ": " + report.Reason
+	}
+
+	// While the candidate is being rolled out, its traffic is not held, it was
+	// not rolled back and it is not stable yet.
+	var progressing Condition
+	paused := Condition{
+		Status:  ConditionFalse,
+		Reason:  reasonNotHeld,
+		Message: fmt.Sprintf("traffic of candidate %s is not held", candidate),
+	}
+	degraded := Condition{
+		Status:  ConditionFalse,
+		Reason:  reasonNotRolledBack,
+		Message: fmt.Sprintf("candidate %s was not rolled back", candidate),
+	}
+	complete := Condition{
+		Status:  ConditionFalse,
+		Reason:  reasonInProgress,
+		Message: fmt.Sprintf("candidate %s is not the stable revision yet", candidate) + progress,
+	}
+	switch report.Decision {
+	case DecisionStart:
+		progressing = Condition{
+			Status:  ConditionTrue,
+			Reason:  reasonNewCandidate,
+			Message: fmt.Sprintf("new candidate %s receives %d%% of the traffic", candidate, percent) + progress,
+		}
+	case DecisionRollForward:
+		progressing = Condition{
+			Status:  ConditionTrue,
+			Reason:  reasonRolledForward,
+			Message: fmt.Sprintf("candidate %s receives %d%% of the traffic", candidate, percent) + progress + explanation,
+		}
+	case DecisionWait:
+		progressing = Condition{
+			Status:  ConditionTrue,
+			Reason:  reasonWaitingForNextStep,
+			Message: fmt.Sprintf("candidate %s is healthy, waiting to roll forward from %d%% of the traffic", candidate, percent) + progress + explanation,
+		}
+	case DecisionHold:
+		reason := reasonHeld
+		if report.Result == health.Inconclusive.String() {
+			reason = reasonHealthInconclusive
+		}
+		progressing = Condition{
+			Status:  ConditionTrue,
+			Reason:  reason,
+			Message: fmt.Sprintf("candidate %s keeps %d%% of the traffic", candidate, percent) + progress,
+		}
+		paused = Condition{
+			Status:  ConditionTrue,
+			Reason:  reason,
+			Message: fmt.Sprintf("traffic of candidate %s is held at %d%%", candidate, percent) + explanation,
+		}
+	case DecisionRollback:
+		progressing = Condition{
+			Status:  ConditionFalse,
+			Reason:  reasonRolledBack,
+			Message: fmt.Sprintf("no candidate is being rolled out, candidate %s was rolled back", candidate),
+		}
+		paused.Message = fmt.Sprintf("candidate %s was rolled back, its traffic is not held", candidate)
+		degraded = Condition{
+			Status:  ConditionTrue,
+			Reason:  reasonUnhealthy,
+			Message: fmt.Sprintf("candidate %s was rolled back", candidate) + explanation,
+		}
+		complete = Condition{
+			Status:  ConditionFalse,
+			Reason:  reasonRolledBack,
+			Message: fmt.Sprintf("candidate %s was rolled back before becoming the stable revision", candidate),
+		}
+	case DecisionPromote:
+		progressing = Condition{
+			Status:  ConditionFalse,
+			Reason:  reasonPromoted,
+			Message: fmt.Sprintf("no candidate is being rolled out, candidate %s became the stable revision", candidate),
+		}
+		paused.Message = fmt.Sprintf("candidate %s became the stable revision, its traffic is not held", candidate)
+		complete = Condition{
+			Status:  ConditionTrue,
+			Reason:  reasonPromoted,
+			Message: fmt.Sprintf("candidate %s became the stable revision", candidate) + explanation,
+		}
+	default:
+		unknown := Condition{
+			Status:  ConditionUnknown,
+			Reason:  reasonUnknown,
+			Message: fmt.Sprintf("the decision about candidate %s is unknown", candidate),
+		}
+		progressing, paused, degraded, complete = unknown, unknown, unknown, unknown
+	}
+
+	conditions := map[ConditionType]Condition{
+		ConditionProgressing: progressing,
+		ConditionPaused:      paused,
+		ConditionDegraded:    degraded,
+		ConditionComplete:    complete,
+	}
+	for conditionType, condition := range conditions {
+		condition.Type = conditionType
+		conditions[conditionType] = condition
+	}
+	return conditions
+}
+
+// setConditionsAnnotation sets the status conditions after the decision in the
+// report.
+//
+// The last transition time of the conditions whose status did not change is
+// kept. Failing to encode the conditions does not fail the rollout.
+func (r *Rollout) setConditionsAnnotation(svc *run.Service, report health.Report) {
+	previous := make(map[ConditionType]Condition)
+	var previousConditions []Condition
+	if err := json.Unmarshal([]byte(svc.Metadata.Annotations[ConditionsAnnotation]), &previousConditions); err == nil {
+		for _, condition := range previousConditions {
+			previous[condition.Type] = condition
+		}
+	}
+
+	now := r.time.Now().UTC().Truncate(time.Second)
+	current := newConditions(report)
+	var conditions []Condition
+	for _, conditionType := range conditionTypes {
+		condition := current[conditionType]
+		condition.LastTransitionTime = now
+		if prev, ok := previous[conditionType]; ok && prev.Status == condition.Status {
+			condition.LastTransitionTime = prev.LastTransitionTime
+		}
+		conditions = append(conditions, condition)
+	}
+
+	data, err := json.Marshal(conditions)
+	if err != nil {
+		r.log.WithError(err).Warn("failed to encode status conditions")
+		return
+	}
+	setAnnotation(svc, ConditionsAnnotation, string(data))
+}
@@ -0,0 +1,212 @@
+package rollout_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics"
+	metricsmock "github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics/mock"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/rollout"
+	runmock "github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/run/mock"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/run/v1"
+)
+
+func TestUpdateService_Conditions(t *testing.T) {
+	runclient := &runmock.RunAPI{}
+	runclient.RevisionFn = readyRevision
+	runclient.ReplaceServiceFn = func(namespace, serviceID string, svc *run.Service) (*run.Service, error) {
+		return svc, nil
+	}
+	clockMock := clockwork.NewFakeClock()
+	strategy := config.Strategy{
+		Steps:               []int64{10, 40, 70},
+		HealthCheckOffset:   5 * time.Minute,
+		TimeBetweenRollouts: 10 * time.Minute,
+		HealthCriteria: []config.HealthCriterion{
+			{Metric: config.RequestCountMetricsCheck, Threshold: 100},
+			{Metric: config.ErrorRateMetricsCheck, Threshold: 5},
+		},
+	}
+
+	newCandidateProgress := fmt.Sprintf("(step 1 of 4, all the traffic expected at %s)", clockMock.Now().Add(30*time.Minute).Format(time.RFC3339))
+	waitProgress := fmt.Sprintf("(step 1 of 4, all the traffic expected at %s)", clockMock.Now().Add(25*time.Minute).Format(time.RFC3339))
+	heldProgress := fmt.Sprintf("(step 1 of 4, all the traffic expected at %s)", clockMock.Now().Add(20*time.Minute).Format(time.RFC3339))
+	tests := []struct {
+		name         string
+		traffic      []*run.TrafficTarget
+		lastRollout  int
+		requestCount int64
+		errorRate    float64
+
+		// conditions are the expected conditions, without their type and
+		// last transition time.
+		conditions map[rollout.ConditionType]rollout.Condition
+	}{
+		{
+			name: "new candidate",
+			traffic: []*run.TrafficTarget{
+				{RevisionName: "test-001", Percent: 100, Tag: rollout.StableTag},
+			},
+			conditions: map[rollout.ConditionType]rollout.Condition{
+				rollout.ConditionProgressing: {Status: rollout.ConditionTrue, Reason: "NewCandidate", Message: "new candidate test-002 receives 10% of the traffic " + newCandidateProgress},
+				rollout.ConditionPaused:      {Status: rollout.ConditionFalse, Reason: "TrafficNotHeld", Message: "traffic of candidate test-002 is not held"},
+				rollout.ConditionDegraded:    {Status: rollout.ConditionFalse, Reason: "CandidateNotRolledBack", Message: "candidate test-002 was not rolled back"},
+				rollout.ConditionComplete:    {Status: rollout.ConditionFalse, Reason: "RolloutInProgress", Message: "candidate test-002 is not the stable revision yet " + newCandidateProgress},
+			},
+		},
+		{
+			name: "healthy, waiting for next step",
+			traffic: []*run.TrafficTarget{
+				{RevisionName: "test-001", Percent: 90, Tag: rollout.StableTag},
+				{RevisionName: "test-002", Percent: 10, Tag: rollout.CandidateTag},
+			},
+			lastRollout:  -5,
+			requestCount: 1000,
+			conditions: map[rollout.ConditionType]rollout.Condition{
+				rollout.ConditionProgressing: {Status: rollout.ConditionTrue, Reason: "WaitingForNextStep", Message: "candidate test-002 is healthy, waiting to roll forward from 10% of the traffic " + waitProgress},
+				rollout.ConditionPaused:      {Status: rollout.ConditionFalse, Reason: "TrafficNotHeld", Message: "traffic of candidate test-002 is not held"},
+				rollout.ConditionDegraded:    {Status: rollout.ConditionFalse, Reason: "CandidateNotRolledBack", Message: "candidate test-002 was not rolled back"},
+				rollout.ConditionComplete:    {Status: rollout.ConditionFalse, Reason: "RolloutInProgress", Message: "candidate test-002 is not the stable revision yet " + waitProgress},
+			},
+		},
+		{
+			name: "inconclusive",
+			traffic: []*run.TrafficTarget{
+				{RevisionName: "test-001", Percent: 90, Tag: rollout.StableTag},
+				{RevisionName: "test-002", Percent: 10, Tag: rollout.CandidateTag},
+			},
+			lastRollout:  -30,
+			requestCount: 10,
+			conditions: map[rollout.ConditionType]rollout.Condition{
+				rollout.ConditionProgressing: {Status: rollout.ConditionTrue, Reason: "HealthInconclusive", Message: "candidate test-002 keeps 10% of the traffic " + heldProgress},
+				rollout.ConditionPaused:      {Status: rollout.ConditionTrue, Reason: "HealthInconclusive", Message: "traffic of candidate test-002 is held at 10%"},
+				rollout.ConditionDegraded:    {Status: rollout.ConditionFalse, Reason: "CandidateNotRolledBack", Message: "candidate test-002 was not rolled back"},
+				rollout.ConditionComplete:    {Status: rollout.ConditionFalse, Reason: "RolloutInProgress", Message: "candidate test-002 is not the stable revision yet " + heldProgress},
+			},
+		},
+		{
+			name: "unhealthy",
+			traffic: []*run.TrafficTarget{
+				{RevisionName: "test-001", Percent: 90, Tag: rollout.StableTag},
+				{RevisionName: "test-002", Percent: 10, Tag: rollout.CandidateTag},
+			},
+			lastRollout:  -30,
+			requestCount: 1000,
+			errorRate:    0.1,
+			conditions: map[rollout.ConditionType]rollout.Condition{
+				rollout.ConditionProgressing: {Status: rollout.ConditionFalse, Reason: "CandidateRolledBack", Message: "no candidate is being rolled out, candidate test-002 was rolled back"},
+				rollout.ConditionPaused:      {Status: rollout.ConditionFalse, Reason: "TrafficNotHeld", Message: "candidate test-002 was rolled back, its traffic is not held"},
+				rollout.ConditionDegraded:    {Status: rollout.ConditionTrue, Reason: "CandidateUnhealthy", Message: "candidate test-002 was rolled back"},
+				rollout.ConditionComplete:    {Status: rollout.ConditionFalse, Reason: "CandidateRolledBack", Message: "candidate test-002 was rolled back before becoming the stable revision"},
+			},
+		},
+		{
+			name: "promoted",
+			traffic: []*run.TrafficTarget{
+				{RevisionName: "test-002", Percent: 100, Tag: rollout.CandidateTag},
+				{RevisionName: "test-001", Percent: 0, Tag: rollout.StableTag},
+			},
+			lastRollout:  -30,
+			requestCount: 1000,
+			conditions: map[rollout.ConditionType]rollout.Condition{
+				rollout.ConditionProgressing: {Status: rollout.ConditionFalse, Reason: "CandidatePromoted", Message: "no candidate is being rolled out, candidate test-002 became the stable revision"},
+				rollout.ConditionPaused:      {Status: rollout.ConditionFalse, Reason: "TrafficNotHeld", Message: "candidate test-002 became the stable revision, its traffic is not held"},
+				rollout.ConditionDegraded:    {Status: rollout.ConditionFalse, Reason: "CandidateNotRolledBack", Message: "candidate test-002 was not rolled back"},
+				rollout.ConditionComplete:    {Status: rollout.ConditionTrue, Reason: "CandidatePromoted", Message: "candidate test-002 became the stable revision"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metricsMock := &metricsmock.Metrics{}
+			metricsMock.RequestCountFn = func(ctx context.Context, query metrics.Query) (int64, error) {
+				return test.requestCount, nil
+			}
+			metricsMock.ErrorRateFn = func(ctx context.Context, query metrics.Query) (float64, error) {
+				return test.errorRate, nil
+			}
+
+			annotations := map[string]string{rollout.LastRolloutAnnotation: makeLastRolloutAnnotation(clockMock, test.lastRollout)}
+			svc := generateService(&ServiceOpts{LatestReadyRevision: "test-002", Traffic: test.traffic, Annotations: annotations})
+			svcRecord := &rollout.ServiceRecord{Service: svc}
+			r := rollout.New(context.TODO(), metricsMock, svcRecord, strategy).WithClient(runclient).WithClock(clockMock)
+
+			retSvc, _, err := r.UpdateService(svc)
+			assert.Nil(t, err)
+
+			var conditions []rollout.Condition
+			assert.Nil(t, json.Unmarshal([]byte(retSvc.Metadata.Annotations[rollout.ConditionsAnnotation]), &conditions))
+			var expected []rollout.Condition
+			for _, conditionType := range []rollout.ConditionType{rollout.ConditionProgressing, rollout.ConditionPaused, rollout.ConditionDegraded, rollout.ConditionComplete} {
+				condition := test.conditions[conditionType]
+				condition.Type = conditionType
+				condition.LastTransitionTime = clockMock.Now().UTC()
+				expected = append(expected, condition)
+			}
+			assert.Equal(t, expected, conditions)
+		})
+	}
+}
+
+// TestUpdateService_ConditionsTransitionTime tests that the last transition
+// time of a condition only changes when its status changes.
+func TestUpdateService_ConditionsTransitionTime(t *testing.T) {
+	runclient := &runmock.RunAPI{}
+	runclient.RevisionFn = readyRevision
+	runclient.ReplaceServiceFn = func(namespace, serviceID string, svc *run.Service) (*run.Service, error) {
+		return svc, nil
+	}
+	clockMock := clockwork.NewFakeClock()
+	metricsMock := &metricsmock.Metrics{}
+	metricsMock.ErrorRateFn = func(ctx context.Context, query metrics.Query) (float64, error) {
+		return 0.01, nil
+	}
+	strategy := config.Strategy{
+		Steps:               []int64{10, 40, 70},
+		HealthCheckOffset:   5 * time.Minute,
+		TimeBetweenRollouts: 10 * time.Minute,
+		HealthCriteria: []config.HealthCriterion{
+			{Metric: config.ErrorRateMetricsCheck, Threshold: 5},
+		},
+	}
+
+	traffic := []*run.TrafficTarget{
+		{RevisionName: "test-001", Percent: 100, Tag: rollout.StableTag},
+	}
+	svc := generateService(&ServiceOpts{LatestReadyRevision: "test-002", Traffic: traffic})
+	start := clockMock.Now().UTC()
+	conditions := func() map[rollout.ConditionType]rollout.Condition {
+		svcRecord := &rollout.ServiceRecord{Service: svc}
+		r := rollout.New(context.TODO(), metricsMock, svcRecord, strategy).WithClient(runclient).WithClock(clockMock)
+		_, _, err := r.UpdateService(svc)
+		assert.Nil(t, err)
+
+		var conditions []rollout.Condition
+		assert.Nil(t, json.Unmarshal([]byte(svc.Metadata.Annotations[rollout.ConditionsAnnotation]), &conditions))
+		byType := make(map[rollout.ConditionType]rollout.Condition)
+		for _, condition := range conditions {
+			byType[condition.Type] = condition
+		}
+		return byType
+	}
+
+	conditions()
+	clockMock.Advance(10 * time.Minute)
+	metricsMock.ErrorRateFn = func(ctx context.Context, query metrics.Query) (float64, error) {
+		return 0.1, nil
+	}
+	rolledBack := conditions()
+
+	assert.Equal(t, rollout.ConditionTrue, rolledBack[rollout.ConditionDegraded].Status)
+	assert.Equal(t, clockMock.Now().UTC(), rolledBack[rollout.ConditionDegraded].LastTransitionTime)
+	assert.Equal(t, clockMock.Now().UTC(), rolledBack[rollout.ConditionProgressing].LastTransitionTime)
+	assert.Equal(t, start, rolledBack[rollout.ConditionPaused].LastTransitionTime)
+	assert.Equal(t, start, rolledBack[rollout.ConditionComplete].LastTransitionTime)
+}
@@ -0,0 +1,53 @@
+package rollout
+
+import (
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
+)
+
+// progress returns how far along the rollout of the candidate is, or nil if
+// no candidate is being rolled out (e.g. it was rolled back or promoted).
+//
+// The estimates assume that the candidate stays healthy, so it goes through a
+// step every time the minimum time between rollouts elapses. They do not
+// account for the time between evaluations.
+func (r *Rollout) progress(state RolloutState) *health.ProgressReport {
+	if state.Phase != PhaseProgressing {
+		return nil
+	}
+
+	// The candidate goes through the steps of the strategy and then receives
+	// all the traffic.
+	var steps []int64
+	for _, step := range r.strategy.Steps {
+		if step < 100 {
+			steps = append(steps, step)
+		}
+	}
+	steps = append(steps, 100)
+
+	progress := &health.ProgressReport{Steps: len(steps)}
+	for _, step := range steps {
+		if step <= state.Step {
+			progress.Step++
+		}
+	}
+	remaining := progress.Steps - progress.Step
+	if remaining == 0 {
+		return progress
+	}
+
+	now := r.time.Now().UTC()
+	nextStep := now
+	if !state.LastRollout.IsZero() {
+		nextStep = state.LastRollout.UTC().Add(r.strategy.TimeBetweenRollouts)
+	}
+	if nextStep.Before(now) {
+		nextStep = now
+	}
+	eta := nextStep.Add(time.Duration(remaining-1) * r.strategy.TimeBetweenRollouts)
+	progress.NextStepAt = &nextStep
+	progress.ETA = &eta
+	return progress
+}
@@ -0,0 +1,104 @@
+package rollout_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics"
+	metricsmock "github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics/mock"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/rollout"
+	runmock "github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/run/mock"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/run/v1"
+)
+
+func TestUpdateService_Progress(t *testing.T) {
+	runclient := &runmock.RunAPI{}
+	runclient.RevisionFn = readyRevision
+	runclient.ReplaceServiceFn = func(namespace, serviceID string, svc *run.Service) (*run.Service, error) {
+		return svc, nil
+	}
+	clockMock := clockwork.NewFakeClock()
+	now := clockMock.Now().UTC()
+	at := func(minutes int) *time.Time {
+		t := now.Add(time.Duration(minutes) * time.Minute)
+		return &t
+	}
+	strategy := config.Strategy{
+		Steps:               []int64{10, 40, 70},
+		HealthCheckOffset:   5 * time.Minute,
+		TimeBetweenRollouts: 10 * time.Minute,
+		HealthCriteria: []config.HealthCriterion{
+			{Metric: config.ErrorRateMetricsCheck, Threshold: 5},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		traffic     []*run.TrafficTarget
+		lastRollout int
+		errorRate   float64
+		expected    *health.ProgressReport
+	}{
+		{
+			name: "new candidate",
+			traffic: []*run.TrafficTarget{
+				{RevisionName: "test-001", Percent: 100, Tag: rollout.StableTag},
+			},
+			expected: &health.ProgressReport{Step: 1, Steps: 4, NextStepAt: at(10), ETA: at(30)},
+		},
+		{
+			name: "not enough time since last rollout",
+			traffic: []*run.TrafficTarget{
+				{RevisionName: "test-001", Percent: 60, Tag: rollout.StableTag},
+				{RevisionName: "test-002", Percent: 40, Tag: rollout.CandidateTag},
+			},
+			lastRollout: -4,
+			expected:    &health.ProgressReport{Step: 2, Steps: 4, NextStepAt: at(6), ETA: at(16)},
+		},
+		{
+			name: "rolled forward to all the traffic",
+			traffic: []*run.TrafficTarget{
+				{RevisionName: "test-001", Percent: 30, Tag: rollout.StableTag},
+				{RevisionName: "test-002", Percent: 70, Tag: rollout.CandidateTag},
+			},
+			lastRollout: -30,
+			expected:    &health.ProgressReport{Step: 4, Steps: 4},
+		},
+		{
+			name: "rolled back",
+			traffic: []*run.TrafficTarget{
+				{RevisionName: "test-001", Percent: 90, Tag: rollout.StableTag},
+				{RevisionName: "test-002", Percent: 10, Tag: rollout.CandidateTag},
+			},
+			lastRollout: -30,
+			errorRate:   0.1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metricsMock := &metricsmock.Metrics{}
+			metricsMock.ErrorRateFn = func(ctx context.Context, query metrics.Query) (float64, error) {
+				return test.errorRate, nil
+			}
+
+			annotations := map[string]string{rollout.LastRolloutAnnotation: makeLastRolloutAnnotation(clockMock, test.lastRollout)}
+			svc := generateService(&ServiceOpts{LatestReadyRevision: "test-002", Traffic: test.traffic, Annotations: annotations})
+			svcRecord := &rollout.ServiceRecord{Service: svc}
+			r := rollout.New(context.TODO(), metricsMock, svcRecord, strategy).WithClient(runclient).WithClock(clockMock)
+
+			retSvc, _, err := r.UpdateService(svc)
+			assert.Nil(t, err)
+
+			var report health.Report
+			assert.Nil(t, json.Unmarshal([]byte(retSvc.Metadata.Annotations[rollout.LastHealthReportJSONAnnotation]), &report))
+			assert.Equal(t, test.expected, report.Progress)
+		})
+	}
+}
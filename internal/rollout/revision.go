@@ -1,6 +1,8 @@
 package rollout
 
 import (
+	"fmt"
+
 	"google.golang.org/api/run/v1"
 )
 
@@ -34,7 +36,16 @@ func DetectStableRevisionName(svc *run.Service) string {
 
 // DetectCandidateRevisionName attempts to deduce what revision could be
 // considered a candidate.
+//
+// The last failed candidate is read from the service's annotations.
 func DetectCandidateRevisionName(svc *run.Service, stable string) string {
+	return detectCandidateRevisionName(svc, stable, svc.Metadata.Annotations[LastFailedCandidateRevisionAnnotation])
+}
+
+// detectCandidateRevisionName returns the candidate revision, which is the
+// latest ready revision if it is not the stable revision or the last failed
+// candidate.
+func detectCandidateRevisionName(svc *run.Service, stable, lastFailed string) string {
 	latestRevision := svc.Status.LatestReadyRevisionName
 	if stable == latestRevision {
 		return ""
@@ -42,12 +53,47 @@ func DetectCandidateRevisionName(svc *run.Service, stable string) string {
 
 	// If the latestRevision has previously been treated as a candidate and
 	// failed to meet health checks, no candidate exists.
-	if latestRevision == svc.Metadata.Annotations[LastFailedCandidateRevisionAnnotation] {
+	if latestRevision == lastFailed {
 		return ""
 	}
 	return latestRevision
 }
 
+// revisionConditions are the conditions of a revision that make it fail if
+// they are false.
+var revisionConditions = []string{"Ready", "ContainerHealthy", "ResourcesAvailable"}
+
+// revisionFailure returns the reason why the revision is failing, or an empty
+// string if it is not failing.
+//
+// A revision is failing if any of its Ready, ContainerHealthy or
+// ResourcesAvailable conditions is false. Unknown conditions (e.g. while the
+// revision is being deployed) are not considered failures. The Admin API does
+// not expose the container restarts or the instance count of a revision, so
+// the instances are checked from the metrics instead.
+func revisionFailure(revision *run.Revision) string {
+	if revision.Status == nil {
+		return ""
+	}
+	for _, conditionType := range revisionConditions {
+		for _, condition := range revision.Status.Conditions {
+			if condition.Type != conditionType || condition.Status != "False" {
+				continue
+			}
+
+			reason := fmt.Sprintf("revision condition %s is false", condition.Type)
+			if condition.Reason != "" {
+				reason += fmt.Sprintf(" (%s)", condition.Reason)
+			}
+			if condition.Message != "" {
+				reason += ": " + condition.Message
+			}
+			return reason
+		}
+	}
+	return ""
+}
+
 // find100PercentServingRevisionName scans the service and retrieves a revision
 // with 100% traffic.
 func find100PercentServingRevisionName(svc *run.Service) string {
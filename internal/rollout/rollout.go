@@ -4,11 +4,18 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"time"
 
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/baseline"
 	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
 	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health/webhook"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/history"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/incident"
 	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification"
 	runapi "github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/run"
 	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/util"
 	"github.com/jonboulle/clockwork"
@@ -24,6 +31,34 @@ const (
 	LastFailedCandidateRevisionAnnotation = "rollout.cloud.run/lastFailedCandidateRevision"
 	LastRolloutAnnotation                 = "rollout.cloud.run/lastRollout"
 	LastHealthReportAnnotation            = "rollout.cloud.run/lastHealthReport"
+
+	// LastHealthReportJSONAnnotation has the machine-readable version of the
+	// last health report. See health.Report for its format.
+	LastHealthReportJSONAnnotation = "rollout.cloud.run/lastHealthReportJSON"
+)
+
+// Decisions made about the candidate, as shown in the JSON health report.
+const (
+	// DecisionStart means a new candidate received its first traffic.
+	DecisionStart = "start"
+
+	// DecisionRollForward means the candidate's traffic was increased.
+	DecisionRollForward = "roll-forward"
+
+	// DecisionPromote means the candidate became the stable revision.
+	DecisionPromote = "promote"
+
+	// DecisionRollback means all the traffic was sent back to the stable
+	// revision.
+	DecisionRollback = "rollback"
+
+	// DecisionWait means the candidate is healthy, but not enough time has
+	// elapsed since the last roll forward.
+	DecisionWait = "wait"
+
+	// DecisionHold means the candidate's traffic was kept because its health
+	// could not be determined.
+	DecisionHold = "hold"
 )
 
 // ServiceRecord holds a service object and information about it.
@@ -35,16 +70,22 @@ type ServiceRecord struct {
 
 // Rollout is the rollout manager.
 type Rollout struct {
-	ctx             context.Context
-	metricsProvider metrics.Provider
-	service         *run.Service
-	serviceName     string
-	project         string
-	region          string
-	strategy        config.Strategy
-	runClient       runapi.Client
-	log             *logrus.Entry
-	time            clockwork.Clock
+	ctx              context.Context
+	metricsProvider  metrics.Provider
+	service          *run.Service
+	serviceName      string
+	project          string
+	region           string
+	strategy         config.Strategy
+	runClient        runapi.Client
+	log              *logrus.Entry
+	time             clockwork.Clock
+	baselineStore    baseline.Store
+	webhookClient    *webhook.Client
+	incidentProvider incident.Provider
+	historyStore     history.Store
+	stateStore       StateStore
+	notifier         notification.Notifier
 
 	// Used to determine if candidate should become stable during update.
 	promoteToStable bool
@@ -78,6 +119,8 @@ func New(ctx context.Context, metricsProvider metrics.Provider, svcRecord *Servi
 		strategy:        strategy,
 		log:             logrus.NewEntry(logrus.New()),
 		time:            clockwork.NewRealClock(),
+		webhookClient:   webhook.NewClient(http.DefaultClient),
+		stateStore:      NewAnnotationStateStore(),
 	}
 }
 
@@ -93,6 +136,46 @@ func (r *Rollout) WithLogger(logger *logrus.Logger) *Rollout {
 	return r
 }
 
+// WithBaselineStore updates the store of baseline samples in the rollout
+// instance.
+//
+// If set, a sample of the candidate's metrics is recorded when it becomes
+// stable, and anomaly criteria are checked against previous samples.
+func (r *Rollout) WithBaselineStore(store baseline.Store) *Rollout {
+	r.baselineStore = store
+	return r
+}
+
+// WithIncidentProvider updates the provider of the open incidents checked by
+// open incidents criteria in the rollout instance.
+func (r *Rollout) WithIncidentProvider(provider incident.Provider) *Rollout {
+	r.incidentProvider = provider
+	return r
+}
+
+// WithHistoryStore updates the store where the evaluations of the candidate
+// are recorded in the rollout instance.
+func (r *Rollout) WithHistoryStore(store history.Store) *Rollout {
+	r.historyStore = store
+	return r
+}
+
+// WithStateStore updates the store of the rollout state in the rollout
+// instance. By default, the state is kept in the annotations of the service.
+func (r *Rollout) WithStateStore(store StateStore) *Rollout {
+	r.stateStore = store
+	return r
+}
+
+// WithNotifier updates the notifier in the rollout instance.
+//
+// If set, a notification is sent every time the traffic of the candidate
+// changes.
+func (r *Rollout) WithNotifier(notifier notification.Notifier) *Rollout {
+	r.notifier = notifier
+	return r
+}
+
 // WithClock updates the clock in the rollout instance.
 func (r *Rollout) WithClock(clock clockwork.Clock) *Rollout {
 	r.time = clock
@@ -130,47 +213,232 @@ func (r *Rollout) UpdateService(svc *run.Service) (*run.Service, bool, error) {
 		return svc, false, nil
 	}
 
-	candidate := DetectCandidateRevisionName(svc, stable)
+	state, err := r.stateStore.Load(r.ctx, r.stateKey(), svc)
+	if err != nil {
+		return svc, false, errors.Wrap(err, "failed to load rollout state")
+	}
+
+	candidate := detectCandidateRevisionName(svc, stable, state.LastFailedCandidateRevision)
 	if candidate == "" {
+		if latest := svc.Status.LatestReadyRevisionName; latest != "" && latest != stable && latest == state.LastFailedCandidateRevision {
+			r.log.WithField("revision", latest).Debug("latest revision was rolled back before, skipping it")
+			if err := r.notifySkipped(svc, state, stable, latest); err != nil {
+				return svc, false, errors.Wrap(err, "failed to save rollout state")
+			}
+			return svc, false, nil
+		}
 		r.log.Debug("currently no candidate revision exists to rollout")
 		return svc, false, nil
 	}
 	r.log = r.log.WithFields(logrus.Fields{"stable": stable, "candidate": candidate})
+	trafficBefore := history.NewTraffic(svc.Spec.Traffic)
 
 	// A new candidate does not have metrics yet, so it can't be diagnosed.
 	if isNewCandidate(svc, candidate) {
 		r.log.Debug("new candidate, assign some traffic")
 		r.shouldRollout = true
 		svc.Spec.Traffic = r.rollForwardTraffic(svc.Spec.Traffic, stable, candidate)
-		svc = r.updateAnnotations(svc, stable, candidate)
-		r.setHealthReportAnnotation(svc, "new candidate, no health report available yet")
-
-		err := r.replaceService(svc)
-		return svc, true, errors.Wrap(err, "failed to replace service")
+		state = r.updateState(svc, state, stable, candidate, health.Unknown)
+		progress := r.progress(state)
+		r.setHealthReportAnnotation(svc, "new candidate, no health report available yet", progress)
+		jsonReport := r.completeReport(svc, health.Report{
+			Version:  health.ReportVersion,
+			Result:   health.Unknown.String(),
+			Reason:   "new candidate",
+			Criteria: []health.CriterionReport{},
+			Progress: progress,
+		}, stable, candidate, 0, DecisionStart)
+		r.setJSONReportAnnotation(svc, jsonReport)
+		r.setConditionsAnnotation(svc, jsonReport)
+		r.sendOnce(&state, r.newEvent(notification.EventCandidate, svc, health.Unknown, jsonReport), candidate)
+
+		if err := r.saveAndReplace(svc, state, jsonReport, trafficBefore); err != nil {
+			return svc, true, errors.Wrap(err, "failed to replace service")
+		}
+		r.notify(svc, health.Unknown, jsonReport)
+		return svc, true, nil
 	}
 
-	diagnosis, err := r.diagnoseCandidate(candidate, r.strategy.HealthCriteria)
+	healthCriteria := r.healthCriteria(state)
+	diagnosis, err := r.diagnoseCandidate(svc, candidate, healthCriteria)
 	if err != nil {
 		r.log.Error("could not diagnose candidate's health")
 		return svc, false, errors.Wrapf(err, "failed to diagnose health for candidate %q", candidate)
 	}
 
-	traffic, trafficChanged, err := r.determineTraffic(svc, diagnosis.OverallResult, stable, candidate)
+	// Votes can only veto or hold the rollout, so they are not needed if the
+	// candidate is already unhealthy.
+	if len(r.strategy.HealthWebhooks) != 0 && diagnosis.OverallResult != health.Unhealthy {
+		r.log.Debug("collecting health votes from webhooks")
+		ctx := util.ContextWithLogger(r.ctx, r.log)
+		diagnosis = health.MergeVotes(ctx, diagnosis, r.collectVotes(svc, stable, candidate))
+	}
+
+	var trafficPercent int64
+	if target := r.currentCandidateTraffic(svc.Spec.Traffic, candidate); target != nil {
+		trafficPercent = target.Percent
+	}
+	traffic, trafficChanged, err := r.determineTraffic(svc, diagnosis.OverallResult, stable, candidate, state.LastRollout)
 	if err != nil {
 		return svc, false, errors.Wrap(err, "failed to configure traffic after diagnosis")
 	}
 
 	svc.Spec.Traffic = traffic
-	svc = r.updateAnnotations(svc, stable, candidate)
+	state = r.updateState(svc, state, stable, candidate, diagnosis.OverallResult)
 
 	// If candidate is healthy, traffic only changes when enough time has
 	// elapsed. Thus, we can pass it as an argument representing if enough time
 	// has elapsed since last rollout.
-	report := health.StringReport(r.strategy.HealthCriteria, diagnosis, trafficChanged)
-	r.setHealthReportAnnotation(svc, report)
+	progress := r.progress(state)
+	report := health.StringReport(healthCriteria, diagnosis, trafficChanged, r.strategy.HealthCheckOffset)
+	r.setHealthReportAnnotation(svc, report, progress)
+	jsonReport := health.NewReport(healthCriteria, diagnosis, r.strategy.HealthCheckOffset)
+	jsonReport.Progress = progress
+	jsonReport = r.completeReport(svc, jsonReport, stable, candidate, trafficPercent, r.decision(diagnosis.OverallResult))
+	r.setJSONReportAnnotation(svc, jsonReport)
+	r.setConditionsAnnotation(svc, jsonReport)
+	if !trafficChanged {
+		r.notifyStalled(svc, &state, diagnosis.OverallResult, jsonReport)
+	}
 
-	err = r.replaceService(svc)
-	return svc, trafficChanged, errors.Wrap(err, "failed to replace service")
+	err = r.saveAndReplace(svc, state, jsonReport, trafficBefore)
+	if err != nil {
+		return svc, trafficChanged, errors.Wrap(err, "failed to replace service")
+	}
+
+	if r.promoteToStable {
+		r.recordBaselineSample(candidate)
+	}
+	if trafficChanged {
+		r.notify(svc, diagnosis.OverallResult, jsonReport)
+	}
+	return svc, trafficChanged, nil
+}
+
+// sinceLastStepPrecision is the precision of the windows since the last step.
+//
+// The window is part of the batched metrics queries, so it is rounded for the
+// services whose last steps are close to share them instead of each running
+// its own query.
+const sinceLastStepPrecision = time.Minute
+
+// healthCriteria returns the health criteria of the strategy with the windows
+// since the last step set to the time elapsed since the candidate's traffic
+// last changed, rounded to sinceLastStepPrecision. If that time is unknown,
+// the health check offset is used.
+func (r *Rollout) healthCriteria(state RolloutState) []config.HealthCriterion {
+	healthCriteria := make([]config.HealthCriterion, len(r.strategy.HealthCriteria))
+	copy(healthCriteria, r.strategy.HealthCriteria)
+
+	for i, criterion := range healthCriteria {
+		if !criterion.WindowSinceLastStep {
+			continue
+		}
+		if state.LastRollout.IsZero() {
+			r.log.Debug("unknown time since last step, using health check offset")
+			continue
+		}
+		elapsed := r.time.Now().Sub(state.LastRollout).Round(sinceLastStepPrecision)
+		if elapsed < sinceLastStepPrecision {
+			elapsed = sinceLastStepPrecision
+		}
+		healthCriteria[i].Window = elapsed
+	}
+	return healthCriteria
+}
+
+// candidateFailure returns the reason why the candidate's revision is failing
+// or an empty string if it is not.
+//
+// If the revision cannot be retrieved, it is not considered failing and the
+// diagnosis relies on metrics.
+func (r *Rollout) candidateFailure(svc *run.Service, candidate string) string {
+	revision, err := r.runClient.Revision(r.project, candidate)
+	if err != nil {
+		r.log.WithError(err).Warn("failed to retrieve candidate revision status")
+		return ""
+	}
+	if reason := revisionFailure(revision); reason != "" {
+		return reason
+	}
+	return r.noInstancesFailure(svc, candidate)
+}
+
+// noInstancesFailure returns the reason why the candidate is failing if it had
+// no instances during the health check offset even though it has traffic and
+// requests were sent to it, which happens when its containers crash or fail to
+// start. Otherwise, or if the metrics provider does not retrieve the instance
+// counts, it returns an empty string.
+//
+// Candidates without requests are not failing, since they might have been
+// scaled to zero.
+func (r *Rollout) noInstancesFailure(svc *run.Service, candidate string) string {
+	provider, ok := r.metricsProvider.(metrics.InstanceCountProvider)
+	if !ok {
+		return ""
+	}
+	target := r.currentCandidateTraffic(svc.Spec.Traffic, candidate)
+	if target == nil || target.Percent == 0 {
+		return ""
+	}
+
+	ctx := util.ContextWithLogger(r.ctx, r.log)
+	query := r.metricsQuery(candidate)
+	instances, err := provider.InstanceCount(ctx, query)
+	if err != nil {
+		if !errors.Is(err, metrics.ErrNoData) {
+			r.log.WithError(err).Warn("failed to retrieve candidate instance count")
+		}
+		return ""
+	}
+	if instances > 0 {
+		return ""
+	}
+	requests, err := r.metricsProvider.RequestCount(ctx, query)
+	if err != nil {
+		r.log.WithError(err).Warn("failed to retrieve candidate request count")
+		return ""
+	}
+	if requests == 0 {
+		return ""
+	}
+	return fmt.Sprintf("revision had no instances in %s while receiving %d%% of the traffic and %d requests", query.Window, target.Percent, requests)
+}
+
+// recordBaselineSample records the steady-state metrics of the candidate that
+// has become stable.
+//
+// Failing to record the sample does not fail the rollout.
+func (r *Rollout) recordBaselineSample(candidate string) {
+	if r.baselineStore == nil {
+		return
+	}
+
+	ctx := util.ContextWithLogger(r.ctx, r.log)
+	sample, err := health.CollectSample(ctx, r.metricsProvider, r.metricsQuery(candidate), r.time.Now())
+	if err == nil {
+		err = r.baselineStore.Add(ctx, r.baselineKey(), sample)
+	}
+	if err != nil {
+		r.log.WithError(err).Warn("failed to record baseline sample")
+		return
+	}
+	r.log.Debug("baseline sample recorded")
+}
+
+// baselineKey returns the key of the service in the baseline store.
+func (r *Rollout) baselineKey() baseline.Key {
+	return baseline.Key{Project: r.project, Region: r.region, Service: r.serviceName}
+}
+
+// metricsQuery returns the query for the metrics of the revision.
+func (r *Rollout) metricsQuery(revision string) metrics.Query {
+	return metrics.Query{
+		Region:   r.region,
+		Service:  r.serviceName,
+		Revision: revision,
+		Window:   r.strategy.HealthCheckOffset,
+	}
 }
 
 // replaceService updates the service object in Cloud Run.
@@ -179,27 +447,281 @@ func (r *Rollout) replaceService(svc *run.Service) error {
 	return errors.Wrapf(err, "could not update service %q", r.serviceName)
 }
 
-// updateAnnotations updates the annotations to keep some state about the rollout.
-func (r *Rollout) updateAnnotations(svc *run.Service, stable, candidate string) *run.Service {
+// saveAndReplace saves the rollout state and updates the service object in
+// Cloud Run.
+func (r *Rollout) saveAndReplace(svc *run.Service, state RolloutState, report health.Report, trafficBefore []history.Target) error {
+	ctx := util.ContextWithLogger(r.ctx, r.log)
+	if r.stateStore.InService() {
+		if err := r.stateStore.Save(ctx, r.stateKey(), svc, state); err != nil {
+			return errors.Wrap(err, "failed to save rollout state")
+		}
+		return r.replaceServiceWithHistory(svc, report, trafficBefore)
+	}
+
+	if err := r.replaceServiceWithHistory(svc, report, trafficBefore); err != nil {
+		return err
+	}
+	return errors.Wrap(r.stateStore.Save(ctx, r.stateKey(), svc, state), "failed to save rollout state")
+}
+
+// notify sends a notification about the change in the traffic of the
+// candidate, if a notifier was set.
+//
+// svc must be the service after the update. Failing to send the notification
+// does not fail the rollout.
+func (r *Rollout) notify(svc *run.Service, diagnosis health.DiagnosisResult, report health.Report) {
+	if r.notifier == nil {
+		return
+	}
+
+	event := r.newEvent(notification.EventRollout, svc, diagnosis, report)
+	switch report.Decision {
+	case DecisionRollback:
+		event.Type = notification.EventRollback
+	case DecisionPromote:
+		// The candidate is now tagged as stable.
+		event.Type = notification.EventPromotion
+		event.CandidateURL = tagURL(svc, StableTag)
+	}
+	r.sendNotification(event)
+}
+
+// notifyStalled sends the notifications about a candidate whose traffic did
+// not change: when it is blocked and when its health stays inconclusive for
+// the strategy's threshold. Each of them is only sent once per step of the
+// candidate, which is recorded in the state.
+func (r *Rollout) notifyStalled(svc *run.Service, state *RolloutState, diagnosis health.DiagnosisResult, report health.Report) {
+	key := fmt.Sprintf("%s/%d", report.Candidate, state.Step)
+	switch {
+	case report.Decision == DecisionWait:
+		event := r.newEvent(notification.EventBlocked, svc, diagnosis, report)
+		event.Reason = notification.ReasonMinWait
+		r.sendOnce(state, event, key)
+	case diagnosis == health.Inconclusive:
+		threshold := r.strategy.InconclusiveThreshold
+		if threshold == 0 || state.InconclusiveStreak < threshold {
+			break
+		}
+		event := r.newEvent(notification.EventInconclusive, svc, diagnosis, report)
+		event.Reason = fmt.Sprintf("inconclusive for %d consecutive evaluations", state.InconclusiveStreak)
+		r.sendOnce(state, event, key)
+	}
+}
+
+// notifySkipped notifies that the latest revision is not rolled out because it
+// was rolled back before. It is only notified once per revision, so the state
+// is saved when the notification is recorded in it.
+func (r *Rollout) notifySkipped(svc *run.Service, state RolloutState, stable, revision string) error {
+	report := health.Report{
+		Version:   health.ReportVersion,
+		Result:    health.Unknown.String(),
+		Reason:    "rolled back before",
+		Criteria:  []health.CriterionReport{},
+		Candidate: revision,
+		Stable:    stable,
+		Timestamp: r.time.Now().UTC(),
+	}
+	event := r.newEvent(notification.EventSkipped, svc, health.Unknown, report)
+	event.Reason = fmt.Sprintf("revision %s was rolled back before, deploy a new revision to roll it out", revision)
+	if !r.sendOnce(&state, event, revision) {
+		return nil
+	}
+
+	ctx := util.ContextWithLogger(r.ctx, r.log)
+	if err := r.stateStore.Save(ctx, r.stateKey(), svc, state); err != nil {
+		return err
+	}
+	if r.stateStore.InService() {
+		return r.replaceService(svc)
+	}
+	return nil
+}
+
+// sendOnce sends the notification if the event of its type and the given key
+// was not sent yet and, once it is sent, records it in the state. It returns
+// true if the state changed.
+//
+// The event is only recorded as sent if all the sinks receive it. Otherwise,
+// the sinks that received it are recorded, so the next evaluation sends it
+// again with the same ID to the other sinks only. Since the state is saved
+// after the notification, an event might also be sent more than once if saving
+// it fails.
+func (r *Rollout) sendOnce(state *RolloutState, event notification.Event, key string) bool {
+	if r.notifier == nil || state.Notified[event.Type] == key {
+		return false
+	}
+	delivery, retried := state.Deliveries[event.Type]
+	if retried && delivery.Key == key {
+		event.ID = delivery.EventID
+		event.SentTo = delivery.SentTo
+	}
+
+	err := r.sendNotification(event)
+	if err != nil {
+		var sentTo []string
+		if fanoutErr, ok := errors.Cause(err).(*notification.FanoutError); ok {
+			sentTo = fanoutErr.SentTo
+		}
+		if retried && delivery.Key == key && len(sentTo) == len(delivery.SentTo) {
+			return false
+		}
+		if state.Deliveries == nil {
+			state.Deliveries = make(map[notification.EventType]Delivery)
+		}
+		state.Deliveries[event.Type] = Delivery{Key: key, EventID: event.ID, SentTo: sentTo}
+		return true
+	}
+
+	delete(state.Deliveries, event.Type)
+	if state.Notified == nil {
+		state.Notified = make(map[notification.EventType]string)
+	}
+	state.Notified[event.Type] = key
+	return true
+}
+
+// newEvent returns a notification about the candidate with a new ID. svc must
+// be the service after the update.
+func (r *Rollout) newEvent(eventType notification.EventType, svc *run.Service, diagnosis health.DiagnosisResult, report health.Report) notification.Event {
+	id, err := notification.NewEventID()
+	if err != nil {
+		// The sinks that need the ID fail to send the notification.
+		r.log.WithError(err).Warn("failed to generate event ID")
+	}
+	return notification.Event{
+		ID:            id,
+		Type:          eventType,
+		Project:       r.project,
+		Region:        r.region,
+		Service:       r.serviceName,
+		CandidateURL:  tagURL(svc, CandidateTag),
+		Report:        report,
+		Time:          report.Timestamp,
+		ServiceObject: svc,
+		Diagnosis:     diagnosis,
+	}
+}
+
+// sendNotification sends the notification, if a notifier was set. Failing to
+// send it does not fail the rollout, the error is logged and returned.
+func (r *Rollout) sendNotification(event notification.Event) error {
+	if r.notifier == nil {
+		return nil
+	}
+	ctx := util.ContextWithLogger(r.ctx, r.log)
+	err := r.notifier.Notify(ctx, event)
+	if err != nil {
+		r.log.WithError(err).WithField("type", event.Type).Warn("failed to send rollout notification")
+	}
+	return err
+}
+
+// tagURL returns the URL of a tag of the service, or an empty string if it is
+// unknown.
+//
+// The URL is based on the service's URL, since the URLs of the traffic targets
+// are only known once the update of the service is done.
+func tagURL(svc *run.Service, tag string) string {
+	if svc.Status == nil || svc.Status.Url == "" {
+		return ""
+	}
+	u, err := url.Parse(svc.Status.Url)
+	if err != nil {
+		return ""
+	}
+	// TODO: this only works for Cloud Run fully managed.
+	u.Host = tag + "---" + u.Host
+	return u.String()
+}
+
+// stateKey returns the key of the service in the state store.
+func (r *Rollout) stateKey() StateKey {
+	return StateKey{Project: r.project, Region: r.region, Service: r.serviceName}
+}
+
+// replaceServiceWithHistory updates the service object in Cloud Run and
+// records the evaluation in the history.
+//
+// Failing to record the evaluation does not fail the rollout.
+func (r *Rollout) replaceServiceWithHistory(svc *run.Service, report health.Report, trafficBefore []history.Target) error {
+	if r.historyStore == nil {
+		return r.replaceService(svc)
+	}
+
+	record := history.Record{
+		Project:       r.project,
+		Region:        r.region,
+		Service:       r.serviceName,
+		Diagnosis:     report,
+		TrafficBefore: trafficBefore,
+		TrafficAfter:  history.NewTraffic(svc.Spec.Traffic),
+		Timestamp:     report.Timestamp,
+	}
+	// Stores that keep the history in the service record the evaluation as part
+	// of the update of the service.
+	if store, ok := r.historyStore.(history.ServiceStore); ok {
+		if err := store.AppendToService(svc, record); err != nil {
+			r.log.WithError(err).Warn("failed to record evaluation in history")
+		}
+		return r.replaceService(svc)
+	}
+
+	if err := r.replaceService(svc); err != nil {
+		return err
+	}
+	ctx := util.ContextWithLogger(r.ctx, r.log)
+	if err := r.historyStore.Append(ctx, record); err != nil {
+		r.log.WithError(err).Warn("failed to record evaluation in history")
+	}
+	return nil
+}
+
+// updateState updates the rollout state after the evaluation of the candidate,
+// whose result is unknown if it is a new candidate.
+func (r *Rollout) updateState(svc *run.Service, state RolloutState, stable, candidate string, diagnosis health.DiagnosisResult) RolloutState {
+	now := r.time.Now()
+	if diagnosis == health.Unknown || state.CandidateRevision != candidate {
+		state.CandidateSince = now
+		state.HealthyStreak = 0
+		state.InconclusiveStreak = 0
+	}
+	switch diagnosis {
+	case health.Healthy:
+		state.HealthyStreak++
+		state.InconclusiveStreak = 0
+	case health.Inconclusive:
+		state.InconclusiveStreak++
+		state.HealthyStreak = 0
+	case health.Unhealthy:
+		state.HealthyStreak = 0
+		state.InconclusiveStreak = 0
+	}
 	if r.shouldRollout {
-		now := r.time.Now().Format(time.RFC3339)
-		setAnnotation(svc, LastRolloutAnnotation, now)
+		state.LastRollout = now
 	}
+	state.LastEvaluation = now
 
 	// The candidate has become the stable revision.
 	if r.promoteToStable {
-		setAnnotation(svc, StableRevisionAnnotation, candidate)
-		delete(svc.Metadata.Annotations, CandidateRevisionAnnotation)
-		return svc
+		state.Phase = PhaseStable
+		state.StableRevision = candidate
+		state.CandidateRevision = ""
+		state.Step = 0
+		return state
 	}
 
-	setAnnotation(svc, StableRevisionAnnotation, stable)
-	setAnnotation(svc, CandidateRevisionAnnotation, candidate)
+	state.Phase = PhaseProgressing
+	state.StableRevision = stable
+	state.CandidateRevision = candidate
+	state.Step = 0
+	if target := r.currentCandidateTraffic(svc.Spec.Traffic, candidate); target != nil {
+		state.Step = target.Percent
+	}
 	if r.shouldRollback {
-		setAnnotation(svc, LastFailedCandidateRevisionAnnotation, candidate)
+		state.Phase = PhaseRolledBack
+		state.LastFailedCandidateRevision = candidate
 	}
-
-	return svc
+	return state
 }
 
 // setAnnotation sets the value of an annotation.
@@ -210,25 +732,126 @@ func setAnnotation(svc *run.Service, key, value string) {
 	svc.Metadata.Annotations[key] = value
 }
 
-// setHealthReportAnnotation appends the current time to the report and sets
-// the health report annotation.
-func (r *Rollout) setHealthReportAnnotation(svc *run.Service, report string) {
+// setHealthReportAnnotation appends the progress of the rollout, if any, and
+// the current time to the report and sets the health report annotation.
+func (r *Rollout) setHealthReportAnnotation(svc *run.Service, report string, progress *health.ProgressReport) {
+	if progress != nil {
+		report += fmt.Sprintf("\nprogress: %s", progress)
+	}
 	report += fmt.Sprintf("\nlastUpdate: %s", r.time.Now().Format(time.RFC3339))
 	setAnnotation(svc, LastHealthReportAnnotation, report)
 }
 
+// completeReport completes the machine-readable report with the information
+// about the rollout.
+func (r *Rollout) completeReport(svc *run.Service, report health.Report, stable, candidate string, trafficPercent int64, decision string) health.Report {
+	report.Candidate = candidate
+	report.Stable = stable
+	report.TrafficPercent = trafficPercent
+	if target := r.currentCandidateTraffic(svc.Spec.Traffic, candidate); target != nil {
+		report.NewTrafficPercent = target.Percent
+	}
+	report.Decision = decision
+	report.Timestamp = r.time.Now().UTC()
+	return report
+}
+
+// setJSONReportAnnotation sets the JSON health report annotation.
+//
+// Failing to encode the report does not fail the rollout.
+func (r *Rollout) setJSONReportAnnotation(svc *run.Service, report health.Report) {
+	data, err := report.JSON()
+	if err != nil {
+		r.log.WithError(err).Warn("failed to encode JSON health report")
+		return
+	}
+	setAnnotation(svc, LastHealthReportJSONAnnotation, data)
+}
+
+// decision returns the decision made about the candidate after the diagnosis.
+func (r *Rollout) decision(diagnosis health.DiagnosisResult) string {
+	switch {
+	case r.shouldRollback:
+		return DecisionRollback
+	case r.promoteToStable:
+		return DecisionPromote
+	case r.shouldRollout:
+		return DecisionRollForward
+	case diagnosis == health.Healthy:
+		return DecisionWait
+	default:
+		return DecisionHold
+	}
+}
+
 // diagnoseCandidate returns the candidate's diagnosis based on metrics.
-func (r *Rollout) diagnoseCandidate(candidate string, healthCriteria []config.HealthCriterion) (d health.Diagnosis, err error) {
+//
+// A candidate whose revision is failing (one of its conditions is false or it
+// has no instances) is unhealthy regardless of its metrics, since it might not
+// serve enough requests to be diagnosed otherwise.
+func (r *Rollout) diagnoseCandidate(svc *run.Service, candidate string, healthCriteria []config.HealthCriterion) (d health.Diagnosis, err error) {
+	if reason := r.candidateFailure(svc, candidate); reason != "" {
+		r.log.WithField("reason", reason).Info("candidate revision is failing")
+		return health.Diagnosis{OverallResult: health.Unhealthy, Reason: reason}, nil
+	}
+
 	r.log.Debug("collecting metrics from API")
 	ctx := util.ContextWithLogger(r.ctx, r.log)
-	r.metricsProvider.SetCandidateRevision(candidate)
-	healthCheckOffset := r.strategy.HealthCheckOffset
-	metricsValues, err := health.CollectMetrics(ctx, r.metricsProvider, healthCheckOffset, healthCriteria)
+	query := r.metricsQuery(candidate)
+	if target := r.currentCandidateTraffic(svc.Spec.Traffic, candidate); target != nil {
+		query.TrafficPercent = target.Percent
+	}
+
+	expr := r.strategy.CompiledHealthExpression()
+	if r.strategy.HealthExpression != "" {
+		if expr == nil {
+			return d, errors.New("the health expression of the strategy was not compiled, the strategy must be validated")
+		}
+		healthCriteria = health.ExpressionCriteria(expr)
+	}
+
+	var samples []baseline.Sample
+	if size := health.BaselineSize(healthCriteria); size > 0 && r.baselineStore != nil {
+		samples, err = r.baselineStore.Samples(ctx, r.baselineKey(), size)
+		if err != nil {
+			return d, errors.Wrap(err, "failed to retrieve baseline samples")
+		}
+	}
+
+	sources := health.Sources{Baseline: samples}
+	if health.UsesIncidents(healthCriteria) {
+		if r.incidentProvider == nil {
+			return d, errors.New("open incidents criteria require an incidents provider")
+		}
+		sources.Incidents, err = r.incidentProvider.OpenIncidents(ctx, incident.Query{Project: r.project, Region: r.region, Service: r.serviceName})
+		if errors.Is(err, metrics.ErrNoData) {
+			r.log.WithError(err).Debug("open incidents are unknown")
+			sources.NoIncidentData = true
+		} else if err != nil {
+			return d, errors.Wrap(err, "failed to retrieve open incidents")
+		}
+	}
+
+	metricsValues, err := health.CollectMetricsWithSources(ctx, r.metricsProvider, query, healthCriteria, sources)
+	if errors.Is(err, metrics.ErrUnavailable) {
+		// Without metrics, the candidate's health cannot be determined. Keep the
+		// current traffic until the provider is available again.
+		r.log.WithError(err).Warn("metrics provider unavailable, diagnosis is inconclusive")
+		return health.Diagnosis{OverallResult: health.Inconclusive, Reason: err.Error()}, nil
+	}
 	if err != nil {
 		return d, errors.Wrap(err, "failed to collect metrics")
 	}
 
 	r.log.Debug("diagnosing candidate's health")
+	if expr != nil {
+		d, err = health.DiagnoseExpression(ctx, expr, metricsValues)
+		return d, errors.Wrap(err, "failed to evaluate candidate's health")
+	}
+	if r.strategy.HealthScoring.Enabled {
+		d, err = health.Score(ctx, healthCriteria, metricsValues, r.strategy.HealthScoring)
+		return d, errors.Wrap(err, "failed to score candidate's health")
+	}
 	d, err = health.Diagnose(ctx, healthCriteria, metricsValues)
 	return d, errors.Wrap(err, "failed to diagnose candidate's health")
 }
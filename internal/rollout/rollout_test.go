@@ -2,16 +2,31 @@ package rollout_test
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/baseline"
 	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health/webhook"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/history"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/incident"
+	incidentmock "github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/incident/mock"
 	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics"
 	metricsmock "github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/metrics/mock"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification"
+	notificationmock "github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification/mock"
 	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/rollout"
 	runmock "github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/run/mock"
 	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/api/run/v1"
@@ -40,6 +55,16 @@ func generateService(opts *ServiceOpts) *run.Service {
 	}
 }
 
+// readyRevision is a mock implementation to retrieve a revision whose
+// conditions are all true.
+func readyRevision(namespace, revisionID string) (*run.Revision, error) {
+	return &run.Revision{
+		Status: &run.RevisionStatus{
+			Conditions: []*run.GoogleCloudRunV1Condition{{Type: "Ready", Status: "True"}},
+		},
+	}, nil
+}
+
 func makeLastRolloutAnnotation(clock clockwork.Clock, offsetFromNowMinute int) string {
 	offset := time.Duration(offsetFromNowMinute) * time.Minute
 	return clock.Now().Add(offset).Format(time.RFC3339)
@@ -47,18 +72,18 @@ func makeLastRolloutAnnotation(clock clockwork.Clock, offsetFromNowMinute int) s
 
 func TestUpdateService(t *testing.T) {
 	runclient := &runmock.RunAPI{}
+	runclient.RevisionFn = readyRevision
 	clockMock := clockwork.NewFakeClock()
 	metricsMock := &metricsmock.Metrics{}
-	metricsMock.RequestCountFn = func(ctx context.Context, offset time.Duration) (int64, error) {
+	metricsMock.RequestCountFn = func(ctx context.Context, query metrics.Query) (int64, error) {
 		return 1000, nil
 	}
-	metricsMock.LatencyFn = func(ctx context.Context, offset time.Duration, alignReduceType metrics.AlignReduce) (float64, error) {
+	metricsMock.LatencyFn = func(ctx context.Context, query metrics.Query) (float64, error) {
 		return 500, nil
 	}
-	metricsMock.ErrorRateFn = func(ctx context.Context, offset time.Duration) (float64, error) {
+	metricsMock.ErrorRateFn = func(ctx context.Context, query metrics.Query) (float64, error) {
 		return 0.01, nil
 	}
-	metricsMock.SetCandidateRevisionFn = func(revisionName string) {}
 	strategy := config.Strategy{
 		Steps:               []int64{10, 40, 70},
 		HealthCheckOffset:   5 * time.Minute,
@@ -96,6 +121,7 @@ func TestUpdateService(t *testing.T) {
 				rollout.CandidateRevisionAnnotation: "test-003",
 				rollout.LastRolloutAnnotation:       clockMock.Now().Format(time.RFC3339),
 				rollout.LastHealthReportAnnotation: "new candidate, no health report available yet" +
+					fmt.Sprintf("\nprogress: step 1 of 4, all the traffic expected at %s", clockMock.Now().Add(3*strategy.TimeBetweenRollouts).Format(time.RFC3339)) +
 					fmt.Sprintf("\nlastUpdate: %s", clockMock.Now().Format(time.RFC3339)),
 			},
 			outTraffic: []*run.TrafficTarget{
@@ -134,6 +160,7 @@ func TestUpdateService(t *testing.T) {
 				rollout.CandidateRevisionAnnotation: "test-002",
 				rollout.LastRolloutAnnotation:       makeLastRolloutAnnotation(clockMock, 0),
 				rollout.LastHealthReportAnnotation: "new candidate, no health report available yet" +
+					fmt.Sprintf("\nprogress: step 1 of 4, all the traffic expected at %s", clockMock.Now().Add(3*strategy.TimeBetweenRollouts).Format(time.RFC3339)) +
 					fmt.Sprintf("\nlastUpdate: %s", clockMock.Now().Format(time.RFC3339)),
 			},
 			outTraffic: []*run.TrafficTarget{
@@ -164,8 +191,9 @@ func TestUpdateService(t *testing.T) {
 				rollout.LastRolloutAnnotation:       makeLastRolloutAnnotation(clockMock, 0),
 				rollout.LastHealthReportAnnotation: "status: healthy\n" +
 					"metrics:" +
-					"\n- request-latency[p99]: 500.00 (needs 750.00)" +
-					"\n- error-rate-percent: 1.00 (needs 5.00)" +
+					"\n- request-latency[p99]: 500.00 (needs 750.00, over 5m0s)" +
+					"\n- error-rate-percent: 1.00 (needs 5.00, over 5m0s)" +
+					fmt.Sprintf("\nprogress: step 3 of 4, all the traffic expected at %s", clockMock.Now().Add(1*strategy.TimeBetweenRollouts).Format(time.RFC3339)) +
 					fmt.Sprintf("\nlastUpdate: %s", clockMock.Now().Format(time.RFC3339)),
 			},
 			outTraffic: []*run.TrafficTarget{
@@ -196,8 +224,9 @@ func TestUpdateService(t *testing.T) {
 				rollout.LastRolloutAnnotation:       makeLastRolloutAnnotation(clockMock, 0),
 				rollout.LastHealthReportAnnotation: "status: healthy, but no enough time since last rollout\n" +
 					"metrics:" +
-					"\n- request-latency[p99]: 500.00 (needs 750.00)" +
-					"\n- error-rate-percent: 1.00 (needs 5.00)" +
+					"\n- request-latency[p99]: 500.00 (needs 750.00, over 5m0s)" +
+					"\n- error-rate-percent: 1.00 (needs 5.00, over 5m0s)" +
+					fmt.Sprintf("\nprogress: step 2 of 4, all the traffic expected at %s", clockMock.Now().Add(2*strategy.TimeBetweenRollouts).Format(time.RFC3339)) +
 					fmt.Sprintf("\nlastUpdate: %s", clockMock.Now().Format(time.RFC3339)),
 			},
 			changedTraffic: false,
@@ -215,6 +244,7 @@ func TestUpdateService(t *testing.T) {
 				rollout.CandidateRevisionAnnotation: "test-003",
 				rollout.LastRolloutAnnotation:       makeLastRolloutAnnotation(clockMock, 0),
 				rollout.LastHealthReportAnnotation: "new candidate, no health report available yet" +
+					fmt.Sprintf("\nprogress: step 1 of 4, all the traffic expected at %s", clockMock.Now().Add(3*strategy.TimeBetweenRollouts).Format(time.RFC3339)) +
 					fmt.Sprintf("\nlastUpdate: %s", clockMock.Now().Format(time.RFC3339)),
 			},
 			outTraffic: []*run.TrafficTarget{
@@ -243,8 +273,8 @@ func TestUpdateService(t *testing.T) {
 				rollout.LastRolloutAnnotation:    makeLastRolloutAnnotation(clockMock, 0),
 				rollout.LastHealthReportAnnotation: "status: healthy\n" +
 					"metrics:" +
-					"\n- request-latency[p99]: 500.00 (needs 750.00)" +
-					"\n- error-rate-percent: 1.00 (needs 5.00)" +
+					"\n- request-latency[p99]: 500.00 (needs 750.00, over 5m0s)" +
+					"\n- error-rate-percent: 1.00 (needs 5.00, over 5m0s)" +
 					fmt.Sprintf("\nlastUpdate: %s", clockMock.Now().Format(time.RFC3339)),
 			},
 			outTraffic: []*run.TrafficTarget{
@@ -270,8 +300,8 @@ func TestUpdateService(t *testing.T) {
 				rollout.LastFailedCandidateRevisionAnnotation: "test-002",
 				rollout.LastHealthReportAnnotation: "status: unhealthy\n" +
 					"metrics:" +
-					"\n- request-latency[p99]: 500.00 (needs 100.00)" +
-					"\n- error-rate-percent: 1.00 (needs 0.95)" +
+					"\n- request-latency[p99]: 500.00 (needs 100.00, over 5m0s)" +
+					"\n- error-rate-percent: 1.00 (needs 0.95, over 5m0s)" +
 					fmt.Sprintf("\nlastUpdate: %s", clockMock.Now().Format(time.RFC3339)),
 			},
 			outTraffic: []*run.TrafficTarget{
@@ -312,8 +342,9 @@ func TestUpdateService(t *testing.T) {
 				rollout.CandidateRevisionAnnotation: "test-002",
 				rollout.LastHealthReportAnnotation: "status: inconclusive\n" +
 					"metrics:" +
-					"\n- request-count: 1000 (needs 1500)" +
-					"\n- error-rate-percent: 1.00 (needs 5.00)" +
+					"\n- request-count: 1000 (needs 1500, over 5m0s)" +
+					"\n- error-rate-percent: 1.00 (needs 5.00, over 5m0s)" +
+					fmt.Sprintf("\nprogress: step 1 of 4, all the traffic expected at %s", clockMock.Now().Add(2*strategy.TimeBetweenRollouts).Format(time.RFC3339)) +
 					fmt.Sprintf("\nlastUpdate: %s", clockMock.Now().Format(time.RFC3339)),
 			},
 			changedTraffic: false,
@@ -359,6 +390,14 @@ func TestUpdateService(t *testing.T) {
 			}
 
 			assert.Equal(tt, test.changedTraffic, changedTraffic)
+			// The structured annotations are tested separately.
+			if _, ok := test.outAnnotations[rollout.LastHealthReportAnnotation]; ok {
+				for _, annotation := range []string{rollout.LastHealthReportJSONAnnotation, rollout.StateAnnotation, rollout.ConditionsAnnotation} {
+					value := retSvc.Metadata.Annotations[annotation]
+					assert.True(tt, json.Valid([]byte(value)), "invalid JSON in %s annotation: %q", annotation, value)
+					delete(retSvc.Metadata.Annotations, annotation)
+				}
+			}
 			assert.Equal(tt, test.outAnnotations, retSvc.Metadata.Annotations)
 			if !test.changedTraffic {
 				assert.Equal(tt, svc.Spec.Traffic, retSvc.Spec.Traffic)
@@ -369,3 +408,1038 @@ func TestUpdateService(t *testing.T) {
 
 	}
 }
+
+// TestUpdateService_MetricsUnavailable tests that the candidate's traffic is
+// kept when the metrics provider is unavailable.
+func TestUpdateService_MetricsUnavailable(t *testing.T) {
+	runclient := &runmock.RunAPI{}
+	runclient.RevisionFn = readyRevision
+	runclient.ReplaceServiceFn = func(namespace, serviceID string, svc *run.Service) (*run.Service, error) {
+		return svc, nil
+	}
+	clockMock := clockwork.NewFakeClock()
+	metricsMock := &metricsmock.Metrics{}
+	metricsMock.ErrorRateFn = func(ctx context.Context, query metrics.Query) (float64, error) {
+		return 0, errors.Wrap(metrics.ErrUnavailable, "circuit breaker open")
+	}
+	strategy := config.Strategy{
+		Steps:             []int64{10, 40, 70},
+		HealthCheckOffset: 5 * time.Minute,
+		HealthCriteria: []config.HealthCriterion{
+			{Metric: config.ErrorRateMetricsCheck, Threshold: 5},
+		},
+	}
+
+	traffic := []*run.TrafficTarget{
+		{RevisionName: "test-002", Percent: 20, Tag: rollout.CandidateTag},
+		{RevisionName: "test-001", Percent: 80, Tag: rollout.StableTag},
+	}
+	svc := generateService(&ServiceOpts{LatestReadyRevision: "test-002", Traffic: traffic})
+	svcRecord := &rollout.ServiceRecord{Service: svc}
+	r := rollout.New(context.TODO(), metricsMock, svcRecord, strategy).WithClient(runclient).WithClock(clockMock)
+
+	retSvc, changedTraffic, err := r.UpdateService(svc)
+	assert.Nil(t, err)
+	assert.False(t, changedTraffic)
+	assert.Equal(t, traffic, retSvc.Spec.Traffic)
+	assert.Equal(t, "status: inconclusive\n"+
+		"reason: failed to obtain metrics \"error-rate-percent\": failed to get error rate metrics: circuit breaker open: metrics provider unavailable\n"+
+		"metrics:"+
+		fmt.Sprintf("\nprogress: step 1 of 4, all the traffic expected at %s", clockMock.Now().Format(time.RFC3339))+
+		fmt.Sprintf("\nlastUpdate: %s", clockMock.Now().Format(time.RFC3339)),
+		retSvc.Metadata.Annotations[rollout.LastHealthReportAnnotation])
+}
+
+// TestUpdateService_JSONHealthReport tests that the machine-readable health
+// report is set with the diagnosis and the decision.
+func TestUpdateService_JSONHealthReport(t *testing.T) {
+	runclient := &runmock.RunAPI{}
+	runclient.RevisionFn = readyRevision
+	runclient.ReplaceServiceFn = func(namespace, serviceID string, svc *run.Service) (*run.Service, error) {
+		return svc, nil
+	}
+	clockMock := clockwork.NewFakeClock()
+	metricsMock := &metricsmock.Metrics{}
+	metricsMock.ErrorRateFn = func(ctx context.Context, query metrics.Query) (float64, error) {
+		return 0.1, nil
+	}
+	strategy := config.Strategy{
+		Steps:             []int64{10, 40, 70},
+		HealthCheckOffset: 5 * time.Minute,
+		HealthCriteria: []config.HealthCriterion{
+			{Metric: config.ErrorRateMetricsCheck, Threshold: 5},
+		},
+	}
+
+	traffic := []*run.TrafficTarget{
+		{RevisionName: "test-002", Percent: 20, Tag: rollout.CandidateTag},
+		{RevisionName: "test-001", Percent: 80, Tag: rollout.StableTag},
+	}
+	svc := generateService(&ServiceOpts{LatestReadyRevision: "test-002", Traffic: traffic})
+	svcRecord := &rollout.ServiceRecord{Service: svc}
+	r := rollout.New(context.TODO(), metricsMock, svcRecord, strategy).WithClient(runclient).WithClock(clockMock)
+
+	retSvc, changedTraffic, err := r.UpdateService(svc)
+	assert.Nil(t, err)
+	assert.True(t, changedTraffic)
+
+	var report health.Report
+	err = json.Unmarshal([]byte(retSvc.Metadata.Annotations[rollout.LastHealthReportJSONAnnotation]), &report)
+	assert.Nil(t, err)
+	assert.Equal(t, health.Report{
+		Version: health.ReportVersion,
+		Result:  "unhealthy",
+		Criteria: []health.CriterionReport{
+			{Metric: "error-rate-percent", Threshold: 5, ActualValue: 10, WindowSeconds: 300},
+		},
+		Candidate:         "test-002",
+		Stable:            "test-001",
+		TrafficPercent:    20,
+		NewTrafficPercent: 0,
+		Decision:          rollout.DecisionRollback,
+		Timestamp:         clockMock.Now().UTC(),
+	}, report)
+}
+
+// TestUpdateService_History tests that the evaluations of the candidate are
+// recorded in the history.
+func TestUpdateService_History(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	runclient := &runmock.RunAPI{}
+	runclient.RevisionFn = readyRevision
+	runclient.ReplaceServiceFn = func(namespace, serviceID string, svc *run.Service) (*run.Service, error) {
+		return svc, nil
+	}
+	clockMock := clockwork.NewFakeClock()
+	metricsMock := &metricsmock.Metrics{}
+	metricsMock.ErrorRateFn = func(ctx context.Context, query metrics.Query) (float64, error) {
+		return 0.1, nil
+	}
+	strategy := config.Strategy{
+		Steps:             []int64{10, 40, 70},
+		HealthCheckOffset: 5 * time.Minute,
+		HealthCriteria: []config.HealthCriterion{
+			{Metric: config.ErrorRateMetricsCheck, Threshold: 5},
+		},
+	}
+
+	stores := map[string]history.Store{
+		"file":       history.NewFileStore(filepath.Join(dir, "history.jsonl")),
+		"annotation": history.NewAnnotationStore(5, nil),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			traffic := []*run.TrafficTarget{
+				{RevisionName: "test-002", Percent: 20, Tag: rollout.CandidateTag},
+				{RevisionName: "test-001", Percent: 80, Tag: rollout.StableTag},
+			}
+			svc := generateService(&ServiceOpts{LatestReadyRevision: "test-002", Traffic: traffic})
+			svc.Metadata.Name = "mysvc"
+			svcRecord := &rollout.ServiceRecord{Service: svc, Project: "myproject", Region: "us-east1"}
+			r := rollout.New(context.TODO(), metricsMock, svcRecord, strategy).WithClient(runclient).WithClock(clockMock).WithHistoryStore(store)
+
+			retSvc, changedTraffic, err := r.UpdateService(svc)
+			assert.Nil(t, err)
+			assert.True(t, changedTraffic)
+
+			var records []history.Record
+			if name == "annotation" {
+				err = json.Unmarshal([]byte(retSvc.Metadata.Annotations[history.Annotation]), &records)
+			} else {
+				records, err = store.Records(context.Background(), history.Key{Project: "myproject", Region: "us-east1", Service: "mysvc"}, 0)
+			}
+			assert.Nil(t, err)
+			assert.Len(t, records, 1)
+
+			record := records[0]
+			assert.Equal(t, "mysvc", record.Service)
+			assert.Equal(t, "unhealthy", record.Diagnosis.Result)
+			assert.Equal(t, rollout.DecisionRollback, record.Diagnosis.Decision)
+			assert.Equal(t, []history.Target{
+				{Revision: "test-002", Percent: 20, Tag: rollout.CandidateTag},
+				{Revision: "test-001", Percent: 80, Tag: rollout.StableTag},
+			}, record.TrafficBefore)
+			assert.True(t, record.TrafficChanged())
+			assert.Equal(t, clockMock.Now().UTC(), record.Timestamp)
+		})
+	}
+}
+
+// TestUpdateService_StateStore tests that the rollout state is kept in the
+// state store across evaluations.
+func TestUpdateService_StateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	runclient := &runmock.RunAPI{}
+	runclient.RevisionFn = readyRevision
+	runclient.ReplaceServiceFn = func(namespace, serviceID string, svc *run.Service) (*run.Service, error) {
+		return svc, nil
+	}
+	clockMock := clockwork.NewFakeClock()
+	metricsMock := &metricsmock.Metrics{}
+	metricsMock.ErrorRateFn = func(ctx context.Context, query metrics.Query) (float64, error) {
+		return 0.01, nil
+	}
+	strategy := config.Strategy{
+		Steps:               []int64{10, 40, 70},
+		HealthCheckOffset:   5 * time.Minute,
+		TimeBetweenRollouts: 10 * time.Minute,
+		HealthCriteria: []config.HealthCriterion{
+			{Metric: config.ErrorRateMetricsCheck, Threshold: 5},
+		},
+	}
+	store := rollout.NewFileStateStore(filepath.Join(dir, "state.json"))
+	key := rollout.StateKey{Project: "myproject", Region: "us-east1", Service: "mysvc"}
+
+	traffic := []*run.TrafficTarget{
+		{RevisionName: "test-001", Percent: 100, Tag: rollout.StableTag},
+	}
+	svc := generateService(&ServiceOpts{LatestReadyRevision: "test-002", Traffic: traffic})
+	svc.Metadata.Name = "mysvc"
+	evaluate := func() {
+		svcRecord := &rollout.ServiceRecord{Service: svc, Project: "myproject", Region: "us-east1"}
+		r := rollout.New(context.TODO(), metricsMock, svcRecord, strategy).WithClient(runclient).WithClock(clockMock).WithStateStore(store)
+		_, _, err := r.UpdateService(svc)
+		assert.Nil(t, err)
+	}
+
+	// The new candidate receives traffic, and the state is not kept in the
+	// annotations.
+	evaluate()
+	state, err := store.Load(context.Background(), key, svc)
+	assert.Nil(t, err)
+	assert.Equal(t, rollout.RolloutState{
+		Phase:             rollout.PhaseProgressing,
+		StableRevision:    "test-001",
+		CandidateRevision: "test-002",
+		Step:              10,
+		CandidateSince:    clockMock.Now(),
+		LastRollout:       clockMock.Now(),
+		LastEvaluation:    clockMock.Now(),
+	}, state)
+	assert.NotContains(t, svc.Metadata.Annotations, rollout.CandidateRevisionAnnotation)
+	assert.NotContains(t, svc.Metadata.Annotations, rollout.StateAnnotation)
+
+	// The candidate is healthy, but not enough time has elapsed.
+	clockMock.Advance(5 * time.Minute)
+	evaluate()
+	state, err = store.Load(context.Background(), key, svc)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), state.Step)
+	assert.Equal(t, 1, state.HealthyStreak)
+
+	clockMock.Advance(5 * time.Minute)
+	evaluate()
+	state, err = store.Load(context.Background(), key, svc)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(40), state.Step)
+	assert.Equal(t, 2, state.HealthyStreak)
+	assert.Equal(t, clockMock.Now(), state.LastRollout)
+	assert.Equal(t, clockMock.Now().Add(-10*time.Minute), state.CandidateSince)
+}
+
+// TestUpdateService_HealthExpression tests that the candidate is diagnosed with
+// the health expression of the strategy.
+func TestUpdateService_HealthExpression(t *testing.T) {
+	runclient := &runmock.RunAPI{}
+	runclient.RevisionFn = readyRevision
+	runclient.ReplaceServiceFn = func(namespace, serviceID string, svc *run.Service) (*run.Service, error) {
+		return svc, nil
+	}
+	clockMock := clockwork.NewFakeClock()
+	metricsMock := &metricsmock.Metrics{}
+	metricsMock.RequestCountFn = func(ctx context.Context, query metrics.Query) (int64, error) {
+		return 1000, nil
+	}
+	metricsMock.LatencyFn = func(ctx context.Context, query metrics.Query) (float64, error) {
+		return 900, nil
+	}
+	metricsMock.ErrorRateFn = func(ctx context.Context, query metrics.Query) (float64, error) {
+		return 0.005, nil
+	}
+	strategy := config.Strategy{
+		Target:            config.NewTarget("myproject", []string{"us-east1"}, "team=backend"),
+		Steps:             []int64{10, 40, 70},
+		HealthCheckOffset: 5 * time.Minute,
+		HealthExpression:  "errorRate < 1 && (p99 < 800 || requestCount < 100)",
+	}
+
+	traffic := []*run.TrafficTarget{
+		{RevisionName: "test-002", Percent: 20, Tag: rollout.CandidateTag},
+		{RevisionName: "test-001", Percent: 80, Tag: rollout.StableTag},
+	}
+	svc := generateService(&ServiceOpts{LatestReadyRevision: "test-002", Traffic: traffic})
+	svcRecord := &rollout.ServiceRecord{Service: svc}
+	err := strategy.Validate()
+	assert.Nil(t, err)
+	r := rollout.New(context.TODO(), metricsMock, svcRecord, strategy).WithClient(runclient).WithClock(clockMock)
+
+	retSvc, changedTraffic, err := r.UpdateService(svc)
+	assert.Nil(t, err)
+	assert.True(t, changedTraffic)
+	assert.Equal(t, "test-002", retSvc.Metadata.Annotations[rollout.LastFailedCandidateRevisionAnnotation])
+	assert.Equal(t, "status: unhealthy\n"+
+		"expression: errorRate < 1 && (p99 < 800 || requestCount < 100)\n"+
+		"metrics:\n"+
+		"- requestCount: 1000.00\n"+
+		"- errorRate: 0.50\n"+
+		"- p99: 900.00"+
+		fmt.Sprintf("\nlastUpdate: %s", clockMock.Now().Format(time.RFC3339)),
+		retSvc.Metadata.Annotations[rollout.LastHealthReportAnnotation])
+}
+
+// TestUpdateService_Baseline tests that a baseline sample is recorded when the
+// candidate becomes stable and anomaly criteria are checked against it.
+func TestUpdateService_Baseline(t *testing.T) {
+	runclient := &runmock.RunAPI{}
+	runclient.RevisionFn = readyRevision
+	runclient.ReplaceServiceFn = func(namespace, serviceID string, svc *run.Service) (*run.Service, error) {
+		return svc, nil
+	}
+	clockMock := clockwork.NewFakeClock()
+	metricsMock := &metricsmock.Metrics{}
+	metricsMock.RequestCountFn = func(ctx context.Context, query metrics.Query) (int64, error) {
+		return 1000, nil
+	}
+	metricsMock.LatencyFn = func(ctx context.Context, query metrics.Query) (float64, error) {
+		return 500, nil
+	}
+	metricsMock.ErrorRateFn = func(ctx context.Context, query metrics.Query) (float64, error) {
+		return 0.01, nil
+	}
+	strategy := config.Strategy{
+		Steps:             []int64{10, 40, 70},
+		HealthCheckOffset: 5 * time.Minute,
+		HealthCriteria: []config.HealthCriterion{
+			{Metric: config.AnomalyMetricsCheck, AnomalyOf: config.LatencyMetricsCheck, Percentile: 99, Threshold: 3, BaselineSize: 5, MissingData: config.MissingDataHealthy},
+		},
+	}
+	store := baseline.NewMemoryStore()
+	key := baseline.Key{Project: "myproject", Region: "us-east1", Service: "mysvc"}
+
+	traffic := []*run.TrafficTarget{
+		{RevisionName: "test-002", Percent: 100, Tag: rollout.CandidateTag},
+		{RevisionName: "test-001", Percent: 0, Tag: rollout.StableTag},
+	}
+	annotations := map[string]string{rollout.LastRolloutAnnotation: makeLastRolloutAnnotation(clockMock, -60)}
+	svc := generateService(&ServiceOpts{LatestReadyRevision: "test-002", Traffic: traffic, Annotations: annotations})
+	svc.Metadata.Name = "mysvc"
+	svcRecord := &rollout.ServiceRecord{Service: svc, Project: "myproject", Region: "us-east1"}
+	r := rollout.New(context.TODO(), metricsMock, svcRecord, strategy).WithClient(runclient).WithClock(clockMock).WithBaselineStore(store)
+
+	// No baseline yet, so the anomaly criterion is met by its policy.
+	retSvc, _, err := r.UpdateService(svc)
+	assert.Nil(t, err)
+	assert.Equal(t, "test-002", retSvc.Metadata.Annotations[rollout.StableRevisionAnnotation])
+
+	samples, err := store.Samples(context.Background(), key, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []baseline.Sample{{
+		Revision:        "test-002",
+		RecordedAt:      clockMock.Now(),
+		RequestCount:    1000,
+		ErrorRate:       1,
+		ClientErrorRate: 1,
+		LatencyP99:      500,
+		LatencyP95:      500,
+		LatencyP50:      500,
+	}}, samples)
+
+	// A candidate with a latency far above the baseline is unhealthy.
+	assert.Nil(t, store.Add(context.Background(), key, baseline.Sample{LatencyP99: 500}))
+	metricsMock.LatencyFn = func(ctx context.Context, query metrics.Query) (float64, error) {
+		return 1000, nil
+	}
+	traffic = []*run.TrafficTarget{
+		{RevisionName: "test-003", Percent: 10, Tag: rollout.CandidateTag},
+		{RevisionName: "test-002", Percent: 90, Tag: rollout.StableTag},
+	}
+	svc = generateService(&ServiceOpts{LatestReadyRevision: "test-003", Traffic: traffic, Annotations: annotations})
+	svc.Metadata.Name = "mysvc"
+	svcRecord = &rollout.ServiceRecord{Service: svc, Project: "myproject", Region: "us-east1"}
+	r = rollout.New(context.TODO(), metricsMock, svcRecord, strategy).WithClient(runclient).WithClock(clockMock).WithBaselineStore(store)
+
+	retSvc, _, err = r.UpdateService(svc)
+	assert.Nil(t, err)
+	assert.Equal(t, "test-003", retSvc.Metadata.Annotations[rollout.LastFailedCandidateRevisionAnnotation])
+}
+
+// TestUpdateService_FailingCandidate tests that a candidate whose revision is
+// failing is rolled back without checking its metrics.
+func TestUpdateService_FailingCandidate(t *testing.T) {
+	runclient := &runmock.RunAPI{}
+	runclient.ReplaceServiceFn = func(namespace, serviceID string, svc *run.Service) (*run.Service, error) {
+		return svc, nil
+	}
+	runclient.RevisionFn = func(namespace, revisionID string) (*run.Revision, error) {
+		return &run.Revision{
+			Status: &run.RevisionStatus{
+				Conditions: []*run.GoogleCloudRunV1Condition{
+					{Type: "Ready", Status: "False", Reason: "HealthCheckContainerError", Message: "container failed to start"},
+					{Type: "ContainerHealthy", Status: "False", Reason: "HealthCheckContainerError"},
+				},
+			},
+		}, nil
+	}
+	clockMock := clockwork.NewFakeClock()
+	// The metrics are healthy, so only the revision's status can cause the
+	// rollback.
+	metricsMock := &metricsmock.Metrics{}
+	metricsMock.ErrorRateFn = func(ctx context.Context, query metrics.Query) (float64, error) {
+		return 0.001, nil
+	}
+	strategy := config.Strategy{
+		Steps:             []int64{10, 40, 70},
+		HealthCheckOffset: 5 * time.Minute,
+		HealthCriteria: []config.HealthCriterion{
+			{Metric: config.ErrorRateMetricsCheck, Threshold: 5},
+		},
+	}
+
+	traffic := []*run.TrafficTarget{
+		{RevisionName: "test-002", Percent: 10, Tag: rollout.CandidateTag},
+		{RevisionName: "test-001", Percent: 90, Tag: rollout.StableTag},
+	}
+	svc := generateService(&ServiceOpts{LatestReadyRevision: "test-002", Traffic: traffic})
+	svcRecord := &rollout.ServiceRecord{Service: svc, Project: "myproject"}
+	r := rollout.New(context.TODO(), metricsMock, svcRecord, strategy).WithClient(runclient).WithClock(clockMock)
+
+	retSvc, changedTraffic, err := r.UpdateService(svc)
+	assert.Nil(t, err)
+	assert.True(t, changedTraffic)
+	assert.False(t, metricsMock.ErrorRateInvoked)
+	assert.Equal(t, []*run.TrafficTarget{
+		{RevisionName: "test-001", Percent: 100, Tag: rollout.StableTag},
+		{RevisionName: "test-002", Percent: 0, Tag: rollout.CandidateTag},
+		{LatestRevision: true, Tag: rollout.LatestTag},
+	}, retSvc.Spec.Traffic)
+	assert.Equal(t, "test-002", retSvc.Metadata.Annotations[rollout.LastFailedCandidateRevisionAnnotation])
+	assert.Equal(t, "status: unhealthy\n"+
+		"reason: revision condition Ready is false (HealthCheckContainerError): container failed to start\n"+
+		"metrics:"+
+		fmt.Sprintf("\nlastUpdate: %s", clockMock.Now().Format(time.RFC3339)),
+		retSvc.Metadata.Annotations[rollout.LastHealthReportAnnotation])
+}
+
+// TestUpdateService_RevisionUnavailable tests that the candidate is diagnosed
+// with metrics if its revision cannot be retrieved.
+func TestUpdateService_RevisionUnavailable(t *testing.T) {
+	runclient := &runmock.RunAPI{}
+	runclient.ReplaceServiceFn = func(namespace, serviceID string, svc *run.Service) (*run.Service, error) {
+		return svc, nil
+	}
+	runclient.RevisionFn = func(namespace, revisionID string) (*run.Revision, error) {
+		return nil, errors.New("service unavailable")
+	}
+	metricsMock := &metricsmock.Metrics{}
+	metricsMock.ErrorRateFn = func(ctx context.Context, query metrics.Query) (float64, error) {
+		return 0.001, nil
+	}
+	strategy := config.Strategy{
+		Steps:             []int64{10, 40, 70},
+		HealthCheckOffset: 5 * time.Minute,
+		HealthCriteria: []config.HealthCriterion{
+			{Metric: config.ErrorRateMetricsCheck, Threshold: 5},
+		},
+	}
+
+	traffic := []*run.TrafficTarget{
+		{RevisionName: "test-002", Percent: 10, Tag: rollout.CandidateTag},
+		{RevisionName: "test-001", Percent: 90, Tag: rollout.StableTag},
+	}
+	clockMock := clockwork.NewFakeClock()
+	svc := generateService(&ServiceOpts{
+		LatestReadyRevision: "test-002",
+		Traffic:             traffic,
+		Annotations:         map[string]string{rollout.LastRolloutAnnotation: makeLastRolloutAnnotation(clockMock, -10)},
+	})
+	svcRecord := &rollout.ServiceRecord{Service: svc, Project: "myproject"}
+	r := rollout.New(context.TODO(), metricsMock, svcRecord, strategy).WithClient(runclient).WithClock(clockMock)
+
+	// The revision's status is unknown, so it does not prevent the healthy
+	// candidate from progressing.
+	retSvc, changedTraffic, err := r.UpdateService(svc)
+	assert.Nil(t, err)
+	assert.True(t, changedTraffic)
+	assert.True(t, metricsMock.ErrorRateInvoked)
+	assert.Empty(t, retSvc.Metadata.Annotations[rollout.LastFailedCandidateRevisionAnnotation])
+	for _, target := range retSvc.Spec.Traffic {
+		if target.Tag == rollout.CandidateTag {
+			assert.Equal(t, int64(40), target.Percent)
+		}
+	}
+}
+
+// TestUpdateService_NoInstances tests that a candidate that receives requests
+// but has no instances is unhealthy.
+func TestUpdateService_NoInstances(t *testing.T) {
+	tests := []struct {
+		name      string
+		instances int64
+		requests  int64
+		unhealthy bool
+	}{
+		{name: "no instances", requests: 50, unhealthy: true},
+		{name: "instances", instances: 2, requests: 50},
+		{name: "scaled to zero", instances: 0, requests: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runclient := &runmock.RunAPI{}
+			runclient.RevisionFn = readyRevision
+			runclient.ReplaceServiceFn = func(namespace, serviceID string, svc *run.Service) (*run.Service, error) {
+				return svc, nil
+			}
+			metricsMock := &metricsmock.InstanceMetrics{}
+			metricsMock.InstanceCountFn = func(ctx context.Context, query metrics.Query) (int64, error) {
+				assert.Equal(t, "test-002", query.Revision)
+				return test.instances, nil
+			}
+			metricsMock.RequestCountFn = func(ctx context.Context, query metrics.Query) (int64, error) {
+				return test.requests, nil
+			}
+			metricsMock.ErrorRateFn = func(ctx context.Context, query metrics.Query) (float64, error) {
+				return 0.001, nil
+			}
+			strategy := config.Strategy{
+				Steps:             []int64{10, 40, 70},
+				HealthCheckOffset: 5 * time.Minute,
+				HealthCriteria: []config.HealthCriterion{
+					{Metric: config.ErrorRateMetricsCheck, Threshold: 5},
+				},
+			}
+
+			traffic := []*run.TrafficTarget{
+				{RevisionName: "test-002", Percent: 10, Tag: rollout.CandidateTag},
+				{RevisionName: "test-001", Percent: 90, Tag: rollout.StableTag},
+			}
+			clockMock := clockwork.NewFakeClock()
+			svc := generateService(&ServiceOpts{
+				LatestReadyRevision: "test-002",
+				Traffic:             traffic,
+				Annotations:         map[string]string{rollout.LastRolloutAnnotation: makeLastRolloutAnnotation(clockMock, -10)},
+			})
+			svcRecord := &rollout.ServiceRecord{Service: svc, Project: "myproject"}
+			r := rollout.New(context.TODO(), metricsMock, svcRecord, strategy).WithClient(runclient).WithClock(clockMock)
+
+			retSvc, _, err := r.UpdateService(svc)
+			assert.Nil(t, err)
+			assert.True(t, metricsMock.InstanceCountInvoked)
+			if !test.unhealthy {
+				assert.Empty(t, retSvc.Metadata.Annotations[rollout.LastFailedCandidateRevisionAnnotation])
+				return
+			}
+			assert.Equal(t, "test-002", retSvc.Metadata.Annotations[rollout.LastFailedCandidateRevisionAnnotation])
+			assert.False(t, metricsMock.ErrorRateInvoked)
+			assert.Contains(t, retSvc.Metadata.Annotations[rollout.LastHealthReportAnnotation],
+				"reason: revision had no instances in 5m0s while receiving 10% of the traffic and 50 requests")
+		})
+	}
+}
+
+// TestUpdateService_TrafficShare tests that the candidate's traffic percentage
+// is used to determine its expected share of requests.
+func TestUpdateService_TrafficShare(t *testing.T) {
+	runclient := &runmock.RunAPI{}
+	runclient.RevisionFn = readyRevision
+	runclient.ReplaceServiceFn = func(namespace, serviceID string, svc *run.Service) (*run.Service, error) {
+		return svc, nil
+	}
+	metricsMock := &metricsmock.Metrics{}
+	metricsMock.RequestCountFn = func(ctx context.Context, query metrics.Query) (int64, error) {
+		assert.Equal(t, int64(10), query.TrafficPercent)
+		if query.Revision == "" {
+			return 1000, nil
+		}
+		return 20, nil
+	}
+	metricsMock.ErrorRateFn = func(ctx context.Context, query metrics.Query) (float64, error) {
+		return 0.001, nil
+	}
+	strategy := config.Strategy{
+		Steps:             []int64{10, 40, 70},
+		HealthCheckOffset: 5 * time.Minute,
+		HealthCriteria: []config.HealthCriterion{
+			{Metric: config.TrafficShareMetricsCheck, Threshold: 90, MisroutedThreshold: 25},
+			{Metric: config.ErrorRateMetricsCheck, Threshold: 5},
+		},
+	}
+
+	traffic := []*run.TrafficTarget{
+		{RevisionName: "test-002", Percent: 10, Tag: rollout.CandidateTag},
+		{RevisionName: "test-001", Percent: 90, Tag: rollout.StableTag},
+	}
+	svc := generateService(&ServiceOpts{LatestReadyRevision: "test-002", Traffic: traffic})
+	svcRecord := &rollout.ServiceRecord{Service: svc, Project: "myproject"}
+	clockMock := clockwork.NewFakeClock()
+	r := rollout.New(context.TODO(), metricsMock, svcRecord, strategy).WithClient(runclient).WithClock(clockMock)
+
+	retSvc, changedTraffic, err := r.UpdateService(svc)
+	assert.Nil(t, err)
+	assert.False(t, changedTraffic)
+	assert.Equal(t, "status: inconclusive\n"+
+		"reason: candidate served 20.00% of its expected share of requests, traffic might be misrouted\n"+
+		"metrics:\n"+
+		"- traffic-share-percent: 20.00 (needs 90.00, over 5m0s)\n"+
+		"- error-rate-percent: 0.10 (needs 5.00, over 5m0s)"+
+		fmt.Sprintf("\nprogress: step 1 of 4, all the traffic expected at %s", clockMock.Now().Format(time.RFC3339))+
+		fmt.Sprintf("\nlastUpdate: %s", clockMock.Now().Format(time.RFC3339)),
+		retSvc.Metadata.Annotations[rollout.LastHealthReportAnnotation])
+}
+
+// TestUpdateService_WindowSinceLastStep tests that criteria evaluated since the
+// last step use the time elapsed since the last rollout, rounded to the minute,
+// as their window.
+func TestUpdateService_WindowSinceLastStep(t *testing.T) {
+	runclient := &runmock.RunAPI{}
+	runclient.RevisionFn = readyRevision
+	runclient.ReplaceServiceFn = func(namespace, serviceID string, svc *run.Service) (*run.Service, error) {
+		return svc, nil
+	}
+	clockMock := clockwork.NewFakeClock()
+	metricsMock := &metricsmock.Metrics{}
+	metricsMock.RequestCountFn = func(ctx context.Context, query metrics.Query) (int64, error) {
+		assert.Equal(t, 12*time.Minute, query.Window)
+		return 1000, nil
+	}
+	metricsMock.ErrorRateFn = func(ctx context.Context, query metrics.Query) (float64, error) {
+		assert.Equal(t, 5*time.Minute, query.Window)
+		return 0.001, nil
+	}
+	strategy := config.Strategy{
+		Steps:               []int64{10, 40, 70},
+		HealthCheckOffset:   5 * time.Minute,
+		TimeBetweenRollouts: 30 * time.Minute,
+		HealthCriteria: []config.HealthCriterion{
+			{Metric: config.RequestCountMetricsCheck, Threshold: 100, WindowSinceLastStep: true},
+			{Metric: config.ErrorRateMetricsCheck, Threshold: 5},
+		},
+	}
+
+	traffic := []*run.TrafficTarget{
+		{RevisionName: "test-002", Percent: 10, Tag: rollout.CandidateTag},
+		{RevisionName: "test-001", Percent: 90, Tag: rollout.StableTag},
+	}
+	annotations := map[string]string{rollout.LastRolloutAnnotation: makeLastRolloutAnnotation(clockMock, -12)}
+	start := clockMock.Now()
+	clockMock.Advance(20 * time.Second)
+	svc := generateService(&ServiceOpts{LatestReadyRevision: "test-002", Traffic: traffic, Annotations: annotations})
+	svcRecord := &rollout.ServiceRecord{Service: svc, Project: "myproject"}
+	r := rollout.New(context.TODO(), metricsMock, svcRecord, strategy).WithClient(runclient).WithClock(clockMock)
+
+	retSvc, changedTraffic, err := r.UpdateService(svc)
+	assert.Nil(t, err)
+	assert.False(t, changedTraffic)
+	assert.Equal(t, "status: healthy, but no enough time since last rollout\n"+
+		"metrics:\n"+
+		"- request-count: 1000 (needs 100, over 12m0s)\n"+
+		"- error-rate-percent: 0.10 (needs 5.00, over 5m0s)"+
+		fmt.Sprintf("\nprogress: step 1 of 4, all the traffic expected at %s", start.Add(78*time.Minute).Format(time.RFC3339))+
+		fmt.Sprintf("\nlastUpdate: %s", clockMock.Now().Format(time.RFC3339)),
+		retSvc.Metadata.Annotations[rollout.LastHealthReportAnnotation])
+}
+
+// TestUpdateService_HealthWebhooks tests that an unhealthy vote from a health
+// webhook rolls back a candidate with healthy metrics.
+func TestUpdateService_HealthWebhooks(t *testing.T) {
+	veto := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req webhook.Request
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, webhook.Request{Project: "myproject", Service: "mysvc", CandidateRevision: "test-002", StableRevision: "test-001", CandidatePercent: 40}, req)
+		fmt.Fprint(w, `{"vote": "unhealthy", "reason": "checkout e2e test failed"}`)
+	}))
+	defer veto.Close()
+	abstain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"vote": "abstain"}`)
+	}))
+	defer abstain.Close()
+
+	runclient := &runmock.RunAPI{}
+	runclient.RevisionFn = readyRevision
+	runclient.ReplaceServiceFn = func(namespace, serviceID string, svc *run.Service) (*run.Service, error) {
+		return svc, nil
+	}
+	clockMock := clockwork.NewFakeClock()
+	metricsMock := &metricsmock.Metrics{}
+	metricsMock.ErrorRateFn = func(ctx context.Context, query metrics.Query) (float64, error) {
+		return 0.001, nil
+	}
+	strategy := config.Strategy{
+		Steps:             []int64{10, 40, 70},
+		HealthCheckOffset: 5 * time.Minute,
+		HealthCriteria: []config.HealthCriterion{
+			{Metric: config.ErrorRateMetricsCheck, Threshold: 5},
+		},
+		HealthWebhooks: []config.HealthWebhook{{URL: veto.URL}, {URL: abstain.URL}},
+	}
+
+	traffic := []*run.TrafficTarget{
+		{RevisionName: "test-002", Percent: 40, Tag: rollout.CandidateTag},
+		{RevisionName: "test-001", Percent: 60, Tag: rollout.StableTag},
+	}
+	annotations := map[string]string{rollout.LastRolloutAnnotation: makeLastRolloutAnnotation(clockMock, -40)}
+	svc := generateService(&ServiceOpts{LatestReadyRevision: "test-002", Traffic: traffic, Annotations: annotations})
+	svc.Metadata.Name = "mysvc"
+	svcRecord := &rollout.ServiceRecord{Service: svc, Project: "myproject"}
+	r := rollout.New(context.TODO(), metricsMock, svcRecord, strategy).WithClient(runclient).WithClock(clockMock)
+
+	retSvc, changedTraffic, err := r.UpdateService(svc)
+	assert.Nil(t, err)
+	assert.True(t, changedTraffic)
+	assert.Equal(t, "test-002", retSvc.Metadata.Annotations[rollout.LastFailedCandidateRevisionAnnotation])
+	assert.Equal(t, "status: unhealthy\n"+
+		"metrics:\n"+
+		"- error-rate-percent: 0.10 (needs 5.00, over 5m0s)\n"+
+		"votes:\n"+
+		"- "+veto.URL+": unhealthy (checkout e2e test failed)\n"+
+		"- "+abstain.URL+": abstain"+
+		fmt.Sprintf("\nlastUpdate: %s", clockMock.Now().Format(time.RFC3339)),
+		retSvc.Metadata.Annotations[rollout.LastHealthReportAnnotation])
+}
+
+// TestUpdateService_OpenIncidents tests that open incidents of the service
+// roll back the candidate if configured so.
+func TestUpdateService_OpenIncidents(t *testing.T) {
+	runclient := &runmock.RunAPI{}
+	runclient.RevisionFn = readyRevision
+	runclient.ReplaceServiceFn = func(namespace, serviceID string, svc *run.Service) (*run.Service, error) {
+		return svc, nil
+	}
+	metricsMock := &metricsmock.Metrics{}
+	metricsMock.ErrorRateFn = func(ctx context.Context, query metrics.Query) (float64, error) {
+		return 0.001, nil
+	}
+	incidentsMock := &incidentmock.Provider{}
+	incidentsMock.OpenIncidentsFn = func(ctx context.Context, query incident.Query) ([]incident.Incident, error) {
+		assert.Equal(t, incident.Query{Project: "myproject", Region: "us-east1", Service: "mysvc"}, query)
+		return []incident.Incident{{ID: "0.1", Policy: "High latency"}}, nil
+	}
+	strategy := config.Strategy{
+		Steps:             []int64{10, 40, 70},
+		HealthCheckOffset: 5 * time.Minute,
+		HealthCriteria: []config.HealthCriterion{
+			{Metric: config.ErrorRateMetricsCheck, Threshold: 5},
+			{Metric: config.OpenIncidentsMetricsCheck, AlertPolicies: []string{"High latency"}, OnIncident: config.IncidentActionRollback},
+		},
+	}
+
+	traffic := []*run.TrafficTarget{
+		{RevisionName: "test-002", Percent: 10, Tag: rollout.CandidateTag},
+		{RevisionName: "test-001", Percent: 90, Tag: rollout.StableTag},
+	}
+	svc := generateService(&ServiceOpts{LatestReadyRevision: "test-002", Traffic: traffic})
+	svc.Metadata.Name = "mysvc"
+	svcRecord := &rollout.ServiceRecord{Service: svc, Project: "myproject", Region: "us-east1"}
+	clockMock := clockwork.NewFakeClock()
+	r := rollout.New(context.TODO(), metricsMock, svcRecord, strategy).WithClient(runclient).WithClock(clockMock).WithIncidentProvider(incidentsMock)
+
+	retSvc, changedTraffic, err := r.UpdateService(svc)
+	assert.Nil(t, err)
+	assert.True(t, changedTraffic)
+	assert.True(t, incidentsMock.OpenIncidentsInvoked)
+	assert.Equal(t, "test-002", retSvc.Metadata.Annotations[rollout.LastFailedCandidateRevisionAnnotation])
+	assert.Equal(t, "status: unhealthy\n"+
+		"metrics:\n"+
+		"- error-rate-percent: 0.10 (needs 5.00, over 5m0s)\n"+
+		"- open-incidents[High latency]: 1 (needs 0)"+
+		fmt.Sprintf("\nlastUpdate: %s", clockMock.Now().Format(time.RFC3339)),
+		retSvc.Metadata.Annotations[rollout.LastHealthReportAnnotation])
+
+	// Without a provider, the candidate cannot be diagnosed.
+	r = rollout.New(context.TODO(), metricsMock, svcRecord, strategy).WithClient(runclient).WithClock(clockMock)
+	_, _, err = r.UpdateService(generateService(&ServiceOpts{LatestReadyRevision: "test-002", Traffic: traffic}))
+	assert.NotNil(t, err)
+}
+
+func TestUpdateService_Notifications(t *testing.T) {
+	runclient := &runmock.RunAPI{}
+	runclient.RevisionFn = readyRevision
+	runclient.ReplaceServiceFn = func(namespace, serviceID string, svc *run.Service) (*run.Service, error) {
+		return svc, nil
+	}
+	clockMock := clockwork.NewFakeClock()
+	strategy := config.Strategy{
+		Steps:               []int64{10, 40, 70},
+		HealthCheckOffset:   5 * time.Minute,
+		TimeBetweenRollouts: 10 * time.Minute,
+		HealthCriteria: []config.HealthCriterion{
+			{Metric: config.ErrorRateMetricsCheck, Threshold: 5},
+		},
+	}
+
+	tests := []struct {
+		name         string
+		traffic      []*run.TrafficTarget
+		lastRollout  int
+		errorRate    float64
+		notifyErr    error
+		eventTypes   []notification.EventType
+		diagnosis    health.DiagnosisResult
+		percent      int64
+		candidateURL string
+	}{
+		{
+			name: "new candidate",
+			traffic: []*run.TrafficTarget{
+				{RevisionName: "test-001", Percent: 100, Tag: rollout.StableTag},
+			},
+			eventTypes:   []notification.EventType{notification.EventCandidate, notification.EventRollout},
+			diagnosis:    health.Unknown,
+			percent:      10,
+			candidateURL: "https://candidate---hello-abcdefgh-ue.a.run.app",
+		},
+		{
+			name: "roll forward",
+			traffic: []*run.TrafficTarget{
+				{RevisionName: "test-001", Percent: 90, Tag: rollout.StableTag},
+				{RevisionName: "test-002", Percent: 10, Tag: rollout.CandidateTag},
+			},
+			lastRollout:  -30,
+			eventTypes:   []notification.EventType{notification.EventRollout},
+			diagnosis:    health.Healthy,
+			percent:      40,
+			candidateURL: "https://candidate---hello-abcdefgh-ue.a.run.app",
+		},
+		{
+			name: "rollback",
+			traffic: []*run.TrafficTarget{
+				{RevisionName: "test-001", Percent: 90, Tag: rollout.StableTag},
+				{RevisionName: "test-002", Percent: 10, Tag: rollout.CandidateTag},
+			},
+			lastRollout:  -30,
+			errorRate:    0.1,
+			eventTypes:   []notification.EventType{notification.EventRollback},
+			diagnosis:    health.Unhealthy,
+			percent:      0,
+			candidateURL: "https://candidate---hello-abcdefgh-ue.a.run.app",
+		},
+		{
+			name: "promotion",
+			traffic: []*run.TrafficTarget{
+				{RevisionName: "test-002", Percent: 100, Tag: rollout.CandidateTag},
+				{RevisionName: "test-001", Percent: 0, Tag: rollout.StableTag},
+			},
+			lastRollout:  -30,
+			eventTypes:   []notification.EventType{notification.EventPromotion},
+			diagnosis:    health.Healthy,
+			percent:      100,
+			candidateURL: "https://stable---hello-abcdefgh-ue.a.run.app",
+		},
+		{
+			name: "blocked by min-wait",
+			traffic: []*run.TrafficTarget{
+				{RevisionName: "test-001", Percent: 90, Tag: rollout.StableTag},
+				{RevisionName: "test-002", Percent: 10, Tag: rollout.CandidateTag},
+			},
+			lastRollout:  -5,
+			eventTypes:   []notification.EventType{notification.EventBlocked},
+			diagnosis:    health.Healthy,
+			percent:      10,
+			candidateURL: "https://candidate---hello-abcdefgh-ue.a.run.app",
+		},
+		{
+			name: "failure to notify does not fail the rollout",
+			traffic: []*run.TrafficTarget{
+				{RevisionName: "test-001", Percent: 90, Tag: rollout.StableTag},
+				{RevisionName: "test-002", Percent: 10, Tag: rollout.CandidateTag},
+			},
+			lastRollout:  -30,
+			notifyErr:    errors.New("topic not found"),
+			eventTypes:   []notification.EventType{notification.EventRollout},
+			diagnosis:    health.Healthy,
+			percent:      40,
+			candidateURL: "https://candidate---hello-abcdefgh-ue.a.run.app",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metricsMock := &metricsmock.Metrics{}
+			metricsMock.ErrorRateFn = func(ctx context.Context, query metrics.Query) (float64, error) {
+				return test.errorRate, nil
+			}
+			var events []notification.Event
+			notifierMock := &notificationmock.Notifier{}
+			notifierMock.NotifyFn = func(ctx context.Context, e notification.Event) error {
+				events = append(events, e)
+				return test.notifyErr
+			}
+
+			annotations := map[string]string{rollout.LastRolloutAnnotation: makeLastRolloutAnnotation(clockMock, test.lastRollout)}
+			svc := generateService(&ServiceOpts{LatestReadyRevision: "test-002", Traffic: test.traffic, Annotations: annotations})
+			svc.Metadata.Name = "hello"
+			svc.Status.Url = "https://hello-abcdefgh-ue.a.run.app"
+			svcRecord := &rollout.ServiceRecord{Service: svc, Project: "myproject", Region: "us-east1"}
+			r := rollout.New(context.TODO(), metricsMock, svcRecord, strategy).WithClient(runclient).WithClock(clockMock).WithNotifier(notifierMock)
+
+			_, _, err := r.UpdateService(svc)
+			assert.Nil(t, err)
+			var eventTypes []notification.EventType
+			for _, e := range events {
+				eventTypes = append(eventTypes, e.Type)
+			}
+			assert.Equal(t, test.eventTypes, eventTypes)
+			if len(events) == 0 {
+				return
+			}
+			event := events[len(events)-1]
+			assert.Equal(t, "myproject", event.Project)
+			assert.Equal(t, "us-east1", event.Region)
+			assert.Equal(t, "hello", event.Service)
+			assert.Equal(t, "test-002", event.Report.Candidate)
+			assert.Equal(t, test.percent, event.Report.NewTrafficPercent)
+			assert.Equal(t, test.candidateURL, event.CandidateURL)
+			assert.Equal(t, test.diagnosis, event.Diagnosis)
+			assert.Equal(t, svc, event.ServiceObject)
+		})
+	}
+}
+
+func TestUpdateService_NotificationDeduplication(t *testing.T) {
+	clockMock := clockwork.NewFakeClock()
+	strategy := config.Strategy{
+		Steps:                 []int64{10, 40, 70},
+		HealthCheckOffset:     5 * time.Minute,
+		TimeBetweenRollouts:   10 * time.Minute,
+		InconclusiveThreshold: 2,
+		HealthCriteria: []config.HealthCriterion{
+			{Metric: config.RequestCountMetricsCheck, Threshold: 1000},
+			{Metric: config.ErrorRateMetricsCheck, Threshold: 5},
+		},
+	}
+	candidateTraffic := []*run.TrafficTarget{
+		{RevisionName: "test-001", Percent: 90, Tag: rollout.StableTag},
+		{RevisionName: "test-002", Percent: 10, Tag: rollout.CandidateTag},
+	}
+
+	tests := []struct {
+		name         string
+		traffic      []*run.TrafficTarget
+		annotations  map[string]string
+		requestCount int64
+		reason       string
+
+		// failures is the number of notifications that fail to be sent and
+		// sentTo are the sinks that receive them anyway.
+		failures int
+		sentTo   []string
+
+		// expected are the events sent at each evaluation, empty if none.
+		expected []notification.EventType
+	}{
+		{
+			name:         "blocked by min-wait",
+			traffic:      candidateTraffic,
+			annotations:  map[string]string{rollout.LastRolloutAnnotation: makeLastRolloutAnnotation(clockMock, -5)},
+			requestCount: 1500,
+			reason:       notification.ReasonMinWait,
+			expected:     []notification.EventType{notification.EventBlocked, "", ""},
+		},
+		{
+			name:         "sent again after failing",
+			traffic:      candidateTraffic,
+			annotations:  map[string]string{rollout.LastRolloutAnnotation: makeLastRolloutAnnotation(clockMock, -5)},
+			requestCount: 1500,
+			reason:       notification.ReasonMinWait,
+			failures:     1,
+			expected:     []notification.EventType{notification.EventBlocked, notification.EventBlocked, ""},
+		},
+		{
+			name:         "sent again to the failed sinks",
+			traffic:      candidateTraffic,
+			annotations:  map[string]string{rollout.LastRolloutAnnotation: makeLastRolloutAnnotation(clockMock, -5)},
+			requestCount: 1500,
+			reason:       notification.ReasonMinWait,
+			failures:     1,
+			sentTo:       []string{"webhook"},
+			expected:     []notification.EventType{notification.EventBlocked, notification.EventBlocked, ""},
+		},
+		{
+			name:         "inconclusive past the threshold",
+			traffic:      candidateTraffic,
+			annotations:  map[string]string{rollout.LastRolloutAnnotation: makeLastRolloutAnnotation(clockMock, -30)},
+			requestCount: 500,
+			reason:       "inconclusive for 2 consecutive evaluations",
+			expected:     []notification.EventType{"", notification.EventInconclusive, ""},
+		},
+		{
+			name: "candidate previously rolled back",
+			traffic: []*run.TrafficTarget{
+				{RevisionName: "test-001", Percent: 100, Tag: rollout.StableTag},
+				{RevisionName: "test-002", Percent: 0, Tag: rollout.CandidateTag},
+			},
+			annotations: map[string]string{
+				rollout.StableRevisionAnnotation:              "test-001",
+				rollout.LastFailedCandidateRevisionAnnotation: "test-002",
+			},
+			reason:   "revision test-002 was rolled back before, deploy a new revision to roll it out",
+			expected: []notification.EventType{notification.EventSkipped, "", ""},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runclient := &runmock.RunAPI{}
+			runclient.RevisionFn = readyRevision
+			runclient.ReplaceServiceFn = func(namespace, serviceID string, svc *run.Service) (*run.Service, error) {
+				return svc, nil
+			}
+			metricsMock := &metricsmock.Metrics{}
+			metricsMock.RequestCountFn = func(ctx context.Context, query metrics.Query) (int64, error) {
+				return test.requestCount, nil
+			}
+			metricsMock.ErrorRateFn = func(ctx context.Context, query metrics.Query) (float64, error) {
+				return 0.01, nil
+			}
+			var events []notification.Event
+			failures := test.failures
+			notifierMock := &notificationmock.Notifier{}
+			notifierMock.NotifyFn = func(ctx context.Context, e notification.Event) error {
+				events = append(events, e)
+				if failures > 0 {
+					failures--
+					if test.sentTo != nil {
+						return &notification.FanoutError{SentTo: test.sentTo}
+					}
+					return errors.New("topic not found")
+				}
+				return nil
+			}
+
+			svc := generateService(&ServiceOpts{LatestReadyRevision: "test-002", Traffic: test.traffic, Annotations: test.annotations})
+			svcRecord := &rollout.ServiceRecord{Service: svc}
+			var eventID string
+			for i, expected := range test.expected {
+				events = nil
+				r := rollout.New(context.TODO(), metricsMock, svcRecord, strategy).WithClient(runclient).WithClock(clockMock).WithNotifier(notifierMock)
+				_, _, err := r.UpdateService(svc)
+				assert.Nil(t, err)
+
+				if expected == "" {
+					assert.Empty(t, events, "evaluation %d", i)
+					continue
+				}
+				if assert.Len(t, events, 1, "evaluation %d", i) {
+					assert.Equal(t, expected, events[0].Type)
+					assert.Equal(t, test.reason, events[0].Reason)
+					assert.Equal(t, "test-002", events[0].Report.Candidate)
+					assert.NotEmpty(t, events[0].ID)
+					if eventID == "" {
+						eventID = events[0].ID
+						continue
+					}
+					// An event sent again keeps its ID and is not sent again
+					// to the sinks that received it.
+					assert.Equal(t, eventID, events[0].ID)
+					assert.Equal(t, test.sentTo, events[0].SentTo)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package rollout
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/notification"
+	"github.com/pkg/errors"
+	"google.golang.org/api/run/v1"
+)
+
+// StateAnnotation is the annotation with the rollout state of a service kept
+// by AnnotationStateStore.
+const StateAnnotation = "rollout.cloud.run/state"
+
+// Phase is the phase of the rollout of a service.
+type Phase string
+
+// Rollout phases.
+const (
+	// PhaseStable means there is no candidate being rolled out.
+	PhaseStable Phase = "stable"
+
+	// PhaseProgressing means a candidate is being rolled out.
+	PhaseProgressing Phase = "progressing"
+
+	// PhaseRolledBack means the last candidate was rolled back.
+	PhaseRolledBack Phase = "rolled-back"
+)
+
+// RolloutState is the state of the rollout of a service, which is kept across
+// evaluations.
+type RolloutState struct {
+	Phase                       Phase  `json:"phase"`
+	StableRevision              string `json:"stableRevision,omitempty"`
+	CandidateRevision           string `json:"candidateRevision,omitempty"`
+	LastFailedCandidateRevision string `json:"lastFailedCandidateRevision,omitempty"`
+
+	// Step is the candidate's traffic percentage.
+	Step int64 `json:"step"`
+
+	// HealthyStreak and InconclusiveStreak are the number of consecutive
+	// evaluations of the candidate with that result.
+	HealthyStreak      int `json:"healthyStreak"`
+	InconclusiveStreak int `json:"inconclusiveStreak"`
+
+	// CandidateSince is when the candidate received traffic for the first
+	// time, LastRollout is when its traffic last increased, and LastEvaluation
+	// is when it was last evaluated. They are zero if unknown.
+	CandidateSince time.Time `json:"candidateSince"`
+	LastRollout    time.Time `json:"lastRollout"`
+	LastEvaluation time.Time `json:"lastEvaluation"`
+
+	// Approvals are the approvals given to the steps of the rollouts of the
+	// service's candidates.
+	Approvals []Approval `json:"approvals,omitempty"`
+
+	// Notified has, for the event types that are not sent at every
+	// evaluation, the key of the last event that was sent (e.g. the candidate
+	// and its step), so the same event is only sent once.
+	Notified map[notification.EventType]string `json:"notified,omitempty"`
+
+	// Deliveries has, for the same event types, the event that was sent to
+	// some of the sinks only, so it is sent again with the same ID to the
+	// other sinks.
+	Deliveries map[notification.EventType]Delivery `json:"deliveries,omitempty"`
+}
+
+// Delivery is an event that was only sent to some of the sinks.
+type Delivery struct {
+	// Key is the key of the event in Notified once it is sent to all the
+	// sinks.
+	Key     string `json:"key"`
+	EventID string `json:"eventId"`
+
+	// SentTo are the names of the sinks that received the event.
+	SentTo []string `json:"sentTo,omitempty"`
+}
+
+// Approval is the approval of a step of the rollout of a candidate.
+type Approval struct {
+	Revision   string    `json:"revision"`
+	Step       int64     `json:"step"`
+	ApprovedBy string    `json:"approvedBy"`
+	ApprovedAt time.Time `json:"approvedAt"`
+}
+
+// StateKey identifies a service.
+type StateKey struct {
+	Project string
+	Region  string
+	Service string
+}
+
+func (k StateKey) String() string {
+	return fmt.Sprintf("%s/%s/%s", k.Project, k.Region, k.Service)
+}
+
+// StateStore persists the rollout state of the services.
+//
+// Implementations must be safe for concurrent use.
+type StateStore interface {
+	// Load returns the rollout state of the service, whose current object is
+	// svc. If no state was saved, it is derived from the legacy annotations of
+	// the service.
+	Load(ctx context.Context, key StateKey, svc *run.Service) (RolloutState, error)
+
+	// Save persists the rollout state of the service. svc is the service
+	// object that is replaced in Cloud Run.
+	Save(ctx context.Context, key StateKey, svc *run.Service, state RolloutState) error
+
+	// InService determines if the state is kept in the service object. If so,
+	// the state is saved before the service is replaced. Otherwise, it is saved
+	// after the service was successfully replaced.
+	InService() bool
+}
+
+// AnnotationStateStore keeps the rollout state in the annotations of the
+// service.
+//
+// The state is dual-written: besides the state annotation, Save keeps the
+// stable, candidate, last failed candidate and last rollout annotations, which
+// were used before the state annotation was introduced. Load always takes these
+// fields from them rather than from the state annotation, so they can still be
+// edited by hand (e.g. to retry a failed candidate) and the state annotation is
+// never the only source of truth for them.
+type AnnotationStateStore struct{}
+
+// NewAnnotationStateStore returns a store that keeps the state in the
+// annotations of the services.
+func NewAnnotationStateStore() *AnnotationStateStore {
+	return &AnnotationStateStore{}
+}
+
+// Load returns the state in the annotations of the service. The fields kept in
+// the legacy annotations are overwritten with their values, even if the state
+// annotation has them.
+func (s *AnnotationStateStore) Load(ctx context.Context, key StateKey, svc *run.Service) (RolloutState, error) {
+	value, ok := svc.Metadata.Annotations[StateAnnotation]
+	if !ok {
+		return migrateState(svc), nil
+	}
+
+	var state RolloutState
+	if err := json.Unmarshal([]byte(value), &state); err != nil {
+		return RolloutState{}, errors.Wrapf(err, "failed to decode annotation %s", StateAnnotation)
+	}
+	legacy := migrateState(svc)
+	state.StableRevision = legacy.StableRevision
+	state.CandidateRevision = legacy.CandidateRevision
+	state.LastFailedCandidateRevision = legacy.LastFailedCandidateRevision
+	state.LastRollout = legacy.LastRollout
+	return state, nil
+}
+
+// Save sets the state in the annotations of the service.
+func (s *AnnotationStateStore) Save(ctx context.Context, key StateKey, svc *run.Service, state RolloutState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode rollout state")
+	}
+	setAnnotation(svc, StateAnnotation, string(data))
+
+	if !state.LastRollout.IsZero() {
+		setAnnotation(svc, LastRolloutAnnotation, state.LastRollout.Format(time.RFC3339))
+	}
+	setAnnotation(svc, StableRevisionAnnotation, state.StableRevision)
+	if state.CandidateRevision == "" {
+		delete(svc.Metadata.Annotations, CandidateRevisionAnnotation)
+	} else {
+		setAnnotation(svc, CandidateRevisionAnnotation, state.CandidateRevision)
+	}
+	if state.LastFailedCandidateRevision != "" {
+		setAnnotation(svc, LastFailedCandidateRevisionAnnotation, state.LastFailedCandidateRevision)
+	}
+	return nil
+}
+
+// InService returns true, since the state is kept in the service object.
+func (s *AnnotationStateStore) InService() bool {
+	return true
+}
+
+// FileStateStore keeps the rollout state of the services in a JSON file. It
+// is meant for testing, since the state is not visible in the services.
+type FileStateStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileStateStore initializes a store that uses the file at the given path.
+// The file is created when the first state is saved.
+func NewFileStateStore(path string) *FileStateStore {
+	return &FileStateStore{path: path}
+}
+
+// Load returns the state of the service in the file.
+func (s *FileStateStore) Load(ctx context.Context, key StateKey, svc *run.Service) (RolloutState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	states, err := s.read()
+	if err != nil {
+		return RolloutState{}, err
+	}
+	state, ok := states[key.String()]
+	if !ok {
+		return migrateState(svc), nil
+	}
+	return state, nil
+}
+
+// Save writes the state of the service to the file.
+func (s *FileStateStore) Save(ctx context.Context, key StateKey, svc *run.Service, state RolloutState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	states, err := s.read()
+	if err != nil {
+		return err
+	}
+	states[key.String()] = state
+
+	data, err := json.Marshal(states)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode rollout states")
+	}
+	// Write to a temporary file first so a crash does not corrupt the store.
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrap(err, "failed to write rollout states")
+	}
+	return errors.Wrap(os.Rename(tmp, s.path), "failed to replace rollout states file")
+}
+
+// InService returns false, since the state is kept in a file.
+func (s *FileStateStore) InService() bool {
+	return false
+}
+
+// read returns the states in the file, indexed by service key.
+func (s *FileStateStore) read() (map[string]RolloutState, error) {
+	states := make(map[string]RolloutState)
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return states, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read rollout states")
+	}
+	if err := json.Unmarshal(data, &states); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode rollout states in %s", s.path)
+	}
+	return states, nil
+}
+
+// migrateState returns the state kept in the legacy annotations of the
+// service, which were used before the state was introduced.
+//
+// An invalid last rollout time is considered unknown.
+func migrateState(svc *run.Service) RolloutState {
+	annotations := svc.Metadata.Annotations
+	state := RolloutState{
+		Phase:                       PhaseStable,
+		StableRevision:              annotations[StableRevisionAnnotation],
+		CandidateRevision:           annotations[CandidateRevisionAnnotation],
+		LastFailedCandidateRevision: annotations[LastFailedCandidateRevisionAnnotation],
+	}
+	if lastRollout, err := time.Parse(time.RFC3339, annotations[LastRolloutAnnotation]); err == nil {
+		state.LastRollout = lastRollout
+	}
+
+	switch {
+	case state.CandidateRevision == "":
+	case state.CandidateRevision == state.LastFailedCandidateRevision:
+		state.Phase = PhaseRolledBack
+	default:
+		state.Phase = PhaseProgressing
+		for _, target := range svc.Spec.Traffic {
+			if target.RevisionName == state.CandidateRevision {
+				state.Step = target.Percent
+			}
+		}
+	}
+	return state
+}
@@ -0,0 +1,150 @@
+package rollout_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/rollout"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/run/v1"
+)
+
+func TestMigrateState(t *testing.T) {
+	lastRollout := time.Date(2020, 8, 13, 15, 35, 10, 0, time.FixedZone("", -4*60*60))
+	traffic := []*run.TrafficTarget{
+		{RevisionName: "test-001", Percent: 80, Tag: rollout.StableTag},
+		{RevisionName: "test-002", Percent: 20, Tag: rollout.CandidateTag},
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expected    rollout.RolloutState
+	}{
+		{
+			name:     "no annotations",
+			expected: rollout.RolloutState{Phase: rollout.PhaseStable},
+		},
+		{
+			name: "candidate",
+			annotations: map[string]string{
+				rollout.StableRevisionAnnotation:    "test-001",
+				rollout.CandidateRevisionAnnotation: "test-002",
+				rollout.LastRolloutAnnotation:       "2020-08-13T15:35:10-04:00",
+			},
+			expected: rollout.RolloutState{
+				Phase:             rollout.PhaseProgressing,
+				StableRevision:    "test-001",
+				CandidateRevision: "test-002",
+				Step:              20,
+				LastRollout:       lastRollout,
+			},
+		},
+		{
+			name: "rolled back candidate",
+			annotations: map[string]string{
+				rollout.StableRevisionAnnotation:              "test-001",
+				rollout.CandidateRevisionAnnotation:           "test-002",
+				rollout.LastFailedCandidateRevisionAnnotation: "test-002",
+				rollout.LastRolloutAnnotation:                 "invalid",
+			},
+			expected: rollout.RolloutState{
+				Phase:                       rollout.PhaseRolledBack,
+				StableRevision:              "test-001",
+				CandidateRevision:           "test-002",
+				LastFailedCandidateRevision: "test-002",
+			},
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "state")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	stores := map[string]rollout.StateStore{
+		"annotation": rollout.NewAnnotationStateStore(),
+		"file":       rollout.NewFileStateStore(filepath.Join(dir, "state.json")),
+	}
+	for name, store := range stores {
+		for _, test := range tests {
+			t.Run(name+"/"+test.name, func(t *testing.T) {
+				svc := generateService(&ServiceOpts{Annotations: test.annotations, Traffic: traffic})
+				state, err := store.Load(context.Background(), rollout.StateKey{Service: "mysvc"}, svc)
+				assert.Nil(t, err)
+				assert.True(t, test.expected.LastRollout.Equal(state.LastRollout))
+				test.expected.LastRollout = state.LastRollout
+				assert.Equal(t, test.expected, state)
+			})
+		}
+	}
+}
+
+func TestAnnotationStateStore(t *testing.T) {
+	ctx := context.Background()
+	key := rollout.StateKey{Project: "myproject", Region: "us-east1", Service: "mysvc"}
+	store := rollout.NewAnnotationStateStore()
+	now := time.Date(2020, 8, 13, 15, 35, 10, 0, time.UTC)
+	state := rollout.RolloutState{
+		Phase:             rollout.PhaseProgressing,
+		StableRevision:    "test-001",
+		CandidateRevision: "test-002",
+		Step:              20,
+		HealthyStreak:     2,
+		CandidateSince:    now.Add(-time.Hour),
+		LastRollout:       now,
+		LastEvaluation:    now,
+		Approvals:         []rollout.Approval{{Revision: "test-002", Step: 50, ApprovedBy: "jane@example.com", ApprovedAt: now}},
+	}
+
+	svc := generateService(&ServiceOpts{})
+	assert.Nil(t, store.Save(ctx, key, svc, state))
+	assert.Equal(t, "test-001", svc.Metadata.Annotations[rollout.StableRevisionAnnotation])
+	assert.Equal(t, "test-002", svc.Metadata.Annotations[rollout.CandidateRevisionAnnotation])
+	assert.Equal(t, "2020-08-13T15:35:10Z", svc.Metadata.Annotations[rollout.LastRolloutAnnotation])
+	assert.NotContains(t, svc.Metadata.Annotations, rollout.LastFailedCandidateRevisionAnnotation)
+
+	loaded, err := store.Load(ctx, key, svc)
+	assert.Nil(t, err)
+	assert.Equal(t, state, loaded)
+
+	// The legacy annotations can be edited by hand.
+	delete(svc.Metadata.Annotations, rollout.CandidateRevisionAnnotation)
+	svc.Metadata.Annotations[rollout.LastFailedCandidateRevisionAnnotation] = "test-002"
+	loaded, err = store.Load(ctx, key, svc)
+	assert.Nil(t, err)
+	assert.Equal(t, "", loaded.CandidateRevision)
+	assert.Equal(t, "test-002", loaded.LastFailedCandidateRevision)
+	assert.Equal(t, 2, loaded.HealthyStreak)
+
+	svc.Metadata.Annotations[rollout.StateAnnotation] = "invalid"
+	_, err = store.Load(ctx, key, svc)
+	assert.NotNil(t, err)
+}
+
+func TestFileStateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	store := rollout.NewFileStateStore(filepath.Join(dir, "state.json"))
+	key := rollout.StateKey{Project: "myproject", Region: "us-east1", Service: "mysvc"}
+	otherKey := rollout.StateKey{Project: "myproject", Region: "us-west1", Service: "mysvc"}
+	state := rollout.RolloutState{Phase: rollout.PhaseProgressing, StableRevision: "test-001", CandidateRevision: "test-002", Step: 20}
+
+	svc := generateService(&ServiceOpts{})
+	assert.Nil(t, store.Save(ctx, key, svc, state))
+	assert.Empty(t, svc.Metadata.Annotations)
+
+	loaded, err := store.Load(ctx, key, svc)
+	assert.Nil(t, err)
+	assert.Equal(t, state, loaded)
+
+	loaded, err = store.Load(ctx, otherKey, svc)
+	assert.Nil(t, err)
+	assert.Equal(t, rollout.RolloutState{Phase: rollout.PhaseStable}, loaded)
+}
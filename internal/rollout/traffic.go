@@ -11,14 +11,16 @@ import (
 
 // determineTraffic returns a traffic configuration based on the diagnosis.
 // If traffic should not changed, nil is returned.
-func (r *Rollout) determineTraffic(svc *run.Service, diagnosis health.DiagnosisResult, stable, candidate string) ([]*run.TrafficTarget, bool, error) {
+//
+// A healthy candidate is only rolled forward if enough time has elapsed since
+// the last rollout.
+func (r *Rollout) determineTraffic(svc *run.Service, diagnosis health.DiagnosisResult, stable, candidate string, lastRollout time.Time) ([]*run.TrafficTarget, bool, error) {
 	switch diagnosis {
 	case health.Inconclusive:
 		r.log.Debug("health check inconclusive")
 		return svc.Spec.Traffic, false, nil
 	case health.Healthy:
 		r.log.Debug("healthy candidate")
-		lastRollout := svc.Metadata.Annotations[LastRolloutAnnotation]
 		enoughTime, err := r.hasEnoughTimeElapsed(lastRollout, r.strategy.TimeBetweenRollouts)
 		if err != nil {
 			return nil, false, errors.Wrap(err, "error while determining if enough time elapsed")
@@ -167,14 +169,10 @@ func newTrafficTarget(revision string, percent int64, tag string) *run.TrafficTa
 // hasEnoughTimeElapsed determines if enough time has elapsed since last
 // rollout.
 //
-// TODO: what if lastRolloutStr is always invalid?
-func (r *Rollout) hasEnoughTimeElapsed(lastRolloutStr string, timeBetweenRollouts time.Duration) (bool, error) {
-	if lastRolloutStr == "" {
-		return false, errors.Errorf("%s annotation is missing", LastRolloutAnnotation)
-	}
-	lastRollout, err := time.Parse(time.RFC3339, lastRolloutStr)
-	if err != nil {
-		return false, errors.Wrap(err, "failed to parse last roll out time")
+// TODO: what if the last rollout time is always unknown?
+func (r *Rollout) hasEnoughTimeElapsed(lastRollout time.Time, timeBetweenRollouts time.Duration) (bool, error) {
+	if lastRollout.IsZero() {
+		return false, errors.New("last rollout time is unknown")
 	}
 
 	currentTime := r.time.Now()
@@ -0,0 +1,48 @@
+package rollout
+
+import (
+	"sync"
+
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/config"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health"
+	"github.com/GoogleCloudPlatform/cloud-run-release-manager/internal/health/webhook"
+	"google.golang.org/api/run/v1"
+)
+
+// collectVotes calls the health webhooks of the strategy concurrently and
+// returns their votes in the same order.
+//
+// A webhook that cannot be called or gives an invalid answer results in a
+// failed vote.
+func (r *Rollout) collectVotes(svc *run.Service, stable, candidate string) []health.Vote {
+	req := webhook.Request{
+		Project:           r.project,
+		Region:            r.region,
+		Service:           r.serviceName,
+		CandidateRevision: candidate,
+		StableRevision:    stable,
+	}
+	if target := r.currentCandidateTraffic(svc.Spec.Traffic, candidate); target != nil {
+		req.CandidatePercent = target.Percent
+	}
+
+	votes := make([]health.Vote, len(r.strategy.HealthWebhooks))
+	var wg sync.WaitGroup
+	for i, hook := range r.strategy.HealthWebhooks {
+		wg.Add(1)
+		go func(i int, hook config.HealthWebhook) {
+			defer wg.Done()
+			vote, err := r.webhookClient.Vote(r.ctx, hook, req)
+			if err != nil {
+				// The URL might hold credentials, which the error does not
+				// include either.
+				voter := webhook.RedactURL(hook.URL)
+				r.log.WithError(err).WithField("webhook", voter).Warn("failed to get health vote")
+				vote = health.Vote{Voter: voter, Failed: true, Reason: err.Error()}
+			}
+			votes[i] = vote
+		}(i, hook)
+	}
+	wg.Wait()
+	return votes
+}
@@ -9,6 +9,9 @@ type RunAPI struct {
 
 	ReplaceServiceFn      func(namespace, serviceID string, svc *run.Service) (*run.Service, error)
 	ReplaceServiceInvoked bool
+
+	RevisionFn      func(namespace, revisionID string) (*run.Revision, error)
+	RevisionInvoked bool
 }
 
 // Service invokes the mock implementation and marks the function as invoked.
@@ -22,3 +25,9 @@ func (a *RunAPI) ReplaceService(namespace, serviceID string, svc *run.Service) (
 	a.ReplaceServiceInvoked = true
 	return a.ReplaceServiceFn(namespace, serviceID, svc)
 }
+
+// Revision invokes the mock implementation and marks the function as invoked.
+func (a *RunAPI) Revision(namespace, revisionID string) (*run.Revision, error) {
+	a.RevisionInvoked = true
+	return a.RevisionFn(namespace, revisionID)
+}
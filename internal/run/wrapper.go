@@ -14,6 +14,7 @@ import (
 type Client interface {
 	Service(namespace, serviceID string) (*run.Service, error)
 	ReplaceService(namespace, serviceID string, svc *run.Service) (*run.Service, error)
+	Revision(namespace, revisionID string) (*run.Revision, error)
 }
 
 // API is a wrapper for the Cloud Run package.
@@ -54,6 +55,12 @@ func (a *API) ReplaceService(namespace, serviceID string, svc *run.Service) (*ru
 	return a.Client.Namespaces.Services.ReplaceService(serviceName, svc).Do()
 }
 
+// Revision retrieves information about a revision.
+func (a *API) Revision(namespace, revisionID string) (*run.Revision, error) {
+	revisionName := fmt.Sprintf("namespaces/%s/revisions/%s", namespace, revisionID)
+	return a.Client.Namespaces.Revisions.Get(revisionName).Do()
+}
+
 // ServicesWithLabelSelector gets services filtered by a label selector.
 func (a *API) ServicesWithLabelSelector(namespace string, labelSelector string) ([]*run.Service, error) {
 	parent := fmt.Sprintf("namespaces/%s", namespace)